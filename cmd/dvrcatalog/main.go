@@ -0,0 +1,131 @@
+// Command dvrcatalog lists the recordings of the cameras recorded by
+// monitor for a time range.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"godvr/internal/catalog"
+)
+
+var (
+	outPath  = flag.String("out", "./", "output path of the recorder")
+	camera   = flag.String("camera", "", "name of the camera, lists the cameras if empty")
+	from     = flag.String("from", "", "start of the time range, e.g. \"2021-06-01 10:00\", 24 hours ago by default")
+	to       = flag.String("to", "", "end of the time range, now by default")
+	jsonMode = flag.Bool("json", false, "print the timeline as JSON")
+)
+
+func parseTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+
+	return catalog.ParseTime(s)
+}
+
+func main() {
+	flag.Parse()
+
+	err := run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	c := catalog.Open(*outPath)
+
+	if *camera == "" {
+		cameras, err := c.Cameras()
+		if err != nil {
+			return err
+		}
+
+		for _, name := range cameras {
+			fmt.Println(name)
+		}
+
+		return nil
+	}
+
+	now := time.Now()
+
+	start, err := parseTime(*from, now.Add(-24*time.Hour))
+	if err != nil {
+		return err
+	}
+
+	end, err := parseTime(*to, now)
+	if err != nil {
+		return err
+	}
+
+	timeline, err := c.Query(*camera, start, end)
+	if err != nil {
+		return err
+	}
+
+	if *jsonMode {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+
+		return e.Encode(timeline)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "START\tEND\tDURATION\tCODEC\tRESOLUTION\tSIZE\tKEYFRAMES\tPATH")
+
+	const layout = "2006-01-02 15:04:05"
+
+	// segments and gaps in chronological order
+	type row struct {
+		start time.Time
+		line  string
+	}
+
+	var rows []row
+
+	for _, s := range timeline.Segments {
+		path := s.Path
+		if s.Event {
+			path += " (event)"
+		}
+
+		// the files of the extra stream of a dual-stream recording
+		extra, err := c.Linked(s)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range extra {
+			path += ", " + e.Path
+		}
+
+		rows = append(rows, row{s.Start, fmt.Sprintf("%v\t%v\t%v\t%v\t%dx%d\t%d\t%d\t%v",
+			s.Start.Local().Format(layout), s.End.Local().Format(layout), s.Duration().Round(time.Second),
+			s.Codec, s.Width, s.Height, s.Size, len(s.Keyframes), path)})
+	}
+
+	for _, g := range timeline.Gaps {
+		rows = append(rows, row{g.Start, fmt.Sprintf("%v\t%v\t%v\tgap\t\t\t\t",
+			g.Start.Local().Format(layout), g.End.Local().Format(layout), g.End.Sub(g.Start).Round(time.Second))})
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].start.Before(rows[j].start)
+	})
+
+	for _, r := range rows {
+		fmt.Fprintln(w, r.line)
+	}
+
+	return w.Flush()
+}
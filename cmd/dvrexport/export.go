@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"godvr/internal/catalog"
+	"godvr/internal/dvrip"
+	"godvr/internal/g711"
+	"godvr/internal/mkv"
+	"godvr/internal/mp4"
+	"godvr/internal/mpegts"
+	"godvr/internal/wav"
+)
+
+// frameReader is implemented by the container readers.
+type frameReader interface {
+	ReadFrame() (*dvrip.Frame, error)
+}
+
+// muxer is implemented by the container writers.
+type muxer interface {
+	WriteFrame(frame *dvrip.Frame) error
+	Close() error
+}
+
+type format struct {
+	open     func(r io.Reader) (frameReader, error)
+	newMuxer func(w io.Writer, audio bool) muxer
+}
+
+// formats are the supported containers by file extension.
+var formats = map[string]format{
+	".mp4": {
+		open: func(r io.Reader) (frameReader, error) {
+			return mp4.NewReader(r)
+		},
+		newMuxer: func(w io.Writer, audio bool) muxer {
+			return mp4.NewWriter(w, mp4.Options{Audio: audio})
+		},
+	},
+	".ts": {
+		open: func(r io.Reader) (frameReader, error) {
+			return mpegts.NewReader(r), nil
+		},
+		newMuxer: func(w io.Writer, audio bool) muxer {
+			return mpegts.NewWriter(w, mpegts.Options{Audio: audio})
+		},
+	},
+	".mkv": {
+		open: func(r io.Reader) (frameReader, error) {
+			return mkv.NewReader(r)
+		},
+		newMuxer: func(w io.Writer, audio bool) muxer {
+			return mkv.NewWriter(w, mkv.Options{Audio: audio})
+		},
+	},
+}
+
+// audioProbeFrames is the number of frames searched for audio at the start
+// of the export.
+const audioProbeFrames = 200
+
+// sidecarFrameSamples is the length of the audio frames made of the WAV
+// files kept beside the video, 40ms like the frames of the cameras.
+const sidecarFrameSamples = g711.SampleRate / 25
+
+// errDone stops reading once the end of the range is reached.
+var errDone = errors.New("done")
+
+// exporter joins the frames of consecutive segments into one stream. It
+// starts at the last keyframe before from and stops at the first keyframe
+// after to, so the export starts decodable and covers the whole range.
+// Gaps between the segments are cut out of the timeline.
+type exporter struct {
+	from, to time.Time
+	out      muxer
+	log      *log.Logger
+
+	codec   string
+	started bool
+	base    time.Time
+	gop     []*dvrip.Frame
+
+	// end is the end of the previous segment and shift the total length of
+	// the gaps so far
+	end   time.Time
+	shift time.Duration
+
+	frames int
+}
+
+// segment adds the frames of a segment within the range.
+func (e *exporter) segment(s catalog.Segment) error {
+	f, ok := formats[filepath.Ext(s.Path)]
+	if !ok {
+		e.log.Printf("skipping %v: unsupported format", s.Path)
+		return nil
+	}
+
+	if !e.end.IsZero() && !s.End.After(e.end) {
+		// e.g. an event clip within a continuous recording
+		return nil
+	}
+
+	// the audio kept in a WAV file is merged with the video by time
+	var audio []*dvrip.Frame
+
+	if s.Audio != "" {
+		var err error
+
+		// keep what was read from a damaged file
+		audio, err = sidecarFrames(s)
+		if err != nil {
+			e.log.Printf("%v: %v", s.Audio, err)
+		}
+	}
+
+	file, err := os.Open(s.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r, err := f.open(file)
+	if err != nil {
+		return fmt.Errorf("%v: %w", s.Path, err)
+	}
+
+	first := true
+
+	put := func(frame *dvrip.Frame) error {
+		// the part that overlaps the previous segment
+		if !e.end.IsZero() && frame.Time.Before(e.end) {
+			return nil
+		}
+
+		if first && e.started {
+			if gap := frame.Time.Sub(e.end); gap > catalog.MaxGap {
+				e.log.Printf("skipping a gap of %v at %v", gap.Round(time.Second), e.end.Format("2006-01-02 15:04:05"))
+				e.shift += gap
+			}
+		}
+
+		first = false
+
+		err := e.add(frame)
+		if err == errDone {
+			return err
+		}
+
+		if err != nil {
+			return fmt.Errorf("%v: %w", s.Path, err)
+		}
+
+		return nil
+	}
+
+	for {
+		frame, err := r.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			// keep what was read from a damaged file
+			e.log.Printf("%v: %v", s.Path, err)
+			break
+		}
+
+		frame.Time = s.Start.Add(frame.PTS)
+
+		for len(audio) > 0 && audio[0].Time.Before(frame.Time) {
+			err = put(audio[0])
+			if err != nil {
+				return err
+			}
+
+			audio = audio[1:]
+		}
+
+		err = put(frame)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, frame := range audio {
+		err = put(frame)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.End.After(e.end) {
+		e.end = s.End
+	}
+
+	return nil
+}
+
+func (e *exporter) add(frame *dvrip.Frame) error {
+	isVideo := frame.Meta.Frame != ""
+
+	if isVideo {
+		if e.codec == "" {
+			e.codec = frame.Meta.Type
+		}
+
+		if frame.Meta.Type != e.codec {
+			return fmt.Errorf("codec changes from %v to %v at %v", e.codec, frame.Meta.Type, frame.Time)
+		}
+	}
+
+	keyframe := isVideo && frame.Keyframe
+
+	if keyframe && !frame.Time.Before(e.to) {
+		return errDone
+	}
+
+	if e.started {
+		return e.write(frame)
+	}
+
+	// keep the frames since the last keyframe before the range
+	if keyframe {
+		e.gop = e.gop[:0]
+	}
+
+	if keyframe || len(e.gop) > 0 {
+		e.gop = append(e.gop, frame)
+	}
+
+	if frame.Time.Before(e.from) || len(e.gop) == 0 {
+		return nil
+	}
+
+	e.started = true
+	e.base = e.gop[0].Time
+
+	for _, frame := range e.gop {
+		err := e.write(frame)
+		if err != nil {
+			return err
+		}
+	}
+
+	e.gop = nil
+
+	return nil
+}
+
+func (e *exporter) write(frame *dvrip.Frame) error {
+	frame.PTS = frame.Time.Sub(e.base) - e.shift
+	if frame.PTS < 0 {
+		frame.PTS = 0
+	}
+
+	frame.DTS = frame.PTS
+	e.frames++
+
+	return e.out.WriteFrame(frame)
+}
+
+// hasAudio reports whether there is audio at the start of a segment or in
+// its WAV file.
+func hasAudio(s catalog.Segment) bool {
+	if s.Audio != "" {
+		return true
+	}
+
+	f, ok := formats[filepath.Ext(s.Path)]
+	if !ok {
+		return false
+	}
+
+	file, err := os.Open(s.Path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	r, err := f.open(file)
+	if err != nil {
+		return false
+	}
+
+	for i := 0; i < audioProbeFrames; i++ {
+		frame, err := r.ReadFrame()
+		if err != nil {
+			return false
+		}
+
+		if frame.Meta.Type == "G711A" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sidecarFrames reads the WAV file of a segment into G.711 A-law frames,
+// the first one starts at AudioStart. The frames read before an error are
+// returned with it.
+func sidecarFrames(s catalog.Segment) ([]*dvrip.Frame, error) {
+	file, err := os.Open(s.Audio)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r, err := wav.NewReader(bufio.NewReader(file))
+	if err != nil {
+		return nil, err
+	}
+
+	if r.SampleRate() != g711.SampleRate {
+		return nil, fmt.Errorf("unsupported sample rate: %v", r.SampleRate())
+	}
+
+	var (
+		frames  []*dvrip.Frame
+		samples = make([]int16, sidecarFrameSamples)
+	)
+
+	t := s.Start.Add(s.AudioStart)
+
+	for {
+		var (
+			data []byte
+			n    int
+		)
+
+		switch r.Format() {
+		case wav.ALaw, wav.MuLaw:
+			data = make([]byte, sidecarFrameSamples)
+
+			n, err = io.ReadFull(r, data)
+			if err == io.ErrUnexpectedEOF {
+				err = nil
+			}
+
+			data = data[:n]
+
+			if r.Format() == wav.MuLaw {
+				data = g711.EncodeALaw(data[:0], g711.DecodeMuLaw(samples[:0], data))
+			}
+		case wav.PCM:
+			n, err = r.ReadSamples(samples)
+			data = g711.EncodeALaw(nil, samples[:n])
+		}
+
+		if err != nil && err != io.EOF {
+			return frames, err
+		}
+
+		if n == 0 {
+			return frames, nil
+		}
+
+		duration := time.Duration(n) * time.Second / g711.SampleRate
+
+		frames = append(frames, &dvrip.Frame{
+			Data:     data,
+			Meta:     dvrip.MetaInfo{Type: "G711A"},
+			Duration: duration,
+			Time:     t,
+		})
+
+		t = t.Add(duration)
+	}
+}
+
+// export writes the frames of the segments within from and to to w. It
+// returns the number of frames written.
+func export(w io.Writer, f format, segments []catalog.Segment, from, to time.Time, logger *log.Logger) (int, error) {
+	if len(segments) == 0 {
+		return 0, errors.New("no recordings in the time range")
+	}
+
+	// the muxers fix their tracks at the first keyframe, so a segment
+	// with audio later in the range needs the audio track from the start
+	audio := false
+	for _, s := range segments {
+		if hasAudio(s) {
+			audio = true
+			break
+		}
+	}
+
+	e := &exporter{
+		from: from,
+		to:   to,
+		out:  f.newMuxer(w, audio),
+		log:  logger,
+	}
+
+	for _, s := range segments {
+		err := e.segment(s)
+		if err == errDone {
+			break
+		}
+
+		if err != nil {
+			e.out.Close()
+			return e.frames, err
+		}
+	}
+
+	err := e.out.Close()
+	if err != nil {
+		return e.frames, err
+	}
+
+	if e.frames == 0 {
+		return 0, errors.New("no keyframe in the time range")
+	}
+
+	return e.frames, nil
+}
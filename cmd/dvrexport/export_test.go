@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"godvr/internal/catalog"
+	"godvr/internal/dvrip"
+	"godvr/internal/g711"
+	"godvr/internal/mediatest"
+	"godvr/internal/mp4"
+	"godvr/internal/nalu"
+	"godvr/internal/wav"
+)
+
+// writeSegment records a segment with a video frame every 500ms, a keyframe
+// every 2s and, if audio is set, audio.
+func writeSegment(t *testing.T, dir string, start time.Time, frames int, audio bool) catalog.Segment {
+	path := filepath.Join(dir, start.Format("15.04.05")+".ts")
+
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := formats[".ts"].newMuxer(file, audio)
+
+	for i := 0; i < frames; i++ {
+		pts := time.Duration(i) * 500 * time.Millisecond
+
+		batch := []*dvrip.Frame{mediatest.VideoFrame(i%4 == 0, pts, 1)}
+		if audio {
+			batch = append(batch, &dvrip.Frame{Data: bytes.Repeat([]byte{0xd5}, 4000), Meta: dvrip.MetaInfo{Type: "G711A"}})
+		}
+
+		for _, frame := range batch {
+			frame.PTS, frame.DTS = pts, pts
+
+			if err := w.WriteFrame(frame); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return catalog.Segment{
+		Path:  path,
+		Start: start,
+		End:   start.Add(time.Duration(frames) * 500 * time.Millisecond),
+		Codec: nalu.CodecH264,
+	}
+}
+
+func TestExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dvrexport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	at := func(seconds int) time.Time {
+		return time.Date(2021, 6, 1, 10, 0, seconds, 0, time.Local)
+	}
+
+	// 10:00:00-10:00:06, a gap of 4s and 10:00:10-10:00:16
+	segments := []catalog.Segment{
+		writeSegment(t, dir, at(0), 12, true),
+		writeSegment(t, dir, at(10), 12, true),
+	}
+
+	var out bytes.Buffer
+
+	_, err = export(&out, formats[".mp4"], segments, at(3), at(12), log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := mp4.NewReader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the export starts at the keyframe of 10:00:02 and ends before the one
+	// of 10:00:12, the gap is cut out
+	expected := []time.Duration{0, 500, 1000, 1500, 2000, 2500, 3000, 3500, 4000, 4500, 5000, 5500}
+
+	var video, audio int
+
+	for {
+		frame, err := r.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if frame.Meta.Type == "G711A" {
+			audio++
+			continue
+		}
+
+		if video < len(expected) && frame.PTS != expected[video]*time.Millisecond {
+			t.Errorf("frame %d: got pts %v, expected %v", video, frame.PTS, expected[video]*time.Millisecond)
+		}
+
+		if keyframe := video%4 == 0; frame.Keyframe != keyframe {
+			t.Errorf("frame %d: got keyframe %v", video, frame.Keyframe)
+		}
+
+		video++
+	}
+
+	if video != len(expected) || audio != len(expected) {
+		t.Errorf("got %d video and %d audio frames, expected %d", video, audio, len(expected))
+	}
+}
+
+func TestExportAudioLater(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2021, 6, 1, 10, 0, 0, 0, time.Local)
+
+	// the camera only sent audio from the second segment on
+	segments := []catalog.Segment{
+		writeSegment(t, dir, start, 12, false),
+		writeSegment(t, dir, start.Add(6*time.Second), 12, true),
+	}
+
+	var out bytes.Buffer
+
+	_, err := export(&out, formats[".mp4"], segments, start, start.Add(12*time.Second), log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := mp4.NewReader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	audio := 0
+
+	for {
+		frame, err := r.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if frame.Meta.Type == "G711A" {
+			audio++
+		}
+	}
+
+	if audio != 12 {
+		t.Errorf("got %d audio frames, expected 12", audio)
+	}
+}
+
+// writeWAV writes the audio of a segment as a WAV file of seconds of silence.
+func writeWAV(t *testing.T, path string, format wav.Format, seconds int) {
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	w, err := wav.NewWriter(file, format, g711.SampleRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	silence := bytes.Repeat([]byte{0xd5}, seconds*g711.SampleRate)
+
+	if format == wav.PCM {
+		err = w.WriteSamples(g711.DecodeALaw(nil, silence))
+	} else {
+		_, err = w.Write(silence)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportAudioSidecar(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2021, 6, 1, 10, 0, 0, 0, time.Local)
+
+	var segments []catalog.Segment
+
+	// the audio of the second segment only starts after a second
+	for i, format := range []wav.Format{wav.ALaw, wav.PCM} {
+		s := writeSegment(t, dir, start.Add(time.Duration(i)*6*time.Second), 12, false)
+		s.Audio = strings.TrimSuffix(s.Path, ".ts") + ".wav"
+		s.AudioStart = time.Duration(i) * time.Second
+		writeWAV(t, s.Audio, format, 6-i)
+
+		segments = append(segments, s)
+	}
+
+	var out bytes.Buffer
+
+	_, err := export(&out, formats[".mp4"], segments, start, start.Add(12*time.Second), log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := mp4.NewReader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var audio []*dvrip.Frame
+
+	for {
+		frame, err := r.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if frame.Meta.Type == "G711A" {
+			audio = append(audio, frame)
+		}
+	}
+
+	// 6s and 5s of 40ms frames
+	if len(audio) != 275 {
+		t.Fatalf("got %d audio frames, expected 275", len(audio))
+	}
+
+	if pts := audio[150].PTS; pts != 7*time.Second {
+		t.Errorf("the audio of the second segment starts at %v", pts)
+	}
+
+	for i, frame := range audio {
+		if !bytes.Equal(frame.Data, bytes.Repeat([]byte{0xd5}, 320)) {
+			t.Fatalf("audio frame %d: got %d bytes %x...", i, len(frame.Data), frame.Data[:4])
+		}
+	}
+}
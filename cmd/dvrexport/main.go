@@ -0,0 +1,85 @@
+// Command dvrexport writes the recordings of a camera within a time range to
+// a single file. The recordings are cut at the keyframes around the range
+// and joined, gaps between them are left out.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"godvr/internal/catalog"
+)
+
+var (
+	outPath = flag.String("out", "./", "output path of the recorder")
+	camera  = flag.String("camera", "", "name of the camera")
+	from    = flag.String("from", "", "start of the time range, e.g. \"2021-06-01 10:00\"")
+	to      = flag.String("to", "", "end of the time range")
+	output  = flag.String("o", "", "file to write, the extension selects the format: .mp4, .ts, .mkv")
+)
+
+func main() {
+	flag.Parse()
+
+	err := run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	if *camera == "" || *from == "" || *to == "" || *output == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	f, ok := formats[filepath.Ext(*output)]
+	if !ok {
+		return fmt.Errorf("unsupported format: %v", filepath.Ext(*output))
+	}
+
+	start, err := catalog.ParseTime(*from)
+	if err != nil {
+		return err
+	}
+
+	end, err := catalog.ParseTime(*to)
+	if err != nil {
+		return err
+	}
+
+	if !end.After(start) {
+		return errors.New("the time range ends before it starts")
+	}
+
+	timeline, err := catalog.Open(*outPath).Query(*camera, start, end)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+
+	logger := log.New(os.Stderr, "", 0)
+
+	frames, err := export(file, f, timeline.Segments, start, end, logger)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(*output)
+		return err
+	}
+
+	logger.Printf("wrote %d frames from %d files to %v", frames, len(timeline.Segments), *output)
+
+	return nil
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"godvr/internal/dvrip"
+	"godvr/internal/hls"
+	"godvr/internal/hub"
+	"godvr/internal/mse"
+	"godvr/internal/rtsp"
+	"godvr/internal/webhook"
+)
+
+const (
+	// recorderBuffer and liveBuffer are the frames buffered for the
+	// recorder and the live outputs, a few seconds of video and audio
+	recorderBuffer = 256
+	liveBuffer     = 64
+)
+
+// camera records a single camera. Every camera runs in its own goroutine
+// with its own connection, reconnects and log, so a failing camera does not
+// affect the others.
+type camera struct {
+	cfg cameraConfig
+	log *log.Logger
+
+	// triggers receives the events requested over HTTP
+	triggers chan time.Time
+
+	// live restreams the frames over RTSP if it is set
+	live *rtsp.Stream
+
+	// hls serves the live view over HTTP, it only muxes while watched
+	hls *hls.Live
+
+	// view pushes the video to browsers over WebSockets
+	view *mse.Stream
+
+	// playback serves the recordings over HTTP and keeps their index
+	// entries between the requests
+	playback *hls.Playback
+
+	snapshots *snapshotter
+
+	// hooks posts the events of the camera, nil without webhooks
+	hooks *webhook.Notifier
+
+	feeds []*feed
+	disk  diskUsage
+}
+
+func newCamera(cfg cameraConfig) *camera {
+	c := &camera{
+		cfg:      cfg,
+		log:      log.New(os.Stderr, "["+cfg.Name+"] ", log.LstdFlags),
+		triggers: make(chan time.Time, 16),
+		hls:      hls.NewLive(),
+		view:     mse.NewStream(),
+		playback: hls.NewPlayback(cfg.Out, cfg.Name),
+	}
+
+	c.snapshots = &snapshotter{dial: c.dial}
+	c.feeds = c.newFeeds()
+
+	return c
+}
+
+func (c *camera) settings() dvrip.Settings {
+	settings := dvrip.Settings{
+		Address:  c.cfg.Address,
+		User:     c.cfg.User,
+		Password: c.cfg.Password,
+		Channel:  c.cfg.Channel,
+		Debug:    c.cfg.Debug,
+		Logger:   dvrip.NewStdLogger(c.log, c.cfg.Debug),
+	}
+
+	settings.SetDefaults()
+
+	return settings
+}
+
+// dial opens a logged in connection besides the one of the recording.
+func (c *camera) dial(ctx context.Context) (*dvrip.Conn, error) {
+	conn, err := dvrip.New(ctx, c.settings())
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.Login()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (c *camera) debugf(msg string, args ...interface{}) {
+	if c.cfg.Debug {
+		c.log.Printf(msg, args...)
+	}
+}
+
+// feed is a monitor session of one stream of the camera. A camera with an
+// extraStream runs two feeds on separate connections, which reconnect on
+// their own.
+type feed struct {
+	stream string
+	log    *log.Logger
+	debug  bool
+
+	// extra is set for the second stream, whose files are marked with
+	// extraSuffix and which is only recorded in the continuous mode
+	extra bool
+
+	// live is set for the feed of the live outputs, the extra stream if
+	// there is one
+	live bool
+
+	stats *feedStats
+}
+
+func (f *feed) debugf(msg string, args ...interface{}) {
+	if f.debug {
+		f.log.Printf(msg, args...)
+	}
+}
+
+// newFeeds returns the monitor sessions of the camera, the log of the extra
+// stream is tagged with its name.
+func (c *camera) newFeeds() []*feed {
+	if c.cfg.ExtraStream == "" {
+		return []*feed{{stream: c.cfg.Stream, log: c.log, debug: c.cfg.Debug, live: true, stats: newFeedStats()}}
+	}
+
+	return []*feed{
+		{stream: c.cfg.Stream, log: c.log, debug: c.cfg.Debug, stats: newFeedStats()},
+		{
+			stream: c.cfg.ExtraStream,
+			log:    log.New(c.log.Writer(), "["+c.cfg.Name+"/"+c.cfg.ExtraStream+"] ", c.log.Flags()),
+			debug:  c.cfg.Debug,
+			extra:  true,
+			live:   true,
+			stats:  newFeedStats(),
+		},
+	}
+}
+
+// errLogin ends a session whose login was rejected.
+var errLogin = errors.New("login failed")
+
+// notify posts an event of a stream of the camera to the webhooks.
+func (c *camera) notify(f *feed, e webhook.Event) {
+	e.Camera = c.cfg.Name
+	if f != nil {
+		e.Stream = f.stream
+	}
+
+	c.hooks.Notify(e)
+}
+
+// run records the camera until ctx is done. It reconnects after errors and
+// restarts the recording after a panic.
+func (c *camera) run(ctx context.Context) {
+	logs, err := c.setupLogs()
+	if err != nil {
+		c.log.Print("warning: failed to setup a log file:", err)
+	} else {
+		defer logs.Close()
+	}
+
+	defer c.snapshots.close()
+	defer c.view.Close()
+
+	var wg sync.WaitGroup
+
+	for _, f := range c.feeds {
+		wg.Add(1)
+
+		go func(f *feed) {
+			defer wg.Done()
+			c.runFeed(ctx, f)
+		}(f)
+	}
+
+	wg.Wait()
+}
+
+// runFeed monitors a stream of the camera until ctx is done.
+func (c *camera) runFeed(ctx context.Context, f *feed) {
+	settings := c.settings()
+	settings.Logger = dvrip.NewStdLogger(f.log, c.cfg.Debug)
+	f.log.Printf("using the following settings for the %v stream: %+v", f.stream, settings)
+
+	// a rejected login is only reported once until a login succeeds
+	loginFailed := false
+
+	for {
+		f.stats.setState(stateConnecting, nil)
+
+		err := c.supervise(ctx, settings, f)
+		if err == nil {
+			break
+		}
+
+		streamed := f.stats.status(f.stream).State == stateStreaming
+
+		switch {
+		case errors.Is(err, errStalled):
+			f.stats.setState(stateStalled, err)
+			c.notify(f, webhook.Event{Type: webhook.Stalled, Error: err.Error()})
+		case errors.Is(err, errLogin):
+			f.stats.setState(stateDisconnected, err)
+
+			if !loginFailed {
+				c.notify(f, webhook.Event{Type: webhook.LoginFailed, Error: err.Error()})
+			}
+		default:
+			f.stats.setState(stateDisconnected, err)
+
+			if streamed {
+				c.notify(f, webhook.Event{Type: webhook.Disconnected, Error: err.Error()})
+			}
+		}
+
+		loginFailed = errors.Is(err, errLogin)
+
+		atomic.AddUint64(&f.stats.reconnects, 1)
+
+		f.debugf("fatal error: %v", err)
+		f.log.Printf("camera is lost, wait %v and try again", time.Duration(c.cfg.RetryTime))
+
+		select {
+		case <-time.After(time.Duration(c.cfg.RetryTime)):
+		case <-ctx.Done():
+			f.log.Print("done")
+			return
+		}
+	}
+}
+
+// supervise turns a panic of a monitor session into an error, so it only
+// costs a reconnect.
+func (c *camera) supervise(ctx context.Context, settings dvrip.Settings, f *feed) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			f.log.Printf("panic: %v\n%s", r, debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return c.monitor(ctx, settings, f)
+}
+
+func (c *camera) monitor(ctx context.Context, settings dvrip.Settings, f *feed) error {
+	conn, err := dvrip.New(ctx, settings)
+	if err != nil {
+		f.debugf("failed to initiate connection: %v", err)
+		return err
+	}
+	defer conn.Close()
+
+	err = conn.Login()
+	if err != nil {
+		atomic.AddUint64(&f.stats.loginFailures, 1)
+		f.log.Print("failed to login: ", err)
+		return fmt.Errorf("%w: %v", errLogin, err)
+	}
+
+	f.log.Print("successfully logged in")
+
+	err = conn.SetKeepAlive()
+	if err != nil {
+		f.log.Print("failed to set keepalive:", err)
+		return err
+	}
+
+	f.log.Print("successfully set keepalive")
+
+	// the main feed keeps the clock of the device
+	if !f.extra {
+		err = conn.SetTime()
+		if err != nil {
+			f.log.Print("failed to set time:", err)
+			return err
+		}
+
+		f.log.Print("successfully synced time")
+	}
+
+	var (
+		rec      recorder
+		events   *eventRecorder
+		triggers <-chan time.Time
+	)
+
+	alarms := make(chan *dvrip.Alarm, 16)
+
+	create := func(t time.Time, audio bool, suffix string) (muxer, error) {
+		return c.createSegment(f, t, audio, suffix)
+	}
+
+	switch {
+	case c.cfg.Mode == "event" && f.extra:
+		rec = discard{}
+	case c.cfg.Mode == "event":
+		events = newEventRecorder(time.Duration(c.cfg.PreRoll), time.Duration(c.cfg.PostRoll), create)
+		rec = events
+		triggers = c.triggers
+	default:
+		rec = newRotator(time.Duration(c.cfg.ChunkInterval), c.cfg.AlignChunks, create)
+	}
+
+	// the alarms, motion detection among them, trigger events and go to the
+	// webhooks; not every device supports them, HTTP calls still trigger
+	// events. The stream metadata does not trigger events as long as
+	// dvrip leaves the info packets undecoded.
+	if !f.extra && (events != nil || c.hooks != nil) {
+		err = conn.MonitorAlarms(alarms)
+		if err != nil {
+			f.log.Print("warning: failed to subscribe to alarms:", err)
+		}
+	}
+
+	outChan := make(chan *dvrip.Frame)
+
+	err = conn.MonitorPooled(f.stream, outChan)
+	if err != nil {
+		f.log.Print("failed to start monitoring:", err)
+		return err
+	}
+
+	// the recorder gets every frame, its buffer absorbs slow writes; the
+	// live outputs skip frames rather than holding up the recording
+	frames := hub.New()
+	recorded := frames.Subscribe("recorder", recorderBuffer, hub.Block)
+
+	var outputs sync.WaitGroup
+
+	if f.live {
+		if c.live != nil {
+			c.live.Restart()
+		}
+
+		c.hls.Restart()
+		c.view.Restart()
+
+		live := frames.Subscribe("live", liveBuffer, hub.DropUntilKeyframe)
+
+		outputs.Add(1)
+		go func() {
+			defer outputs.Done()
+			c.writeLive(live)
+		}()
+	}
+
+	subscribers := frames.Subscribers()
+	f.stats.started(conn, subscribers)
+	c.notify(f, webhook.Event{Type: webhook.Connected})
+
+	go frames.Run(outChan)
+
+	defer func() {
+		conn.Close()
+		frames.Unsubscribe(recorded)
+		outputs.Wait()
+
+		for _, s := range subscribers {
+			if n := s.Dropped(); n > 0 {
+				f.log.Printf("%v dropped %d frames", s.Name(), n)
+			}
+		}
+
+		f.stats.stopped()
+	}()
+
+	// the watchdog reconnects a stream that stopped sending keyframes while
+	// the connection stays open
+	var watchdog <-chan time.Time
+
+	stallTimeout := time.Duration(c.cfg.StallTimeout)
+	if stallTimeout > 0 {
+		ticker := time.NewTicker(stallTimeout / 4)
+		defer ticker.Stop()
+
+		watchdog = ticker.C
+	}
+
+	lastKeyframe := time.Now()
+
+	trigger := func(t time.Time, reason string) {
+		if events == nil {
+			return
+		}
+
+		f.log.Printf("event triggered by %v", reason)
+
+		err := events.Trigger(t)
+		if err != nil {
+			f.log.Printf("failed to start a clip: %v", err)
+		}
+	}
+
+	for {
+		select {
+		case frame, ok := <-recorded.Frames():
+			if !ok {
+				err = rec.Close()
+				if err != nil {
+					f.log.Printf("error occurred: %v", err)
+				}
+
+				return conn.MonitorErr
+			}
+
+			if frame.Keyframe {
+				lastKeyframe = time.Now()
+			}
+
+			f.stats.count(frame)
+
+			start := time.Now()
+			err = rec.Record(frame)
+			f.stats.writes.Observe(time.Since(start).Seconds())
+
+			if err != nil {
+				f.log.Println("warning: failed to write to file", err)
+			}
+		case alarm := <-alarms:
+			c.notify(f, webhook.Event{
+				Type:  webhook.Alarm,
+				Time:  alarm.Time,
+				Alarm: &webhook.AlarmInfo{Channel: alarm.Channel, Event: alarm.Event, Active: alarm.Active},
+			})
+
+			trigger(alarm.Time, "alarm "+alarm.Event)
+		case t := <-triggers:
+			trigger(t, "HTTP request")
+		case <-watchdog:
+			if time.Since(lastKeyframe) < stallTimeout {
+				continue
+			}
+
+			atomic.AddUint64(&f.stats.stalls, 1)
+			f.log.Printf("no keyframe for %v, reconnecting", stallTimeout)
+
+			err = rec.Close()
+			if err != nil {
+				f.log.Printf("error occurred: %v", err)
+			}
+
+			return errStalled
+		case <-ctx.Done():
+			err = rec.Close()
+			if err != nil {
+				f.log.Printf("error occurred: %v", err)
+			}
+
+			f.log.Print("done")
+			return nil
+		}
+	}
+}
+
+// writeLive passes the frames to the live outputs until the session ends.
+// The outputs copy what they need.
+func (c *camera) writeLive(s *hub.Subscriber) {
+	for frame := range s.Frames() {
+		if c.live != nil {
+			c.live.WriteFrame(frame)
+		}
+
+		c.hls.WriteFrame(frame)
+		c.view.WriteFrame(frame)
+		c.snapshots.update(frame)
+
+		frame.Release()
+	}
+}
+
+// setupLogs makes the camera log to the logs.log file of its directory.
+func (c *camera) setupLogs() (io.Closer, error) {
+	err := os.MkdirAll(c.cfg.dir(), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	logsFile, err := os.OpenFile(c.cfg.dir()+"/"+"logs.log", os.O_RDWR|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range c.feeds {
+		f.log.SetOutput(logsFile)
+	}
+
+	return logsFile, nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"godvr/internal/retention"
+)
+
+// config is the file read with -config. The settings of each camera default
+// to the ones in Defaults, which default to the flag defaults.
+//
+//	{
+//		"http": ":8080",
+//		"rtsp": ":8554",
+//		"defaults": {"out": "/recordings", "format": "mkv", "maxAge": "720h"},
+//		"cameras": [
+//			{"name": "gate", "address": "192.168.1.147", "password": "secret"},
+//			{"name": "yard", "address": "192.168.1.150", "channel": 1, "mode": "event"}
+//		]
+//	}
+type config struct {
+	services
+
+	Defaults json.RawMessage   `json:"defaults"`
+	Cameras  []json.RawMessage `json:"cameras"`
+}
+
+// services are the listen addresses of the servers shared by all cameras,
+// a server is disabled if its address is empty.
+type services struct {
+	HTTP string `json:"http"`
+	RTSP string `json:"rtsp"`
+
+	// Webhook is the URL the events of the cameras are posted to, signed
+	// with WebhookSecret if it is set
+	Webhook       string `json:"webhook"`
+	WebhookSecret string `json:"webhookSecret"`
+
+	// AllowedOrigins are the sites besides the HTTP server itself whose
+	// pages may open the WebSockets of the cameras, e.g.
+	// "https://example.com", or "*" for any
+	AllowedOrigins []string `json:"allowedOrigins"`
+}
+
+// flagServices returns the servers configured by the command line flags.
+func flagServices() services {
+	svc := services{HTTP: *httpAddress, RTSP: *rtspAddress, Webhook: *webhookURL, WebhookSecret: *webhookSecret}
+
+	if *allowOrigins != "" {
+		svc.AllowedOrigins = strings.Split(*allowOrigins, ",")
+	}
+
+	return svc
+}
+
+// cameraConfig configures the recording of a single camera.
+type cameraConfig struct {
+	Name     string `json:"name"`
+	Address  string `json:"address"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Stream   string `json:"stream"`
+	Channel  int    `json:"channel"`
+	Debug    bool   `json:"debug"`
+
+	// ExtraStream is a second stream, e.g. "Extra", that feeds the live
+	// outputs and is recorded next to Stream
+	ExtraStream string `json:"extraStream"`
+
+	Out    string `json:"out"`
+	Format string `json:"format"`
+
+	// Audio is "mux", "wav" or "pcm". The WAV files of the latter two are
+	// neither played back over HLS nor exported by dvrexport
+	Audio string `json:"audio"`
+
+	Mode          string   `json:"mode"`
+	ChunkInterval duration `json:"chunkInterval"`
+	AlignChunks   bool     `json:"alignChunks"`
+	PreRoll       duration `json:"preRoll"`
+	PostRoll      duration `json:"postRoll"`
+	RetryTime     duration `json:"retryTime"`
+	StallTimeout  duration `json:"stallTimeout"`
+
+	MaxAge        duration `json:"maxAge"`
+	MaxSize       string   `json:"maxSize"`
+	MinFree       string   `json:"minFree"`
+	ProtectEvents bool     `json:"protectEvents"`
+}
+
+// duration reads a time.Duration from a JSON string such as "10m".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = duration(v)
+
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// flagConfig returns the camera configured by the command line flags.
+func flagConfig() cameraConfig {
+	return cameraConfig{
+		Name:          *name,
+		Address:       *address,
+		User:          *user,
+		Password:      *password,
+		Stream:        *stream,
+		ExtraStream:   *extraStream,
+		Channel:       *channel,
+		Debug:         *debugMode,
+		Out:           *outPath,
+		Format:        *outFormat,
+		Audio:         *audioMode,
+		Mode:          *mode,
+		ChunkInterval: duration(*chunkInterval),
+		AlignChunks:   *alignChunks,
+		PreRoll:       duration(*preRoll),
+		PostRoll:      duration(*postRoll),
+		RetryTime:     duration(*retryTime),
+		StallTimeout:  duration(*stallTimeout),
+		MaxAge:        duration(*maxAge),
+		MaxSize:       *maxSize,
+		MinFree:       *minFree,
+		ProtectEvents: *protectEvents,
+	}
+}
+
+// loadConfig reads the config file at path and returns the servers, which
+// default to the flags, and the validated camera configs.
+func loadConfig(path string) (services, []cameraConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return services{}, nil, err
+	}
+
+	c := config{services: flagServices()}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+
+	err = d.Decode(&c)
+	if err != nil {
+		return services{}, nil, fmt.Errorf("failed to parse %v: %v", path, err)
+	}
+
+	defaults := flagConfig()
+	defaults.Name = ""
+	defaults.Address = ""
+
+	if len(c.Defaults) > 0 {
+		err = decodeStrict(c.Defaults, &defaults)
+		if err != nil {
+			return services{}, nil, fmt.Errorf("failed to parse the defaults: %v", err)
+		}
+	}
+
+	if len(c.Cameras) == 0 {
+		return services{}, nil, errors.New("no cameras configured")
+	}
+
+	cameras := make([]cameraConfig, 0, len(c.Cameras))
+	names := map[string]bool{}
+
+	for i, raw := range c.Cameras {
+		cfg := defaults
+
+		err = decodeStrict(raw, &cfg)
+		if err != nil {
+			return services{}, nil, fmt.Errorf("failed to parse camera %d: %v", i+1, err)
+		}
+
+		err = cfg.validate()
+		if err != nil {
+			return services{}, nil, fmt.Errorf("camera %d: %v", i+1, err)
+		}
+
+		if names[cfg.Name] {
+			return services{}, nil, fmt.Errorf("camera %d: duplicate name %q", i+1, cfg.Name)
+		}
+
+		names[cfg.Name] = true
+		cameras = append(cameras, cfg)
+	}
+
+	return c.services, cameras, nil
+}
+
+func decodeStrict(b []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+
+	return d.Decode(v)
+}
+
+func (c *cameraConfig) validate() error {
+	if c.Name == "" {
+		return errors.New("name is missing")
+	}
+
+	// the name is a directory of the recordings and part of the HTTP routes
+	if c.Name == "." || strings.Contains(c.Name, "..") || strings.ContainsAny(c.Name, `/\`) {
+		return fmt.Errorf("invalid name: %q", c.Name)
+	}
+
+	if c.Address == "" {
+		return errors.New("address is missing")
+	}
+
+	if _, ok := formats[c.Format]; !ok {
+		return fmt.Errorf("unsupported format: %v", c.Format)
+	}
+
+	if _, ok := audioFormats[c.Audio]; !ok && c.Audio != "mux" {
+		return fmt.Errorf("unsupported audio: %v", c.Audio)
+	}
+
+	if c.Mode != "continuous" && c.Mode != "event" {
+		return fmt.Errorf("unsupported mode: %v", c.Mode)
+	}
+
+	if c.ExtraStream != "" && c.ExtraStream == c.Stream {
+		return fmt.Errorf("extraStream is the recorded stream: %v", c.ExtraStream)
+	}
+
+	if c.ChunkInterval <= 0 {
+		return errors.New("chunkInterval must be positive")
+	}
+
+	if c.StallTimeout < 0 {
+		return errors.New("stallTimeout must not be negative")
+	}
+
+	_, err := c.retentionPolicy()
+
+	return err
+}
+
+func (c *cameraConfig) retentionPolicy() (retention.Policy, error) {
+	policy := retention.Policy{
+		MaxAge:        time.Duration(c.MaxAge),
+		ProtectEvents: c.ProtectEvents,
+	}
+
+	var err error
+
+	if c.MaxSize != "" {
+		policy.MaxBytes, err = retention.ParseSize(c.MaxSize)
+		if err != nil {
+			return policy, fmt.Errorf("maxSize: %v", err)
+		}
+	}
+
+	if c.MinFree != "" {
+		policy.MinFreeBytes, err = retention.ParseSize(c.MinFree)
+		if err != nil {
+			return policy, fmt.Errorf("minFree: %v", err)
+		}
+	}
+
+	return policy, nil
+}
+
+// dir is where the recordings and the log of the camera are kept.
+func (c *cameraConfig) dir() string {
+	return c.Out + "/" + c.Name
+}
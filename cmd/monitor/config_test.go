@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "cameras.json")
+
+	err := os.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `{
+		"http": ":8080",
+		"rtsp": ":8554",
+		"allowedOrigins": ["https://example.com"],
+		"defaults": {"out": "/recordings", "format": "mkv", "maxAge": "720h"},
+		"cameras": [
+			{"name": "gate", "address": "192.168.1.147", "password": "secret"},
+			{"name": "yard", "address": "192.168.1.150", "channel": 1, "format": "ts", "chunkInterval": "5m"}
+		]
+	}`)
+
+	svc, cfgs, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if svc.HTTP != ":8080" || svc.RTSP != ":8554" || len(svc.AllowedOrigins) != 1 || len(cfgs) != 2 {
+		t.Fatalf("got servers %+v and %d cameras", svc, len(cfgs))
+	}
+
+	gate, yard := cfgs[0], cfgs[1]
+
+	if gate.Out != "/recordings" || gate.Format != "mkv" || time.Duration(gate.MaxAge) != 720*time.Hour {
+		t.Errorf("defaults were not applied: %+v", gate)
+	}
+
+	// the flag defaults apply where neither sets a value
+	if gate.Stream != "Main" || gate.Mode != "continuous" || time.Duration(gate.ChunkInterval) != 10*time.Minute {
+		t.Errorf("flag defaults were not applied: %+v", gate)
+	}
+
+	if yard.Channel != 1 || yard.Format != "ts" || time.Duration(yard.ChunkInterval) != 5*time.Minute || yard.Password != "" {
+		t.Errorf("unexpected camera: %+v", yard)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := map[string]string{
+		`{"cameras": []}`: "no cameras",
+		`{"cameras": [{"name": "a", "address": "x"}, {"name": "a", "address": "y"}]}`: "duplicate name",
+		`{"cameras": [{"name": "a", "address": "x", "adress": "y"}]}`:                 "unknown field",
+		`{"cameras": [{"name": "a", "address": "x", "format": "avi"}]}`:               "unsupported format",
+		`{"cameras": [{"name": "a", "address": "x", "maxSize": "lots"}]}`:             "maxSize",
+		`{"cameras": [{"name": "a", "address": "x", "audio": "mp3"}]}`:                "unsupported audio",
+		`{"cameras": [{"name": "a", "address": "x", "stallTimeout": "-1s"}]}`:         "stallTimeout",
+		`{"cameras": [{"address": "x"}]}`:                                             "name is missing",
+		`{"cameras": [{"name": "../etc", "address": "x"}]}`:                           "invalid name",
+		`{"cameras": [{"name": "a/b", "address": "x"}]}`:                              "invalid name",
+		`{"cameras": [{"name": "a\\b", "address": "x"}]}`:                             "invalid name",
+		`{"cameras": [{"name": "a", "address": "x", "extraStream": "Main"}]}`:         "extraStream",
+	}
+
+	for content, expected := range tests {
+		_, _, err := loadConfig(writeConfig(t, content))
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%v: got error %v, expected %q", content, err, expected)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// errStalled ends a session whose stream stopped delivering keyframes while
+// the connection stayed open.
+var errStalled = errors.New("stream stalled")
+
+// feedState is the state of a feed reported by the health endpoints.
+type feedState string
+
+const (
+	stateConnecting   feedState = "connecting"
+	stateStreaming    feedState = "streaming"
+	stateStalled      feedState = "stalled"
+	stateDisconnected feedState = "disconnected"
+)
+
+// setState records a state other than streaming, which started sets, and
+// the error that led to it.
+func (s *feedStats) setState(state feedState, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.state, s.since, s.lastErr = state, time.Now(), err
+}
+
+// streamStatus is the status of a feed in the responses of the health
+// endpoints.
+type streamStatus struct {
+	Stream       string     `json:"stream"`
+	State        feedState  `json:"state"`
+	Since        time.Time  `json:"since"`
+	LastKeyframe *time.Time `json:"lastKeyframe,omitempty"`
+	Error        string     `json:"error,omitempty"`
+
+	// progress is the last sign of life of a streaming feed
+	progress time.Time
+}
+
+type cameraStatus struct {
+	Name    string         `json:"name"`
+	Ready   bool           `json:"ready"`
+	Streams []streamStatus `json:"streams"`
+}
+
+type healthResponse struct {
+	Status  string         `json:"status"`
+	Cameras []cameraStatus `json:"cameras"`
+}
+
+func (s *feedStats) status(stream string) streamStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st := streamStatus{Stream: stream, State: s.state, Since: s.since, progress: s.since}
+
+	if !s.lastKeyframe.IsZero() {
+		t := s.lastKeyframe
+		st.LastKeyframe = &t
+
+		if t.After(st.progress) {
+			st.progress = t
+		}
+	}
+
+	if s.lastErr != nil {
+		st.Error = s.lastErr.Error()
+	}
+
+	return st
+}
+
+// health returns the status of every camera. A camera is ready while all
+// its streams deliver keyframes, the process is ready while a camera is, so
+// it has something to serve while other cameras are offline. live is false
+// if a stream went without keyframes for twice the stall timeout, so the
+// watchdog that should have reconnected it is stuck.
+func (s *supervisor) health() (resp healthResponse, ready, live bool) {
+	live = true
+
+	for _, c := range s.cameras() {
+		cs := cameraStatus{Name: c.cfg.Name, Ready: true}
+		timeout := time.Duration(c.cfg.StallTimeout)
+
+		for _, f := range c.feeds {
+			st := f.stats.status(f.stream)
+
+			if st.State != stateStreaming || st.LastKeyframe == nil {
+				cs.Ready = false
+			}
+
+			if timeout > 0 && st.State == stateStreaming {
+				age := time.Since(st.progress)
+				cs.Ready = cs.Ready && age <= timeout
+				live = live && age <= 2*timeout
+			}
+
+			cs.Streams = append(cs.Streams, st)
+		}
+
+		ready = ready || cs.Ready
+		resp.Cameras = append(resp.Cameras, cs)
+	}
+
+	return resp, ready, live
+}
+
+// handleHealth serves /healthz, which fails only if a camera is stuck, and
+// /readyz, which fails while no camera streams. Both list the status of
+// every camera.
+func (s *supervisor) handleHealth(w http.ResponseWriter, r *http.Request) {
+	resp, ready, live := s.health()
+
+	ok := live
+	if r.URL.Path == "/readyz" {
+		ok = ready
+	}
+
+	resp.Status = "ok"
+	code := http.StatusOK
+
+	if !ok {
+		resp.Status = "unavailable"
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	e.Encode(resp)
+}
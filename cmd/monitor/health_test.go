@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"godvr/internal/dvrip"
+	"godvr/internal/webhook"
+)
+
+func TestWatchdog(t *testing.T) {
+	address, _ := fakeDevice(t)
+
+	c := newCamera(cameraConfig{
+		Name:         "gate",
+		Address:      address,
+		Stream:       "Main",
+		Out:          t.TempDir(),
+		Format:       "mp4",
+		Mode:         "continuous",
+		StallTimeout: duration(200 * time.Millisecond),
+	})
+
+	c.log.SetOutput(io.Discard)
+	f := c.feeds[0]
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the device accepts the monitor but never sends a frame
+	err := c.monitor(ctx, c.settings(), f)
+	if !errors.Is(err, errStalled) {
+		t.Fatalf("got %v, expected a stall", err)
+	}
+
+	if n := atomic.LoadUint64(&f.stats.stalls); n != 1 {
+		t.Errorf("got %d stalls", n)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := newSupervisor(ctx)
+	s.run = func(ctx context.Context, c *camera) {
+		<-ctx.Done()
+	}
+
+	s.apply([]cameraConfig{{Name: "gate", Address: "1", Stream: "Main", StallTimeout: duration(10 * time.Second)}})
+
+	stats := s.lookup("gate").feeds[0].stats
+
+	check := func(path string, code int, state feedState) {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		s.handleHealth(w, httptest.NewRequest("GET", path, nil))
+
+		var resp healthResponse
+
+		err := json.Unmarshal(w.Body.Bytes(), &resp)
+		if err != nil || len(resp.Cameras) != 1 || len(resp.Cameras[0].Streams) != 1 {
+			t.Fatalf("%v: got %s: %v", path, w.Body.String(), err)
+		}
+
+		if w.Code != code || resp.Cameras[0].Streams[0].State != state {
+			t.Errorf("%v: got status %d and %s", path, w.Code, w.Body.String())
+		}
+	}
+
+	check("/healthz", http.StatusOK, stateConnecting)
+	check("/readyz", http.StatusServiceUnavailable, stateConnecting)
+
+	stats.started(&dvrip.Conn{}, nil)
+	stats.count(&dvrip.Frame{Meta: dvrip.MetaInfo{Type: "H264", Frame: "I"}, Keyframe: true})
+
+	check("/healthz", http.StatusOK, stateStreaming)
+	check("/readyz", http.StatusOK, stateStreaming)
+
+	// a stream without keyframes the watchdog did not end
+	stats.lock.Lock()
+	stats.since = stats.since.Add(-time.Minute)
+	stats.lastKeyframe = stats.lastKeyframe.Add(-time.Minute)
+	stats.lock.Unlock()
+
+	check("/healthz", http.StatusServiceUnavailable, stateStreaming)
+	check("/readyz", http.StatusServiceUnavailable, stateStreaming)
+
+	stats.stopped()
+	stats.setState(stateStalled, errStalled)
+
+	check("/healthz", http.StatusOK, stateStalled)
+	check("/readyz", http.StatusServiceUnavailable, stateStalled)
+}
+
+func TestReadyWithOfflineCamera(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := newSupervisor(ctx)
+	s.run = func(ctx context.Context, c *camera) {
+		<-ctx.Done()
+	}
+
+	s.apply([]cameraConfig{{Name: "gate", Address: "1", Stream: "Main"}, {Name: "yard", Address: "2", Stream: "Main"}})
+
+	stats := s.lookup("gate").feeds[0].stats
+	stats.started(&dvrip.Conn{}, nil)
+	stats.count(&dvrip.Frame{Meta: dvrip.MetaInfo{Type: "H264", Frame: "I"}, Keyframe: true})
+
+	w := httptest.NewRecorder()
+	s.handleHealth(w, httptest.NewRequest("GET", "/readyz", nil))
+
+	var resp healthResponse
+
+	err := json.Unmarshal(w.Body.Bytes(), &resp)
+	if err != nil || len(resp.Cameras) != 2 {
+		t.Fatalf("got %s: %v", w.Body.String(), err)
+	}
+
+	// the yard camera is still connecting
+	ready := map[string]bool{}
+	for _, c := range resp.Cameras {
+		ready[c.Name] = c.Ready
+	}
+
+	if w.Code != http.StatusOK || !ready["gate"] || ready["yard"] {
+		t.Errorf("got status %d and %s", w.Code, w.Body.String())
+	}
+}
+
+func TestStallWebhooks(t *testing.T) {
+	address, _ := fakeDevice(t)
+
+	events := make(chan webhook.Event, 10)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e webhook.Event
+		json.NewDecoder(r.Body).Decode(&e)
+		events <- e
+	}))
+	defer server.Close()
+
+	c := newCamera(cameraConfig{
+		Name:         "gate",
+		Address:      address,
+		Stream:       "Main",
+		Out:          t.TempDir(),
+		Format:       "mp4",
+		Mode:         "continuous",
+		RetryTime:    duration(time.Hour),
+		StallTimeout: duration(200 * time.Millisecond),
+	})
+
+	c.log.SetOutput(io.Discard)
+	c.hooks = webhook.New(server.URL, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		c.runFeed(ctx, c.feeds[0])
+	}()
+
+	for _, expected := range []string{webhook.Connected, webhook.Stalled} {
+		select {
+		case e := <-events:
+			if e.Type != expected || e.Camera != "gate" || e.Stream != "Main" {
+				t.Errorf("got %+v, expected a %v event", e, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %v event", expected)
+		}
+	}
+
+	cancel()
+	<-done
+	c.hooks.Close(time.Second)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// minMJPEGInterval limits the pictures per second of an MJPEG stream, each
+// one may cost an OPSNAP request.
+const minMJPEGInterval = 100 * time.Millisecond
+
+func serveHTTP(address string, s *supervisor) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cameras/", s.handleCamera)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/healthz", s.handleHealth)
+	mux.HandleFunc("/readyz", s.handleHealth)
+
+	log.Print("serving HTTP on ", address)
+
+	err := http.ListenAndServe(address, mux)
+	if err != nil {
+		log.Print("failed to serve HTTP: ", err)
+	}
+}
+
+// handleCamera routes /cameras/{name}/{action} and the HLS files below
+// /cameras/{name}/live/ and /cameras/{name}/playback/.
+func (s *supervisor) handleCamera(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/cameras/"), "/", 3)
+	if len(parts) < 2 || len(parts) == 3 && parts[1] != "live" && parts[1] != "playback" {
+		http.NotFound(w, r)
+		return
+	}
+
+	c := s.lookup(parts[0])
+	if c == nil {
+		http.Error(w, "unknown camera", http.StatusNotFound)
+		return
+	}
+
+	switch parts[1] {
+	case "trigger":
+		c.handleTrigger(w, r)
+	case "snapshot.jpg":
+		c.handleSnapshot(w, r)
+	case "mjpeg":
+		c.handleMJPEG(w, r)
+	case "ws":
+		c.view.ServeHTTP(w, r)
+	case "live":
+		c.hls.ServeHTTP(w, r)
+	case "playback":
+		c.playback.ServeHTTP(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleTrigger starts or extends an event clip, see the event mode.
+func (c *camera) handleTrigger(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if c.cfg.Mode != "event" {
+		http.Error(w, "not in event mode", http.StatusConflict)
+		return
+	}
+
+	select {
+	case c.triggers <- time.Now():
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "too many triggers", http.StatusServiceUnavailable)
+	}
+}
+
+// handleSnapshot serves a recent JPEG picture of the camera.
+func (c *camera) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	picture, taken, err := c.snapshots.get(r.Context())
+	if err != nil {
+		http.Error(w, "no snapshot: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.Itoa(len(picture)))
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Last-Modified", taken.UTC().Format(http.TimeFormat))
+	w.Write(picture)
+}
+
+// handleMJPEG streams snapshots as multipart/x-mixed-replace, which browsers
+// show as a moving picture. The interval parameter sets the time between
+// pictures, one second by default.
+func (c *camera) handleMJPEG(w http.ResponseWriter, r *http.Request) {
+	interval := time.Second
+
+	if s := r.URL.Query().Get("interval"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < minMJPEGInterval {
+			http.Error(w, "invalid interval", http.StatusBadRequest)
+			return
+		}
+
+		interval = d
+	}
+
+	picture, taken, err := c.snapshots.get(r.Context())
+	if err != nil {
+		http.Error(w, "no snapshot: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	parts := multipart.NewWriter(w)
+
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+parts.Boundary())
+	w.Header().Set("Cache-Control", "no-cache")
+
+	flusher, _ := w.(http.Flusher)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var sent time.Time
+
+	for {
+		// pictures are only sent again if they changed
+		if !taken.Equal(sent) {
+			part, err := parts.CreatePart(textproto.MIMEHeader{
+				"Content-Type":   {"image/jpeg"},
+				"Content-Length": {strconv.Itoa(len(picture))},
+			})
+			if err == nil {
+				_, err = part.Write(picture)
+			}
+
+			if err != nil {
+				return
+			}
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+
+			sent = taken
+		}
+
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return
+		}
+
+		p, t, err := c.snapshots.get(r.Context())
+		if err != nil {
+			c.debugf("failed to take a snapshot: %v", err)
+			continue
+		}
+
+		picture, taken = p, t
+	}
+}
@@ -2,234 +2,156 @@ package main
 
 import (
 	"context"
-	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"reflect"
+	"syscall"
 	"time"
 
-	"godvr/internal/dvrip"
+	"godvr/internal/mkv"
+	"godvr/internal/rtsp"
+	"godvr/internal/webhook"
 )
 
+// webhookShutdownTimeout is how long the pending webhooks may take on exit.
+const webhookShutdownTimeout = 5 * time.Second
+
 var (
 	address       = flag.String("address", "192.168.1.147", "camera address: 192.168.1.147, 192.168.1.147:34567")
 	name          = flag.String("name", "camera1", "name of the camera")
 	outPath       = flag.String("out", "./", "output path that video files will be kept")
 	chunkInterval = flag.Duration("chunkInterval", time.Minute*10, "time when application must create a new files")
+	alignChunks   = flag.Bool("alignChunks", false, "align new files to multiples of chunkInterval on the wall clock")
 	stream        = flag.String("stream", "Main", "camera stream name")
+	extraStream   = flag.String("extraStream", "", "second stream, e.g. Extra, for the live outputs that is recorded as well")
+	channel       = flag.Int("channel", 0, "video channel of a DVR or NVR")
 	user          = flag.String("user", "admin", "username")
 	password      = flag.String("password", "", "password for the user")
 	retryTime     = flag.Duration("retryTime", time.Second*5, "retry to connect if problem occur")
+	stallTimeout  = flag.Duration("stallTimeout", time.Second*20, "reconnect if no keyframe arrives for this long, 0 disables the watchdog")
 	debugMode     = flag.Bool("debug", false, "debug mode")
+	outFormat     = flag.String("format", "mp4", "output format of the video files: mp4, ts, mkv")
+	audioMode     = flag.String("audio", "mux", "how the audio is kept: mux into the video files, wav for G.711 or pcm for 16-bit PCM WAV files beside them, which playback leaves out")
+	repairFile    = flag.String("repair", "", "repair an mkv file cut short by a crash and exit")
+	mode          = flag.String("mode", "continuous", "recording mode: continuous, event")
+	preRoll       = flag.Duration("preRoll", time.Second*10, "time recorded before an event in event mode")
+	postRoll      = flag.Duration("postRoll", time.Second*10, "time recorded after the last event in event mode")
+	httpAddress   = flag.String("http", "", "address of the HTTP API, e.g. :8080, disabled if empty")
+	allowOrigins  = flag.String("allowOrigins", "", "comma separated origins of other sites allowed to open the WebSockets, e.g. https://example.com, * for any")
+	rtspAddress   = flag.String("rtsp", "", "address of the RTSP server restreaming the cameras, e.g. :8554, disabled if empty")
+	maxAge        = flag.Duration("maxAge", 0, "delete recordings older than this, 0 keeps them forever")
+	maxSize       = flag.String("maxSize", "", "limit of the total size of the recordings, e.g. 500GB")
+	minFree       = flag.String("minFree", "", "delete the oldest recordings while the disk has less free space, e.g. 10GB")
+	protectEvents = flag.Bool("protectEvents", false, "only delete event clips by age")
+	webhookURL    = flag.String("webhook", "", "URL the camera events are posted to as JSON, disabled if empty")
+	webhookSecret = flag.String("webhookSecret", "", "secret of the HMAC-SHA256 signature of the webhooks")
+	configPath    = flag.String("config", "", "record the cameras listed in this JSON file instead of the one set by flags")
 )
 
 func main() {
 	flag.Parse()
 
-	settings := dvrip.Settings{
-		Address:  *address,
-		User:     *user,
-		Password: *password,
-		Debug:    *debugMode,
-	}
+	if *repairFile != "" {
+		repaired, err := mkv.RepairFile(*repairFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to repair %v: %v\n", *repairFile, err)
+			os.Exit(1)
+		}
 
-	err := setupLogs()
-	if err != nil {
-		log.Print("warning: failed to setup a log file:", err)
-	}
+		if !repaired {
+			fmt.Println("file is complete, nothing to repair")
+		}
 
-	settings.SetDefaults()
-	log.Printf("using the following settings: %+v", settings)
+		return
+	}
 
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt, os.Kill)
+	svc := flagServices()
 
-	ctx, cancel := context.WithCancel(context.Background())
-	go func() {
-		select {
-		case <-stop:
-			fmt.Println("received interrupt signal")
-			cancel()
-		}
-	}()
+	var configs []cameraConfig
 
-	for {
-		err := monitor(ctx, settings)
-		if err == nil {
-			break
+	if *configPath != "" {
+		s, cfgs, err := loadConfig(*configPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
 		}
 
-		debugf("fatal error: %v", err)
-		log.Printf("camera is lost, wait %v and try again", *retryTime)
+		svc = s
+		configs = cfgs
+	} else {
+		cfg := flagConfig()
 
-		select {
-		case <-time.Tick(*retryTime):
-		case <-ctx.Done():
-			log.Print("done")
-			return
+		err := cfg.validate()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
 		}
-	}
-
-}
 
-func debugf(msg string, args ...interface{}) {
-	if *debugMode {
-		log.Printf(msg, args...)
+		configs = append(configs, cfg)
 	}
-}
 
-func monitor(ctx context.Context, settings dvrip.Settings) error {
-	conn, err := dvrip.New(ctx, settings)
-	if err != nil {
-		debugf("failed to initiate connection: %v", err)
-		return err
-	}
-
-	err = conn.Login()
-	if err != nil {
-		log.Print("failed to login: ", err)
-		return err
-	}
+	ctx, cancel := context.WithCancel(context.Background())
 
-	log.Print("successfully logged in")
+	sup := newSupervisor(ctx)
 
-	err = conn.SetKeepAlive()
-	if err != nil {
-		log.Print("failed to set keepalive:", err)
-		return err
+	if svc.RTSP != "" {
+		sup.rtsp = rtsp.NewServer(log.Default())
+		go serveRTSP(svc.RTSP, sup.rtsp)
 	}
 
-	log.Print("successfully set keepalive")
-
-	err = conn.SetTime()
-	if err != nil {
-		log.Print("failed to set time:", err)
-		return err
+	if svc.Webhook != "" {
+		sup.hooks = webhook.New(svc.Webhook, svc.WebhookSecret)
 	}
 
-	log.Print("successfully synced time")
+	sup.origins = svc.AllowedOrigins
+	sup.apply(configs)
 
-	outChan := make(chan *dvrip.Frame)
-	var videoFile, audioFile *os.File
+	go enforceRetention(ctx, sup.cameras)
 
-	err = conn.Monitor(*stream, outChan)
-	if err != nil {
-		log.Print("failed to start monitoring:", err)
-		return err
+	if svc.HTTP != "" {
+		go serveHTTP(svc.HTTP, sup)
 	}
 
-	videoFile, audioFile, err = createChunkFiles(time.Now())
-	if err != nil {
-		return err
-	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, os.Kill)
 
-	prevTime := time.Now()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 
 	for {
 		select {
-		case frame, ok := <-outChan:
-			if !ok {
-				return conn.MonitorErr
-			}
-
-			now := time.Now()
-
-			if prevTime.Add(*chunkInterval).Before(now) {
-				errs := closeFiles(videoFile, audioFile)
-				if err != nil {
-					log.Printf("error occurred: %v", errs)
-				}
-
-				videoFile, audioFile, err = createChunkFiles(now)
-				prevTime = now
-			}
-
-			processFrame(frame, audioFile, videoFile)
-		case <-ctx.Done():
-			errs := closeFiles(videoFile, audioFile)
-			if err != nil {
-				log.Printf("error occurred: %v", errs)
-			}
-
-			log.Print("done")
-			return nil
+		case <-hup:
+			reload(sup, svc)
+		case <-stop:
+			fmt.Println("received interrupt signal")
+			cancel()
+			sup.wait()
+			sup.hooks.Close(webhookShutdownTimeout)
+			return
 		}
 	}
 }
 
-func processFrame(frame *dvrip.Frame, audioFile, videoFile *os.File) {
-	if frame.Meta.Type == "G711A" { // audio
-		_, err := audioFile.Write(frame.Data)
-		if err != nil {
-			log.Println("warning: failed to write to file", err)
-		}
-
+// reload applies the config file to the running cameras.
+func reload(sup *supervisor, running services) {
+	if *configPath == "" {
+		log.Print("received SIGHUP but there is no config file to reload")
 		return
 	}
 
-	if frame.Meta.Frame != "" {
-		_, err := videoFile.Write(frame.Data)
-		if err != nil {
-			log.Println("warning: failed to write to file", err)
-		}
-
-		return
-	}
-
-	return
-}
-
-func closeFiles(files ...*os.File) (errs []error) {
-	for _, f := range files {
-		err := f.Close()
-		if err != nil {
-			errs = append(errs, fmt.Errorf("failed to close file: %v cause: %v", f.Name(), err))
-		}
-	}
-
-	return
-}
-
-func createChunkFiles(t time.Time) (*os.File, *os.File, error) {
-	dir := *outPath + "/" + (*name) + t.Format("/2006/01/02/")
-
-	err := os.MkdirAll(dir, os.ModePerm)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	file := *outPath + "/" + (*name) + t.Format("/2006/01/02/15.04.05")
-	log.Print("starting files:", file)
-
-	videoFile, err := os.Create(file + ".video")
+	svc, configs, err := loadConfig(*configPath)
 	if err != nil {
-		return nil, nil, err
-	}
-
-	audioFile, err := os.Create(file + ".audio")
-	if err != nil {
-		return nil, nil, err
-	}
-
-	return videoFile, audioFile, nil
-}
-
-func setupLogs() error {
-	outDir := *outPath + "/" + *name
-	err := os.Mkdir(outDir, os.ModePerm)
-
-	if err != nil && !errors.Is(err, os.ErrExist) {
-		return err
+		log.Printf("failed to reload the config, keeping the running one: %v", err)
+		return
 	}
 
-	logsFile, err := os.OpenFile(outDir+"/"+"logs.log", os.O_RDWR|os.O_APPEND|os.O_CREATE, 0666)
-	if err != nil {
-		return err
+	if !reflect.DeepEqual(svc, running) {
+		log.Print("the servers, the webhook or the allowed origins changed, they only apply after a restart")
 	}
 
-	log.SetOutput(logsFile)
-
-	return nil
+	added, removed, changed := sup.apply(configs)
+	log.Printf("config reloaded: added %v, removed %v, changed %v", added, removed, changed)
 }
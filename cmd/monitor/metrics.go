@@ -0,0 +1,340 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"godvr/internal/dvrip"
+	"godvr/internal/hub"
+	"godvr/internal/metrics"
+)
+
+// frameKind splits the received frames for the metrics.
+type frameKind int
+
+const (
+	kindI frameKind = iota
+	kindP
+	kindAudio
+	kindCount
+)
+
+var frameKindLabels = [kindCount]metrics.Labels{
+	{"media", "video", "frame", "I"},
+	{"media", "video", "frame", "P"},
+	{"media", "audio"},
+}
+
+// rateWindow is the time over which the frame rate and the bitrate are
+// measured, they read zero once no video arrived for two windows.
+const rateWindow = 5 * time.Second
+
+// writeBuckets are the upper bounds of the histogram of the time it takes
+// to write a frame to the recording, in seconds.
+var writeBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+// feedStats counts what a feed received across its sessions.
+type feedStats struct {
+	// the counters are accessed atomically and come first to be 64-bit
+	// aligned on 32-bit platforms
+	frames        [kindCount]uint64
+	bytes         [kindCount]uint64
+	reconnects    uint64
+	loginFailures uint64
+	stalls        uint64
+	connected     int32
+
+	writes *metrics.Histogram
+
+	lock sync.Mutex
+
+	// conn and subscribers are the ones of the running session, the totals
+	// of the finished sessions are added up
+	conn        *dvrip.Conn
+	subscribers []*hub.Subscriber
+	parseErrors uint64
+	dropped     map[string]uint64
+
+	windowStart  time.Time
+	windowFrames int
+	windowBytes  int
+	fps, bitrate float64
+	lastVideo    time.Time
+
+	// the status reported by the health endpoints
+	state        feedState
+	since        time.Time
+	lastKeyframe time.Time
+	lastErr      error
+}
+
+func newFeedStats() *feedStats {
+	return &feedStats{
+		writes:  metrics.NewHistogram(writeBuckets...),
+		dropped: map[string]uint64{},
+		state:   stateConnecting,
+		since:   time.Now(),
+	}
+}
+
+// count adds a received frame.
+func (s *feedStats) count(frame *dvrip.Frame) {
+	var kind frameKind
+
+	switch {
+	case frame.Meta.Type == "G711A":
+		kind = kindAudio
+	case frame.Meta.Frame == "I":
+		kind = kindI
+	case frame.Meta.Frame == "P":
+		kind = kindP
+	default:
+		return
+	}
+
+	atomic.AddUint64(&s.frames[kind], 1)
+	atomic.AddUint64(&s.bytes[kind], uint64(len(frame.Data)))
+
+	if kind == kindAudio {
+		return
+	}
+
+	now := time.Now()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lastVideo = now
+
+	if frame.Keyframe {
+		s.lastKeyframe = now
+	}
+
+	if s.windowStart.IsZero() {
+		s.windowStart = now
+	}
+
+	s.windowFrames++
+	s.windowBytes += len(frame.Data)
+
+	if elapsed := now.Sub(s.windowStart); elapsed >= rateWindow {
+		s.fps = float64(s.windowFrames) / elapsed.Seconds()
+		s.bitrate = float64(8*s.windowBytes) / elapsed.Seconds()
+		s.windowStart, s.windowFrames, s.windowBytes = now, 0, 0
+	}
+}
+
+// rates returns the frame rate and the bitrate of the video.
+func (s *feedStats) rates() (float64, float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if time.Since(s.lastVideo) > 2*rateWindow {
+		return 0, 0
+	}
+
+	return s.fps, s.bitrate
+}
+
+// started records the start of a session.
+func (s *feedStats) started(conn *dvrip.Conn, subscribers []*hub.Subscriber) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.conn, s.subscribers = conn, subscribers
+	s.windowStart, s.windowFrames, s.windowBytes = time.Time{}, 0, 0
+	s.state, s.since, s.lastErr = stateStreaming, time.Now(), nil
+	atomic.StoreInt32(&s.connected, 1)
+}
+
+// stopped adds the counts of the session that ended.
+func (s *feedStats) stopped() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.parseErrors += s.conn.ParseErrors()
+
+	for _, sub := range s.subscribers {
+		s.dropped[sub.Name()] += sub.Dropped()
+	}
+
+	s.conn, s.subscribers = nil, nil
+	s.fps, s.bitrate = 0, 0
+	atomic.StoreInt32(&s.connected, 0)
+}
+
+// errorCounts returns the parse errors and the dropped frames by subscriber
+// of all sessions.
+func (s *feedStats) errorCounts() (uint64, map[string]uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	parseErrors := s.parseErrors
+	if s.conn != nil {
+		parseErrors += s.conn.ParseErrors()
+	}
+
+	dropped := map[string]uint64{}
+	for name, n := range s.dropped {
+		dropped[name] = n
+	}
+
+	for _, sub := range s.subscribers {
+		dropped[sub.Name()] += sub.Dropped()
+	}
+
+	return parseErrors, dropped
+}
+
+// diskUsage is the space taken by the recordings of a camera, measured with
+// the retention.
+type diskUsage struct {
+	lock       sync.Mutex
+	used, free int64
+	known      bool
+}
+
+func (d *diskUsage) set(used, free int64) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.used, d.free, d.known = used, free, true
+}
+
+func (d *diskUsage) get() (used, free int64, known bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.used, d.free, d.known
+}
+
+// handleMetrics serves the metrics of the running cameras to Prometheus.
+func (s *supervisor) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metrics.ContentType)
+
+	cameras := s.cameras()
+
+	// the series of the streams are labeled with the camera and the stream
+	type series struct {
+		camera *camera
+		feed   *feed
+		labels metrics.Labels
+	}
+
+	var all []series
+
+	for _, c := range cameras {
+		for _, f := range c.feeds {
+			all = append(all, series{c, f, metrics.Labels{"camera", c.cfg.Name, "stream", f.stream}})
+		}
+	}
+
+	m := metrics.NewWriter(w)
+
+	// family writes a family with a sample per stream
+	family := func(name, typ, help string, value func(f *feed) float64) {
+		m.Family(name, typ, help)
+
+		for _, s := range all {
+			m.Sample(name, s.labels, value(s.feed))
+		}
+	}
+
+	family("godvr_camera_connected", metrics.GaugeType, "Whether the stream is connected and monitored.", func(f *feed) float64 {
+		return float64(atomic.LoadInt32(&f.stats.connected))
+	})
+
+	family("godvr_camera_reconnects_total", metrics.CounterType, "Connection attempts after the stream was lost or could not be started.", func(f *feed) float64 {
+		return float64(atomic.LoadUint64(&f.stats.reconnects))
+	})
+
+	family("godvr_camera_login_failures_total", metrics.CounterType, "Failed logins.", func(f *feed) float64 {
+		return float64(atomic.LoadUint64(&f.stats.loginFailures))
+	})
+
+	for _, counter := range []struct {
+		name, help string
+		values     func(s *feedStats) *[kindCount]uint64
+	}{
+		{"godvr_camera_frames_total", "Frames received by media and frame type.", func(s *feedStats) *[kindCount]uint64 { return &s.frames }},
+		{"godvr_camera_received_bytes_total", "Bytes of the frames received by media and frame type.", func(s *feedStats) *[kindCount]uint64 { return &s.bytes }},
+	} {
+		m.Family(counter.name, metrics.CounterType, counter.help)
+
+		for _, s := range all {
+			values := counter.values(s.feed.stats)
+
+			for kind, labels := range frameKindLabels {
+				m.Sample(counter.name, append(s.labels[:len(s.labels):len(s.labels)], labels...), float64(atomic.LoadUint64(&values[kind])))
+			}
+		}
+	}
+
+	family("godvr_camera_fps", metrics.GaugeType, "Video frames per second over the last seconds.", func(f *feed) float64 {
+		fps, _ := f.stats.rates()
+		return fps
+	})
+
+	family("godvr_camera_bitrate_bits_per_second", metrics.GaugeType, "Video bitrate over the last seconds.", func(f *feed) float64 {
+		_, bitrate := f.stats.rates()
+		return bitrate
+	})
+
+	family("godvr_camera_stalls_total", metrics.CounterType, "Reconnects forced by the watchdog because no keyframe arrived.", func(f *feed) float64 {
+		return float64(atomic.LoadUint64(&f.stats.stalls))
+	})
+
+	family("godvr_camera_parse_errors_total", metrics.CounterType, "Frames that could not be reassembled from the stream and were skipped.", func(f *feed) float64 {
+		n, _ := f.stats.errorCounts()
+		return float64(n)
+	})
+
+	m.Family("godvr_camera_dropped_frames_total", metrics.CounterType, "Frames dropped for a consumer that did not keep up.")
+
+	for _, s := range all {
+		_, dropped := s.feed.stats.errorCounts()
+
+		// the WebSocket viewers of the live stream skip frames on their own
+		if s.feed.live {
+			dropped["ws"] = s.camera.view.Dropped()
+		}
+
+		names := make([]string, 0, len(dropped))
+		for name := range dropped {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		for _, name := range names {
+			m.Sample("godvr_camera_dropped_frames_total", s.labels.With("consumer", name), float64(dropped[name]))
+		}
+	}
+
+	m.Family("godvr_camera_write_seconds", metrics.HistogramType, "Time to write a frame to the recording, including file rotation.")
+
+	for _, s := range all {
+		m.Histogram("godvr_camera_write_seconds", s.labels, s.feed.stats.writes)
+	}
+
+	for _, disk := range []struct {
+		name, help string
+		value      func(used, free int64) int64
+	}{
+		{"godvr_camera_disk_used_bytes", "Size of the recordings of the camera.", func(used, _ int64) int64 { return used }},
+		{"godvr_camera_disk_free_bytes", "Free space of the file system holding the recordings.", func(_, free int64) int64 { return free }},
+	} {
+		m.Family(disk.name, metrics.GaugeType, disk.help)
+
+		for _, c := range cameras {
+			if used, free, ok := c.disk.get(); ok {
+				m.Sample(disk.name, metrics.Labels{"camera", c.cfg.Name}, float64(disk.value(used, free)))
+			}
+		}
+	}
+
+	m.Flush()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"godvr/internal/dvrip"
+	"godvr/internal/hub"
+)
+
+func TestMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := newSupervisor(ctx)
+	s.run = func(ctx context.Context, c *camera) {
+		<-ctx.Done()
+	}
+
+	s.apply([]cameraConfig{{Name: "gate", Address: "1", Stream: "Main", ExtraStream: "Extra"}})
+
+	gate := s.lookup("gate")
+	stats := gate.feeds[0].stats
+
+	frames := hub.New()
+	live := frames.Subscribe("live", 1, hub.DropOldest)
+
+	stats.started(&dvrip.Conn{}, []*hub.Subscriber{live})
+
+	for _, frame := range []*dvrip.Frame{
+		{Data: make([]byte, 100), Meta: dvrip.MetaInfo{Type: "H264", Frame: "I"}},
+		{Data: make([]byte, 10), Meta: dvrip.MetaInfo{Type: "H264", Frame: "P"}},
+		{Data: make([]byte, 10), Meta: dvrip.MetaInfo{Type: "H264", Frame: "P"}},
+		{Data: make([]byte, 320), Meta: dvrip.MetaInfo{Type: "G711A"}},
+	} {
+		stats.count(frame)
+		frames.Publish(frame)
+	}
+
+	stats.writes.Observe(0.002)
+	gate.disk.set(1000, 5000)
+
+	w := httptest.NewRecorder()
+	s.handleMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := w.Body.String()
+
+	for _, line := range []string{
+		"# TYPE godvr_camera_connected gauge",
+		`godvr_camera_connected{camera="gate",stream="Main"} 1`,
+		`godvr_camera_connected{camera="gate",stream="Extra"} 0`,
+		`godvr_camera_frames_total{camera="gate",stream="Main",media="video",frame="P"} 2`,
+		`godvr_camera_received_bytes_total{camera="gate",stream="Main",media="video",frame="I"} 100`,
+		`godvr_camera_received_bytes_total{camera="gate",stream="Main",media="audio"} 320`,
+		`godvr_camera_dropped_frames_total{camera="gate",stream="Main",consumer="live"} 3`,
+		`godvr_camera_dropped_frames_total{camera="gate",stream="Extra",consumer="ws"} 0`,
+		`godvr_camera_write_seconds_bucket{camera="gate",stream="Main",le="0.005"} 1`,
+		`godvr_camera_disk_used_bytes{camera="gate"} 1000`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %q in\n%s", line, body)
+		}
+	}
+
+	// the counts of a session are kept after it ended
+	stats.stopped()
+
+	w = httptest.NewRecorder()
+	s.handleMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if body := w.Body.String(); !strings.Contains(body, `consumer="live"} 3`) || !strings.Contains(body, `godvr_camera_connected{camera="gate",stream="Main"} 0`) {
+		t.Errorf("unexpected metrics after the session:\n%s", body)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"godvr/internal/dvrip"
+)
+
+// maxKeyframeInterval bounds the pre-roll buffer of a stream that stops
+// sending keyframes.
+const maxKeyframeInterval = 30 * time.Second
+
+// audioProbe is how long a session waits for an audio frame before its
+// files are created without an audio track. The muxers fix their tracks when
+// they start, so the first file of a session is held back until then.
+const audioProbe = 2 * time.Second
+
+// audioDetector tells whether the stream of a session carries audio: from
+// its first audio frame on, and not once audioProbe passed without one.
+type audioDetector struct {
+	start time.Time
+	audio bool
+	known bool
+}
+
+func (d *audioDetector) observe(frame *dvrip.Frame) {
+	switch {
+	case d.known:
+	case frame.Meta.Type == "G711A":
+		d.audio, d.known = true, true
+	case d.start.IsZero():
+		d.start = frame.Time
+	case frame.Time.Sub(d.start) >= audioProbe:
+		d.known = true
+	}
+}
+
+// recorder writes the frames of a monitor session to files.
+type recorder interface {
+	// Record takes the ownership of frame and releases it once it is
+	// written or dropped.
+	Record(frame *dvrip.Frame) error
+	Close() error
+}
+
+// discard drops the frames of a stream that is only watched live.
+type discard struct{}
+
+func (discard) Record(frame *dvrip.Frame) error {
+	frame.Release()
+	return nil
+}
+
+func (discard) Close() error {
+	return nil
+}
+
+// createFunc starts a file with the frame at time t, see createSegment.
+type createFunc func(t time.Time, audio bool, suffix string) (muxer, error)
+
+// rotator records continuously and starts a new file at the first keyframe
+// after each chunk boundary, so every file starts decodable.
+type rotator struct {
+	interval time.Duration
+	align    bool
+	create   createFunc
+
+	seg      muxer
+	boundary time.Time
+	probe    audioDetector
+
+	// pending are the frames from the first keyframe on while the probe
+	// has not decided on the audio yet
+	pending []*dvrip.Frame
+}
+
+func newRotator(interval time.Duration, align bool, create createFunc) *rotator {
+	return &rotator{interval: interval, align: align, create: create}
+}
+
+func (r *rotator) Record(frame *dvrip.Frame) error {
+	r.probe.observe(frame)
+
+	if !r.probe.known {
+		if len(r.pending) > 0 || frame.Keyframe {
+			r.pending = append(r.pending, frame)
+		} else {
+			frame.Release()
+		}
+
+		return nil
+	}
+
+	err := r.flush()
+	if err != nil {
+		frame.Release()
+		return err
+	}
+
+	return r.write(frame)
+}
+
+// flush writes the frames held back while probing for audio.
+func (r *rotator) flush() error {
+	var err error
+
+	for i, frame := range r.pending {
+		if err == nil {
+			err = r.write(frame)
+		} else {
+			frame.Release()
+		}
+
+		r.pending[i] = nil
+	}
+
+	r.pending = r.pending[:0]
+
+	return err
+}
+
+func (r *rotator) write(frame *dvrip.Frame) error {
+	defer frame.Release()
+
+	if frame.Keyframe && (r.seg == nil || !frame.Time.Before(r.boundary)) {
+		err := r.closeSegment()
+		if err != nil {
+			log.Printf("error occurred: %v", err)
+		}
+
+		r.seg, err = r.create(frame.Time, r.probe.audio, "")
+		if err != nil {
+			return err
+		}
+
+		r.boundary = nextBoundary(frame.Time, r.interval, r.align)
+	}
+
+	if r.seg == nil {
+		return nil
+	}
+
+	return r.seg.WriteFrame(frame)
+}
+
+// Close writes the frames still held back, without audio unless it was
+// seen, and finishes the file.
+func (r *rotator) Close() error {
+	r.probe.known = true
+
+	err := r.flush()
+	if err != nil {
+		log.Printf("error occurred: %v", err)
+	}
+
+	return r.closeSegment()
+}
+
+func (r *rotator) closeSegment() error {
+	if r.seg == nil {
+		return nil
+	}
+
+	err := r.seg.Close()
+	r.seg = nil
+
+	return err
+}
+
+// eventRecorder keeps the frames of the last preRoll, starting at a
+// keyframe, in memory and only writes clips around triggered events. A clip
+// lasts until postRoll after the last trigger, so overlapping events end up
+// in the same clip.
+type eventRecorder struct {
+	preRoll  time.Duration
+	postRoll time.Duration
+
+	create createFunc
+
+	buffer []*dvrip.Frame
+	clip   muxer
+	until  time.Time
+	probe  audioDetector
+}
+
+func newEventRecorder(preRoll, postRoll time.Duration, create createFunc) *eventRecorder {
+	return &eventRecorder{
+		preRoll:  preRoll,
+		postRoll: postRoll,
+		create:   create,
+	}
+}
+
+func (r *eventRecorder) Record(frame *dvrip.Frame) error {
+	r.probe.observe(frame)
+
+	if r.clip != nil && frame.Time.After(r.until) {
+		err := r.closeClip()
+		if err != nil {
+			log.Printf("error occurred: %v", err)
+		}
+	}
+
+	if r.clip != nil {
+		defer frame.Release()
+		return r.clip.WriteFrame(frame)
+	}
+
+	if len(r.buffer) == 0 && !frame.Keyframe {
+		frame.Release()
+		return nil
+	}
+
+	r.buffer = append(r.buffer, frame)
+
+	// an event triggered before the first keyframe arrived or before the
+	// probe decided on the audio
+	if r.probe.known && !r.buffer[0].Time.After(r.until) {
+		return r.startClip()
+	}
+
+	r.trim(frame.Time)
+
+	return nil
+}
+
+// Trigger records an event that happened at time t.
+func (r *eventRecorder) Trigger(t time.Time) error {
+	if until := t.Add(r.postRoll); until.After(r.until) {
+		r.until = until
+	}
+
+	if r.clip == nil && len(r.buffer) > 0 && r.probe.known {
+		return r.startClip()
+	}
+
+	return nil
+}
+
+// trim drops the frames before the latest keyframe that still covers the
+// pre-roll.
+func (r *eventRecorder) trim(now time.Time) {
+	cutoff := now.Add(-r.preRoll)
+
+	if r.buffer[0].Time.Before(cutoff.Add(-maxKeyframeInterval)) {
+		r.release(len(r.buffer))
+		return
+	}
+
+	start := 0
+	for i, frame := range r.buffer {
+		if frame.Time.After(cutoff) {
+			break
+		}
+
+		if frame.Keyframe {
+			start = i
+		}
+	}
+
+	r.release(start)
+}
+
+// release drops the first n frames of the buffer.
+func (r *eventRecorder) release(n int) {
+	if n == 0 {
+		return
+	}
+
+	for _, frame := range r.buffer[:n] {
+		frame.Release()
+	}
+
+	rest := copy(r.buffer, r.buffer[n:])
+	for i := rest; i < len(r.buffer); i++ {
+		r.buffer[i] = nil
+	}
+
+	r.buffer = r.buffer[:rest]
+}
+
+// startClip creates a clip and writes the buffered frames to it.
+func (r *eventRecorder) startClip() error {
+	clip, err := r.create(r.buffer[0].Time, r.probe.audio, eventSuffix)
+	if err != nil {
+		return err
+	}
+
+	r.clip = clip
+
+	for _, frame := range r.buffer {
+		if werr := clip.WriteFrame(frame); werr != nil && err == nil {
+			err = werr
+		}
+	}
+
+	r.release(len(r.buffer))
+
+	return err
+}
+
+func (r *eventRecorder) closeClip() error {
+	err := r.clip.Close()
+	r.clip = nil
+
+	return err
+}
+
+func (r *eventRecorder) Close() error {
+	r.release(len(r.buffer))
+
+	if r.clip == nil {
+		return nil
+	}
+
+	return r.closeClip()
+}
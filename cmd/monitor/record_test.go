@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"godvr/internal/dvrip"
+	"godvr/internal/mediatest"
+	"godvr/internal/mp4"
+)
+
+type clip struct {
+	start  time.Time
+	frames []time.Time
+	closed bool
+}
+
+func (c *clip) WriteFrame(frame *dvrip.Frame) error {
+	c.frames = append(c.frames, frame.Time)
+	return nil
+}
+
+func (c *clip) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestEventRecorder(t *testing.T) {
+	var clips []*clip
+
+	r := newEventRecorder(2*time.Second, 3*time.Second, func(start time.Time, _ bool, suffix string) (muxer, error) {
+		if suffix != eventSuffix {
+			t.Errorf("got suffix %q", suffix)
+		}
+
+		c := &clip{start: start}
+		clips = append(clips, c)
+		return c, nil
+	})
+
+	origin := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time {
+		return origin.Add(time.Duration(seconds) * time.Second)
+	}
+
+	// a keyframe every 2 seconds and a P-frame in between
+	record := func(from, to int) {
+		for s := from; s < to; s++ {
+			r.Record(&dvrip.Frame{Meta: dvrip.MetaInfo{Frame: "P"}, Keyframe: s%2 == 0, Time: at(s)})
+		}
+	}
+
+	record(1, 10) // the P-frame at 1s is dropped, there is no keyframe yet
+
+	// the pre-roll of 2s at 9s starts at the keyframe at 6s
+	r.Trigger(at(9))
+	record(10, 12)
+
+	// overlaps the first event and extends the clip until 14s
+	r.Trigger(at(11))
+	record(12, 20)
+
+	r.Trigger(at(19))
+	record(20, 30)
+	r.Close()
+
+	if len(clips) != 2 {
+		t.Fatalf("got %d clips, expected 2", len(clips))
+	}
+
+	first := clips[0]
+	if !first.start.Equal(at(6)) || len(first.frames) != 9 || !first.frames[8].Equal(at(14)) {
+		t.Errorf("unexpected first clip: start %v, %d frames", first.start, len(first.frames))
+	}
+
+	second := clips[1]
+	if !second.start.Equal(at(16)) || !second.frames[len(second.frames)-1].Equal(at(22)) {
+		t.Errorf("unexpected second clip: start %v, %d frames", second.start, len(second.frames))
+	}
+
+	for i, c := range clips {
+		if !c.closed {
+			t.Errorf("clip %d was not closed", i)
+		}
+	}
+
+	if len(r.buffer) != 0 {
+		t.Errorf("%d frames left in the buffer", len(r.buffer))
+	}
+}
+
+// recordAV records a stream of 25 fps video frames, each followed by the audio
+// of the same time, and returns the number of audio frames in every file.
+func recordAV(t *testing.T, r recorder, files *[]*bytes.Buffer, frames int) []int {
+	origin := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+
+	for i := 0; i < frames; i++ {
+		video := mediatest.StreamFrame(i)
+		audio := mediatest.AudioFrame(video.PTS)
+
+		for _, frame := range []*dvrip.Frame{video, audio} {
+			frame.Time = origin.Add(frame.PTS)
+
+			if err := r.Record(frame); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var counts []int
+
+	for i, file := range *files {
+		rd, err := mp4.NewReader(file)
+		if err != nil {
+			t.Fatalf("file %d: %v", i, err)
+		}
+
+		n := 0
+
+		for {
+			frame, err := rd.ReadFrame()
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				t.Fatalf("file %d: %v", i, err)
+			}
+
+			if frame.Meta.Type == "G711A" {
+				n++
+			}
+		}
+
+		counts = append(counts, n)
+	}
+
+	return counts
+}
+
+// createMP4 creates the files of a recorder in memory.
+func createMP4(files *[]*bytes.Buffer) createFunc {
+	return func(_ time.Time, audio bool, _ string) (muxer, error) {
+		file := &bytes.Buffer{}
+		*files = append(*files, file)
+
+		return formats["mp4"].newMuxer(file, audio), nil
+	}
+}
+
+func TestRotatorAudio(t *testing.T) {
+	var files []*bytes.Buffer
+
+	counts := recordAV(t, newRotator(time.Second, false, createMP4(&files)), &files, 60)
+
+	// the audio of the first file is held back until the probe saw it
+	if len(counts) != 3 || counts[0] != 25 || counts[1] != 25 || counts[2] != 10 {
+		t.Errorf("got %v audio frames per file, expected [25 25 10]", counts)
+	}
+}
+
+func TestEventRecorderAudio(t *testing.T) {
+	var files []*bytes.Buffer
+
+	r := newEventRecorder(time.Second, time.Second, createMP4(&files))
+
+	// an event right at the start of the session
+	r.Trigger(time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC))
+
+	counts := recordAV(t, r, &files, 30)
+
+	if len(counts) != 1 || counts[0] == 0 {
+		t.Errorf("got %v audio frames per clip, expected audio in the clip", counts)
+	}
+}
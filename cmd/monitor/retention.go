@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"godvr/internal/retention"
+)
+
+// retentionInterval is how often the recordings are checked against the
+// retention policy.
+const retentionInterval = time.Minute
+
+// enforceRetention applies the policies of the running cameras to their
+// recordings until ctx is done and reports the disk usage afterwards. The
+// cameras are handled together so that the free space floor deletes the
+// oldest recordings of all of them rather than those of each camera.
+func enforceRetention(ctx context.Context, cameras func() []*camera) {
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+
+	for {
+		running := cameras()
+		dirs := make([]retention.Dir, len(running))
+
+		for i, c := range running {
+			policy, _ := c.cfg.retentionPolicy()
+			dirs[i] = retention.Dir{Path: c.cfg.dir(), Policy: policy}
+		}
+
+		deleted, err := retention.EnforceAll(dirs)
+		for _, path := range deleted {
+			owner(running, path).log.Print("deleted file:", path)
+		}
+
+		if err != nil {
+			log.Printf("failed to enforce retention: %v", err)
+		}
+
+		for _, c := range running {
+			if used, free, err := retention.Usage(c.cfg.dir()); err == nil {
+				c.disk.set(used, free)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// owner returns the camera whose directory holds path.
+func owner(cameras []*camera, path string) *camera {
+	for _, c := range cameras {
+		if strings.HasPrefix(path, filepath.Clean(c.cfg.dir())+string(filepath.Separator)) {
+			return c
+		}
+	}
+
+	return cameras[0]
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"log"
+
+	"godvr/internal/rtsp"
+)
+
+// serveRTSP restreams the cameras at rtsp://address/{name}.
+func serveRTSP(address string, s *rtsp.Server) {
+	log.Print("serving RTSP on ", address)
+
+	err := s.ListenAndServe(address)
+	if err != nil {
+		log.Print("failed to serve RTSP: ", err)
+	}
+}
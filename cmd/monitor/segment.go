@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"godvr/internal/catalog"
+	"godvr/internal/dvrip"
+	"godvr/internal/g711"
+	"godvr/internal/mkv"
+	"godvr/internal/mp4"
+	"godvr/internal/mpegts"
+	"godvr/internal/wav"
+	"godvr/internal/webhook"
+)
+
+// muxer is implemented by the container writers of the supported output
+// formats.
+type muxer interface {
+	WriteFrame(frame *dvrip.Frame) error
+	Close() error
+}
+
+type format struct {
+	ext string
+
+	// newMuxer creates a writer, audio adds an audio track to the file
+	newMuxer func(w io.Writer, audio bool) muxer
+}
+
+var formats = map[string]format{
+	"mp4": {
+		ext: ".mp4",
+		newMuxer: func(w io.Writer, audio bool) muxer {
+			return mp4.NewWriter(w, mp4.Options{Audio: audio})
+		},
+	},
+	"ts": {
+		ext: ".ts",
+		newMuxer: func(w io.Writer, audio bool) muxer {
+			return mpegts.NewWriter(w, mpegts.Options{Audio: audio})
+		},
+	},
+	"mkv": {
+		ext: ".mkv",
+		newMuxer: func(w io.Writer, audio bool) muxer {
+			return mkv.NewWriter(w, mkv.Options{Audio: audio})
+		},
+	},
+}
+
+// audioFormats are the encodings of the WAV files that keep the audio beside
+// the video files instead of in them, by the name of the audio setting. The
+// default "mux" writes the audio to the video files.
+var audioFormats = map[string]wav.Format{
+	"wav": wav.ALaw,
+	"pcm": wav.PCM,
+}
+
+// segmentTimeFormat names the files after the time of their first and last
+// frame, e.g. 15.00.00-15.10.00.mp4. Files that are still being written only
+// carry the start time.
+const segmentTimeFormat = "15.04.05"
+
+// eventSuffix marks the clips of the event recording mode, e.g.
+// 15.00.00-15.00.30.event.mp4.
+const eventSuffix = ".event"
+
+// extraSuffix marks the files of the second stream of a dual-stream
+// recording, e.g. 15.00.00-15.10.00.extra.mp4.
+const extraSuffix = ".extra"
+
+// segment is a single recording file.
+type segment struct {
+	log   *log.Logger
+	file  *os.File
+	muxer muxer
+	ext   string // including the suffix
+
+	// audio is the WAV file started by the first audio frame if the audio
+	// is kept beside the video, with the format audioFormat
+	audioFormat wav.Format
+	audioFile   *os.File
+	audio       *wav.Writer
+	samples     []int16
+
+	start time.Time
+	end   time.Time
+
+	// index receives the catalog entry of the file once it is finished
+	index    string
+	metadata catalog.Segment
+
+	// closed is called with the entry after it was added to the catalog
+	closed func(m catalog.Segment)
+}
+
+// createSegment starts a file with the frame at time t, which should be a
+// keyframe so the file is decodable from its beginning. The suffix is added
+// to the file name before the extension.
+func (c *camera) createSegment(f *feed, t time.Time, audio bool, suffix string) (muxer, error) {
+	dir := c.cfg.dir() + t.Format("/2006/01/02/")
+
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.extra {
+		suffix += extraSuffix
+	}
+
+	audioFormat, separate := audioFormats[c.cfg.Audio]
+	if separate {
+		audio = false
+	}
+
+	format := formats[c.cfg.Format]
+	ext := suffix + format.ext
+	file := dir + t.Format(segmentTimeFormat) + ext
+	f.log.Print("starting file:", file)
+
+	out, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return &segment{
+		log:   f.log,
+		file:  out,
+		muxer: format.newMuxer(out, audio),
+		ext:   ext,
+		start: t,
+		end:   t,
+		index: c.cfg.dir(),
+		metadata: catalog.Segment{
+			Camera: c.cfg.Name,
+			Stream: f.stream,
+			Extra:  f.extra,
+			Event:  strings.HasPrefix(suffix, eventSuffix),
+		},
+		audioFormat: audioFormat,
+		closed:      c.segmentClosed,
+	}, nil
+}
+
+// segmentClosed reports the finished clips of the event mode to the
+// webhooks.
+func (c *camera) segmentClosed(m catalog.Segment) {
+	if !m.Event {
+		return
+	}
+
+	c.hooks.Notify(webhook.Event{
+		Type:   webhook.ClipWritten,
+		Camera: c.cfg.Name,
+		Stream: m.Stream,
+		Clip:   &webhook.ClipInfo{Path: m.Path, Start: m.Start, End: m.End, Size: m.Size},
+	})
+}
+
+func (s *segment) WriteFrame(frame *dvrip.Frame) error {
+	if frame.Time.After(s.end) {
+		s.end = frame.Time
+	}
+
+	if frame.Meta.Type == "G711A" && s.audioFormat != 0 {
+		return s.writeAudio(frame)
+	}
+
+	if frame.Keyframe {
+		m := &s.metadata
+		if m.Codec == "" {
+			m.Codec, m.Width, m.Height = frame.Meta.Type, frame.Meta.Width, frame.Meta.Height
+		}
+
+		// the muxers write whole fragments, clusters or packets, so the data
+		// written so far ends at a point a reader can resume at before the
+		// keyframe
+		offset, err := s.file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+
+		m.Keyframes = append(m.Keyframes, frame.Time.Sub(s.start))
+		m.KeyframeOffsets = append(m.KeyframeOffsets, offset)
+	}
+
+	return s.muxer.WriteFrame(frame)
+}
+
+// writeAudio writes an audio frame to the WAV file of the segment, which
+// is named like the video file.
+func (s *segment) writeAudio(frame *dvrip.Frame) error {
+	if s.audio == nil {
+		name := strings.TrimSuffix(s.file.Name(), filepath.Ext(s.file.Name())) + ".wav"
+
+		f, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+
+		s.audio, err = wav.NewWriter(f, s.audioFormat, g711.SampleRate)
+		if err != nil {
+			f.Close()
+			return err
+		}
+
+		s.audioFile = f
+		s.metadata.AudioStart = frame.Time.Sub(s.start)
+	}
+
+	if s.audioFormat == wav.PCM {
+		s.samples = g711.DecodeALaw(s.samples[:0], frame.Data)
+		return s.audio.WriteSamples(s.samples)
+	}
+
+	_, err := s.audio.Write(frame.Data)
+
+	return err
+}
+
+// closeAudio finishes the WAV file and renames it like the video file
+// name, it returns the new name.
+func (s *segment) closeAudio(name string) (string, error) {
+	err := s.audio.Close()
+	if err != nil {
+		s.audioFile.Close()
+		return "", fmt.Errorf("failed to finish file: %v cause: %v", s.audioFile.Name(), err)
+	}
+
+	err = s.audioFile.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to close file: %v cause: %v", s.audioFile.Name(), err)
+	}
+
+	audioName := strings.TrimSuffix(name, filepath.Ext(name)) + ".wav"
+
+	err = os.Rename(s.audioFile.Name(), audioName)
+	if err != nil {
+		return "", fmt.Errorf("failed to rename file: %v cause: %v", s.audioFile.Name(), err)
+	}
+
+	return audioName, nil
+}
+
+// Close finishes the file, renames it to include the time of its last frame
+// and adds it to the catalog.
+func (s *segment) Close() error {
+	err := s.muxer.Close()
+	if err != nil {
+		s.file.Close()
+		return fmt.Errorf("failed to finish file: %v cause: %v", s.file.Name(), err)
+	}
+
+	err = s.file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close file: %v cause: %v", s.file.Name(), err)
+	}
+
+	name := filepath.Join(filepath.Dir(s.file.Name()),
+		s.start.Format(segmentTimeFormat)+"-"+s.end.Format(segmentTimeFormat)+s.ext)
+
+	err = os.Rename(s.file.Name(), name)
+	if err != nil {
+		return fmt.Errorf("failed to rename file: %v cause: %v", s.file.Name(), err)
+	}
+
+	s.log.Print("finished file:", name)
+
+	m := s.metadata
+	m.Path, m.Start, m.End = name, s.start, s.end
+
+	if s.audio != nil {
+		m.Audio, err = s.closeAudio(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	if info, err := os.Stat(name); err == nil {
+		m.Size = info.Size()
+	}
+
+	err = catalog.Append(s.index, m)
+	if err != nil {
+		return fmt.Errorf("failed to index file: %v cause: %v", name, err)
+	}
+
+	if s.closed != nil {
+		s.closed(m)
+	}
+
+	return nil
+}
+
+// nextBoundary returns the time after t when the next file should be
+// started. With align set, boundaries are multiples of interval counted from
+// local midnight, e.g. :00, :10 and :20 for ten minutes.
+func nextBoundary(t time.Time, interval time.Duration, align bool) time.Time {
+	if !align {
+		return t.Add(interval)
+	}
+
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	elapsed := t.Sub(midnight)
+
+	return midnight.Add((elapsed/interval + 1) * interval)
+}
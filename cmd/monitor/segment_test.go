@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"godvr/internal/catalog"
+	"godvr/internal/dvrip"
+)
+
+func TestNextBoundary(t *testing.T) {
+	loc := time.FixedZone("IST", 5*3600+30*60)
+	at := func(h, m, s int) time.Time {
+		return time.Date(2021, 6, 1, h, m, s, 0, loc)
+	}
+
+	tests := []struct {
+		t        time.Time
+		interval time.Duration
+		align    bool
+		expected time.Time
+	}{
+		{at(10, 3, 7), 10 * time.Minute, false, at(10, 13, 7)},
+		{at(10, 3, 7), 10 * time.Minute, true, at(10, 10, 0)},
+		{at(10, 10, 0), 10 * time.Minute, true, at(10, 20, 0)},
+		{at(10, 3, 7), time.Hour, true, at(11, 0, 0)},
+		{at(23, 55, 0), 10 * time.Minute, true, time.Date(2021, 6, 2, 0, 0, 0, 0, loc)},
+	}
+
+	for _, test := range tests {
+		got := nextBoundary(test.t, test.interval, test.align)
+		if !got.Equal(test.expected) {
+			t.Errorf("nextBoundary(%v, %v, %v) = %v, expected %v", test.t, test.interval, test.align, got, test.expected)
+		}
+	}
+}
+
+func TestSegmentAudio(t *testing.T) {
+	c := &camera{cfg: cameraConfig{Name: "gate", Out: t.TempDir(), Format: "ts", Audio: "pcm"}}
+	f := &feed{stream: "Main", log: log.New(io.Discard, "", 0)}
+
+	start := time.Date(2021, 6, 1, 10, 0, 0, 0, time.Local)
+
+	seg, err := c.createSegment(f, start, true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		frame := &dvrip.Frame{
+			Data: bytes.Repeat([]byte{0xD5}, 160),
+			Meta: dvrip.MetaInfo{Type: "G711A"},
+			Time: start.Add(500*time.Millisecond + time.Duration(i)*time.Second),
+		}
+
+		err = seg.WriteFrame(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = seg.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	segments, err := catalog.Read(c.cfg.dir())
+	if err != nil || len(segments) != 1 {
+		t.Fatalf("got %d segments: %v", len(segments), err)
+	}
+
+	if audio := segments[0].Audio; audio != "2021/06/01/10.00.00-10.00.01.wav" || segments[0].AudioStart != 500*time.Millisecond {
+		t.Fatalf("got audio file %q starting at %v", audio, segments[0].AudioStart)
+	}
+
+	// the A-law silence decodes to 8
+	b, err := os.ReadFile(filepath.Join(c.cfg.dir(), "2021/06/01/10.00.00-10.00.01.wav"))
+	if err != nil || len(b) != 44+2*320 || b[44] != 8 || b[45] != 0 {
+		t.Errorf("got %d bytes: %v", len(b), err)
+	}
+}
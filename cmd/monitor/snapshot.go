@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"godvr/internal/dvrip"
+)
+
+const (
+	// streamSnapshotAge is how long a JPEG frame of the stream is served,
+	// devices that send them do so every few seconds
+	streamSnapshotAge = 10 * time.Second
+
+	// snapshotAge is how long a picture taken with OPSNAP is shared
+	// between requests
+	snapshotAge = time.Second
+
+	// snapshotIdle closes the snapshot connection once no picture was
+	// requested for that long
+	snapshotIdle = 20 * time.Second
+)
+
+// snapshotter provides the JPEG pictures of a camera without decoding video.
+// Devices that send JPEG frames on the stream are served from the latest
+// one, the others are asked with OPSNAP on a second connection, which is
+// kept open while pictures are requested.
+type snapshotter struct {
+	dial func(ctx context.Context) (*dvrip.Conn, error)
+
+	// lock guards the picture, the camera loop must not wait for OPSNAP
+	lock       sync.Mutex
+	picture    []byte
+	taken      time.Time
+	fromStream bool
+
+	// connLock serialises the OPSNAP requests
+	connLock sync.Mutex
+	conn     *dvrip.Conn
+	idle     *time.Timer
+}
+
+// update keeps the picture of a JPEG frame of the stream.
+func (s *snapshotter) update(frame *dvrip.Frame) {
+	if frame.Meta.Type != "JPEG" || len(frame.Data) == 0 {
+		return
+	}
+
+	picture := append([]byte(nil), frame.Data...)
+
+	s.lock.Lock()
+	s.picture, s.taken, s.fromStream = picture, time.Now(), true
+	s.lock.Unlock()
+}
+
+// current returns the picture if it is recent enough.
+func (s *snapshotter) current() ([]byte, time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	age := snapshotAge
+	if s.fromStream {
+		age = streamSnapshotAge
+	}
+
+	if s.picture == nil || time.Since(s.taken) > age {
+		return nil, time.Time{}
+	}
+
+	return s.picture, s.taken
+}
+
+// get returns a recent picture and the time it was taken. The returned
+// picture must not be modified.
+func (s *snapshotter) get(ctx context.Context) ([]byte, time.Time, error) {
+	if picture, taken := s.current(); picture != nil {
+		return picture, taken, nil
+	}
+
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+
+	// another request may have taken one meanwhile
+	if picture, taken := s.current(); picture != nil {
+		return picture, taken, nil
+	}
+
+	picture, err := s.snapshot(ctx)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	taken := time.Now()
+
+	s.lock.Lock()
+	s.picture, s.taken, s.fromStream = picture, taken, false
+	s.lock.Unlock()
+
+	return picture, taken, nil
+}
+
+// snapshot takes a picture with OPSNAP, it is called with connLock held. A
+// kept connection may have been dropped by the device, so a failure on it
+// is retried once on a new one.
+func (s *snapshotter) snapshot(ctx context.Context) ([]byte, error) {
+	reused := s.conn != nil
+
+	for {
+		if s.conn == nil {
+			conn, err := s.dial(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			s.conn = conn
+		}
+
+		picture, err := s.conn.Snapshot()
+		if err == nil {
+			s.keep()
+			return picture, nil
+		}
+
+		s.closeConn()
+
+		if !reused {
+			return nil, err
+		}
+
+		reused = false
+	}
+}
+
+// keep closes the connection after snapshotIdle without requests.
+func (s *snapshotter) keep() {
+	if s.idle != nil {
+		s.idle.Stop()
+	}
+
+	s.idle = time.AfterFunc(snapshotIdle, func() {
+		s.connLock.Lock()
+		defer s.connLock.Unlock()
+
+		s.closeConn()
+	})
+}
+
+func (s *snapshotter) closeConn() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// close closes the snapshot connection when the camera stops.
+func (s *snapshotter) close() {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+
+	if s.idle != nil {
+		s.idle.Stop()
+	}
+
+	s.closeConn()
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"godvr/internal/dvrip"
+)
+
+var testPicture = []byte{0xFF, 0xD8, 0xFF, 0xE0, 1, 2, 3, 0xFF, 0xD9}
+
+// fakeDevice answers logins and OPSNAP requests.
+func fakeDevice(t *testing.T) (string, *int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	var logins int32
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer c.Close()
+
+				header := make([]byte, 20)
+
+				for {
+					if _, err := io.ReadFull(c, header); err != nil {
+						return
+					}
+
+					if _, err := io.CopyN(io.Discard, c, int64(binary.LittleEndian.Uint32(header[16:]))); err != nil {
+						return
+					}
+
+					body := append([]byte(nil), testPicture...)
+					if binary.LittleEndian.Uint16(header[14:]) == 1000 {
+						atomic.AddInt32(&logins, 1)
+						body = []byte("{ \"AliveInterval\" : 20, \"Ret\" : 100, \"SessionID\" : \"0x00000001\" }\n\x00")
+					}
+
+					reply := make([]byte, 20, 20+len(body))
+					reply[0] = 0xff
+					binary.LittleEndian.PutUint32(reply[16:], uint32(len(body)))
+					c.Write(append(reply, body...))
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String(), &logins
+}
+
+func TestSnapshotter(t *testing.T) {
+	address, logins := fakeDevice(t)
+
+	c := newCamera(cameraConfig{Name: "gate", Address: address})
+	defer c.snapshots.close()
+
+	for i := 0; i < 3; i++ {
+		picture, _, err := c.snapshots.get(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(picture, testPicture) {
+			t.Errorf("got picture %x", picture)
+		}
+
+		// skip the shared picture
+		c.snapshots.lock.Lock()
+		c.snapshots.picture = nil
+		c.snapshots.lock.Unlock()
+	}
+
+	if n := atomic.LoadInt32(logins); n != 1 {
+		t.Errorf("got %d logins, the connection is not kept", n)
+	}
+
+	// a JPEG frame of the stream is served without asking the device
+	c.snapshots.dial = func(context.Context) (*dvrip.Conn, error) {
+		return nil, errors.New("unreachable")
+	}
+
+	c.snapshots.update(&dvrip.Frame{Data: []byte{0xFF, 0xD8, 0xFF, 0xD9}, Meta: dvrip.MetaInfo{Type: "JPEG"}})
+
+	picture, _, err := c.snapshots.get(context.Background())
+	if err != nil || !bytes.Equal(picture, []byte{0xFF, 0xD8, 0xFF, 0xD9}) {
+		t.Errorf("got picture %x, %v", picture, err)
+	}
+
+	c.snapshots.lock.Lock()
+	c.snapshots.taken = time.Now().Add(-time.Minute)
+	c.snapshots.lock.Unlock()
+
+	c.snapshots.close()
+
+	if _, _, err := c.snapshots.get(context.Background()); err == nil {
+		t.Error("expected an error without a recent picture")
+	}
+}
+
+func TestMJPEG(t *testing.T) {
+	address, _ := fakeDevice(t)
+
+	s := newSupervisor(context.Background())
+	s.run = func(ctx context.Context, c *camera) { <-ctx.Done() }
+	s.apply([]cameraConfig{{Name: "gate", Address: address}})
+
+	defer s.lookup("gate").snapshots.close()
+
+	server := httptest.NewServer(http.HandlerFunc(s.handleCamera))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/cameras/gate/snapshot.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/jpeg" || !bytes.Equal(body, testPicture) {
+		t.Errorf("got status %d, picture %x", resp.StatusCode, body)
+	}
+
+	resp, err = http.Get(server.URL + "/cameras/gate/mjpeg?interval=100ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/x-mixed-replace" {
+		t.Fatalf("got content type %v", resp.Header.Get("Content-Type"))
+	}
+
+	parts := multipart.NewReader(resp.Body, params["boundary"])
+
+	// the picture is taken again once it is older than a second
+	for i := 0; i < 2; i++ {
+		part, err := parts.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		picture, _ := io.ReadAll(part)
+		if part.Header.Get("Content-Type") != "image/jpeg" || !bytes.Equal(picture, testPicture) {
+			t.Errorf("part %d: got picture %x", i, picture)
+		}
+	}
+
+	resp, err = http.Get(server.URL + "/cameras/gate/mjpeg?interval=1ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d for a short interval", resp.StatusCode)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"godvr/internal/rtsp"
+	"godvr/internal/webhook"
+)
+
+// supervisor runs a goroutine per camera and applies config changes to
+// them. Cameras whose config did not change keep recording.
+type supervisor struct {
+	ctx context.Context
+	run func(ctx context.Context, c *camera)
+
+	// rtsp restreams the cameras if it is set
+	rtsp *rtsp.Server
+
+	// hooks posts the events of the cameras, nil without webhooks
+	hooks *webhook.Notifier
+
+	// origins are the other sites allowed to open the WebSockets
+	origins []string
+
+	// reload serialises apply, lock guards running
+	reload  sync.Mutex
+	lock    sync.Mutex
+	running map[string]*instance
+	wg      sync.WaitGroup
+}
+
+type instance struct {
+	camera *camera
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newSupervisor(ctx context.Context) *supervisor {
+	return &supervisor{
+		ctx: ctx,
+		run: func(ctx context.Context, c *camera) {
+			c.run(ctx)
+		},
+		running: map[string]*instance{},
+	}
+}
+
+// apply starts the cameras that were added, stops the removed ones and
+// restarts the ones whose config changed. It returns the names of the
+// cameras in each group.
+func (s *supervisor) apply(configs []cameraConfig) (added, removed, changed []string) {
+	s.reload.Lock()
+	defer s.reload.Unlock()
+
+	s.lock.Lock()
+
+	wanted := map[string]cameraConfig{}
+	for _, cfg := range configs {
+		wanted[cfg.Name] = cfg
+	}
+
+	var stopping []*instance
+
+	for name, inst := range s.running {
+		cfg, ok := wanted[name]
+
+		switch {
+		case !ok:
+			removed = append(removed, name)
+		case cfg != inst.camera.cfg:
+			changed = append(changed, name)
+		default:
+			continue
+		}
+
+		inst.cancel()
+		stopping = append(stopping, inst)
+		delete(s.running, name)
+	}
+
+	s.lock.Unlock()
+
+	// the old recording must have finished its file before the new one
+	// starts writing to the same directory; the lock is released meanwhile
+	// so that HTTP requests for the other cameras are served
+	for _, inst := range stopping {
+		<-inst.done
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// a changed camera keeps its stream and clients
+	if s.rtsp != nil {
+		for _, name := range removed {
+			s.rtsp.RemoveStream(name)
+		}
+	}
+
+	for _, cfg := range configs {
+		if _, ok := s.running[cfg.Name]; ok {
+			continue
+		}
+
+		if !contains(changed, cfg.Name) {
+			added = append(added, cfg.Name)
+		}
+
+		s.start(cfg)
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+
+	return added, removed, changed
+}
+
+func (s *supervisor) start(cfg cameraConfig) {
+	ctx, cancel := context.WithCancel(s.ctx)
+
+	inst := &instance{
+		camera: newCamera(cfg),
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	if s.rtsp != nil {
+		inst.camera.live = s.rtsp.Stream(cfg.Name)
+	}
+
+	inst.camera.hooks = s.hooks
+	inst.camera.view.Upgrade.AllowedOrigins = s.origins
+
+	s.running[cfg.Name] = inst
+	s.wg.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+		defer close(inst.done)
+		defer cancel()
+
+		s.run(ctx, inst.camera)
+	}()
+}
+
+// lookup returns the running camera with the given name or nil.
+func (s *supervisor) lookup(name string) *camera {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	inst, ok := s.running[name]
+	if !ok {
+		return nil
+	}
+
+	return inst.camera
+}
+
+// cameras returns the running cameras ordered by name.
+func (s *supervisor) cameras() []*camera {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	cameras := make([]*camera, 0, len(s.running))
+	for _, inst := range s.running {
+		cameras = append(cameras, inst.camera)
+	}
+
+	sort.Slice(cameras, func(i, j int) bool {
+		return cameras[i].cfg.Name < cameras[j].cfg.Name
+	})
+
+	return cameras
+}
+
+// wait waits until every camera stopped after the context is done.
+func (s *supervisor) wait() {
+	s.wg.Wait()
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
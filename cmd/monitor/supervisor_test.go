@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSupervisorApply(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		lock    sync.Mutex
+		started []string
+		stopped []string
+	)
+
+	s := newSupervisor(ctx)
+	s.run = func(ctx context.Context, c *camera) {
+		lock.Lock()
+		started = append(started, c.cfg.Name)
+		lock.Unlock()
+
+		<-ctx.Done()
+
+		lock.Lock()
+		stopped = append(stopped, c.cfg.Name)
+		lock.Unlock()
+	}
+
+	cfg := func(name, address string) cameraConfig {
+		return cameraConfig{Name: name, Address: address}
+	}
+
+	added, _, _ := s.apply([]cameraConfig{cfg("a", "1"), cfg("b", "2"), cfg("c", "3")})
+	if !reflect.DeepEqual(added, []string{"a", "b", "c"}) {
+		t.Errorf("got added %v", added)
+	}
+
+	gate := s.lookup("a")
+
+	added, removed, changed := s.apply([]cameraConfig{cfg("a", "1"), cfg("c", "4"), cfg("d", "5")})
+	if !reflect.DeepEqual(added, []string{"d"}) || !reflect.DeepEqual(removed, []string{"b"}) || !reflect.DeepEqual(changed, []string{"c"}) {
+		t.Errorf("got added %v, removed %v, changed %v", added, removed, changed)
+	}
+
+	if s.lookup("a") != gate {
+		t.Error("an unchanged camera was restarted")
+	}
+
+	if s.lookup("b") != nil || s.lookup("c").cfg.Address != "4" {
+		t.Error("the cameras were not updated")
+	}
+
+	lock.Lock()
+	sort.Strings(stopped)
+	if !reflect.DeepEqual(stopped, []string{"b", "c"}) {
+		t.Errorf("got stopped %v, expected b and c", stopped)
+	}
+	lock.Unlock()
+
+	cancel()
+	s.wait()
+
+	if len(stopped) != len(started) {
+		t.Errorf("started %v but stopped %v", started, stopped)
+	}
+}
+
+func TestSupervisorApplySlowStop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	release := make(chan struct{})
+
+	s := newSupervisor(ctx)
+	s.run = func(ctx context.Context, c *camera) {
+		<-ctx.Done()
+
+		if c.cfg.Name == "slow" {
+			<-release
+		}
+	}
+
+	s.apply([]cameraConfig{{Name: "fast", Address: "1"}, {Name: "slow", Address: "2"}})
+
+	done := make(chan struct{})
+	go func() {
+		s.apply([]cameraConfig{{Name: "fast", Address: "1"}})
+		close(done)
+	}()
+
+	// the fast camera is served while the slow one shuts down
+	for s.lookup("slow") != nil {
+		time.Sleep(time.Millisecond)
+	}
+
+	lookup := make(chan *camera)
+	go func() {
+		lookup <- s.lookup("fast")
+	}()
+
+	select {
+	case c := <-lookup:
+		if c == nil {
+			t.Error("the unchanged camera is gone")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("lookup blocked while a camera was stopping")
+	}
+
+	close(release)
+	<-done
+
+	cancel()
+	s.wait()
+}
@@ -0,0 +1,398 @@
+// Package catalog keeps an index of the recorded segments of each camera
+// and answers which recordings cover a time range.
+//
+// The index of a camera is the file index.jsonl in the camera directory,
+// next to the date directories, with one JSON encoded Segment per line.
+// Lines are appended as segments finish, so the index survives crashes up to
+// the last finished segment. Compact rewrites it once files are deleted.
+package catalog
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IndexFile is the name of the index in a camera directory.
+const IndexFile = "index.jsonl"
+
+// MaxGap is the longest interruption between two continuous segments that
+// is not reported as a gap, files are rotated without losing frames but the
+// boundary falls between two frames.
+const MaxGap = 2 * time.Second
+
+// Segment describes a recorded file.
+type Segment struct {
+	Camera string `json:"camera"`
+
+	// Path is the file relative to the camera directory, Query returns it
+	// joined with the directory.
+	Path string `json:"path"`
+
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	Codec  string `json:"codec"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Size   int64  `json:"size"`
+
+	// Keyframes are the times of the keyframes relative to Start, the
+	// points a player can seek to.
+	Keyframes []time.Duration `json:"keyframes,omitempty"`
+
+	// KeyframeOffsets are the byte offsets in the file, one per keyframe,
+	// at which a reader can resume to reach the keyframe without parsing
+	// the file from its start.
+	KeyframeOffsets []int64 `json:"keyframeOffsets,omitempty"`
+
+	// Event is set for the clips of the event recording mode, which do not
+	// count towards gaps.
+	Event bool `json:"event,omitempty"`
+
+	// Stream is the stream of the camera the file was recorded from, e.g.
+	// "Main" or "Extra".
+	Stream string `json:"stream,omitempty"`
+
+	// Extra is set for the files of the second stream of a dual-stream
+	// recording. Query leaves them out, Linked pairs them with the files of
+	// the main stream.
+	Extra bool `json:"extra,omitempty"`
+
+	// Audio is the WAV file with the audio of the segment if the recorder
+	// keeps it beside the video, relative to the camera directory like
+	// Path.
+	Audio string `json:"audio,omitempty"`
+
+	// AudioStart is the time of the first sample of Audio relative to
+	// Start, the audio follows without interruption from there.
+	AudioStart time.Duration `json:"audioStart,omitempty"`
+}
+
+// Duration returns the time covered by the segment.
+func (s Segment) Duration() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+// Gap is a time without continuous recording between two segments, e.g.
+// while the camera was reconnecting.
+type Gap struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// Timeline is the answer of Query.
+type Timeline struct {
+	Segments []Segment `json:"segments"`
+	Gaps     []Gap     `json:"gaps"`
+}
+
+// appendLock serialises appends and compactions within the process, each
+// line is written with a single call so concurrent readers never see partial
+// lines.
+var appendLock sync.Mutex
+
+// Append adds a segment to the index in the camera directory dir.
+func Append(dir string, s Segment) error {
+	s.Path = relative(dir, s.Path)
+	if s.Audio != "" {
+		s.Audio = relative(dir, s.Audio)
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	appendLock.Lock()
+	defer appendLock.Unlock()
+
+	f, err := os.OpenFile(filepath.Join(dir, IndexFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(b, '\n'))
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// relative returns path relative to the camera directory dir if it is
+// within it.
+func relative(dir, path string) string {
+	if rel, err := filepath.Rel(dir, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(rel)
+	}
+
+	return path
+}
+
+// Compact rewrites the index in the camera directory dir without the
+// segments whose files no longer exist, e.g. after the retention deleted
+// them, and drops the audio of segments whose WAV file is gone. The new
+// index replaces the old one by a rename, so readers see either of them.
+func Compact(dir string) error {
+	appendLock.Lock()
+	defer appendLock.Unlock()
+
+	segments, err := Read(dir)
+	if err != nil || segments == nil {
+		return err
+	}
+
+	var (
+		buf     []byte
+		changed bool
+	)
+
+	for _, s := range segments {
+		if !exists(resolve(dir, s.Path)) {
+			changed = true
+			continue
+		}
+
+		if s.Audio != "" && !exists(resolve(dir, s.Audio)) {
+			s.Audio, s.AudioStart = "", 0
+			changed = true
+		}
+
+		b, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+
+		buf = append(append(buf, b...), '\n')
+	}
+
+	if !changed {
+		return nil
+	}
+
+	path := filepath.Join(dir, IndexFile)
+
+	err = os.WriteFile(path+".tmp", buf, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// resolve returns the path of a segment file given relative to the camera
+// directory dir.
+func resolve(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+
+	return filepath.Join(dir, filepath.FromSlash(path))
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Read returns the segments of the index in the camera directory dir in the
+// order they were added. A line cut short by a crash at the end is skipped.
+func Read(dir string) ([]Segment, error) {
+	f, err := os.Open(filepath.Join(dir, IndexFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+	defer f.Close()
+
+	var segments []Segment
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20)
+
+	for line := 1; scanner.Scan(); line++ {
+		var s Segment
+
+		err := json.Unmarshal(scanner.Bytes(), &s)
+		if err != nil {
+			if isLastLine(scanner) {
+				break
+			}
+
+			return nil, fmt.Errorf("%v:%d: %v", f.Name(), line, err)
+		}
+
+		segments = append(segments, s)
+	}
+
+	return segments, scanner.Err()
+}
+
+func isLastLine(scanner *bufio.Scanner) bool {
+	return !scanner.Scan()
+}
+
+// Catalog gives access to the indexes of all cameras recorded to a
+// directory.
+type Catalog struct {
+	root string
+}
+
+// Open returns the catalog of the recordings in root, the output directory
+// of the recorder.
+func Open(root string) *Catalog {
+	return &Catalog{root: root}
+}
+
+// Cameras returns the names of the cameras that have an index.
+func (c *Catalog) Cameras() ([]string, error) {
+	entries, err := os.ReadDir(c.root)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+
+		_, err := os.Stat(filepath.Join(c.root, e.Name(), IndexFile))
+		if err == nil {
+			names = append(names, e.Name())
+		}
+	}
+
+	return names, nil
+}
+
+// Query returns the segments of a camera that overlap the time range from
+// to, ordered by their start, and the gaps between its continuous segments
+// within the range. Segments whose files were deleted but are still in the
+// index are left out, as are the files of the extra stream. The paths
+// of the files are joined with the camera directory.
+func (c *Catalog) Query(camera string, from, to time.Time) (Timeline, error) {
+	segments, err := c.find(camera, from, to, false)
+	if err != nil {
+		return Timeline{}, err
+	}
+
+	return Timeline{Segments: segments, Gaps: gaps(segments, from, to)}, nil
+}
+
+// Linked returns the segments of the other stream of a dual-stream
+// recording that overlap s, a segment returned by Query or Linked: the
+// files of the extra stream for a file of the main stream and the other way
+// round. The streams are rotated separately, so their files are linked by
+// time.
+func (c *Catalog) Linked(s Segment) ([]Segment, error) {
+	return c.find(s.Camera, s.Start, s.End, !s.Extra)
+}
+
+// find returns the existing segments of a camera that overlap the time
+// range from to and belong to the main or the extra stream, ordered by their
+// start.
+func (c *Catalog) find(camera string, from, to time.Time, extra bool) ([]Segment, error) {
+	dir := filepath.Join(c.root, camera)
+
+	all, err := Read(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []Segment
+
+	for _, s := range all {
+		if s.Extra != extra || !s.End.After(from) || !s.Start.Before(to) {
+			continue
+		}
+
+		s.Path = resolve(dir, s.Path)
+
+		if !exists(s.Path) {
+			continue
+		}
+
+		if s.Audio != "" {
+			s.Audio = resolve(dir, s.Audio)
+		}
+
+		segments = append(segments, s)
+	}
+
+	sort.SliceStable(segments, func(i, j int) bool {
+		return segments[i].Start.Before(segments[j].Start)
+	})
+
+	return segments, nil
+}
+
+// timeLayouts are the formats accepted by ParseTime.
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+// ParseTime parses the time of a query as given on a command line, e.g.
+// "2021-06-01 10:00", in local time unless the zone is given.
+func ParseTime(s string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		t, err := time.ParseInLocation(layout, s, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time: %q", s)
+}
+
+// gaps returns the interruptions between the continuous segments, clipped
+// to the range from to, including the time before the first segment and
+// after the last one.
+func gaps(segments []Segment, from, to time.Time) []Gap {
+	var out []Gap
+
+	end := from
+
+	for _, s := range segments {
+		if s.Event {
+			continue
+		}
+
+		if s.Start.Sub(end) > MaxGap {
+			g := Gap{Start: end, End: s.Start}
+
+			if g.End.After(to) {
+				g.End = to
+			}
+
+			out = append(out, g)
+		}
+
+		if s.End.After(end) {
+			end = s.End
+		}
+	}
+
+	if to.Sub(end) > MaxGap {
+		out = append(out, Gap{Start: end, End: to})
+	}
+
+	return out
+}
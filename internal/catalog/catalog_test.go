@@ -0,0 +1,185 @@
+package catalog
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQuery(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "gate")
+
+	at := func(h, m int) time.Time {
+		return time.Date(2021, 6, 1, h, m, 0, 0, time.UTC)
+	}
+
+	segments := []Segment{
+		{Path: "2021/06/01/10.00.00-10.10.00.mp4", Start: at(10, 0), End: at(10, 10)},
+		{Path: "2021/06/01/10.10.00-10.20.00.mp4", Start: at(10, 10), End: at(10, 20)},
+		// the extra stream of a dual-stream recording
+		{Path: "2021/06/01/10.12.00-10.22.00.extra.mp4", Start: at(10, 12), End: at(10, 22), Extra: true},
+		// the camera was lost for 5 minutes
+		{Path: "2021/06/01/10.25.00-10.35.00.mp4", Start: at(10, 25), End: at(10, 35)},
+		{Path: "2021/06/01/10.30.00-10.31.00.event.mp4", Start: at(10, 30), End: at(10, 31), Event: true},
+		{Path: "2021/06/01/10.35.00-10.45.00.mp4", Start: at(10, 35), End: at(10, 45)},
+		// deleted by the retention
+		{Path: "2021/06/01/10.45.00-10.55.00.mp4", Start: at(10, 45), End: at(10, 55)},
+	}
+
+	err := os.MkdirAll(filepath.Join(dir, "2021/06/01"), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, s := range segments {
+		s.Camera = "gate"
+		s.Path = filepath.Join(dir, s.Path)
+
+		if i < len(segments)-1 {
+			os.WriteFile(s.Path, nil, 0644)
+		}
+
+		err := Append(dir, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a line cut short by a crash
+	f, _ := os.OpenFile(filepath.Join(dir, IndexFile), os.O_WRONLY|os.O_APPEND, 0)
+	f.WriteString(`{"camera":"gate","pa`)
+	f.Close()
+
+	cameras, err := Open(root).Cameras()
+	if err != nil || len(cameras) != 1 || cameras[0] != "gate" {
+		t.Fatalf("got cameras %v: %v", cameras, err)
+	}
+
+	timeline, err := Open(root).Query("gate", at(10, 15), at(10, 50))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []time.Time{at(10, 10), at(10, 25), at(10, 30), at(10, 35)}
+	if len(timeline.Segments) != len(expected) {
+		t.Fatalf("got %d segments, expected %d", len(timeline.Segments), len(expected))
+	}
+
+	for i, s := range timeline.Segments {
+		if !s.Start.Equal(expected[i]) {
+			t.Errorf("segment %d starts at %v, expected %v", i, s.Start, expected[i])
+		}
+	}
+
+	if p := timeline.Segments[0].Path; p != filepath.Join(dir, "2021/06/01/10.10.00-10.20.00.mp4") {
+		t.Errorf("got path %v", p)
+	}
+
+	// the lost camera and the deleted last segment
+	if len(timeline.Gaps) != 2 || !timeline.Gaps[0].Start.Equal(at(10, 20)) || !timeline.Gaps[0].End.Equal(at(10, 25)) ||
+		!timeline.Gaps[1].Start.Equal(at(10, 45)) || !timeline.Gaps[1].End.Equal(at(10, 50)) {
+		t.Errorf("unexpected gaps: %+v", timeline.Gaps)
+	}
+
+	extra, err := Open(root).Linked(timeline.Segments[0])
+	if err != nil || len(extra) != 1 || extra[0].Path != filepath.Join(dir, "2021/06/01/10.12.00-10.22.00.extra.mp4") {
+		t.Fatalf("got linked segments %+v: %v", extra, err)
+	}
+
+	linked, err := Open(root).Linked(extra[0])
+	if err != nil || len(linked) != 1 || !linked[0].Start.Equal(at(10, 10)) {
+		t.Errorf("got segments %+v linked to the extra stream: %v", linked, err)
+	}
+}
+
+func TestGaps(t *testing.T) {
+	at := func(h, m int) time.Time {
+		return time.Date(2021, 6, 1, h, m, 0, 0, time.UTC)
+	}
+
+	segments := []Segment{
+		{Start: at(10, 10), End: at(10, 20)},
+		{Start: at(10, 25), End: at(10, 35)},
+		{Start: at(10, 40), End: at(10, 41), Event: true},
+	}
+
+	tests := []struct {
+		name     string
+		from, to time.Time
+		expected []Gap
+	}{
+		{"within", at(10, 12), at(10, 30), []Gap{{at(10, 20), at(10, 25)}}},
+		{"leading", at(10, 0), at(10, 30), []Gap{{at(10, 0), at(10, 10)}, {at(10, 20), at(10, 25)}}},
+		{"trailing", at(10, 12), at(10, 50), []Gap{{at(10, 20), at(10, 25)}, {at(10, 35), at(10, 50)}}},
+		{"clipped", at(10, 21), at(10, 23), []Gap{{at(10, 21), at(10, 23)}}},
+		{"short", at(10, 10).Add(-time.Second), at(10, 35), []Gap{{at(10, 20), at(10, 25)}}},
+	}
+
+	for _, test := range tests {
+		got := gaps(segments, test.from, test.to)
+
+		if len(got) != len(test.expected) {
+			t.Errorf("%v: got gaps %+v, expected %+v", test.name, got, test.expected)
+			continue
+		}
+
+		for i := range got {
+			if !got[i].Start.Equal(test.expected[i].Start) || !got[i].End.Equal(test.expected[i].End) {
+				t.Errorf("%v: got gaps %+v, expected %+v", test.name, got, test.expected)
+				break
+			}
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	at := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+
+	for i, name := range []string{"10.00.00-10.10.00", "10.10.00-10.20.00", "10.20.00-10.30.00"} {
+		s := Segment{
+			Camera: "gate",
+			Path:   filepath.Join(dir, name+".mp4"),
+			Audio:  filepath.Join(dir, name+".wav"),
+			Start:  at.Add(time.Duration(i) * 10 * time.Minute),
+			End:    at.Add(time.Duration(i+1) * 10 * time.Minute),
+		}
+
+		os.WriteFile(s.Path, nil, 0644)
+		os.WriteFile(s.Audio, nil, 0644)
+
+		err := Append(dir, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the retention deleted the first segment and the audio of the second
+	os.Remove(filepath.Join(dir, "10.00.00-10.10.00.mp4"))
+	os.Remove(filepath.Join(dir, "10.00.00-10.10.00.wav"))
+	os.Remove(filepath.Join(dir, "10.10.00-10.20.00.wav"))
+
+	err := Compact(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	segments, err := Read(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(segments) != 2 || segments[0].Path != "10.10.00-10.20.00.mp4" || segments[1].Path != "10.20.00-10.30.00.mp4" {
+		t.Fatalf("unexpected index: %+v", segments)
+	}
+
+	if segments[0].Audio != "" || segments[1].Audio != "10.20.00-10.30.00.wav" {
+		t.Errorf("unexpected audio: %q %q", segments[0].Audio, segments[1].Audio)
+	}
+
+	if exists(filepath.Join(dir, IndexFile+".tmp")) {
+		t.Error("temporary index was left behind")
+	}
+}
@@ -0,0 +1,113 @@
+package dvrip
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Alarm is a device alarm, e.g. motion detection or an alarm input, pushed
+// by the camera after MonitorAlarms subscribed to them.
+type Alarm struct {
+	Channel int
+
+	// Event is the alarm type as named by the device, e.g. "VideoMotion",
+	// "LocalAlarm" or "HumanDetect".
+	Event string
+
+	// Active is true when the alarm started and false when it ended.
+	Active bool
+
+	// StartTime is the device time the alarm started at.
+	StartTime time.Time
+
+	// Time is the wall clock time the alarm was received at.
+	Time time.Time
+}
+
+// MonitorAlarms subscribes to the device alarms and sends them to ch once
+// Monitor runs. It must be called before Monitor since the alarms arrive on
+// the monitor connection. Like metadata events, alarms are dropped while ch
+// is full.
+func (c *Conn) MonitorAlarms(ch chan *Alarm) error {
+	body, err := json.Marshal(map[string]string{
+		"Name":      "",
+		"SessionID": fmt.Sprintf("%08X", c.session),
+	})
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	err = c.send(codeAlarmSet, body)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = c.recv()
+	if err != nil {
+		return err
+	}
+
+	c.alarms = ch
+
+	c.log.Info("subscribed to alarms")
+
+	return nil
+}
+
+func (c *Conn) publishAlarm(body []byte) {
+	if c.alarms == nil {
+		return
+	}
+
+	alarm, err := parseAlarm(body)
+	if err != nil {
+		c.log.Warn("failed to parse alarm", "err", err)
+		return
+	}
+
+	alarm.Time = time.Now()
+
+	select {
+	case c.alarms <- alarm:
+	default:
+		c.log.Debug("alarm dropped", "event", alarm.Event)
+	}
+}
+
+// parseAlarm decodes the JSON body of an AlarmInfo message.
+func parseAlarm(body []byte) (*Alarm, error) {
+	body = bytes.TrimRight(body, "\x0a\x00")
+
+	var m struct {
+		AlarmInfo struct {
+			Channel   int
+			Event     string
+			StartTime string
+			Status    string
+		}
+	}
+
+	err := json.Unmarshal(body, &m)
+	if err != nil {
+		return nil, err
+	}
+
+	info := m.AlarmInfo
+	alarm := &Alarm{
+		Channel: info.Channel,
+		Event:   info.Event,
+		Active:  info.Status == "Start",
+	}
+
+	start, err := time.ParseInLocation("2006-01-02 15:04:05", info.StartTime, time.Local)
+	if err == nil {
+		alarm.StartTime = start
+	}
+
+	return alarm, nil
+}
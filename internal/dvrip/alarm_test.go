@@ -0,0 +1,64 @@
+package dvrip
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+const alarmBody = `{ "AlarmInfo" : { "Channel" : 0, "Event" : "VideoMotion", "StartTime" : "2021-03-14 15:09:26", "Status" : "Start" }, "Name" : "AlarmInfo", "SessionID" : "0x00000003" }` + "\x0a\x00"
+
+func TestParseAlarm(t *testing.T) {
+	alarm, err := parseAlarm([]byte(alarmBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if alarm.Event != "VideoMotion" || !alarm.Active || alarm.Channel != 0 {
+		t.Errorf("unexpected alarm: %+v", alarm)
+	}
+
+	if !alarm.StartTime.Equal(time.Date(2021, 3, 14, 15, 9, 26, 0, time.Local)) {
+		t.Errorf("got start time %v", alarm.StartTime)
+	}
+}
+
+func TestReassembleBinPayloadAlarm(t *testing.T) {
+	conn, server := pipeConn(t, Settings{})
+
+	alarms := make(chan *Alarm, 1)
+	conn.alarms = alarms
+
+	go func() {
+		// an alarm in the middle of a frame spread over two packets
+		frame := pframe([]byte{1, 2, 3, 4, 5, 6})
+		server.Write(packet(frame[:10]))
+
+		alarm := packet([]byte(alarmBody))
+		binary.LittleEndian.PutUint16(alarm[14:], uint16(codeAlarmInfo))
+		server.Write(alarm)
+
+		server.Write(packet(frame[10:]))
+	}()
+
+	frame := acquireFrame()
+	defer frame.Release()
+
+	err := conn.reassembleBinPayload(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(frame.Data) != 6 {
+		t.Errorf("got %d bytes, expected 6", len(frame.Data))
+	}
+
+	select {
+	case alarm := <-alarms:
+		if alarm.Event != "VideoMotion" {
+			t.Errorf("unexpected alarm: %+v", alarm)
+		}
+	default:
+		t.Error("alarm was not published")
+	}
+}
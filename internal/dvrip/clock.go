@@ -0,0 +1,100 @@
+package dvrip
+
+import "time"
+
+const (
+	// defaultFPS is used until the camera reports its frame rate.
+	defaultFPS = 25
+
+	// g711SampleRate is the rate of the standard, used if the camera does not
+	// report one. G.711 takes one byte per sample.
+	g711SampleRate = 8000
+
+	// maxClockDrift is how far the nominal timestamps may run away from the
+	// packet arrival times before they are resynchronised.
+	maxClockDrift = time.Second
+)
+
+// mediaClock assigns presentation timestamps to the frames of a monitor
+// session. Video and audio share the same origin, so their timestamps can be
+// used for A/V sync.
+type mediaClock struct {
+	origin time.Time
+	video  streamClock
+	audio  streamClock
+	fps    int
+}
+
+// streamClock advances the timestamp of a single stream by the nominal
+// duration of each frame and falls back to the arrival time when the two
+// drift apart, e.g. after dropped frames or a stalled connection.
+type streamClock struct {
+	started bool
+	next    time.Duration
+	last    time.Duration
+}
+
+func (s *streamClock) stamp(elapsed, duration time.Duration) time.Duration {
+	pts := s.next
+
+	if !s.started {
+		pts = elapsed
+	}
+
+	if drift := elapsed - pts; drift > maxClockDrift || drift < -maxClockDrift {
+		pts = elapsed
+	}
+
+	// timestamps must be strictly increasing within a stream
+	if s.started && pts <= s.last {
+		pts = s.last + time.Millisecond
+	}
+
+	s.started = true
+	s.last = pts
+	s.next = pts + duration
+
+	return pts
+}
+
+// stamp sets the timing fields of a frame that arrived at the given time.
+// The arrival time is compared on the monotonic clock, so wall clock jumps,
+// e.g. caused by SetTime, do not affect the timestamps.
+func (m *mediaClock) stamp(frame *Frame, arrival time.Time) {
+	if m.origin.IsZero() {
+		m.origin = arrival
+	}
+
+	elapsed := arrival.Sub(m.origin)
+	frame.Time = arrival
+
+	switch {
+	case frame.Meta.Frame != "":
+		if frame.Meta.FPS > 0 && (frame.Meta.Frame == "I" || m.fps == 0) {
+			m.fps = frame.Meta.FPS
+		}
+
+		fps := m.fps
+		if fps <= 0 {
+			fps = defaultFPS
+		}
+
+		frame.Meta.FPS = fps
+		frame.Duration = time.Second / time.Duration(fps)
+		frame.PTS = m.video.stamp(elapsed, frame.Duration)
+	case frame.Meta.Type == "G711A":
+		rate := frame.Meta.SampleRate
+		if rate <= 0 {
+			rate = g711SampleRate
+		}
+
+		frame.Duration = time.Duration(len(frame.Data)) * time.Second / time.Duration(rate)
+		frame.PTS = m.audio.stamp(elapsed, frame.Duration)
+	default:
+		frame.PTS = elapsed
+	}
+
+	// the cameras do not produce B-frames, so frames are decoded in
+	// presentation order
+	frame.DTS = frame.PTS
+}
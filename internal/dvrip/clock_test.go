@@ -0,0 +1,69 @@
+package dvrip
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMediaClock(t *testing.T) {
+	var clock mediaClock
+
+	start := time.Now()
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	video := func(kind string, fps int, arrival time.Duration) *Frame {
+		frame := &Frame{Meta: MetaInfo{Frame: kind, FPS: fps}}
+		clock.stamp(frame, at(arrival))
+
+		return frame
+	}
+
+	// jittery arrival times do not leak into the timestamps
+	expected := []time.Duration{0, 40 * time.Millisecond, 80 * time.Millisecond, 120 * time.Millisecond}
+	arrivals := []time.Duration{0, 70 * time.Millisecond, 75 * time.Millisecond, 110 * time.Millisecond}
+
+	for i := range arrivals {
+		kind := "P"
+		if i == 0 {
+			kind = "I"
+		}
+
+		frame := video(kind, 25, arrivals[i])
+		if frame.PTS != expected[i] || frame.DTS != frame.PTS || frame.Meta.FPS != 25 {
+			t.Errorf("frame %d: got pts=%v dts=%v fps=%v, expected pts=%v", i, frame.PTS, frame.DTS, frame.Meta.FPS, expected[i])
+		}
+	}
+
+	// a gap larger than maxClockDrift resynchronises with the arrival time
+	if frame := video("P", 0, 5*time.Second); frame.PTS != 5*time.Second {
+		t.Errorf("got pts=%v after a gap, expected 5s", frame.PTS)
+	}
+
+	// audio is timed by its sample count on the same origin
+	audio := &Frame{Data: make([]byte, 320), Meta: MetaInfo{Type: "G711A"}}
+	clock.stamp(audio, at(5*time.Second))
+
+	if audio.PTS != 5*time.Second || audio.Duration != 40*time.Millisecond {
+		t.Errorf("got audio pts=%v duration=%v", audio.PTS, audio.Duration)
+	}
+
+	// the same bytes last half as long at 16 kHz
+	audio = &Frame{Data: make([]byte, 320), Meta: MetaInfo{Type: "G711A", SampleRate: 16000}}
+	clock.stamp(audio, at(5*time.Second+40*time.Millisecond))
+
+	if audio.PTS != 5*time.Second+40*time.Millisecond || audio.Duration != 20*time.Millisecond {
+		t.Errorf("got 16 kHz audio pts=%v duration=%v", audio.PTS, audio.Duration)
+	}
+}
+
+func TestStreamClockMonotonic(t *testing.T) {
+	var clock streamClock
+
+	first := clock.stamp(10*time.Second, time.Second)
+	// arrival time going backwards must not produce decreasing timestamps
+	second := clock.stamp(0, time.Second)
+
+	if second <= first {
+		t.Errorf("got %v after %v", second, first)
+	}
+}
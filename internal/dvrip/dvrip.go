@@ -8,10 +8,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"godvr/internal/nalu"
 )
 
 const (
@@ -97,6 +101,15 @@ const (
 var requestCodes = map[requestCode]string{
 	codeOPMonitor:     "OPMonitor",
 	codeOPTimeSetting: "OPTimeSetting",
+	codeOPSNAP:        "OPSNAP",
+}
+
+func (c requestCode) String() string {
+	if name, ok := requestCodes[c]; ok {
+		return name
+	}
+
+	return strconv.Itoa(int(c))
 }
 
 var keyCodes = map[string]string{
@@ -112,7 +125,12 @@ var keyCodes = map[string]string{
 }
 
 type Conn struct {
+	// parseErrors is accessed atomically and comes first to be 64-bit
+	// aligned on 32-bit platforms
+	parseErrors uint64
+
 	settings *Settings
+	log      Logger
 
 	session        int32
 	packetSequence int32
@@ -121,7 +139,19 @@ type Conn struct {
 	c    net.Conn
 	lock sync.Mutex
 
+	header  [payloadHeaderSize]byte
+	scratch []byte
+
+	// codec and parameters of the last video frames, P-frames do not
+	// carry them
+	videoType string
+	videoSPS  nalu.SPS
+
 	stopMonitor chan struct{}
+	closed      chan struct{}
+	closeOnce   sync.Once
+	metadata    chan *Metadata
+	alarms      chan *Alarm
 	MonitorErr  error
 }
 
@@ -146,11 +176,138 @@ type MetaInfo struct {
 	FPS      int
 	Frame    string
 	Type     string
+	Profile  string
+	Level    string
+
+	// SampleRate is the rate of an audio frame in Hz, zero if the camera
+	// sent an unknown rate code.
+	SampleRate int
 }
 
 type Frame struct {
 	Data []byte
 	Meta MetaInfo
+
+	// NALUs holds the NAL units of an H.264/H.265 frame and VPS, SPS and PPS
+	// the parameter sets among them. All of them share memory with Data.
+	NALUs [][]byte
+	VPS   []byte
+	SPS   []byte
+	PPS   []byte
+
+	// Keyframe reports whether the frame is an IDR/IRAP picture that can be
+	// decoded without earlier frames. Frames of codecs without NAL units,
+	// e.g. MPEG4, are keyframes if they are I-frames.
+	Keyframe bool
+
+	// PTS and DTS are the presentation and decoding timestamps relative to
+	// the start of the monitor session, separately monotonic for video and
+	// audio. Duration is the nominal length of the frame and Time the wall
+	// clock time it arrived at.
+	PTS      time.Duration
+	DTS      time.Duration
+	Duration time.Duration
+	Time     time.Time
+
+	dataType uint32
+	media    byte
+	pooled   bool
+
+	// refs counts the owners of a pooled frame, see Retain
+	refs int32
+}
+
+var framePool = sync.Pool{
+	New: func() interface{} {
+		return &Frame{}
+	},
+}
+
+// pooledFrames counts the frames taken from the pool and not released yet.
+var pooledFrames int64
+
+func acquireFrame() *Frame {
+	frame := framePool.Get().(*Frame)
+	frame.pooled = true
+	frame.refs = 1
+
+	atomic.AddInt64(&pooledFrames, 1)
+
+	return frame
+}
+
+// AcquireFrame returns an empty frame from the pool, for publishers other
+// than MonitorPooled, e.g. tests. It is released like the frames of
+// MonitorPooled.
+func AcquireFrame() *Frame {
+	return acquireFrame()
+}
+
+// PooledFrames returns the number of frames taken from the pool and not
+// released yet, a leak shows as a count that keeps growing.
+func PooledFrames() int64 {
+	return atomic.LoadInt64(&pooledFrames)
+}
+
+// Retain adds an owner to a pooled frame, which is then only returned to
+// the pool once every owner called Release. The owners must not modify the
+// frame. It is a no-op for frames that were not taken from the pool.
+func (f *Frame) Retain() {
+	if f.pooled {
+		atomic.AddInt32(&f.refs, 1)
+	}
+}
+
+// Release returns a frame received from MonitorPooled to the pool. It is a
+// no-op for frames that were not taken from the pool.
+func (f *Frame) Release() {
+	if !f.pooled || atomic.AddInt32(&f.refs, -1) > 0 {
+		return
+	}
+
+	f.Data = f.Data[:0]
+	f.Meta = MetaInfo{}
+	f.NALUs = f.NALUs[:0]
+	f.VPS, f.SPS, f.PPS = nil, nil, nil
+	f.Keyframe = false
+	f.PTS, f.DTS, f.Duration = 0, 0, 0
+	f.Time = time.Time{}
+	f.dataType, f.media = 0, 0
+	f.pooled = false
+
+	atomic.AddInt64(&pooledFrames, -1)
+	framePool.Put(f)
+}
+
+// Clone returns a copy of the frame that shares no memory with it and is
+// not pooled, e.g. to keep a frame beyond its Release.
+func (f *Frame) Clone() *Frame {
+	frame := &Frame{
+		Data:     append([]byte(nil), f.Data...),
+		Meta:     f.Meta,
+		Keyframe: f.Keyframe,
+		PTS:      f.PTS,
+		DTS:      f.DTS,
+		Duration: f.Duration,
+		Time:     f.Time,
+	}
+
+	if len(f.NALUs) > 0 {
+		frame.NALUs = make([][]byte, 0, len(f.NALUs))
+		frame.NALUs = nalu.AppendSplit(frame.NALUs, frame.Data)
+		frame.VPS, frame.SPS, frame.PPS = parameterSets(frame.Meta.Type, frame.NALUs)
+	}
+
+	return frame
+}
+
+// detach copies a pooled frame into an exactly sized one that is owned by
+// the caller and releases the original.
+func (f *Frame) detach() *Frame {
+	frame := f.Clone()
+	f.Release()
+
+	return frame
 }
 
 type Settings struct {
@@ -161,9 +318,26 @@ type Settings struct {
 	PasswordHash string
 	Debug        bool
 
+	// Channel is the video channel monitored on devices with several
+	// cameras such as DVRs and NVRs.
+	Channel int
+
+	// Logger receives connection, command and frame events. When nil and
+	// Debug is set, SetDefaults and New install a logger on top of the
+	// standard log package that reports every event; otherwise nothing is
+	// logged.
+	Logger Logger
+
 	DialTimout   time.Duration
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
+
+	// MaxBodyLength limits the size of a single packet body and MaxFrameSize
+	// the size of a reassembled frame. Oversized packets and frames are
+	// skipped. Zero selects DefaultMaxBodyLength and DefaultMaxFrameSize, a
+	// negative value disables the limit.
+	MaxBodyLength int
+	MaxFrameSize  int
 }
 
 func (s *Settings) SetDefaults() {
@@ -175,6 +349,14 @@ func (s *Settings) SetDefaults() {
 		s.Network = "tcp"
 	}
 
+	if s.Logger == nil {
+		s.Logger = nopLogger{}
+
+		if s.Debug {
+			s.Logger = NewStdLogger(nil, true)
+		}
+	}
+
 	if s.PasswordHash == "" {
 		s.PasswordHash = sofiaHash(s.Password)
 	}
@@ -204,8 +386,21 @@ func (s *Settings) SetDefaults() {
 	if s.WriteTimeout == 0 {
 		s.WriteTimeout = time.Second * 5
 	}
+
+	if s.MaxBodyLength == 0 {
+		s.MaxBodyLength = DefaultMaxBodyLength
+	}
+
+	if s.MaxFrameSize == 0 {
+		s.MaxFrameSize = DefaultMaxFrameSize
+	}
 }
 
+const (
+	DefaultMaxBodyLength = 4 << 20
+	DefaultMaxFrameSize  = 16 << 20
+)
+
 const alnum = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
 
 func sofiaHash(password string) string {
@@ -220,10 +415,17 @@ func sofiaHash(password string) string {
 	return string(hash)
 }
 
+// New connects to the device. The settings get the defaults of SetDefaults,
+// so calling it beforehand is optional.
 func New(ctx context.Context, settings Settings) (*Conn, error) {
+	settings.SetDefaults()
+
 	conn := Conn{
-		settings: &settings,
+		settings:    &settings,
+		stopMonitor: make(chan struct{}),
+		closed:      make(chan struct{}),
 	}
+	conn.log = connLogger{conn: &conn}
 
 	var (
 		err    error
@@ -235,9 +437,12 @@ func New(ctx context.Context, settings Settings) (*Conn, error) {
 
 	conn.c, err = dialer.DialContext(ctx, settings.Network, settings.Address)
 	if err != nil {
+		conn.log.Error("failed to connect", "err", err)
 		return nil, err
 	}
 
+	conn.log.Info("connected", "network", settings.Network)
+
 	return &conn, nil
 }
 
@@ -277,6 +482,7 @@ func (c *Conn) Login() error {
 	}
 
 	if (statusCode(status) != statusOK) && (statusCode(status) != statusUpgradeSuccessful) {
+		c.log.Error("login failed", "user", c.settings.User, "status", status)
 		return fmt.Errorf("unexpected status code: %v - %v", status, statusCodes[statusCode(status)])
 	}
 
@@ -287,6 +493,8 @@ func (c *Conn) Login() error {
 	c.session = int32(session)
 	c.aliveTime = time.Second * time.Duration(m["AliveInterval"].(float64))
 
+	c.log.Info("logged in", "user", c.settings.User, "aliveInterval", c.aliveTime)
+
 	return nil
 }
 
@@ -303,26 +511,64 @@ func (c *Conn) Command(command requestCode, data interface{}) (*Payload, []byte,
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
+	c.log.Debug("sending command", "command", command)
+
 	err = c.send(command, params)
 	if err != nil {
+		c.log.Warn("failed to send command", "command", command, "err", err)
 		return nil, nil, err
 	}
 
 	resp, body, err := c.recv()
+	if err != nil {
+		c.log.Warn("failed to receive command response", "command", command, "err", err)
+		return nil, nil, err
+	}
+
 	body = body[:len(body)-2] // skip the trailing 0x0a and 0x00 bytes
 
-	return resp, body, err
+	return resp, body, nil
 }
 
 func (c *Conn) StopMonitor() {
-	c.stopMonitor <- struct{}{}
+	select {
+	case c.stopMonitor <- struct{}{}:
+	case <-c.closed:
+	}
+}
+
+// Close closes the connection. A running monitor stops and closes its
+// channel, the keepalive stops with the next attempt.
+func (c *Conn) Close() error {
+	err := net.ErrClosed
+
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.c.Close()
+		c.log.Info("connection closed")
+	})
+
+	return err
 }
 
+// Monitor starts streaming the given stream type and sends every reassembled
+// frame to ch. The channel is closed when the stream ends, see MonitorErr.
 func (c *Conn) Monitor(stream string, ch chan *Frame) error {
+	return c.monitor(stream, ch, false)
+}
+
+// MonitorPooled works like Monitor but hands out frames whose buffers are
+// taken from a shared pool. The receiver owns each frame until it calls
+// Release on it; Frame.Data must not be used afterwards.
+func (c *Conn) MonitorPooled(stream string, ch chan *Frame) error {
+	return c.monitor(stream, ch, true)
+}
+
+func (c *Conn) monitor(stream string, ch chan *Frame, pooled bool) error {
 	_, _, err := c.Command(codeOPMonitor, map[string]interface{}{
 		"Action": "Claim",
 		"Parameter": map[string]interface{}{
-			"Channel":    0,
+			"Channel":    c.settings.Channel,
 			"CombinMode": "NONE",
 			"StreamType": stream,
 			"TransMode":  "TCP",
@@ -341,7 +587,7 @@ func (c *Conn) Monitor(stream string, ch chan *Frame) error {
 		"OPMonitor": map[string]interface{}{
 			"Action": "Start",
 			"Parameter": map[string]interface{}{
-				"Channel":    0,
+				"Channel":    c.settings.Channel,
 				"CombinMode": "NONE",
 				"StreamType": stream,
 				"TransMode":  "TCP",
@@ -357,34 +603,77 @@ func (c *Conn) Monitor(stream string, ch chan *Frame) error {
 		return err
 	}
 
+	c.log.Info("monitor started", "stream", stream)
+
 	go func() {
 		defer c.lock.Unlock()
 
+		// the metadata events end with the stream they came from
+		defer func() {
+			if c.metadata != nil {
+				close(c.metadata)
+				c.metadata = nil
+			}
+		}()
+
+		var clock mediaClock
+
 		for {
-			frame, err := c.reassembleBinPayload()
+			frame := acquireFrame()
+
+			err := c.reassembleBinPayload(frame)
 			if err != nil {
-				if errors.Is(err, net.ErrClosed) {
+				frame.Release()
+
+				if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+					c.log.Info("monitor stopped", "stream", stream, "err", err)
 					c.MonitorErr = err
 					close(ch)
 					return
 				}
 
 				if err, ok := err.(net.Error); ok && err.Timeout() {
+					c.log.Warn("monitor timed out", "stream", stream, "err", err)
 					c.MonitorErr = err
 					close(ch)
 					return
 				}
 
-				if c.settings.Debug {
-					fmt.Printf("error while reassembleBinPayload: %v", err)
-				}
+				atomic.AddUint64(&c.parseErrors, 1)
+				c.log.Warn("failed to reassemble frame", "stream", stream, "err", err)
 
 				continue
 			}
 
+			if frame.Meta.Frame != "" {
+				c.parseVideo(frame)
+			}
+
+			clock.stamp(frame, time.Now())
+
+			if frame.dataType == 0x1F9 {
+				c.publishMetadata(frame, frame.media)
+			}
+
+			if !pooled {
+				frame = frame.detach()
+			}
+
+			if debugEnabled(c.settings.Logger) {
+				c.log.Debug("frame received", "stream", stream, "frame", frame.Meta.Frame, "type", frame.Meta.Type, "size", len(frame.Data))
+			}
+
 			select {
 			case ch <- frame:
 			case <-c.stopMonitor:
+				frame.Release()
+				c.log.Info("monitor stopped", "stream", stream)
+				close(ch)
+				return
+			case <-c.closed:
+				frame.Release()
+				c.log.Info("monitor stopped", "stream", stream, "err", net.ErrClosed)
+				c.MonitorErr = net.ErrClosed
 				close(ch)
 				return
 			}
@@ -394,6 +683,12 @@ func (c *Conn) Monitor(stream string, ch chan *Frame) error {
 	return nil
 }
 
+// ParseErrors returns the number of frames of the monitor that could not be
+// reassembled and were skipped.
+func (c *Conn) ParseErrors() uint64 {
+	return atomic.LoadUint64(&c.parseErrors)
+}
+
 func (c *Conn) SetTime() error {
 	_, _, err := c.Command(codeOPTimeSetting, time.Now().Format("2006-01-02 15:04:05"))
 
@@ -423,13 +718,18 @@ func (c *Conn) SetKeepAlive() error {
 		return err
 	}
 
+	c.log.Debug("keepalive sent", "next", c.aliveTime)
+
 	time.AfterFunc(c.aliveTime, func() {
+		select {
+		case <-c.closed:
+			return
+		default:
+		}
+
 		err := c.SetKeepAlive()
 		if err != nil {
-			if c.settings.Debug {
-				fmt.Printf("failed to setKeepAlive: %v", err)
-			}
-
+			c.log.Error("failed to send keepalive", "err", err)
 			return
 		}
 	})
@@ -472,127 +772,186 @@ func (c *Conn) send(msgID requestCode, data []byte) error {
 	return nil
 }
 
-func (c *Conn) recv() (*Payload, []byte, error) {
-	var p Payload
-	var b = make([]byte, 20)
+const payloadHeaderSize = 20
 
+func (c *Conn) recvHeader() (*Payload, error) {
 	c.c.SetReadDeadline(time.Now().Add(c.settings.ReadTimeout))
-	_, err := c.c.Read(b)
+
+	_, err := io.ReadFull(c.c, c.header[:])
+	if err != nil {
+		return nil, err
+	}
+
+	b := c.header[:]
+	p := Payload{
+		Head:           b[0],
+		Version:        b[1],
+		Session:        int32(binary.LittleEndian.Uint32(b[4:8])),
+		SequenceNumber: int32(binary.LittleEndian.Uint32(b[8:12])),
+		MsgID:          int16(binary.LittleEndian.Uint16(b[14:16])),
+		BodyLength:     int32(binary.LittleEndian.Uint32(b[16:20])),
+	}
+
+	c.packetSequence += 1
+
+	if p.BodyLength <= 0 {
+		return nil, fmt.Errorf("invalid bodylength: %v", p.BodyLength)
+	}
+
+	if max := c.settings.MaxBodyLength; max > 0 && int(p.BodyLength) > max {
+		// skip the body so that the next read starts at a packet boundary
+		_, err = io.CopyN(io.Discard, c.c, int64(p.BodyLength))
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("bodylength %v exceeds the maximum of %v", p.BodyLength, max)
+	}
+
+	return &p, nil
+}
+
+func (c *Conn) recv() (*Payload, []byte, error) {
+	p, err := c.recvHeader()
 	if err != nil {
 		return nil, nil, err
 	}
 
+	body := make([]byte, p.BodyLength)
+
 	c.c.SetReadDeadline(time.Now().Add(c.settings.ReadTimeout))
-	err = binary.Read(bytes.NewReader(b), binary.LittleEndian, &p)
+	_, err = io.ReadFull(c.c, body)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	c.packetSequence += 1
+	return p, body, nil
+}
 
-	if p.BodyLength <= 0 || p.BodyLength >= 100000 {
-		return nil, nil, fmt.Errorf("invalid bodylength: %v", p.BodyLength)
+// recvScratch works like recv but reads the body into a buffer owned by the
+// connection, which is only valid until the next call.
+func (c *Conn) recvScratch() (*Payload, []byte, error) {
+	p, err := c.recvHeader()
+	if err != nil {
+		return nil, nil, err
 	}
 
-	body := make([]byte, p.BodyLength)
-	err = binary.Read(c.c, binary.LittleEndian, &body)
+	if cap(c.scratch) < int(p.BodyLength) {
+		c.scratch = make([]byte, p.BodyLength)
+	}
+
+	body := c.scratch[:p.BodyLength]
+
+	c.c.SetReadDeadline(time.Now().Add(c.settings.ReadTimeout))
+	_, err = io.ReadFull(c.c, body)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	return &p, body, nil
+	return p, body, nil
 }
 
-func (c *Conn) reassembleBinPayload() (*Frame, error) {
+func (c *Conn) reassembleBinPayload(frame *Frame) error {
 	var length uint32 = 0
-	var data bytes.Buffer
-	var meta MetaInfo
+	var tooLarge bool
+
+	meta := &frame.Meta
 
 	for {
-		_, body, err := c.recv()
+		p, body, err := c.recvScratch()
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		buf := bytes.NewReader(body)
+		// alarms are pushed between the media packets
+		if requestCode(p.MsgID) == codeAlarmInfo {
+			c.publishAlarm(body)
+			continue
+		}
 
 		if length == 0 {
-			var dataType uint32
-			err = binary.Read(buf, binary.BigEndian, &dataType)
-			if err != nil {
-				return nil, err
+			if len(body) < 4 {
+				return fmt.Errorf("packet is too short: %v bytes", len(body))
 			}
 
+			dataType := binary.BigEndian.Uint32(body)
+			body = body[4:]
+			frame.dataType = dataType
+
 			switch dataType {
 			case 0x1FC, 0x1FE:
-				frame := struct {
-					Media    byte
-					FPS      byte
-					Width    byte
-					Height   byte
-					DateTime uint32
-					Length   uint32
-				}{}
-
-				err = binary.Read(buf, binary.LittleEndian, &frame)
-				if err != nil {
-					return nil, err
+				// Media, FPS, Width, Height, DateTime, Length
+				if len(body) < 12 {
+					return fmt.Errorf("frame header is too short: %v bytes", len(body))
 				}
 
 				if dataType == 0x1FC {
 					meta.Frame = "I"
+					c.videoType = parseMediaType(dataType, body[0])
+					meta.Type = c.videoType
+				} else {
+					meta.Type = parseMediaType(dataType, body[0])
 				}
 
-				length = frame.Length
-				meta.Width = int(frame.Width) * 8
-				meta.Height = int(frame.Height) * 8
-				meta.Datetime = parseDatetime(frame.DateTime)
+				meta.FPS = int(body[1])
+
+				length = binary.LittleEndian.Uint32(body[8:12])
+				meta.Width = int(body[2]) * 8
+				meta.Height = int(body[3]) * 8
+				meta.Datetime = parseDatetime(binary.LittleEndian.Uint32(body[4:8]))
+				body = body[12:]
 			case 0x1FD:
 				// 4 bytes
-				err = binary.Read(buf, binary.LittleEndian, &length)
-				if err != nil {
-					return nil, err
+				if len(body) < 4 {
+					return fmt.Errorf("frame header is too short: %v bytes", len(body))
 				}
 
+				length = binary.LittleEndian.Uint32(body)
 				meta.Frame = "P"
+				meta.Type = c.videoType
+				body = body[4:]
 			case 0x1FA, 0x1F9:
-				packet := struct {
-					Media      byte
-					SampleRate byte
-					Length     uint16
-				}{}
-
-				err = binary.Read(buf, binary.LittleEndian, &packet)
-				if err != nil {
-					return nil, err
+				// Media, SampleRate, Length
+				if len(body) < 4 {
+					return fmt.Errorf("packet header is too short: %v bytes", len(body))
 				}
 
-				length = uint32(packet.Length)
-				meta.Type = parseMediaType(dataType, packet.Media)
+				length = uint32(binary.LittleEndian.Uint16(body[2:4]))
+				meta.Type = parseMediaType(dataType, body[0])
+				frame.media = body[0]
+
+				if dataType == 0x1FA {
+					meta.SampleRate = parseSampleRate(body[1])
+				}
+
+				body = body[4:]
 			case 0xFFD8FFE0:
-				return &Frame{
-					Data: data.Bytes(),
-					Meta: meta,
-				}, nil
+				return nil
 			default:
-				return nil, fmt.Errorf("unexpected data type: %X", dataType)
+				return fmt.Errorf("unexpected data type: %X", dataType)
+			}
+
+			if max := c.settings.MaxFrameSize; max > 0 && int(length) > max {
+				tooLarge = true
 			}
 		}
 
-		n, err := buf.WriteTo(&data)
-		if err != nil {
-			return nil, err
+		if !tooLarge {
+			frame.Data = append(frame.Data, body...)
 		}
 
-		length -= uint32(n)
+		if uint32(len(body)) >= length {
+			length = 0
+		} else {
+			length -= uint32(len(body))
+		}
 
 		if length == 0 {
-			frame := &Frame{
-				Data: data.Bytes(),
-				Meta: meta,
+			if tooLarge {
+				return fmt.Errorf("frame exceeds the maximum size of %v bytes", c.settings.MaxFrameSize)
 			}
 
-			return frame, nil
+			return nil
 		}
 	}
 }
@@ -627,6 +986,18 @@ func parseMediaType(dataType uint32, mediaCode byte) string {
 	return "unexpected"
 }
 
+// sampleRates are the audio sample rates by their code in the audio frame
+// header, starting at 1.
+var sampleRates = []int{4000, 8000, 11025, 16000, 20000, 22050, 32000, 44100, 48000}
+
+func parseSampleRate(code byte) int {
+	if code == 0 || int(code) > len(sampleRates) {
+		return 0
+	}
+
+	return sampleRates[code-1]
+}
+
 func parseDatetime(value uint32) time.Time {
 	second := int(value & 0x3F)
 	minute := int((value & 0xFC0) >> 6)
@@ -2,9 +2,15 @@ package dvrip
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestSofiaHash(t *testing.T) {
@@ -34,7 +40,8 @@ func TestKeepAlive(t *testing.T) {
 		var b = make([]byte, 98)
 		_, err = conn.Read(b)
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
+			return
 		}
 
 		_, err = conn.Write([]byte{
@@ -51,13 +58,15 @@ func TestKeepAlive(t *testing.T) {
 		})
 
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
+			return
 		}
 
 		b = make([]byte, 65)
 		_, err = conn.Read(b)
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
+			return
 		}
 
 		_, err = conn.Write([]byte{
@@ -74,16 +83,20 @@ func TestKeepAlive(t *testing.T) {
 		})
 
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
+			return
 		}
 	}()
 
-	conn, err := New(Settings{
+	settings := Settings{
 		Network:  "tcp",
 		Address:  ln.Addr().String(),
 		User:     "foo",
 		Password: "bar",
-	})
+	}
+	settings.SetDefaults()
+
+	conn, err := New(context.Background(), settings)
 
 	if err != nil {
 		t.Fatal(err)
@@ -109,7 +122,8 @@ func TestLogin(t *testing.T) {
 	go func() {
 		conn, err := ln.Accept()
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
+			return
 		}
 
 		defer conn.Close()
@@ -117,7 +131,8 @@ func TestLogin(t *testing.T) {
 		var b = make([]byte, 98)
 		_, err = conn.Read(b)
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
+			return
 		}
 
 		// { "AliveInterval" : 30, "ChannelNum" : 1, "DeviceType " : "IPC", "ExtraChannel" : 0, "Ret" : 100, "SessionID" : "0x00000018" }
@@ -140,12 +155,15 @@ func TestLogin(t *testing.T) {
 		}
 	}()
 
-	conn, err := New(Settings{
+	settings := Settings{
 		Network:  "tcp",
 		Address:  ln.Addr().String(),
 		User:     "foo",
 		Password: "bar",
-	})
+	}
+	settings.SetDefaults()
+
+	conn, err := New(context.Background(), settings)
 
 	if err != nil {
 		t.Fatal(err)
@@ -729,12 +747,15 @@ func TestMonitor(t *testing.T) {
 		fmt.Println("done", n)
 	}()
 
-	conn, err := New(Settings{
+	settings := Settings{
 		Network:  "tcp",
 		Address:  ln.Addr().String(),
 		User:     "foo",
 		Password: "bar",
-	})
+	}
+	settings.SetDefaults()
+
+	conn, err := New(context.Background(), settings)
 
 	if err != nil {
 		t.Fatal(err)
@@ -750,3 +771,252 @@ func TestMonitor(t *testing.T) {
 		fmt.Println("---->", frame.Meta)
 	}
 }
+
+func packet(body []byte) []byte {
+	b := make([]byte, payloadHeaderSize, payloadHeaderSize+len(body))
+	b[0] = 0xff
+	binary.LittleEndian.PutUint32(b[16:], uint32(len(body)))
+
+	return append(b, body...)
+}
+
+func pframe(data []byte) []byte {
+	b := []byte{0x00, 0x00, 0x01, 0xfd, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(data)))
+
+	return append(b, data...)
+}
+
+func pipeConn(t *testing.T, settings Settings) (*Conn, net.Conn) {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	settings.Address = "pipe"
+	settings.SetDefaults()
+
+	conn := &Conn{settings: &settings, c: client, stopMonitor: make(chan struct{}), closed: make(chan struct{})}
+	conn.log = connLogger{conn: conn}
+
+	return conn, server
+}
+
+func TestReassembleBinPayloadLimits(t *testing.T) {
+	conn, server := pipeConn(t, Settings{MaxBodyLength: 16, MaxFrameSize: 8})
+
+	go func() {
+		// too large packet, a frame spread over two packets and a too large frame
+		server.Write(packet(make([]byte, 32)))
+		first := pframe([]byte{1, 2, 3, 4, 5, 6})
+		server.Write(packet(first[:10]))
+		server.Write(packet(first[10:]))
+		server.Write(packet(pframe(make([]byte, 9))[:16]))
+		server.Write(packet([]byte{0}))
+	}()
+
+	frame := acquireFrame()
+	defer frame.Release()
+
+	err := conn.reassembleBinPayload(frame)
+	if err == nil || !strings.Contains(err.Error(), "exceeds the maximum of 16") {
+		t.Fatalf("expected packet size error, got %v", err)
+	}
+
+	err = conn.reassembleBinPayload(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(frame.Data, []byte{1, 2, 3, 4, 5, 6}) || frame.Meta.Frame != "P" {
+		t.Errorf("unexpected frame: %v %+v", frame.Data, frame.Meta)
+	}
+
+	frame.Release()
+	frame = acquireFrame()
+
+	err = conn.reassembleBinPayload(frame)
+	if err == nil || !strings.Contains(err.Error(), "maximum size of 8") {
+		t.Fatalf("expected frame size error, got %v", err)
+	}
+}
+
+func TestReassembleAudioSampleRate(t *testing.T) {
+	conn, server := pipeConn(t, Settings{})
+
+	audio := func(rate byte) []byte {
+		return packet([]byte{0x00, 0x00, 0x01, 0xfa, 0x0e, rate, 4, 0, 0xd5, 0xd5, 0xd5, 0xd5})
+	}
+
+	go func() {
+		server.Write(audio(2))
+		server.Write(audio(4))
+		server.Write(audio(0x7f))
+	}()
+
+	for _, expected := range []int{8000, 16000, 0} {
+		frame := acquireFrame()
+
+		err := conn.reassembleBinPayload(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if frame.Meta.Type != "G711A" || frame.Meta.SampleRate != expected || len(frame.Data) != 4 {
+			t.Errorf("got %+v with %d bytes, expected a rate of %d", frame.Meta, len(frame.Data), expected)
+		}
+
+		frame.Release()
+	}
+}
+
+func TestReassembleBinPayloadUnlimited(t *testing.T) {
+	conn, server := pipeConn(t, Settings{MaxBodyLength: -1, MaxFrameSize: -1})
+
+	if conn.settings.MaxBodyLength != -1 || conn.settings.MaxFrameSize != -1 {
+		t.Fatalf("SetDefaults replaced disabled limits: %+v", conn.settings)
+	}
+
+	data := make([]byte, DefaultMaxBodyLength+1)
+
+	go server.Write(packet(pframe(data)))
+
+	frame := acquireFrame()
+	defer frame.Release()
+
+	err := conn.reassembleBinPayload(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(frame.Data) != len(data) {
+		t.Errorf("got %v bytes, expected %v", len(frame.Data), len(data))
+	}
+}
+
+func TestMonitorClosesMetadata(t *testing.T) {
+	conn, server := pipeConn(t, Settings{})
+
+	metadata := make(chan *Metadata, 1)
+	conn.MonitorMetadata(metadata)
+
+	go func() {
+		readPacket := func() {
+			header := make([]byte, payloadHeaderSize)
+			io.ReadFull(server, header)
+			io.CopyN(io.Discard, server, int64(binary.LittleEndian.Uint32(header[16:])))
+		}
+
+		readPacket() // claim
+		server.Write(packet([]byte("{ \"Ret\" : 100 }\x0a\x00")))
+		readPacket() // start
+		server.Close()
+	}()
+
+	outch := make(chan *Frame)
+
+	err := conn.Monitor("Main", outch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range outch {
+	}
+
+	select {
+	case _, ok := <-metadata:
+		if ok {
+			t.Errorf("unexpected metadata event")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("metadata channel was not closed")
+	}
+}
+
+func TestMonitorMPEG4Keyframes(t *testing.T) {
+	conn, server := pipeConn(t, Settings{})
+
+	go func() {
+		readPacket := func() {
+			header := make([]byte, payloadHeaderSize)
+			io.ReadFull(server, header)
+			io.CopyN(io.Discard, server, int64(binary.LittleEndian.Uint32(header[16:])))
+		}
+
+		readPacket() // claim
+		server.Write(packet([]byte("{ \"Ret\" : 100 }\x0a\x00")))
+		readPacket() // start
+
+		// an MPEG4 I-frame, media code 1, and a P-frame
+		iframe := []byte{0x00, 0x00, 0x01, 0xfc, 0x01, 25, 1920 / 8, 1080 / 8, 0, 0, 0, 0, 5, 0, 0, 0}
+		server.Write(packet(append(iframe, 0, 0, 1, 0xb6, 0x10)))
+		server.Write(packet(pframe([]byte{0, 0, 1, 0xb6, 0x50})))
+		server.Close()
+	}()
+
+	outch := make(chan *Frame)
+
+	err := conn.Monitor("Main", outch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keyframes []bool
+
+	for frame := range outch {
+		keyframes = append(keyframes, frame.Keyframe)
+
+		if frame.Meta.Type != "MPEG4" {
+			t.Errorf("got type %q", frame.Meta.Type)
+		}
+
+		frame.Release()
+	}
+
+	if len(keyframes) != 2 || !keyframes[0] || keyframes[1] {
+		t.Errorf("got keyframes %v, expected the I-frame only", keyframes)
+	}
+}
+
+func TestFrameRelease(t *testing.T) {
+	frame := acquireFrame()
+	frame.Data = append(frame.Data, 1, 2, 3)
+	frame.Meta.Frame = "I"
+
+	detached := frame.detach()
+	if detached.pooled || !bytes.Equal(detached.Data, []byte{1, 2, 3}) || detached.Meta.Frame != "I" {
+		t.Errorf("unexpected detached frame: %+v", detached)
+	}
+
+	if frame.pooled || len(frame.Data) != 0 || frame.Meta.Frame != "" {
+		t.Errorf("released frame was not reset: %+v", frame)
+	}
+
+	// releasing a frame that is not pooled must be a no-op
+	detached.Release()
+	if len(detached.Data) != 3 {
+		t.Errorf("unpooled frame was modified by Release")
+	}
+}
+
+func TestFrameRetain(t *testing.T) {
+	frame := acquireFrame()
+	frame.Data = append(frame.Data, 1, 2, 3)
+
+	frame.Retain()
+	frame.Retain()
+
+	frame.Release()
+	frame.Release()
+
+	if !frame.pooled || len(frame.Data) != 3 {
+		t.Fatal("frame was released while it has an owner")
+	}
+
+	frame.Release()
+
+	if frame.pooled || len(frame.Data) != 0 {
+		t.Errorf("frame was not released by its last owner: %+v", frame)
+	}
+}
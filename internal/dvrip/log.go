@@ -0,0 +1,129 @@
+package dvrip
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger receives connection, command and frame level events from Conn.
+// Arguments after msg are alternating key/value pairs, the same convention
+// log/slog uses, so a *slog.Logger can be assigned to Settings.Logger as is.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// debugEnabler is implemented by loggers that can tell up front whether
+// they drop debug events, which lets Conn skip building them per frame.
+type debugEnabler interface {
+	DebugEnabled() bool
+}
+
+// NewStdLogger returns a Logger that writes key=value lines to l.
+// Info, Warn and Error events are always written, Debug events only if
+// debug is true. Conn itself stays quiet unless Settings.Debug is set or a
+// Logger is assigned.
+func NewStdLogger(l *log.Logger, debug bool) Logger {
+	if l == nil {
+		l = log.Default()
+	}
+
+	return &stdLogger{l: l, debug: debug}
+}
+
+type stdLogger struct {
+	l     *log.Logger
+	debug bool
+}
+
+func (s *stdLogger) Debug(msg string, args ...interface{}) {
+	if s.debug {
+		s.print("DEBUG", msg, args)
+	}
+}
+
+func (s *stdLogger) DebugEnabled() bool { return s.debug }
+
+func (s *stdLogger) Info(msg string, args ...interface{})  { s.print("INFO", msg, args) }
+func (s *stdLogger) Warn(msg string, args ...interface{})  { s.print("WARN", msg, args) }
+func (s *stdLogger) Error(msg string, args ...interface{}) { s.print("ERROR", msg, args) }
+
+func (s *stdLogger) print(level, msg string, args []interface{}) {
+	var b strings.Builder
+
+	b.WriteString(level)
+	b.WriteByte(' ')
+	b.WriteString(msg)
+
+	for i := 0; i < len(args); i += 2 {
+		b.WriteByte(' ')
+
+		if i+1 == len(args) {
+			fmt.Fprintf(&b, "!BADKEY=%v", args[i])
+			break
+		}
+
+		fmt.Fprintf(&b, "%v=%v", args[i], args[i+1])
+	}
+
+	s.l.Println(b.String())
+}
+
+type nopLogger struct{}
+
+func (nopLogger) DebugEnabled() bool           { return false }
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// connLogger attaches the device address and the current session ID to
+// every event before handing it to the configured Logger.
+type connLogger struct {
+	conn *Conn
+}
+
+func (l connLogger) Debug(msg string, args ...interface{}) {
+	if !debugEnabled(l.conn.settings.Logger) {
+		return
+	}
+
+	l.conn.settings.Logger.Debug(msg, l.with(args)...)
+}
+
+// debugEnabled reports whether l wants debug events. Callers on hot paths
+// check it before building the arguments.
+func debugEnabled(l Logger) bool {
+	d, ok := l.(debugEnabler)
+
+	return !ok || d.DebugEnabled()
+}
+
+func (l connLogger) Info(msg string, args ...interface{}) {
+	l.conn.settings.Logger.Info(msg, l.with(args)...)
+}
+
+func (l connLogger) Warn(msg string, args ...interface{}) {
+	l.conn.settings.Logger.Warn(msg, l.with(args)...)
+}
+
+func (l connLogger) Error(msg string, args ...interface{}) {
+	l.conn.settings.Logger.Error(msg, l.with(args)...)
+}
+
+func (l connLogger) with(args []interface{}) []interface{} {
+	return append([]interface{}{
+		"address", l.conn.settings.Address,
+		"session", sessionID(l.conn.session),
+	}, args...)
+}
+
+// sessionID formats a session as hex only when a logger prints it.
+type sessionID int32
+
+func (s sessionID) String() string {
+	return fmt.Sprintf("%08X", uint32(s))
+}
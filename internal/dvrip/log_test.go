@@ -0,0 +1,107 @@
+package dvrip
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+
+	logger := NewStdLogger(log.New(&buf, "", 0), false)
+	logger.Debug("hidden", "key", "value")
+	logger.Info("connected", "address", "192.168.1.147:34567", "session", "00000018")
+	logger.Warn("odd", "dangling")
+
+	expected := "INFO connected address=192.168.1.147:34567 session=00000018\n" +
+		"WARN odd !BADKEY=dangling\n"
+
+	if buf.String() != expected {
+		t.Errorf("got %q, expected %q", buf.String(), expected)
+	}
+}
+
+func TestConnLogger(t *testing.T) {
+	var buf bytes.Buffer
+
+	conn := &Conn{
+		settings: &Settings{
+			Address: "192.168.1.147:34567",
+			Logger:  NewStdLogger(log.New(&buf, "", 0), true),
+		},
+		session: 0x18,
+	}
+	conn.log = connLogger{conn: conn}
+
+	conn.log.Debug("sending command", "command", codeOPMonitor)
+
+	expected := "DEBUG sending command address=192.168.1.147:34567 session=00000018 command=OPMonitor\n"
+
+	if buf.String() != expected {
+		t.Errorf("got %q, expected %q", buf.String(), expected)
+	}
+}
+
+type countingLogger struct {
+	nopLogger
+	debug int
+}
+
+func (c *countingLogger) Debug(string, ...interface{}) { c.debug++ }
+
+func TestConnLoggerSkipsDisabledDebug(t *testing.T) {
+	logger := &countingLogger{}
+	conn := &Conn{settings: &Settings{Logger: logger}}
+	conn.log = connLogger{conn: conn}
+
+	conn.log.Debug("frame received", "size", 1)
+
+	if logger.debug != 0 {
+		t.Errorf("debug event reached a logger that disabled it")
+	}
+}
+
+func TestSetDefaultsQuietLogger(t *testing.T) {
+	settings := Settings{Address: "192.168.1.147"}
+	settings.SetDefaults()
+
+	if _, ok := settings.Logger.(nopLogger); !ok {
+		t.Errorf("got %T, expected the default logger to be quiet", settings.Logger)
+	}
+
+	settings = Settings{Address: "192.168.1.147", Debug: true}
+	settings.SetDefaults()
+
+	if _, ok := settings.Logger.(*stdLogger); !ok {
+		t.Errorf("got %T, expected a standard logger with Debug set", settings.Logger)
+	}
+}
+
+func TestNewAppliesDefaultLogger(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var buf bytes.Buffer
+
+	output := log.Writer()
+	log.SetOutput(&buf)
+	defer log.SetOutput(output)
+
+	// without SetDefaults
+	conn, err := New(context.Background(), Settings{Address: ln.Addr().String(), Debug: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if !strings.Contains(buf.String(), "INFO connected") {
+		t.Errorf("got %q, expected the connection to be logged with Debug set", buf.String())
+	}
+}
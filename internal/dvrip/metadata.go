@@ -0,0 +1,47 @@
+package dvrip
+
+import "time"
+
+// Metadata is a 0x1F9 info packet. The devices send OSD text, the device
+// time, motion and intelligent video analysis results in them. None of these
+// are decoded yet: the layout of the payload is not documented and there are
+// no captured packets to check a decoder against, so Raw is all there is
+// until such captures exist.
+type Metadata struct {
+	// Media is the media code from the packet header that tells the kinds
+	// of info packets apart.
+	Media byte
+
+	PTS  time.Duration
+	Time time.Time
+
+	// Raw is the payload of the packet.
+	Raw []byte
+}
+
+// MonitorMetadata makes the monitor send the info packets to ch besides
+// delivering them as frames. It must be called before Monitor. Sends never
+// block the stream: events are dropped while ch is full, so ch should be
+// buffered. ch is closed when the monitor stops.
+func (c *Conn) MonitorMetadata(ch chan *Metadata) {
+	c.metadata = ch
+}
+
+func (c *Conn) publishMetadata(frame *Frame, media byte) {
+	if c.metadata == nil {
+		return
+	}
+
+	event := &Metadata{
+		Media: media,
+		PTS:   frame.PTS,
+		Time:  frame.Time,
+		Raw:   append([]byte(nil), frame.Data...),
+	}
+
+	select {
+	case c.metadata <- event:
+	default:
+		c.log.Debug("metadata event dropped", "media", event.Media)
+	}
+}
@@ -0,0 +1,34 @@
+package dvrip
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestPublishMetadata(t *testing.T) {
+	conn := &Conn{settings: &Settings{Logger: nopLogger{}}, metadata: make(chan *Metadata, 1)}
+	conn.log = connLogger{conn: conn}
+
+	frame := &Frame{Data: []byte{0x02, 0x00}, PTS: time.Second}
+	conn.publishMetadata(frame, 6)
+	frame.Data[0] = 0xFF
+
+	event := <-conn.metadata
+	if event.Media != 6 || event.PTS != time.Second || !bytes.Equal(event.Raw, []byte{0x02, 0x00}) {
+		t.Errorf("unexpected event: %+v", event)
+	}
+}
+
+func TestPublishMetadataDoesNotBlock(t *testing.T) {
+	conn := &Conn{settings: &Settings{Logger: nopLogger{}}, metadata: make(chan *Metadata, 1)}
+	conn.log = connLogger{conn: conn}
+
+	frame := &Frame{Data: []byte{0x00, 0x00}}
+	conn.publishMetadata(frame, 6)
+	conn.publishMetadata(frame, 6)
+
+	if len(conn.metadata) != 1 {
+		t.Errorf("expected one queued event, got %d", len(conn.metadata))
+	}
+}
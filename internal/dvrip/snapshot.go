@@ -0,0 +1,105 @@
+package dvrip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var (
+	jpegStart = []byte{0xFF, 0xD8}
+	jpegEnd   = []byte{0xFF, 0xD9}
+)
+
+// Snapshot takes a JPEG picture of the channel with OPSNAP. The device
+// encodes the picture, so no video has to be decoded. A running monitor
+// holds the connection, so snapshots are taken on a connection of their
+// own while recording.
+func (c *Conn) Snapshot() ([]byte, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"Name":      requestCodes[codeOPSNAP],
+		"SessionID": fmt.Sprintf("%08X", c.session),
+		requestCodes[codeOPSNAP]: map[string]interface{}{
+			"Channel": c.settings.Channel,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	err = c.send(codeOPSNAP, body)
+	if err != nil {
+		return nil, err
+	}
+
+	picture, err := c.recvPicture()
+	if err != nil {
+		return nil, err
+	}
+
+	c.log.Debug("snapshot taken", "size", len(picture))
+
+	return picture, nil
+}
+
+// recvPicture reads an OPSNAP reply, which spans several packets if the
+// picture does not fit into one. Devices either send it as a 0x1FE picture
+// frame that announces its length, like the frames of a monitor, or as the
+// bare JPEG, which is complete at its end marker.
+func (c *Conn) recvPicture() ([]byte, error) {
+	_, picture, err := c.recv()
+	if err != nil {
+		return nil, err
+	}
+
+	framed := len(picture) >= 16 && binary.BigEndian.Uint32(picture) == 0x1FE
+
+	var length int
+
+	switch {
+	case framed:
+		// data type, media, FPS, width, height, date time, length
+		length = int(binary.LittleEndian.Uint32(picture[12:16]))
+		picture = picture[16:]
+	case !bytes.HasPrefix(picture, jpegStart):
+		// devices that can't take snapshots answer with a JSON status
+		return nil, fmt.Errorf("snapshot failed: %q", bytes.TrimRight(picture, "\n\x00"))
+	}
+
+	for framed && len(picture) < length || !framed && !jpegComplete(picture) {
+		if max := c.settings.MaxFrameSize; max > 0 && len(picture) > max {
+			return nil, fmt.Errorf("snapshot exceeds the maximum size of %v bytes", max)
+		}
+
+		_, body, err := c.recv()
+		if err != nil {
+			return nil, err
+		}
+
+		picture = append(picture, body...)
+	}
+
+	if framed {
+		picture = picture[:length]
+	} else {
+		// some firmwares append the trailer of the JSON replies
+		picture = picture[:bytes.LastIndex(picture, jpegEnd)+len(jpegEnd)]
+	}
+
+	if !bytes.HasPrefix(picture, jpegStart) {
+		return nil, errors.New("snapshot is not a JPEG picture")
+	}
+
+	return picture, nil
+}
+
+// jpegComplete reports whether b ends with the end marker, followed by the
+// trailer of the JSON replies on some firmwares.
+func jpegComplete(b []byte) bool {
+	return bytes.HasSuffix(bytes.TrimRight(b, "\n\x00"), jpegEnd)
+}
@@ -0,0 +1,107 @@
+package dvrip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	conn, server := pipeConn(t, Settings{Channel: 2})
+
+	picture := []byte{0xFF, 0xD8, 0xFF, 0xE0, 1, 2, 3, 0xFF, 0xD9}
+
+	requests := make(chan map[string]interface{}, 2)
+
+	go func() {
+		for _, reply := range [][]byte{
+			append(append([]byte(nil), picture...), 0x0a, 0x00),
+			[]byte("{ \"Ret\" : 607 }\n\x00"),
+		} {
+			header := make([]byte, payloadHeaderSize)
+			if _, err := io.ReadFull(server, header); err != nil {
+				return
+			}
+
+			body := make([]byte, binary.LittleEndian.Uint32(header[16:]))
+			if _, err := io.ReadFull(server, body); err != nil {
+				return
+			}
+
+			var request map[string]interface{}
+			json.Unmarshal(body[:len(body)-2], &request)
+			requests <- request
+
+			server.Write(packet(reply))
+		}
+	}()
+
+	got, err := conn.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, picture) {
+		t.Errorf("got %x, expected %x", got, picture)
+	}
+
+	request := <-requests
+	if request["Name"] != "OPSNAP" || request["OPSNAP"].(map[string]interface{})["Channel"] != 2.0 {
+		t.Errorf("unexpected request: %v", request)
+	}
+
+	_, err = conn.Snapshot()
+	if err == nil || !strings.Contains(err.Error(), "607") {
+		t.Errorf("expected a snapshot error, got %v", err)
+	}
+}
+
+func TestSnapshotMultiplePackets(t *testing.T) {
+	conn, server := pipeConn(t, Settings{})
+
+	picture := append([]byte{0xFF, 0xD8, 0xFF, 0xE0}, bytes.Repeat([]byte{1, 2, 3}, 100)...)
+	picture = append(picture, 0xFF, 0xD9)
+
+	// a 0x1FE picture frame with its length and the bare JPEG, each split
+	// over three packets
+	framed := []byte{0x00, 0x00, 0x01, 0xFE, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(framed[12:], uint32(len(picture)))
+	framed = append(framed, picture...)
+
+	bare := append(append([]byte(nil), picture...), 0x0a, 0x00)
+
+	go func() {
+		for _, reply := range [][]byte{framed, bare} {
+			header := make([]byte, payloadHeaderSize)
+			if _, err := io.ReadFull(server, header); err != nil {
+				return
+			}
+
+			io.CopyN(io.Discard, server, int64(binary.LittleEndian.Uint32(header[16:])))
+
+			for len(reply) > 0 {
+				n := len(reply)
+				if n > 128 {
+					n = 128
+				}
+
+				server.Write(packet(reply[:n]))
+				reply = reply[n:]
+			}
+		}
+	}()
+
+	for _, name := range []string{"framed", "bare"} {
+		got, err := conn.Snapshot()
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+
+		if !bytes.Equal(got, picture) {
+			t.Errorf("%v: got %d bytes, expected %d", name, len(got), len(picture))
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package dvrip
+
+import "godvr/internal/nalu"
+
+// parseVideo splits a video frame into NAL units, picks up its parameter
+// sets and fills the frame metadata from the latest SPS. The one byte
+// width/height fields of the frame header can't describe resolutions over
+// 2040 pixels, so the SPS values take precedence.
+func (c *Conn) parseVideo(frame *Frame) {
+	codec := frame.Meta.Type
+	if codec == "" || codec == "unexpected" {
+		codec = c.videoType
+	}
+
+	if codec == "" || codec == "unexpected" {
+		codec = nalu.DetectCodec(frame.Data)
+	}
+
+	// frames without NAL units, e.g. MPEG4, are keyframes if the header
+	// marks them as I-frames
+	if codec != nalu.CodecH264 && codec != nalu.CodecH265 {
+		frame.Keyframe = frame.Meta.Frame == "I"
+		return
+	}
+
+	c.videoType = codec
+	frame.Meta.Type = codec
+
+	splitVideo(frame, codec)
+
+	if frame.SPS != nil {
+		sps, err := nalu.ParseSPS(codec, frame.SPS)
+		if err != nil {
+			c.log.Warn("failed to parse SPS", "codec", codec, "err", err)
+		} else {
+			c.videoSPS = sps
+		}
+	}
+
+	if c.videoSPS.Codec != codec {
+		return
+	}
+
+	frame.Meta.Width = c.videoSPS.Width
+	frame.Meta.Height = c.videoSPS.Height
+	frame.Meta.Profile = c.videoSPS.Profile
+	frame.Meta.Level = c.videoSPS.Level
+
+	if frame.Meta.FPS == 0 && c.videoSPS.FPS > 0 {
+		frame.Meta.FPS = int(c.videoSPS.FPS + 0.5)
+	}
+}
+
+// NewVideoFrame builds a frame from an H.264/H.265 access unit in Annex B
+// form, e.g. one read back from a recording. The resolution is only set for
+// frames that carry an SPS.
+func NewVideoFrame(codec string, data []byte) *Frame {
+	frame := &Frame{
+		Data: data,
+		Meta: MetaInfo{Frame: "P", Type: codec},
+	}
+
+	splitVideo(frame, codec)
+
+	if frame.Keyframe {
+		frame.Meta.Frame = "I"
+	}
+
+	if frame.SPS != nil {
+		sps, err := nalu.ParseSPS(codec, frame.SPS)
+		if err == nil {
+			frame.Meta.Width = sps.Width
+			frame.Meta.Height = sps.Height
+			frame.Meta.Profile = sps.Profile
+			frame.Meta.Level = sps.Level
+		}
+	}
+
+	return frame
+}
+
+// splitVideo fills the NAL units, parameter sets and keyframe flag of a
+// frame.
+func splitVideo(frame *Frame, codec string) {
+	frame.NALUs = nalu.AppendSplit(frame.NALUs[:0], frame.Data)
+	frame.VPS, frame.SPS, frame.PPS = parameterSets(codec, frame.NALUs)
+
+	for _, unit := range frame.NALUs {
+		if nalu.IsKeyframe(codec, unit) {
+			frame.Keyframe = true
+			break
+		}
+	}
+}
+
+func parameterSets(codec string, units [][]byte) (vps, sps, pps []byte) {
+	for _, unit := range units {
+		switch codec {
+		case nalu.CodecH264:
+			switch nalu.H264Type(unit) {
+			case nalu.H264SPS:
+				sps = unit
+			case nalu.H264PPS:
+				pps = unit
+			}
+		case nalu.CodecH265:
+			switch nalu.H265Type(unit) {
+			case nalu.H265VPS:
+				vps = unit
+			case nalu.H265SPS:
+				sps = unit
+			case nalu.H265PPS:
+				pps = unit
+			}
+		}
+	}
+
+	return vps, sps, pps
+}
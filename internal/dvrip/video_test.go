@@ -0,0 +1,53 @@
+package dvrip
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestParseVideo(t *testing.T) {
+	sps, _ := hex.DecodeString("6764002aacd940780227e5c044000003000400000300323c60c658")
+
+	iframe := []byte{0, 0, 0, 1}
+	iframe = append(iframe, sps...)
+	iframe = append(iframe, 0, 0, 0, 1, 0x68, 0xeb, 0xe3, 0xcb, 0, 0, 0, 1, 0x65, 0x88, 0x84)
+
+	conn := &Conn{settings: &Settings{Logger: nopLogger{}}}
+	conn.log = connLogger{conn: conn}
+
+	frame := &Frame{Data: iframe, Meta: MetaInfo{Frame: "I", Type: "H264", Width: 2040, Height: 1080}}
+	conn.parseVideo(frame)
+
+	if !frame.Keyframe || len(frame.NALUs) != 3 || frame.SPS == nil || frame.PPS == nil || frame.VPS != nil {
+		t.Errorf("unexpected I-frame: keyframe=%v nalus=%d sps=%x pps=%x", frame.Keyframe, len(frame.NALUs), frame.SPS, frame.PPS)
+	}
+
+	if frame.Meta.Width != 1920 || frame.Meta.Height != 1080 || frame.Meta.Profile != "High" || frame.Meta.Level != "4.2" {
+		t.Errorf("unexpected I-frame meta: %+v", frame.Meta)
+	}
+
+	// P-frames carry neither a codec nor parameter sets
+	frame = &Frame{Data: []byte{0, 0, 0, 1, 0x41, 0x9a, 0x02}, Meta: MetaInfo{Frame: "P"}}
+	conn.parseVideo(frame)
+
+	if frame.Keyframe || len(frame.NALUs) != 1 {
+		t.Errorf("unexpected P-frame: keyframe=%v nalus=%d", frame.Keyframe, len(frame.NALUs))
+	}
+
+	if frame.Meta.Type != "H264" || frame.Meta.Width != 1920 || frame.Meta.Height != 1080 {
+		t.Errorf("unexpected P-frame meta: %+v", frame.Meta)
+	}
+
+	// MPEG4 has no NAL units, the header tells the I-frames
+	conn = &Conn{settings: &Settings{Logger: nopLogger{}}}
+	conn.log = connLogger{conn: conn}
+
+	for _, kind := range []string{"I", "P"} {
+		frame = &Frame{Data: []byte{0, 0, 1, 0xb6, 0x10}, Meta: MetaInfo{Frame: kind, Type: "MPEG4"}}
+		conn.parseVideo(frame)
+
+		if frame.Keyframe != (kind == "I") || frame.Meta.Type != "MPEG4" || frame.NALUs != nil {
+			t.Errorf("unexpected MPEG4 %v-frame: keyframe=%v meta=%+v", kind, frame.Keyframe, frame.Meta)
+		}
+	}
+}
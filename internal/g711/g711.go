@@ -0,0 +1,165 @@
+// Package g711 converts between 16-bit linear PCM and the G.711 A-law and
+// µ-law encodings of ITU-T G.711, the audio of the cameras. The devices
+// send A-law at 8000 Hz, mono, one byte per sample; decoding doubles the
+// size and makes the audio usable by tools that don't know G.711, and
+// encoding turns PCM into what the devices play back, e.g. for talk.
+package g711
+
+// SampleRate is the sample rate of the audio of the devices.
+const SampleRate = 8000
+
+var (
+	alawTable [256]int16
+	ulawTable [256]int16
+
+	// alawEnd and ulawEnd are the largest magnitudes of the eight segments
+	// of the 13-bit and 14-bit values the encodings quantise
+	alawEnd = [8]int{0x1F, 0x3F, 0x7F, 0xFF, 0x1FF, 0x3FF, 0x7FF, 0xFFF}
+	ulawEnd = [8]int{0x3F, 0x7F, 0xFF, 0x1FF, 0x3FF, 0x7FF, 0xFFF, 0x1FFF}
+)
+
+const (
+	// ulawBias is added to the magnitudes before µ-law encoding
+	ulawBias = 0x84
+	ulawClip = 8159
+)
+
+func init() {
+	for i := range alawTable {
+		alawTable[i] = alawToLinear(byte(i))
+		ulawTable[i] = ulawToLinear(byte(i))
+	}
+}
+
+func alawToLinear(a byte) int16 {
+	a ^= 0x55
+
+	t := int(a&0x0F)<<4 + 8
+	if seg := int(a&0x70) >> 4; seg > 0 {
+		t = (t + 0x100) << (seg - 1)
+	}
+
+	if a&0x80 == 0 {
+		return int16(-t)
+	}
+
+	return int16(t)
+}
+
+func ulawToLinear(u byte) int16 {
+	u = ^u
+
+	t := (int(u&0x0F)<<3 + ulawBias) << (int(u&0x70) >> 4)
+
+	if u&0x80 != 0 {
+		return int16(ulawBias - t)
+	}
+
+	return int16(t - ulawBias)
+}
+
+// segment returns the segment of a magnitude, 8 if it is beyond the last.
+func segment(v int, end *[8]int) int {
+	for i, e := range end {
+		if v <= e {
+			return i
+		}
+	}
+
+	return len(end)
+}
+
+// ALawToLinear decodes an A-law sample.
+func ALawToLinear(a byte) int16 {
+	return alawTable[a]
+}
+
+// LinearToALaw encodes a sample as A-law.
+func LinearToALaw(sample int16) byte {
+	v := int(sample) >> 3
+
+	mask := byte(0xD5)
+	if v < 0 {
+		mask = 0x55
+		v = -v - 1
+	}
+
+	seg := segment(v, &alawEnd)
+	if seg >= 8 {
+		return 0x7F ^ mask
+	}
+
+	a := seg << 4
+	if seg < 2 {
+		a |= (v >> 1) & 0x0F
+	} else {
+		a |= (v >> seg) & 0x0F
+	}
+
+	return byte(a) ^ mask
+}
+
+// MuLawToLinear decodes a µ-law sample.
+func MuLawToLinear(u byte) int16 {
+	return ulawTable[u]
+}
+
+// LinearToMuLaw encodes a sample as µ-law.
+func LinearToMuLaw(sample int16) byte {
+	v := int(sample) >> 2
+
+	mask := byte(0xFF)
+	if v < 0 {
+		mask = 0x7F
+		v = -v
+	}
+
+	if v > ulawClip {
+		v = ulawClip
+	}
+
+	v += ulawBias >> 2
+
+	seg := segment(v, &ulawEnd)
+	if seg >= 8 {
+		return 0x7F ^ mask
+	}
+
+	return byte(seg<<4|(v>>(seg+1))&0x0F) ^ mask
+}
+
+// DecodeALaw appends the samples of A-law data to dst and returns it.
+func DecodeALaw(dst []int16, src []byte) []int16 {
+	for _, a := range src {
+		dst = append(dst, alawTable[a])
+	}
+
+	return dst
+}
+
+// EncodeALaw appends the A-law encoding of samples to dst and returns it.
+func EncodeALaw(dst []byte, samples []int16) []byte {
+	for _, s := range samples {
+		dst = append(dst, LinearToALaw(s))
+	}
+
+	return dst
+}
+
+// DecodeMuLaw appends the samples of µ-law data to dst and returns it.
+func DecodeMuLaw(dst []int16, src []byte) []int16 {
+	for _, u := range src {
+		dst = append(dst, ulawTable[u])
+	}
+
+	return dst
+}
+
+// EncodeMuLaw appends the µ-law encoding of samples to dst and returns it.
+func EncodeMuLaw(dst []byte, samples []int16) []byte {
+	for _, s := range samples {
+		dst = append(dst, LinearToMuLaw(s))
+	}
+
+	return dst
+}
@@ -0,0 +1,76 @@
+package g711
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		code  byte
+		alaw  int16
+		mulaw int16
+	}{
+		{0xD5, 8, 716},
+		{0x55, -8, -716},
+		{0xAA, 32256, 5372},
+		{0x00, -5504, -32124},
+		{0x80, 5504, 32124},
+		{0xFF, 848, 0},
+		{0x7F, -848, 0},
+	}
+
+	for _, test := range tests {
+		if a, u := ALawToLinear(test.code), MuLawToLinear(test.code); a != test.alaw || u != test.mulaw {
+			t.Errorf("%#02x: got %d and %d, expected %d and %d", test.code, a, u, test.alaw, test.mulaw)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		sample int16
+		alaw   byte
+		mulaw  byte
+	}{
+		{0, 0xD5, 0xFF},
+		{-1, 0x55, 0x7E},
+		{100, 0xD3, 0xF2},
+		{-100, 0x53, 0x72},
+		{32767, 0xAA, 0x80},
+		{-32768, 0x2A, 0x00},
+	}
+
+	for _, test := range tests {
+		if a, u := LinearToALaw(test.sample), LinearToMuLaw(test.sample); a != test.alaw || u != test.mulaw {
+			t.Errorf("%d: got %#02x and %#02x, expected %#02x and %#02x", test.sample, a, u, test.alaw, test.mulaw)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for i := 0; i < 256; i++ {
+		code := byte(i)
+
+		if a := LinearToALaw(ALawToLinear(code)); a != code {
+			t.Errorf("A-law %#02x came back as %#02x", code, a)
+		}
+
+		// 0x7F is the negative zero of µ-law
+		if u := LinearToMuLaw(MuLawToLinear(code)); u != code && code != 0x7F {
+			t.Errorf("µ-law %#02x came back as %#02x", code, u)
+		}
+	}
+
+	samples := []int16{0, 1000, -1000, 20000}
+
+	alaw := EncodeALaw(nil, samples)
+	if decoded := DecodeALaw(nil, alaw); !reflect.DeepEqual(decoded, []int16{8, 1008, -1008, 19968}) {
+		t.Errorf("got A-law samples %v", decoded)
+	}
+
+	mulaw := EncodeMuLaw(nil, samples)
+	if decoded := DecodeMuLaw(nil, mulaw); !reflect.DeepEqual(decoded, []int16{0, 988, -988, 19836}) {
+		t.Errorf("got µ-law samples %v", decoded)
+	}
+}
@@ -0,0 +1,354 @@
+package hls
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"godvr/internal/catalog"
+	"godvr/internal/dvrip"
+	"godvr/internal/mediatest"
+	"godvr/internal/mkv"
+	"godvr/internal/mp4"
+	"godvr/internal/mpegts"
+)
+
+var testStart = time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+
+// videoFrame returns frame i of a stream recorded from testStart.
+func videoFrame(i int) *dvrip.Frame {
+	frame := mediatest.StreamFrame(i)
+	frame.Time = testStart.Add(frame.PTS)
+
+	return frame
+}
+
+func get(t *testing.T, url string) (int, []byte) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode, body
+}
+
+// decodeTime returns the decode time of the first fragment in b.
+func decodeTime(t *testing.T, b []byte) uint64 {
+	i := bytes.Index(b, []byte("tfdt"))
+	if i < 0 || len(b) < i+16 {
+		t.Fatal("no tfdt box")
+	}
+
+	return binary.BigEndian.Uint64(b[i+8:])
+}
+
+func TestLive(t *testing.T) {
+	l := NewLive()
+
+	server := httptest.NewServer(l)
+	defer server.Close()
+
+	// frames are dropped until the first request
+	l.WriteFrame(videoFrame(0))
+
+	if l.active {
+		t.Fatal("stream is active before a request")
+	}
+
+	l.lock.Lock()
+	l.touch()
+	l.lock.Unlock()
+
+	for i := 0; i < 150; i++ {
+		l.WriteFrame(videoFrame(i))
+	}
+
+	status, body := get(t, server.URL+"/index.m3u8")
+	if status != http.StatusOK {
+		t.Fatalf("got status %d", status)
+	}
+
+	playlist := string(body)
+
+	for _, line := range []string{
+		"#EXT-X-MEDIA-SEQUENCE:0\n",
+		"#EXT-X-MAP:URI=\"init1.mp4\"\n",
+		"#EXT-X-PROGRAM-DATE-TIME:2021-06-01T10:00:00.000Z\n",
+		"#EXT-X-PART:DURATION=0.480,URI=\"part1.0.m4s\",INDEPENDENT=YES\n",
+		"#EXT-X-PART:DURATION=0.480,URI=\"part1.1.m4s\"\n",
+		"#EXT-X-PART:DURATION=0.040,URI=\"part1.2.m4s\"\n",
+		"#EXTINF:2.000,\nseg1.m4s\n",
+		"#EXT-X-PART:DURATION=0.480,URI=\"part2.0.m4s\",INDEPENDENT=YES\n",
+	} {
+		if !strings.Contains(playlist, line) {
+			t.Errorf("playlist does not contain %q:\n%v", line, playlist)
+		}
+	}
+
+	// the last segment is still being written
+	if strings.Contains(playlist, "seg2.m4s") {
+		t.Errorf("unfinished segment is listed:\n%v", playlist)
+	}
+
+	status, body = get(t, server.URL+"/init1.mp4")
+	if status != http.StatusOK || string(body[4:8]) != "ftyp" {
+		t.Errorf("got status %d for the init segment", status)
+	}
+
+	status, body = get(t, server.URL+"/part1.1.m4s")
+	if status != http.StatusOK || string(body[4:8]) != "moof" {
+		t.Errorf("got status %d for a part", status)
+	}
+
+	if status, _ = get(t, server.URL+"/seg1.m4sx"); status != http.StatusNotFound {
+		t.Errorf("got status %d for an invalid name", status)
+	}
+
+	// a blocking reload waits for the next part
+	done := make(chan string)
+
+	go func() {
+		_, body := get(t, server.URL+"/index.m3u8?_HLS_msn=2&_HLS_part=5")
+		done <- string(body)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("blocking reload returned early")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for i := 150; i < 165; i++ {
+		l.WriteFrame(videoFrame(i))
+	}
+
+	if playlist := <-done; !strings.Contains(playlist, "part2.5.m4s") {
+		t.Errorf("blocking reload does not contain the part:\n%v", playlist)
+	}
+
+	// a reconnect starts a new muxer
+	l.Restart()
+
+	for i := 0; i < 60; i++ {
+		l.WriteFrame(videoFrame(i))
+	}
+
+	_, body = get(t, server.URL+"/index.m3u8")
+	if playlist := string(body); !strings.Contains(playlist, "#EXT-X-DISCONTINUITY\n#EXT-X-MAP:URI=\"init2.mp4\"\n") {
+		t.Errorf("playlist has no discontinuity:\n%v", playlist)
+	}
+}
+
+func TestChunks(t *testing.T) {
+	s := catalog.Segment{Start: testStart, End: testStart.Add(20 * time.Second)}
+	for i := 0; i < 10; i++ {
+		s.Keyframes = append(s.Keyframes, time.Duration(i)*2*time.Second)
+	}
+
+	// the keyframe at 18s is too close to the end for a chunk of its own
+	expected := []chunk{{0, 6 * time.Second}, {6 * time.Second, 12 * time.Second}, {12 * time.Second, 20 * time.Second}}
+
+	got := chunks(s, 0, time.Hour)
+	if len(got) != len(expected) {
+		t.Fatalf("got chunks %v", got)
+	}
+
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Errorf("chunk %d: got %v, expected %v", i, got[i], expected[i])
+		}
+	}
+
+	if got := chunks(s, 7*time.Second, 11*time.Second); len(got) != 1 || got[0] != expected[1] {
+		t.Errorf("got chunks %v for a range", got)
+	}
+
+	s.Keyframes = nil
+	if got := chunks(s, 0, time.Hour); len(got) != 1 || got[0] != (chunk{0, 20 * time.Second}) {
+		t.Errorf("got chunks %v without keyframes", got)
+	}
+}
+
+func TestPlayback(t *testing.T) {
+	root, err := ioutil.TempDir("", "hls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	dir := filepath.Join(root, "gate", "2021-06-01")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// 20s with a keyframe every second
+	var out bytes.Buffer
+
+	w := mp4.NewWriter(&out, mp4.Options{})
+	for i := 0; i < 500; i++ {
+		if err := w.WriteFrame(videoFrame(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "10.00.00.mp4")
+	if err := ioutil.WriteFile(path, out.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := catalog.Segment{Camera: "gate", Path: path, Start: testStart, End: testStart.Add(20 * time.Second)}
+	for i := 0; i < 20; i++ {
+		s.Keyframes = append(s.Keyframes, time.Duration(i)*time.Second)
+	}
+
+	if err := catalog.Append(filepath.Join(root, "gate"), s); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(NewPlayback(root, "gate"))
+	defer server.Close()
+
+	query := url.Values{"from": {"2021-06-01T10:00:05Z"}, "to": {"2021-06-01T10:00:30Z"}}
+
+	status, body := get(t, server.URL+"/index.m3u8?"+query.Encode())
+	if status != http.StatusOK {
+		t.Fatalf("got status %d: %s", status, body)
+	}
+
+	playlist := string(body)
+	file := "file=" + url.QueryEscape("2021-06-01/10.00.00.mp4")
+
+	for _, line := range []string{
+		"#EXT-X-PLAYLIST-TYPE:VOD\n",
+		"#EXT-X-MAP:URI=\"init.mp4?" + file + "\"\n",
+		"#EXT-X-PROGRAM-DATE-TIME:2021-06-01T10:00:00.000Z\n",
+		"#EXTINF:6.000,\nchunk.m4s?" + file + "&start=6000&end=12000\n",
+		"#EXTINF:8.000,\nchunk.m4s?" + file + "&start=12000&end=20000\n",
+		"#EXT-X-ENDLIST\n",
+	} {
+		if !strings.Contains(playlist, line) {
+			t.Errorf("playlist does not contain %q:\n%v", line, playlist)
+		}
+	}
+
+	status, body = get(t, server.URL+"/init.mp4?"+file)
+	if status != http.StatusOK || string(body[4:8]) != "ftyp" || bytes.Contains(body, []byte("moof")) {
+		t.Errorf("got status %d for the init segment", status)
+	}
+
+	// the chunks of a playlist are served without reading the index again
+	if err := os.Rename(filepath.Join(root, "gate", catalog.IndexFile), filepath.Join(root, "index.jsonl")); err != nil {
+		t.Fatal(err)
+	}
+
+	status, body = get(t, server.URL+"/chunk.m4s?"+file+"&start=6000&end=12000")
+	if status != http.StatusOK || string(body[4:8]) != "moof" {
+		t.Fatalf("got status %d for a chunk: %s", status, body)
+	}
+
+	// the chunk keeps the timestamps of the recording and ends before the
+	// keyframe at 12s
+	if dts := decodeTime(t, body); dts != 6*90000 {
+		t.Errorf("got decode time %d", dts)
+	}
+
+	if n := bytes.Count(body, []byte("moof")); n != 6 {
+		t.Errorf("got %d fragments", n)
+	}
+
+	if err := os.Rename(filepath.Join(root, "index.jsonl"), filepath.Join(root, "gate", catalog.IndexFile)); err != nil {
+		t.Fatal(err)
+	}
+
+	// only indexed files are served
+	for _, name := range []string{"../gate/index.jsonl", "index.jsonl", ""} {
+		if status, _ := get(t, server.URL+"/init.mp4?file="+url.QueryEscape(name)); status != http.StatusNotFound {
+			t.Errorf("got status %d for %q", status, name)
+		}
+	}
+
+	query = url.Values{"from": {"2021-06-02"}, "to": {"2021-06-03"}}
+	if status, _ := get(t, server.URL+"/index.m3u8?"+query.Encode()); status != http.StatusNotFound {
+		t.Errorf("got status %d for an empty range", status)
+	}
+}
+
+func TestRemuxSeek(t *testing.T) {
+	type muxer interface {
+		WriteFrame(frame *dvrip.Frame) error
+		Close() error
+	}
+
+	formats := map[string]func(w io.Writer) muxer{
+		".mp4": func(w io.Writer) muxer { return mp4.NewWriter(w, mp4.Options{}) },
+		".ts":  func(w io.Writer) muxer { return mpegts.NewWriter(w, mpegts.Options{}) },
+		".mkv": func(w io.Writer) muxer { return mkv.NewWriter(w, mkv.Options{}) },
+	}
+
+	for ext, newMuxer := range formats {
+		var out bytes.Buffer
+
+		rec := &recording{Segment: catalog.Segment{Path: filepath.Join(t.TempDir(), "10.00.00"+ext)}}
+
+		// 20s with a keyframe every second, the offsets are taken like the
+		// recorder does before each keyframe is written
+		w := newMuxer(&out)
+		for i := 0; i < 500; i++ {
+			if i%25 == 0 {
+				rec.Keyframes = append(rec.Keyframes, time.Duration(i/25)*time.Second)
+				rec.KeyframeOffsets = append(rec.KeyframeOffsets, int64(out.Len()))
+			}
+
+			if err := w.WriteFrame(videoFrame(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// the reader must not touch the data between the first two seconds
+		// and the offset of the chunk
+		data := out.Bytes()
+		for i := rec.KeyframeOffsets[2]; i < rec.KeyframeOffsets[6]; i++ {
+			data[i] = 0xFF
+		}
+
+		if err := ioutil.WriteFile(rec.Path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		chunk, err := remux(rec, false, false, 6*time.Second, 12*time.Second)
+		if err != nil {
+			t.Fatalf("%v: %v", ext, err)
+		}
+
+		if dts := decodeTime(t, chunk); dts != 6*90000 {
+			t.Errorf("%v: got decode time %d", ext, dts)
+		}
+
+		if n := bytes.Count(chunk, []byte("moof")); n != 6 {
+			t.Errorf("%v: got %d fragments", ext, n)
+		}
+	}
+}
@@ -0,0 +1,480 @@
+// Package hls publishes camera streams and recordings as HTTP Live
+// Streaming with fragmented MP4 segments, which browsers play through Media
+// Source Extensions, e.g. with hls.js, or natively.
+//
+// Live serves a low-latency playlist of the latest segments of a camera,
+// Playback serves playlists over its recordings for a time range.
+package hls
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"godvr/internal/dvrip"
+	"godvr/internal/mp4"
+)
+
+const (
+	// partTarget is the longest part, segments are made of parts and
+	// start at keyframes once they last segmentTarget.
+	partTarget    = 500 * time.Millisecond
+	segmentTarget = 2 * time.Second
+
+	// liveSegments is the number of finished segments in the playlist,
+	// the parts are listed for the last partSegments of them.
+	liveSegments = 7
+	partSegments = 2
+
+	// idleTimeout stops the muxing once no client requested anything for
+	// that long
+	idleTimeout = time.Minute
+
+	// waitTimeout limits how long a request waits for the stream to start
+	// or for a blocking playlist reload
+	waitTimeout = 10 * time.Second
+)
+
+// Live muxes the frames of a camera into a rolling window of segments. The
+// muxing only runs while clients request the playlist, a first request
+// waits for the next keyframe.
+type Live struct {
+	lock sync.Mutex
+
+	// changed is closed and replaced when a part is added
+	changed chan struct{}
+
+	lastRequest time.Time
+	active      bool
+
+	muxer   *mp4.Writer
+	capture mp4.Capture
+	codec   string
+	started bool
+
+	// generation counts the muxers, a new one starts after a reconnect
+	// or a codec change
+	generation int
+	inits      map[int][]byte
+
+	segments      []*segment
+	current       *segment
+	discontinuity int
+
+	partStart time.Duration
+	partKey   bool
+}
+
+type segment struct {
+	msn        int
+	generation int
+	start      time.Time
+	duration   time.Duration
+	data       []byte
+	parts      []part
+}
+
+type part struct {
+	start, end  int // in the segment data
+	duration    time.Duration
+	independent bool
+}
+
+// NewLive returns an idle stream, the first request starts it.
+func NewLive() *Live {
+	return &Live{
+		changed: make(chan struct{}),
+		inits:   map[int][]byte{},
+	}
+}
+
+// Restart tells the stream that the source reconnected, the following
+// frames start a new muxer.
+func (l *Live) Restart() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.active {
+		l.newGeneration()
+	}
+}
+
+// WriteFrame adds a frame to the current part. The frame is not retained.
+func (l *Live) WriteFrame(frame *dvrip.Frame) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if !l.active {
+		return
+	}
+
+	if time.Since(l.lastRequest) > idleTimeout {
+		l.reset()
+		return
+	}
+
+	isVideo := frame.Meta.Frame != ""
+
+	if isVideo && l.started {
+		if frame.Meta.Type != l.codec {
+			l.newGeneration()
+		} else if frame.Keyframe || frame.DTS+frame.Duration-l.partStart > partTarget {
+			l.cut(frame)
+		}
+	}
+
+	err := l.muxer.WriteFrame(frame)
+	if err != nil {
+		return
+	}
+
+	if !l.started && l.muxer.Started() {
+		l.started = true
+		l.codec = frame.Meta.Type
+		l.inits[l.generation] = l.capture.Take()
+		l.partStart = frame.DTS
+		l.partKey = true
+		l.current = &segment{msn: l.nextMSN(), generation: l.generation, start: frame.Time}
+	}
+}
+
+// cut finishes the current part before frame, and the segment if frame is
+// a keyframe and the segment is long enough.
+func (l *Live) cut(frame *dvrip.Frame) {
+	err := l.muxer.Flush()
+	if err != nil {
+		return
+	}
+
+	data := l.capture.Take()
+	if len(data) == 0 {
+		return
+	}
+
+	s := l.current
+	duration := frame.DTS - l.partStart
+
+	s.parts = append(s.parts, part{
+		start:       len(s.data),
+		end:         len(s.data) + len(data),
+		duration:    duration,
+		independent: l.partKey,
+	})
+
+	s.data = append(s.data, data...)
+	s.duration += duration
+
+	l.partStart = frame.DTS
+	l.partKey = frame.Keyframe
+
+	if frame.Keyframe && s.duration >= segmentTarget {
+		l.finish()
+		l.current = &segment{msn: s.msn + 1, generation: l.generation, start: frame.Time}
+	}
+
+	l.notify()
+}
+
+// finish moves the current segment to the window.
+func (l *Live) finish() {
+	if l.current == nil || len(l.current.parts) == 0 {
+		return
+	}
+
+	l.segments = append(l.segments, l.current)
+	l.current = nil
+
+	for len(l.segments) > liveSegments {
+		if l.segments[1].generation != l.segments[0].generation {
+			l.discontinuity++
+			delete(l.inits, l.segments[0].generation)
+		}
+
+		l.segments[0] = nil
+		l.segments = l.segments[1:]
+	}
+}
+
+func (l *Live) nextMSN() int {
+	if n := len(l.segments); n > 0 {
+		return l.segments[n-1].msn + 1
+	}
+
+	return 0
+}
+
+// newGeneration drops the unfinished part and starts a new muxer.
+func (l *Live) newGeneration() {
+	l.finish()
+	l.current = nil
+	l.generation++
+	l.started = false
+	l.capture.Writes = nil
+	l.muxer = mp4.NewWriter(&l.capture, mp4.Options{MaxFragmentDuration: time.Hour, NoIndex: true})
+	l.notify()
+}
+
+// reset stops the muxing and drops the segments.
+func (l *Live) reset() {
+	l.active = false
+	l.muxer = nil
+	l.started = false
+	l.capture.Writes = nil
+	l.segments = nil
+	l.current = nil
+	l.inits = map[int][]byte{}
+	l.notify()
+}
+
+func (l *Live) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// touch records a request and starts the muxing.
+func (l *Live) touch() {
+	l.lastRequest = time.Now()
+
+	if !l.active {
+		l.active = true
+		l.newGeneration()
+	}
+}
+
+// wait waits until ready returns true or the timeout passes and reports
+// whether it is ready. It is called with the lock held.
+func (l *Live) wait(ctx context.Context, ready func() bool) bool {
+	timeout := time.NewTimer(waitTimeout)
+	defer timeout.Stop()
+
+	for !ready() {
+		changed := l.changed
+
+		l.lock.Unlock()
+
+		select {
+		case <-changed:
+			l.lock.Lock()
+		case <-timeout.C:
+			l.lock.Lock()
+			return ready()
+		case <-ctx.Done():
+			l.lock.Lock()
+			return false
+		}
+	}
+
+	return true
+}
+
+// has reports whether the part of a segment was published, part -1 stands
+// for the whole segment.
+func (l *Live) has(msn, part int) bool {
+	if l.current != nil && msn == l.current.msn {
+		return part >= 0 && part < len(l.current.parts)
+	}
+
+	if n := len(l.segments); n > 0 {
+		return msn <= l.segments[n-1].msn
+	}
+
+	return false
+}
+
+func (l *Live) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := path.Base(r.URL.Path)
+
+	if name == "index.m3u8" {
+		l.servePlaylist(w, r)
+		return
+	}
+
+	var (
+		generation, msn, index int
+		data                   []byte
+	)
+
+	l.lock.Lock()
+	l.touch()
+
+	switch {
+	case scan(name, "init%d.mp4", &generation):
+		data = l.inits[generation]
+	case scan(name, "seg%d.m4s", &msn):
+		for _, s := range l.segments {
+			if s.msn == msn {
+				data = s.data
+			}
+		}
+	case scan(name, "part%d.%d.m4s", &msn, &index):
+		data = l.part(msn, index)
+	}
+
+	l.lock.Unlock()
+
+	// the data is never modified once published
+	if data == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+func (l *Live) part(msn, index int) []byte {
+	segments := l.segments
+	if l.current != nil {
+		segments = append(segments[:len(segments):len(segments)], l.current)
+	}
+
+	for _, s := range segments {
+		if s.msn == msn && index >= 0 && index < len(s.parts) {
+			p := s.parts[index]
+			return s.data[p.start:p.end]
+		}
+	}
+
+	return nil
+}
+
+// servePlaylist serves the playlist, blocking until the part given by the
+// _HLS_msn and _HLS_part parameters is available.
+func (l *Live) servePlaylist(w http.ResponseWriter, r *http.Request) {
+	msn, part := -1, -1
+
+	if q := r.URL.Query(); q.Get("_HLS_msn") != "" {
+		var err error
+
+		msn, err = strconv.Atoi(q.Get("_HLS_msn"))
+		if err != nil {
+			http.Error(w, "invalid _HLS_msn", http.StatusBadRequest)
+			return
+		}
+
+		if q.Get("_HLS_part") != "" {
+			part, err = strconv.Atoi(q.Get("_HLS_part"))
+			if err != nil {
+				http.Error(w, "invalid _HLS_part", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	l.lock.Lock()
+	l.touch()
+
+	published := func() bool {
+		return len(l.segments) > 0 || l.current != nil && len(l.current.parts) > 0
+	}
+
+	ready := published
+	if msn >= 0 {
+		ready = func() bool {
+			return l.has(msn, part)
+		}
+	}
+
+	var playlist string
+
+	l.wait(r.Context(), ready)
+
+	if published() {
+		playlist = l.playlist()
+	}
+
+	l.lock.Unlock()
+
+	if playlist == "" {
+		http.Error(w, "stream not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(playlist))
+}
+
+func (l *Live) playlist() string {
+	segments := l.segments
+	if l.current != nil && len(l.current.parts) > 0 {
+		segments = append(segments[:len(segments):len(segments)], l.current)
+	}
+
+	target := segmentTarget
+	for _, s := range segments {
+		if s.duration > target {
+			target = s.duration
+		}
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "#EXTM3U\n")
+	fmt.Fprintf(&b, "#EXT-X-VERSION:9\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target.Seconds())))
+	fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", (3 * partTarget).Seconds())
+	fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget.Seconds())
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", segments[0].msn)
+	fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", l.discontinuity)
+
+	for i, s := range segments {
+		if i == 0 || s.generation != segments[i-1].generation {
+			if i > 0 {
+				fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY\n")
+			}
+
+			fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"init%d.mp4\"\n", s.generation)
+		}
+
+		if !s.start.IsZero() {
+			fmt.Fprintf(&b, "#EXT-X-PROGRAM-DATE-TIME:%v\n", s.start.UTC().Format("2006-01-02T15:04:05.000Z"))
+		}
+
+		if s == l.current || i >= len(segments)-partSegments-1 {
+			for j, p := range s.parts {
+				fmt.Fprintf(&b, "#EXT-X-PART:DURATION=%.3f,URI=\"part%d.%d.m4s\"", p.duration.Seconds(), s.msn, j)
+
+				if p.independent {
+					fmt.Fprintf(&b, ",INDEPENDENT=YES")
+				}
+
+				fmt.Fprintf(&b, "\n")
+			}
+		}
+
+		if s != l.current {
+			fmt.Fprintf(&b, "#EXTINF:%.3f,\nseg%d.m4s\n", s.duration.Seconds(), s.msn)
+		}
+	}
+
+	return b.String()
+}
+
+// scan parses name with the format and reports whether it matched
+// completely.
+func scan(name, format string, args ...interface{}) bool {
+	n, err := fmt.Sscanf(name, format, args...)
+	if err != nil || n != len(args) {
+		return false
+	}
+
+	// Sscanf ignores the text after the last verb
+	return fmt.Sprintf(format, derefInts(args)...) == name
+}
+
+func derefInts(args []interface{}) []interface{} {
+	values := make([]interface{}, len(args))
+	for i, a := range args {
+		values[i] = *a.(*int)
+	}
+
+	return values
+}
@@ -0,0 +1,526 @@
+package hls
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"godvr/internal/catalog"
+	"godvr/internal/dvrip"
+	"godvr/internal/mkv"
+	"godvr/internal/mp4"
+	"godvr/internal/mpegts"
+)
+
+const (
+	// chunkTarget is the shortest playback segment, they span whole groups
+	// of pictures
+	chunkTarget = 6 * time.Second
+
+	// keyframeTolerance matches the keyframe times of the index, which are
+	// wall clock times, with the timestamps in the files
+	keyframeTolerance = 500 * time.Millisecond
+
+	// defaultRange is played back if the request has no range
+	defaultRange = time.Hour
+
+	// audioProbeFrames is the number of frames searched for audio at the
+	// start of a recording
+	audioProbeFrames = 200
+)
+
+// Playback serves video on demand playlists over the recordings of a camera
+// for a time range, see catalog.Catalog.Query. Each recording starts a
+// discontinuity and is split into chunks at its keyframes, which are remuxed
+// on request, so recordings of every format can be played back. The audio of
+// recordings that keep it in a WAV file beside the video is not played.
+type Playback struct {
+	catalog *catalog.Catalog
+	camera  string
+	dir     string
+
+	// recordings caches the index entries by the path relative to dir, the
+	// playlists and the requests for their chunks refer to the same files
+	lock       sync.Mutex
+	recordings map[string]*recording
+}
+
+// recording is a cached index entry.
+type recording struct {
+	catalog.Segment
+
+	// audio is probed on the first request for the file
+	probed bool
+	audio  bool
+}
+
+// NewPlayback serves the recordings of the camera in the output directory
+// root of the recorder.
+func NewPlayback(root, camera string) *Playback {
+	return &Playback{
+		catalog: catalog.Open(root),
+		camera:  camera,
+		dir:     filepath.Join(root, camera),
+	}
+}
+
+// chunk is a part of a recording between two keyframes, relative to the
+// start of the recording.
+type chunk struct {
+	start, end time.Duration
+}
+
+func (p *Playback) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch path.Base(r.URL.Path) {
+	case "index.m3u8":
+		p.servePlaylist(w, r)
+	case "init.mp4":
+		p.serveMedia(w, r, true)
+	case "chunk.m4s":
+		p.serveMedia(w, r, false)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// servePlaylist serves the playlist for the from and to parameters, the
+// last hour by default.
+func (p *Playback) servePlaylist(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	to := time.Now()
+	from := to.Add(-defaultRange)
+
+	var err error
+
+	if s := q.Get("from"); s != "" {
+		from, err = catalog.ParseTime(s)
+	}
+
+	if s := q.Get("to"); s != "" && err == nil {
+		to, err = catalog.ParseTime(s)
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	timeline, err := p.catalog.Query(p.camera, from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	p.cache(timeline.Segments)
+
+	if len(timeline.Segments) == 0 {
+		http.Error(w, "no recordings in the time range", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Write([]byte(p.playlist(timeline.Segments, from, to)))
+}
+
+func (p *Playback) playlist(segments []catalog.Segment, from, to time.Time) string {
+	var (
+		body   strings.Builder
+		target time.Duration
+		first  = true
+	)
+
+	for _, s := range segments {
+		rel, err := filepath.Rel(p.dir, s.Path)
+		if err != nil {
+			continue
+		}
+
+		file := "file=" + url.QueryEscape(filepath.ToSlash(rel))
+
+		chunks := chunks(s, from.Sub(s.Start), to.Sub(s.Start))
+		if len(chunks) == 0 {
+			continue
+		}
+
+		if !first {
+			fmt.Fprintf(&body, "#EXT-X-DISCONTINUITY\n")
+		}
+
+		first = false
+
+		if s.Audio != "" {
+			fmt.Fprintf(&body, "# the audio is kept in %v and not played\n", filepath.Base(s.Audio))
+		}
+
+		fmt.Fprintf(&body, "#EXT-X-MAP:URI=\"init.mp4?%v\"\n", file)
+		fmt.Fprintf(&body, "#EXT-X-PROGRAM-DATE-TIME:%v\n", s.Start.Add(chunks[0].start).UTC().Format("2006-01-02T15:04:05.000Z"))
+
+		for _, c := range chunks {
+			if d := c.end - c.start; d > target {
+				target = d
+			}
+
+			fmt.Fprintf(&body, "#EXTINF:%.3f,\nchunk.m4s?%v&start=%d&end=%d\n",
+				(c.end - c.start).Seconds(), file, c.start.Milliseconds(), c.end.Milliseconds())
+		}
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "#EXTM3U\n")
+	fmt.Fprintf(&b, "#EXT-X-VERSION:7\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target.Seconds())))
+	fmt.Fprintf(&b, "#EXT-X-PLAYLIST-TYPE:VOD\n")
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:0\n")
+	b.WriteString(body.String())
+	fmt.Fprintf(&b, "#EXT-X-ENDLIST\n")
+
+	return b.String()
+}
+
+// chunks splits a recording at its keyframes into chunks of at least
+// chunkTarget and returns the ones that overlap from to.
+func chunks(s catalog.Segment, from, to time.Duration) []chunk {
+	duration := s.Duration()
+
+	keyframes := s.Keyframes
+	if len(keyframes) == 0 {
+		keyframes = []time.Duration{0}
+	}
+
+	var out []chunk
+
+	for i := 0; i < len(keyframes); {
+		c := chunk{start: keyframes[i], end: duration}
+
+		j := i + 1
+		for j < len(keyframes) && keyframes[j]-c.start < chunkTarget {
+			j++
+		}
+
+		// a short rest joins the last chunk
+		if j < len(keyframes) && duration-keyframes[j] >= chunkTarget/2 {
+			c.end = keyframes[j]
+		} else {
+			j = len(keyframes)
+		}
+
+		if c.end > from && c.start < to {
+			out = append(out, c)
+		}
+
+		i = j
+	}
+
+	return out
+}
+
+// serveMedia serves the init segment or a chunk of a recording.
+func (p *Playback) serveMedia(w http.ResponseWriter, r *http.Request, init bool) {
+	q := r.URL.Query()
+
+	rec, err := p.lookup(q.Get("file"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var start, end time.Duration
+
+	if !init {
+		s, err1 := strconv.ParseInt(q.Get("start"), 10, 64)
+		e, err2 := strconv.ParseInt(q.Get("end"), 10, 64)
+
+		if err1 != nil || err2 != nil || e <= s {
+			http.Error(w, "invalid chunk", http.StatusBadRequest)
+			return
+		}
+
+		start, end = time.Duration(s)*time.Millisecond, time.Duration(e)*time.Millisecond
+	}
+
+	data, err := remux(rec, p.hasAudio(rec), init, start, end)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// cache adds segments returned by the catalog to the cached entries.
+func (p *Playback) cache(segments []catalog.Segment) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.recordings == nil {
+		p.recordings = map[string]*recording{}
+	}
+
+	for _, s := range segments {
+		rel, err := filepath.Rel(p.dir, s.Path)
+		if err != nil {
+			continue
+		}
+
+		rel = filepath.ToSlash(rel)
+		if _, ok := p.recordings[rel]; !ok {
+			p.recordings[rel] = &recording{Segment: s}
+		}
+	}
+}
+
+// lookup returns the recording of the camera given relative to the camera
+// directory. Only files of the index are served, it is read again if the
+// file is not cached, e.g. after a restart.
+func (p *Playback) lookup(file string) (*recording, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if rec, ok := p.recordings[file]; ok {
+		return rec, nil
+	}
+
+	segments, err := catalog.Read(p.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// entries compacted away are dropped from the cache as well
+	recordings := map[string]*recording{}
+
+	for _, s := range segments {
+		key := s.Path
+
+		rec, ok := p.recordings[key]
+		if !ok {
+			s.Path = filepath.Join(p.dir, filepath.FromSlash(s.Path))
+			if s.Audio != "" {
+				s.Audio = filepath.Join(p.dir, filepath.FromSlash(s.Audio))
+			}
+
+			rec = &recording{Segment: s}
+		}
+
+		recordings[key] = rec
+	}
+
+	p.recordings = recordings
+
+	rec, ok := recordings[file]
+	if !ok {
+		return nil, errors.New("unknown recording")
+	}
+
+	return rec, nil
+}
+
+// frameReader is implemented by the container readers.
+type frameReader interface {
+	ReadFrame() (*dvrip.Frame, error)
+	Reset(r io.Reader)
+}
+
+// openRecording opens a recording with the reader for its extension.
+func openRecording(file string) (frameReader, *os.File, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var r frameReader
+
+	switch filepath.Ext(file) {
+	case ".mp4":
+		r, err = mp4.NewReader(f)
+	case ".ts":
+		r = mpegts.NewReader(f)
+	case ".mkv":
+		r, err = mkv.NewReader(f)
+	default:
+		err = fmt.Errorf("unsupported format: %v", filepath.Ext(file))
+	}
+
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return r, f, nil
+}
+
+// hasAudio reports whether there is audio at the start of a recording, the
+// init segment and the chunks have to agree on the tracks. The answer is
+// kept with the cached entry.
+func (p *Playback) hasAudio(rec *recording) bool {
+	p.lock.Lock()
+	probed, audio := rec.probed, rec.audio
+	p.lock.Unlock()
+
+	if probed {
+		return audio
+	}
+
+	audio = probeAudio(rec.Path)
+
+	p.lock.Lock()
+	rec.probed, rec.audio = true, audio
+	p.lock.Unlock()
+
+	return audio
+}
+
+func probeAudio(file string) bool {
+	r, f, err := openRecording(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	for i := 0; i < audioProbeFrames; i++ {
+		frame, err := r.ReadFrame()
+		if err != nil {
+			return false
+		}
+
+		if frame.Meta.Type == "G711A" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// offset returns the byte offset in the file to resume reading at for the
+// keyframe at start. The first keyframe follows the header, which the
+// readers have read already.
+func (rec *recording) offset(start time.Duration) (int64, bool) {
+	for i, k := range rec.Keyframes {
+		if i == 0 || i >= len(rec.KeyframeOffsets) {
+			continue
+		}
+
+		if k > start-keyframeTolerance && k < start+keyframeTolerance {
+			return rec.KeyframeOffsets[i], true
+		}
+	}
+
+	return 0, false
+}
+
+// remux returns the init segment of a recording or the fragments from the
+// keyframe at start to the one at end. The decode times are the timestamps
+// in the recording, so consecutive chunks line up. Chunks are read from the
+// keyframe offset of the index if it has one.
+func remux(rec *recording, audio, init bool, start, end time.Duration) ([]byte, error) {
+	r, f, err := openRecording(rec.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if offset, ok := rec.offset(start); ok && !init {
+		// the first frame fixes the timestamp origin of the readers
+		_, err = r.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = f.Seek(offset, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+
+		r.Reset(f)
+	}
+
+	var out mp4.Capture
+
+	w := mp4.NewWriter(&out, mp4.Options{Audio: audio, NoIndex: true, KeepTimestamps: true})
+
+	var (
+		started  bool
+		seen     [2]bool
+		lastDTS  [2]time.Duration
+		interval [2]time.Duration
+	)
+
+	for {
+		frame, err := r.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		isVideo := frame.Meta.Frame != ""
+		keyframe := isVideo && frame.Keyframe
+
+		if !started {
+			if !keyframe || frame.PTS < start-keyframeTolerance {
+				continue
+			}
+
+			started = true
+		} else if keyframe && frame.PTS >= end-keyframeTolerance {
+			break
+		}
+
+		// the last frame lasts as long as the one before
+		track := 0
+		if !isVideo {
+			track = 1
+		}
+
+		if seen[track] {
+			interval[track] = frame.DTS - lastDTS[track]
+		}
+
+		seen[track], lastDTS[track] = true, frame.DTS
+
+		if frame.Duration == 0 {
+			frame.Duration = interval[track]
+		}
+
+		err = w.WriteFrame(frame)
+		if err != nil {
+			return nil, err
+		}
+
+		if init && w.Started() {
+			return out.Take(), nil
+		}
+	}
+
+	if !started {
+		return nil, errors.New("no keyframe in the chunk")
+	}
+
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// drop the init segment
+	if len(out.Writes) < 2 {
+		return nil, errors.New("empty chunk")
+	}
+
+	out.Writes = out.Writes[1:]
+
+	return out.Take(), nil
+}
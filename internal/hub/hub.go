@@ -0,0 +1,275 @@
+// Package hub fans the frames of a monitor session out to several
+// subscribers, e.g. the recorder, the restreams and analytics. Every
+// subscriber has its own buffer and a policy for when it is full, so a slow
+// subscriber costs itself frames instead of stalling the read loop of the
+// connection, which would run into the read timeout and end the stream.
+package hub
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"godvr/internal/dvrip"
+)
+
+// Policy decides what happens to a frame for a subscriber whose buffer is
+// full.
+type Policy int
+
+const (
+	// Block waits for room in the buffer, which holds up the publisher and
+	// so every other subscriber. It suits lossless subscribers such as the
+	// recorder, whose buffer absorbs slow writes.
+	Block Policy = iota
+
+	// DropOldest drops the oldest buffered frame to make room, so the
+	// subscriber always gets the latest frames.
+	DropOldest
+
+	// DropUntilKeyframe drops frames until the next keyframe once the
+	// buffer is full, so a video decoder never sees a broken group of
+	// pictures.
+	DropUntilKeyframe
+)
+
+var policyNames = []string{"block", "drop-oldest", "drop-until-keyframe"}
+
+func (p Policy) String() string {
+	if int(p) < len(policyNames) {
+		return policyNames[p]
+	}
+
+	return fmt.Sprintf("Policy(%d)", int(p))
+}
+
+// ParsePolicy returns the policy named as by String.
+func ParsePolicy(s string) (Policy, error) {
+	for i, name := range policyNames {
+		if strings.EqualFold(s, name) {
+			return Policy(i), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown policy: %q", s)
+}
+
+// Subscriber receives the frames of a hub. The frames are shared with the
+// other subscribers, so they must not be modified, and each one has to be
+// released with Frame.Release.
+type Subscriber struct {
+	name   string
+	policy Policy
+	frames chan *dvrip.Frame
+	done   chan struct{}
+
+	// waiting is only used by the publisher, see DropUntilKeyframe
+	waiting bool
+
+	// sending is held by the publisher while it hands a frame to the
+	// subscriber, so Unsubscribe can wait for it before the final drain;
+	// removed is set once drained and guarded by sending
+	sending sync.Mutex
+	removed bool
+
+	dropped uint64
+}
+
+// Name returns the name given to Subscribe.
+func (s *Subscriber) Name() string {
+	return s.name
+}
+
+// Frames returns the channel of the frames, it is closed after the last
+// frame when the hub closes.
+func (s *Subscriber) Frames() <-chan *dvrip.Frame {
+	return s.frames
+}
+
+// Dropped returns the number of frames the subscriber lost.
+func (s *Subscriber) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *Subscriber) drop(frame *dvrip.Frame) {
+	frame.Release()
+	atomic.AddUint64(&s.dropped, 1)
+}
+
+// Hub distributes frames from one publisher.
+type Hub struct {
+	lock        sync.Mutex
+	subscribers []*Subscriber
+	closed      bool
+}
+
+// New returns a hub without subscribers.
+func New() *Hub {
+	return &Hub{}
+}
+
+// Subscribe adds a subscriber that buffers up to size frames. It gets the
+// frames published from now on.
+func (h *Hub) Subscribe(name string, size int, policy Policy) *Subscriber {
+	s := &Subscriber{
+		name:   name,
+		policy: policy,
+		frames: make(chan *dvrip.Frame, size),
+		done:   make(chan struct{}),
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.closed {
+		close(s.frames)
+		return s
+	}
+
+	h.subscribers = append(h.subscribers, s)
+
+	return s
+}
+
+// Unsubscribe removes a subscriber that stops reading, a publisher blocked
+// on it goes on. The frames still buffered are released.
+func (h *Hub) Unsubscribe(s *Subscriber) {
+	h.lock.Lock()
+
+	for i, other := range h.subscribers {
+		if other == s {
+			h.subscribers = append(h.subscribers[:i:i], h.subscribers[i+1:]...)
+			close(s.done)
+
+			break
+		}
+	}
+
+	h.lock.Unlock()
+
+	// a publisher blocked on the subscriber gives up on done, one that took
+	// it from the list before it was removed is waited for, so that no frame
+	// arrives after the drain
+	s.sending.Lock()
+	defer s.sending.Unlock()
+
+	s.removed = true
+
+	for {
+		select {
+		case frame, ok := <-s.frames:
+			if !ok {
+				return
+			}
+
+			frame.Release()
+		default:
+			return
+		}
+	}
+}
+
+// Subscribers returns the current subscribers.
+func (h *Hub) Subscribers() []*Subscriber {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return append([]*Subscriber(nil), h.subscribers...)
+}
+
+// Publish hands a frame to every subscriber and takes the ownership of it.
+// Publish and Close are called by a single publisher.
+func (h *Hub) Publish(frame *dvrip.Frame) {
+	defer frame.Release()
+
+	for _, s := range h.Subscribers() {
+		s.sending.Lock()
+
+		if s.removed {
+			s.sending.Unlock()
+			continue
+		}
+
+		frame.Retain()
+
+		switch s.policy {
+		case Block:
+			select {
+			case s.frames <- frame:
+			case <-s.done:
+				frame.Release()
+			}
+		case DropOldest:
+			publishDropOldest(s, frame)
+		case DropUntilKeyframe:
+			publishDropUntilKeyframe(s, frame)
+		}
+
+		s.sending.Unlock()
+	}
+}
+
+func publishDropOldest(s *Subscriber, frame *dvrip.Frame) {
+	for {
+		select {
+		case s.frames <- frame:
+			return
+		default:
+		}
+
+		// the subscriber may have taken it meanwhile
+		select {
+		case old := <-s.frames:
+			s.drop(old)
+		default:
+		}
+	}
+}
+
+func publishDropUntilKeyframe(s *Subscriber, frame *dvrip.Frame) {
+	if s.waiting {
+		if !frame.Keyframe {
+			s.drop(frame)
+			return
+		}
+
+		s.waiting = false
+	}
+
+	select {
+	case s.frames <- frame:
+	default:
+		s.waiting = true
+		s.drop(frame)
+	}
+}
+
+// Run publishes the frames of a monitor until its channel is closed and
+// closes the hub.
+func (h *Hub) Run(frames <-chan *dvrip.Frame) {
+	for frame := range frames {
+		h.Publish(frame)
+	}
+
+	h.Close()
+}
+
+// Close closes the channels of the subscribers once they read the buffered
+// frames.
+func (h *Hub) Close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.closed {
+		return
+	}
+
+	h.closed = true
+
+	for _, s := range h.subscribers {
+		close(s.frames)
+	}
+
+	h.subscribers = nil
+}
@@ -0,0 +1,215 @@
+package hub
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"godvr/internal/dvrip"
+)
+
+// frames returns numbered frames, "K" marks keyframes.
+func frames(kinds string) []*dvrip.Frame {
+	var out []*dvrip.Frame
+
+	for i, kind := range kinds {
+		frame := &dvrip.Frame{Meta: dvrip.MetaInfo{Type: "H264", Frame: "P"}, PTS: time.Duration(i)}
+		if kind == 'K' {
+			frame.Meta.Frame, frame.Keyframe = "I", true
+		}
+
+		out = append(out, frame)
+	}
+
+	return out
+}
+
+// drain returns the numbers of the buffered frames.
+func drain(s *Subscriber) []int {
+	var got []int
+
+	for {
+		select {
+		case frame, ok := <-s.Frames():
+			if !ok {
+				return got
+			}
+
+			got = append(got, int(frame.PTS))
+		default:
+			return got
+		}
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	h := New()
+
+	oldest := h.Subscribe("oldest", 2, DropOldest)
+	keyframe := h.Subscribe("keyframe", 2, DropUntilKeyframe)
+
+	input := frames("KPPPKP")
+
+	for _, frame := range input[:4] {
+		h.Publish(frame)
+	}
+
+	if got := drain(keyframe); !reflect.DeepEqual(got, []int{0, 1}) {
+		t.Errorf("drop-until-keyframe got %v before draining", got)
+	}
+
+	for _, frame := range input[4:] {
+		h.Publish(frame)
+	}
+
+	if got := drain(oldest); !reflect.DeepEqual(got, []int{4, 5}) {
+		t.Errorf("drop-oldest got %v", got)
+	}
+
+	// the P-frames after the full buffer are dropped up to the keyframe
+	if got := drain(keyframe); !reflect.DeepEqual(got, []int{4, 5}) {
+		t.Errorf("drop-until-keyframe got %v", got)
+	}
+
+	if oldest.Dropped() != 4 || keyframe.Dropped() != 2 {
+		t.Errorf("got %d and %d dropped frames", oldest.Dropped(), keyframe.Dropped())
+	}
+}
+
+func TestBlock(t *testing.T) {
+	h := New()
+
+	s := h.Subscribe("recorder", 1, Block)
+	other := h.Subscribe("other", 10, DropOldest)
+
+	in := make(chan *dvrip.Frame)
+	go h.Run(in)
+
+	var got []int
+	read := make(chan struct{})
+
+	go func() {
+		for frame := range s.Frames() {
+			got = append(got, int(frame.PTS))
+		}
+
+		close(read)
+	}()
+
+	for _, frame := range frames("KPPP") {
+		in <- frame
+	}
+
+	close(in)
+	<-read
+
+	if !reflect.DeepEqual(got, []int{0, 1, 2, 3}) || s.Dropped() != 0 {
+		t.Errorf("got %v, %d dropped", got, s.Dropped())
+	}
+
+	// the closed hub keeps the buffered frames
+	if got := drain(other); !reflect.DeepEqual(got, []int{0, 1, 2, 3}) {
+		t.Errorf("other subscriber got %v", got)
+	}
+
+	if _, ok := <-h.Subscribe("late", 1, Block).Frames(); ok {
+		t.Error("subscriber of a closed hub got a frame")
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	h := New()
+	s := h.Subscribe("recorder", 1, Block)
+
+	published := make(chan struct{})
+
+	go func() {
+		for _, frame := range frames("KPP") {
+			h.Publish(frame)
+		}
+
+		close(published)
+	}()
+
+	select {
+	case <-published:
+		t.Fatal("publisher did not block")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// a subscriber that goes away does not hold up the publisher
+	h.Unsubscribe(s)
+
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publisher is still blocked")
+	}
+
+	if n := len(h.Subscribers()); n != 0 {
+		t.Errorf("got %d subscribers", n)
+	}
+}
+
+// TestUnsubscribeRace unsubscribes while frames are published, no frame may
+// end up in a buffer after its final drain.
+func TestUnsubscribeRace(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		h := New()
+
+		subscribers := []*Subscriber{
+			h.Subscribe("recorder", 2, Block),
+			h.Subscribe("live", 2, DropOldest),
+			h.Subscribe("analytics", 2, DropUntilKeyframe),
+		}
+
+		started := make(chan struct{})
+		published := make(chan struct{})
+
+		go func() {
+			for j := 0; j < 100; j++ {
+				if j == 1 {
+					close(started)
+				}
+
+				frame := dvrip.AcquireFrame()
+				frame.Keyframe = j%5 == 0
+
+				h.Publish(frame)
+			}
+
+			close(published)
+		}()
+
+		<-started
+
+		for _, s := range subscribers {
+			go h.Unsubscribe(s)
+		}
+
+		<-published
+
+		// the unsubscribing goroutines may still be draining
+		deadline := time.Now().Add(5 * time.Second)
+		for dvrip.PooledFrames() != 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+
+		if n := dvrip.PooledFrames(); n != 0 {
+			t.Fatalf("%d frames were not released", n)
+		}
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, p := range []Policy{Block, DropOldest, DropUntilKeyframe} {
+		got, err := ParsePolicy(p.String())
+		if err != nil || got != p {
+			t.Errorf("%v: got %v, %v", p, got, err)
+		}
+	}
+
+	if _, err := ParsePolicy("drop-newest"); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+}
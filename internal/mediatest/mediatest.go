@@ -0,0 +1,61 @@
+// Package mediatest builds the H.264 and G.711 frames fed to the muxers,
+// servers and tools in their tests.
+package mediatest
+
+import (
+	"bytes"
+	"time"
+
+	"godvr/internal/dvrip"
+	"godvr/internal/nalu"
+)
+
+var (
+	// SPS and PPS are the parameter sets of a 1920x1080 H.264 stream.
+	SPS = []byte{
+		0x67, 0x64, 0x00, 0x2a, 0xac, 0xd9, 0x40, 0x78, 0x02, 0x27, 0xe5, 0xc0, 0x44, 0x00,
+		0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0x32, 0x3c, 0x60, 0xc6, 0x58,
+	}
+	PPS = []byte{0x68, 0xeb, 0xe3, 0xcb}
+)
+
+// FrameDuration is the length of the frames, 25 per second.
+const FrameDuration = 40 * time.Millisecond
+
+// VideoFrame returns an H.264 frame with pts as both timestamps, whose slice
+// is padded by size bytes. Keyframes carry the parameter sets.
+func VideoFrame(keyframe bool, pts time.Duration, size int) *dvrip.Frame {
+	data := []byte{0, 0, 0, 1, 0x41, 0x9a}
+	if keyframe {
+		data = append([]byte{0, 0, 0, 1}, SPS...)
+		data = append(data, 0, 0, 0, 1)
+		data = append(data, PPS...)
+		data = append(data, 0, 0, 0, 1, 0x65, 0x88)
+	}
+
+	data = append(data, bytes.Repeat([]byte{0xAB}, size)...)
+
+	frame := dvrip.NewVideoFrame(nalu.CodecH264, data)
+	frame.Meta.FPS = 25
+	frame.PTS, frame.DTS = pts, pts
+	frame.Duration = FrameDuration
+
+	return frame
+}
+
+// StreamFrame returns frame i of a stream with a keyframe every second.
+func StreamFrame(i int) *dvrip.Frame {
+	return VideoFrame(i%25 == 0, time.Duration(i)*FrameDuration, 1)
+}
+
+// AudioFrame returns a G.711 A-law frame of silence as long as a video
+// frame.
+func AudioFrame(pts time.Duration) *dvrip.Frame {
+	return &dvrip.Frame{
+		Data:     bytes.Repeat([]byte{0xd5}, 320),
+		Meta:     dvrip.MetaInfo{Type: "G711A"},
+		PTS:      pts,
+		DTS:      pts,
+		Duration: FrameDuration,
+	}
+}
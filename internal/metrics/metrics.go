@@ -0,0 +1,159 @@
+// Package metrics writes metrics in the Prometheus text exposition format,
+// see https://prometheus.io/docs/instrumenting/exposition_formats/.
+//
+// The recorder keeps its own counters and writes them on every scrape, so
+// there is no registry: a handler writes the header of a metric family and
+// then a sample per series.
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the media type of the text format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Types of the metric families.
+const (
+	CounterType   = "counter"
+	GaugeType     = "gauge"
+	HistogramType = "histogram"
+)
+
+// Labels are the label names and values of a series in pairs, e.g.
+// Labels{"camera", "gate"}.
+type Labels []string
+
+// With returns a copy of the labels with another pair added.
+func (l Labels) With(name, value string) Labels {
+	return append(l[:len(l):len(l)], name, value)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+// Writer writes metric families.
+type Writer struct {
+	w   *bufio.Writer
+	err error
+}
+
+// NewWriter returns a writer to w, Flush writes out the buffered samples.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+func (w *Writer) print(s ...string) {
+	for _, part := range s {
+		if w.err != nil {
+			return
+		}
+
+		_, w.err = w.w.WriteString(part)
+	}
+}
+
+// Family starts a metric family with the type typ, the samples of the
+// family must follow.
+func (w *Writer) Family(name, typ, help string) {
+	w.print("# HELP ", name, " ", helpEscaper.Replace(help), "\n")
+	w.print("# TYPE ", name, " ", typ, "\n")
+}
+
+// Sample writes the value of a series.
+func (w *Writer) Sample(name string, labels Labels, value float64) {
+	w.print(name)
+
+	if len(labels) > 0 {
+		w.print("{")
+
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.print(",")
+			}
+
+			w.print(labels[i], `="`, labelEscaper.Replace(labels[i+1]), `"`)
+		}
+
+		w.print("}")
+	}
+
+	w.print(" ", formatFloat(value), "\n")
+}
+
+// Histogram writes the buckets, sum and count of a histogram series.
+func (w *Writer) Histogram(name string, labels Labels, h *Histogram) {
+	bounds, counts, sum, count := h.snapshot()
+
+	for i, bound := range bounds {
+		w.Sample(name+"_bucket", labels.With("le", formatFloat(bound)), float64(counts[i]))
+	}
+
+	w.Sample(name+"_bucket", labels.With("le", "+Inf"), float64(count))
+	w.Sample(name+"_sum", labels, sum)
+	w.Sample(name+"_count", labels, float64(count))
+}
+
+// Flush writes the buffered samples and returns the first error.
+func (w *Writer) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+
+	return w.w.Flush()
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Histogram counts observations in cumulative buckets.
+type Histogram struct {
+	lock   sync.Mutex
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram returns a histogram with the upper bounds of its buckets in
+// increasing order, the +Inf bucket is implicit.
+func NewHistogram(bounds ...float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+// Observe adds a value.
+func (h *Histogram) Observe(v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) snapshot() ([]float64, []uint64, float64, uint64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.bounds, append([]uint64(nil), h.counts...), h.sum, h.count
+}
@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	var b bytes.Buffer
+
+	h := NewHistogram(0.01, 0.1)
+	h.Observe(0.005)
+	h.Observe(0.05)
+	h.Observe(2)
+
+	w := NewWriter(&b)
+
+	w.Family("godvr_frames_total", CounterType, "Frames received.")
+	w.Sample("godvr_frames_total", Labels{"camera", `a "b"`, "frame", "I"}, 42)
+	w.Sample("godvr_frames_total", nil, 1.5)
+
+	w.Family("godvr_write_seconds", HistogramType, "Write latency.")
+	w.Histogram("godvr_write_seconds", Labels{"camera", "gate"}, h)
+
+	err := w.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP godvr_frames_total Frames received.
+# TYPE godvr_frames_total counter
+godvr_frames_total{camera="a \"b\"",frame="I"} 42
+godvr_frames_total 1.5
+# HELP godvr_write_seconds Write latency.
+# TYPE godvr_write_seconds histogram
+godvr_write_seconds_bucket{camera="gate",le="0.01"} 1
+godvr_write_seconds_bucket{camera="gate",le="0.1"} 2
+godvr_write_seconds_bucket{camera="gate",le="+Inf"} 3
+godvr_write_seconds_sum{camera="gate"} 2.055
+godvr_write_seconds_count{camera="gate"} 3
+`
+
+	if b.String() != expected {
+		t.Errorf("got\n%s", b.String())
+	}
+}
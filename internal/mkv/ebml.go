@@ -0,0 +1,205 @@
+package mkv
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// Element IDs, written with their length marker bits.
+const (
+	idEBML               = 0x1A45DFA3
+	idEBMLVersion        = 0x4286
+	idEBMLReadVersion    = 0x42F7
+	idEBMLMaxIDLength    = 0x42F2
+	idEBMLMaxSizeLength  = 0x42F3
+	idDocType            = 0x4282
+	idDocTypeVersion     = 0x4287
+	idDocTypeReadVersion = 0x4285
+
+	idSegment      = 0x18538067
+	idSeekHead     = 0x114D9B74
+	idSeek         = 0x4DBB
+	idSeekID       = 0x53AB
+	idSeekPosition = 0x53AC
+	idVoid         = 0xEC
+
+	idInfo          = 0x1549A966
+	idTimecodeScale = 0x2AD7B1
+	idDuration      = 0x4489
+	idMuxingApp     = 0x4D80
+	idWritingApp    = 0x5741
+
+	idTracks            = 0x1654AE6B
+	idTrackEntry        = 0xAE
+	idTrackNumber       = 0xD7
+	idTrackUID          = 0x73C5
+	idTrackType         = 0x83
+	idFlagLacing        = 0x9C
+	idCodecID           = 0x86
+	idCodecPrivate      = 0x63A2
+	idVideo             = 0xE0
+	idPixelWidth        = 0xB0
+	idPixelHeight       = 0xBA
+	idAudio             = 0xE1
+	idSamplingFrequency = 0xB5
+	idChannels          = 0x9F
+	idBitDepth          = 0x6264
+
+	idCluster     = 0x1F43B675
+	idTimecode    = 0xE7
+	idSimpleBlock = 0xA3
+
+	idCues               = 0x1C53BB6B
+	idCuePoint           = 0xBB
+	idCueTime            = 0xB3
+	idCueTrackPositions  = 0xB7
+	idCueTrack           = 0xF7
+	idCueClusterPosition = 0xF1
+)
+
+// unknownSize is the 8 byte size of an element whose size is not known
+// while it is written.
+const unknownSize = 0x00FFFFFFFFFFFFFF
+
+func appendID(b []byte, id uint32) []byte {
+	switch {
+	case id >= 1<<24:
+		return append(b, byte(id>>24), byte(id>>16), byte(id>>8), byte(id))
+	case id >= 1<<16:
+		return append(b, byte(id>>16), byte(id>>8), byte(id))
+	case id >= 1<<8:
+		return append(b, byte(id>>8), byte(id))
+	}
+
+	return append(b, byte(id))
+}
+
+// appendSize appends a size in the shortest variable length encoding.
+func appendSize(b []byte, size uint64) []byte {
+	n := 1
+	for n < 8 && size >= 1<<(7*uint(n))-1 {
+		n++
+	}
+
+	return appendSizeN(b, size, n)
+}
+
+// appendSizeN appends a size as an n byte variable length integer.
+func appendSizeN(b []byte, size uint64, n int) []byte {
+	size |= 1 << (7 * uint(n))
+
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(size>>(8*uint(i))))
+	}
+
+	return b
+}
+
+func appendElement(b []byte, id uint32, payload []byte) []byte {
+	b = appendID(b, id)
+	b = appendSize(b, uint64(len(payload)))
+
+	return append(b, payload...)
+}
+
+func appendUint(b []byte, id uint32, v uint64) []byte {
+	n := 1
+	for n < 8 && v >= 1<<(8*uint(n)) {
+		n++
+	}
+
+	var payload [8]byte
+	binary.BigEndian.PutUint64(payload[:], v)
+
+	return appendElement(b, id, payload[8-n:])
+}
+
+func appendFloat(b []byte, id uint32, v float64) []byte {
+	var payload [8]byte
+	binary.BigEndian.PutUint64(payload[:], math.Float64bits(v))
+
+	return appendElement(b, id, payload[:])
+}
+
+func appendString(b []byte, id uint32, v string) []byte {
+	return appendElement(b, id, []byte(v))
+}
+
+var errInvalidVint = errors.New("invalid variable length integer")
+
+// readVint reads a variable length integer and returns its value with the
+// marker bit removed, its raw value and its length.
+func readVint(r io.Reader) (value, raw uint64, n int, err error) {
+	var first [1]byte
+
+	_, err = io.ReadFull(r, first[:])
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	n = 1
+	for mask := byte(0x80); first[0]&mask == 0; mask >>= 1 {
+		n++
+
+		if n > 8 {
+			return 0, 0, 0, errInvalidVint
+		}
+	}
+
+	buf := make([]byte, n)
+	buf[0] = first[0]
+
+	_, err = io.ReadFull(r, buf[1:])
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return 0, 0, 0, err
+	}
+
+	for _, c := range buf {
+		raw = raw<<8 | uint64(c)
+	}
+
+	value = raw &^ (1 << (7 * uint(n)))
+
+	return value, raw, n, nil
+}
+
+// elementHeader is the ID and size of an element read from a file.
+type elementHeader struct {
+	id      uint32
+	size    uint64
+	unknown bool
+	length  int // of the ID and size fields
+}
+
+func readElementHeader(r io.Reader) (elementHeader, error) {
+	_, id, idLength, err := readVint(r)
+	if err != nil {
+		return elementHeader{}, err
+	}
+
+	if idLength > 4 {
+		return elementHeader{}, errInvalidVint
+	}
+
+	size, _, sizeLength, err := readVint(r)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return elementHeader{}, err
+	}
+
+	return elementHeader{
+		id:      uint32(id),
+		size:    size,
+		unknown: size == 1<<(7*uint(sizeLength))-1,
+		length:  idLength + sizeLength,
+	}, nil
+}
@@ -0,0 +1,465 @@
+// Package mkv writes dvrip frame streams as Matroska files.
+//
+// Clusters are written whole, each with a single call to the underlying
+// writer, and the segment is written with an unknown size, so a file cut
+// short by a crash stays readable up to its last complete cluster. Close
+// appends the cues and, if the writer can seek, fills in the seek head,
+// duration and segment size. Repair does the same for a truncated file.
+package mkv
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"time"
+
+	"godvr/internal/dvrip"
+	"godvr/internal/nalu"
+)
+
+const (
+	videoTrack = 1
+	audioTrack = 2
+
+	trackTypeVideo = 1
+	trackTypeAudio = 2
+
+	// timecodes are in milliseconds
+	timecodeScale = 1000000
+
+	// space reserved for the seek head that is written on Close
+	seekHeadSize = 96
+
+	// block timecodes are 16 bit offsets from the cluster timecode
+	maxClusterDuration = 30 * time.Second
+)
+
+// DefaultMaxClusterDuration is used when Options.MaxClusterDuration is not
+// set.
+const DefaultMaxClusterDuration = 5 * time.Second
+
+type Options struct {
+	// Audio adds a G.711 A-law track even if no audio frame arrived before
+	// the first keyframe.
+	Audio bool
+
+	// MaxClusterDuration starts a new cluster once the current one exceeds
+	// it, even without a keyframe. Clusters start at keyframes otherwise.
+	MaxClusterDuration time.Duration
+}
+
+// Writer muxes frames into a Matroska stream.
+type Writer struct {
+	w    io.Writer
+	opts Options
+
+	started  bool
+	sawAudio bool
+	audio    bool
+	codec    string
+	origin   time.Duration
+
+	layout  layout
+	written int64
+
+	cluster     []byte
+	clusterTime int64
+}
+
+// layout records where the elements patched by finish are located.
+type layout struct {
+	// absolute offsets of the segment payload, the reserved seek head and
+	// the payload of the Duration element
+	segment     int64
+	seekHead    int64
+	durationPos int64
+
+	// offsets of the Info and Tracks elements relative to the segment
+	info   int64
+	tracks int64
+
+	cues     []cue
+	duration int64
+}
+
+type cue struct {
+	time     int64
+	position int64
+}
+
+var ErrClosed = errors.New("mkv: writer is closed")
+
+func NewWriter(w io.Writer, opts Options) *Writer {
+	if opts.MaxClusterDuration <= 0 || opts.MaxClusterDuration > maxClusterDuration {
+		opts.MaxClusterDuration = DefaultMaxClusterDuration
+	}
+
+	return &Writer{w: w, opts: opts}
+}
+
+// Started reports whether the header has been written, which happens at the
+// first keyframe that carries parameter sets.
+func (w *Writer) Started() bool {
+	return w.started
+}
+
+// WriteFrame adds a frame to the current cluster. Video frames before the
+// first keyframe and frames of unsupported codecs are dropped.
+func (w *Writer) WriteFrame(frame *dvrip.Frame) error {
+	if w.w == nil {
+		return ErrClosed
+	}
+
+	isVideo := frame.Meta.Frame != ""
+	isAudio := frame.Meta.Type == "G711A"
+
+	if !w.started {
+		if isAudio {
+			w.sawAudio = true
+		}
+
+		if !isVideo || !frame.Keyframe {
+			return nil
+		}
+
+		err := w.start(frame)
+		if err != nil || !w.started {
+			return err
+		}
+	}
+
+	timecode := int64((frame.PTS - w.origin) / time.Millisecond)
+	if timecode < 0 {
+		timecode = 0
+	}
+
+	switch {
+	case isVideo:
+		if frame.Meta.Type != w.codec {
+			return nil
+		}
+
+		overdue := time.Duration(timecode-w.clusterTime)*time.Millisecond >= w.opts.MaxClusterDuration
+		if w.cluster != nil && (frame.Keyframe || overdue) {
+			err := w.Flush()
+			if err != nil {
+				return err
+			}
+		}
+
+		if w.cluster == nil && frame.Keyframe {
+			w.layout.cues = append(w.layout.cues, cue{time: timecode, position: w.written - w.layout.segment})
+		}
+
+		data := nalu.AppendLengthPrefixed(nil, w.codec, frame.NALUs)
+		w.addBlock(videoTrack, timecode, frame.Keyframe, data)
+	case isAudio && w.audio:
+		if w.cluster != nil && timecode-w.clusterTime > int64(maxClusterDuration/time.Millisecond) {
+			err := w.Flush()
+			if err != nil {
+				return err
+			}
+		}
+
+		w.addBlock(audioTrack, timecode, true, frame.Data)
+	}
+
+	end := timecode + int64(frame.Duration/time.Millisecond)
+	if end > w.layout.duration {
+		w.layout.duration = end
+	}
+
+	return nil
+}
+
+func (w *Writer) addBlock(track byte, timecode int64, keyframe bool, data []byte) {
+	if w.cluster == nil {
+		w.clusterTime = timecode
+		w.cluster = appendUint(make([]byte, 0, len(data)+64), idTimecode, uint64(timecode))
+	}
+
+	// audio may arrive slightly before the keyframe that opened the
+	// cluster, keep it inside the cluster
+	if timecode < w.clusterTime {
+		timecode = w.clusterTime
+	}
+
+	flags := byte(0)
+	if keyframe {
+		flags = 0x80
+	}
+
+	relative := timecode - w.clusterTime
+
+	w.cluster = appendID(w.cluster, idSimpleBlock)
+	w.cluster = appendSize(w.cluster, uint64(4+len(data)))
+	w.cluster = append(w.cluster, 0x80|track, byte(relative>>8), byte(relative), flags)
+	w.cluster = append(w.cluster, data...)
+}
+
+// Flush writes the current cluster.
+func (w *Writer) Flush() error {
+	if w.cluster == nil {
+		return nil
+	}
+
+	b := appendElement(nil, idCluster, w.cluster)
+	w.cluster = nil
+
+	return w.write(b)
+}
+
+func (w *Writer) start(frame *dvrip.Frame) error {
+	var (
+		codecID string
+		private []byte
+		err     error
+	)
+
+	switch frame.Meta.Type {
+	case nalu.CodecH264:
+		codecID = "V_MPEG4/ISO/AVC"
+		private, err = nalu.AVCConfig(frame.SPS, frame.PPS)
+	case nalu.CodecH265:
+		codecID = "V_MPEGH/ISO/HEVC"
+		private, err = nalu.HEVCConfig(frame.VPS, frame.SPS, frame.PPS)
+	default:
+		return nil
+	}
+
+	if err != nil {
+		// keep waiting for a keyframe with complete parameter sets
+		return nil
+	}
+
+	w.codec = frame.Meta.Type
+	w.origin = frame.PTS
+	w.audio = w.opts.Audio || w.sawAudio
+
+	header := w.header(frame.Meta.Width, frame.Meta.Height, codecID, private)
+
+	err = w.write(header)
+	if err != nil {
+		return err
+	}
+
+	w.started = true
+
+	return nil
+}
+
+// header builds the EBML header, the start of the segment, the space for
+// the seek head and the Info and Tracks elements.
+func (w *Writer) header(width, height int, codecID string, private []byte) []byte {
+	var ebml []byte
+	ebml = appendUint(ebml, idEBMLVersion, 1)
+	ebml = appendUint(ebml, idEBMLReadVersion, 1)
+	ebml = appendUint(ebml, idEBMLMaxIDLength, 4)
+	ebml = appendUint(ebml, idEBMLMaxSizeLength, 8)
+	ebml = appendString(ebml, idDocType, "matroska")
+	ebml = appendUint(ebml, idDocTypeVersion, 4)
+	ebml = appendUint(ebml, idDocTypeReadVersion, 2)
+
+	b := appendElement(nil, idEBML, ebml)
+	b = appendID(b, idSegment)
+	b = appendSizeN(b, unknownSize, 8)
+
+	l := &w.layout
+	l.segment = w.written + int64(len(b))
+	l.seekHead = l.segment
+	b = appendVoid(b, seekHeadSize)
+
+	var info []byte
+	info = appendUint(info, idTimecodeScale, timecodeScale)
+	info = appendString(info, idMuxingApp, "godvr")
+	info = appendString(info, idWritingApp, "godvr")
+	durationOffset := len(info) + 3
+	info = appendFloat(info, idDuration, 0)
+
+	l.info = w.written + int64(len(b)) - l.segment
+	b = appendID(b, idInfo)
+	b = appendSize(b, uint64(len(info)))
+	l.durationPos = w.written + int64(len(b)+durationOffset)
+	b = append(b, info...)
+
+	var video []byte
+	video = appendUint(video, idPixelWidth, uint64(width))
+	video = appendUint(video, idPixelHeight, uint64(height))
+
+	var entry []byte
+	entry = appendUint(entry, idTrackNumber, videoTrack)
+	entry = appendUint(entry, idTrackUID, videoTrack)
+	entry = appendUint(entry, idTrackType, trackTypeVideo)
+	entry = appendUint(entry, idFlagLacing, 0)
+	entry = appendString(entry, idCodecID, codecID)
+	entry = appendElement(entry, idCodecPrivate, private)
+	entry = appendElement(entry, idVideo, video)
+
+	tracks := appendElement(nil, idTrackEntry, entry)
+
+	if w.audio {
+		var audio []byte
+		audio = appendFloat(audio, idSamplingFrequency, 8000)
+		audio = appendUint(audio, idChannels, 1)
+		audio = appendUint(audio, idBitDepth, 8)
+
+		entry = entry[:0]
+		entry = appendUint(entry, idTrackNumber, audioTrack)
+		entry = appendUint(entry, idTrackUID, audioTrack)
+		entry = appendUint(entry, idTrackType, trackTypeAudio)
+		entry = appendUint(entry, idFlagLacing, 0)
+		entry = appendString(entry, idCodecID, "A_MS/ACM")
+		entry = appendElement(entry, idCodecPrivate, alawFormat())
+		entry = appendElement(entry, idAudio, audio)
+
+		tracks = appendElement(tracks, idTrackEntry, entry)
+	}
+
+	l.tracks = w.written + int64(len(b)) - l.segment
+	b = appendElement(b, idTracks, tracks)
+
+	return b
+}
+
+// alawFormat is the WAVEFORMATEX structure describing 8kHz mono A-law.
+func alawFormat() []byte {
+	b := make([]byte, 18)
+	binary.LittleEndian.PutUint16(b[0:], 6) // WAVE_FORMAT_ALAW
+	binary.LittleEndian.PutUint16(b[2:], 1)
+	binary.LittleEndian.PutUint32(b[4:], 8000)
+	binary.LittleEndian.PutUint32(b[8:], 8000)
+	binary.LittleEndian.PutUint16(b[12:], 1)
+	binary.LittleEndian.PutUint16(b[14:], 8)
+
+	return b
+}
+
+// appendVoid appends a Void element that occupies exactly size bytes.
+func appendVoid(b []byte, size int) []byte {
+	b = append(b, idVoid)
+	b = appendSizeN(b, uint64(size-9), 8)
+
+	return append(b, make([]byte, size-9)...)
+}
+
+// Close writes the last cluster and the cues. If the underlying writer is
+// an io.WriteSeeker the seek head, duration and segment size are filled in
+// as well. Close does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.w == nil {
+		return ErrClosed
+	}
+
+	defer func() { w.w = nil }()
+
+	if !w.started {
+		return nil
+	}
+
+	err := w.Flush()
+	if err != nil {
+		return err
+	}
+
+	err = w.write(cues(&w.layout, w.written))
+	if err != nil {
+		return err
+	}
+
+	ws, ok := w.w.(io.WriteSeeker)
+	if !ok {
+		return nil
+	}
+
+	return finish(ws, &w.layout, w.written)
+}
+
+func (w *Writer) write(b []byte) error {
+	n, err := w.w.Write(b)
+	w.written += int64(n)
+
+	return err
+}
+
+// cues builds the Cues element and records its position, which is at the
+// given absolute offset, for the seek head.
+func cues(l *layout, offset int64) []byte {
+	var points []byte
+
+	for _, c := range l.cues {
+		var positions []byte
+		positions = appendUint(positions, idCueTrack, videoTrack)
+		positions = appendUint(positions, idCueClusterPosition, uint64(c.position))
+
+		var point []byte
+		point = appendUint(point, idCueTime, uint64(c.time))
+		point = appendElement(point, idCueTrackPositions, positions)
+
+		points = appendElement(points, idCuePoint, point)
+	}
+
+	return appendElement(nil, idCues, points)
+}
+
+type patch struct {
+	offset int64
+	data   []byte
+}
+
+// finish fills in the seek head, the duration and the segment size of a
+// file whose cues start at cuesOffset and that ends right after them. The
+// file position is left at the end of the file.
+func finish(ws io.WriteSeeker, l *layout, cuesOffset int64) error {
+	end, err := ws.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	var seeks []byte
+	for _, s := range []struct {
+		id       uint32
+		position int64
+	}{
+		{idInfo, l.info},
+		{idTracks, l.tracks},
+		{idCues, cuesOffset - l.segment},
+	} {
+		var seek []byte
+		seek = appendElement(seek, idSeekID, appendID(nil, s.id))
+		seek = appendUint(seek, idSeekPosition, uint64(s.position))
+
+		seeks = appendElement(seeks, idSeek, seek)
+	}
+
+	seekHead := appendElement(nil, idSeekHead, seeks)
+	seekHead = appendVoid(seekHead, seekHeadSize-len(seekHead))
+
+	patches := []patch{
+		{l.seekHead, seekHead},
+		{l.segment - 8, appendSizeN(nil, uint64(end-l.segment), 8)},
+	}
+
+	if l.durationPos > 0 {
+		var duration [8]byte
+		binary.BigEndian.PutUint64(duration[:], math.Float64bits(float64(l.duration)))
+
+		patches = append(patches, patch{l.durationPos, duration[:]})
+	}
+
+	for _, p := range patches {
+		_, err = ws.Seek(p.offset, io.SeekStart)
+		if err != nil {
+			return err
+		}
+
+		_, err = ws.Write(p.data)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = ws.Seek(end, io.SeekStart)
+
+	return err
+}
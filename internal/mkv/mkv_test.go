@@ -0,0 +1,258 @@
+package mkv
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"godvr/internal/dvrip"
+	"godvr/internal/mediatest"
+)
+
+// writeGOPs writes gops groups of a keyframe and two P-frames with audio.
+func writeGOPs(t *testing.T, w *Writer, gops int) {
+	pts := time.Duration(0)
+
+	for i := 0; i < gops; i++ {
+		for j := 0; j < 3; j++ {
+			for _, frame := range []*dvrip.Frame{mediatest.AudioFrame(pts), mediatest.VideoFrame(j == 0, pts, 0)} {
+				if err := w.WriteFrame(frame); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			pts += 40 * time.Millisecond
+		}
+	}
+}
+
+type element struct {
+	id      uint32
+	payload []byte
+}
+
+// segmentChildren returns the top level elements of the segment and the
+// segment size as written in the file.
+func segmentChildren(t *testing.T, b []byte) ([]element, uint64) {
+	r := &fileReader{r: bufio.NewReader(bytes.NewReader(b))}
+
+	h, err := readElementHeader(r)
+	if err != nil || h.id != idEBML {
+		t.Fatalf("missing EBML header: %v", err)
+	}
+
+	r.skip(int64(h.size))
+
+	segment, err := readElementHeader(r)
+	if err != nil || segment.id != idSegment {
+		t.Fatalf("missing segment: %v", err)
+	}
+
+	var children []element
+
+	err = walk(b[r.pos:], func(id uint32, _ int, payload []byte) error {
+		children = append(children, element{id, payload})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := segment.size
+	if segment.unknown {
+		size = unknownSize
+	}
+
+	return children, size
+}
+
+func count(children []element, id uint32) int {
+	n := 0
+	for _, c := range children {
+		if c.id == id {
+			n++
+		}
+	}
+
+	return n
+}
+
+func cuePoints(t *testing.T, children []element) int {
+	for _, c := range children {
+		if c.id == idCues {
+			n := 0
+			walk(c.payload, func(id uint32, _ int, _ []byte) error {
+				if id == idCuePoint {
+					n++
+				}
+				return nil
+			})
+
+			return n
+		}
+	}
+
+	t.Fatal("cues not found")
+
+	return 0
+}
+
+func TestWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.mkv")
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w := NewWriter(f, Options{})
+
+	// audio ahead of the first keyframe adds the audio track
+	w.WriteFrame(mediatest.AudioFrame(0))
+	writeGOPs(t, w, 3)
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := os.ReadFile(path)
+	children, size := segmentChildren(t, b)
+
+	if children[0].id != idSeekHead {
+		t.Errorf("expected the seek head first, got %x", children[0].id)
+	}
+
+	if size != uint64(len(b)-int(w.layout.segment)) {
+		t.Errorf("got segment size %d, expected %d", size, len(b)-int(w.layout.segment))
+	}
+
+	if n := count(children, idCluster); n != 3 {
+		t.Errorf("got %d clusters, expected 3", n)
+	}
+
+	if n := cuePoints(t, children); n != 3 {
+		t.Errorf("got %d cue points, expected 3", n)
+	}
+
+	for _, c := range children {
+		if c.id == idTracks && !bytes.Contains(c.payload, []byte("A_MS/ACM")) {
+			t.Error("audio track is missing")
+		}
+	}
+
+	repaired, err := RepairFile(path)
+	if err != nil || repaired {
+		t.Errorf("a complete file must not be repaired: %v %v", repaired, err)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.mkv")
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := NewWriter(f, Options{})
+	writeGOPs(t, w, 4)
+	w.Flush()
+
+	// cut the last cluster in half as a power loss would
+	stat, _ := f.Stat()
+	f.Truncate(stat.Size() - 20)
+	f.Close()
+
+	repaired, err := RepairFile(path)
+	if err != nil || !repaired {
+		t.Fatalf("expected the file to be repaired: %v %v", repaired, err)
+	}
+
+	b, _ := os.ReadFile(path)
+	children, size := segmentChildren(t, b)
+
+	if size == unknownSize {
+		t.Error("segment size was not filled in")
+	}
+
+	if n := count(children, idCluster); n != 3 {
+		t.Errorf("got %d clusters, expected 3", n)
+	}
+
+	if n := cuePoints(t, children); n != 3 {
+		t.Errorf("got %d cue points, expected 3", n)
+	}
+
+	repaired, err = RepairFile(path)
+	if err != nil || repaired {
+		t.Errorf("a repaired file must not be repaired again: %v %v", repaired, err)
+	}
+}
+
+func TestReader(t *testing.T) {
+	var out bytes.Buffer
+
+	w := NewWriter(&out, Options{})
+	writeGOPs(t, w, 4)
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the last cluster is cut off and skipped
+	for _, size := range []int{out.Len(), out.Len() - 100} {
+		r, err := NewReader(bytes.NewReader(out.Bytes()[:size]))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var video, audio, keyframes int
+
+		for {
+			frame, err := r.ReadFrame()
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if frame.Meta.Type == "G711A" {
+				audio++
+				continue
+			}
+
+			expected := mediatest.VideoFrame(frame.Keyframe, 0, 0)
+			if !bytes.Equal(frame.Data, expected.Data) {
+				t.Errorf("frame %d: got %x, expected %x", video, frame.Data, expected.Data)
+			}
+
+			if frame.PTS != time.Duration(video)*40*time.Millisecond {
+				t.Errorf("frame %d: got pts %v", video, frame.PTS)
+			}
+
+			if frame.Keyframe {
+				keyframes++
+			}
+
+			video++
+		}
+
+		// the audio in front of the first keyframe is dropped by the writer,
+		// the one in front of the other keyframes ends the previous cluster
+		gops, audioFrames := 4, 11
+		if size < out.Len() {
+			gops, audioFrames = 3, 9
+		}
+
+		if video != 3*gops || audio != audioFrames || keyframes != gops {
+			t.Errorf("size %d: got %d video frames, %d keyframes and %d audio frames", size, video, keyframes, audio)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package mkv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"godvr/internal/dvrip"
+	"godvr/internal/nalu"
+)
+
+// maxElementSize limits the elements read into memory by Reader.
+const maxElementSize = 256 << 20
+
+// Reader reads back the frames of a Matroska file as written by Writer.
+// Video frames are returned in Annex B form with the parameter sets in front
+// of every keyframe, so they can be muxed again. A file cut short by a crash
+// reads up to its last complete cluster.
+type Reader struct {
+	r *fileReader
+
+	codec         string
+	vps, sps, pps []byte
+	video, audio  uint64 // track numbers
+
+	pending []*dvrip.Frame
+}
+
+// NewReader reads the header and the tracks of r.
+func NewReader(r io.Reader) (*Reader, error) {
+	reader := &Reader{r: &fileReader{r: bufio.NewReader(r)}}
+
+	h, err := readElementHeader(reader.r)
+	if err != nil || h.id != idEBML {
+		return nil, errors.New("mkv: not a Matroska file")
+	}
+
+	err = reader.r.skip(int64(h.size))
+	if err != nil {
+		return nil, err
+	}
+
+	h, err = readElementHeader(reader.r)
+	if err != nil || h.id != idSegment {
+		return nil, errors.New("mkv: segment not found")
+	}
+
+	for {
+		id, payload, err := reader.readElement()
+		if err != nil {
+			if err == io.EOF {
+				err = errors.New("mkv: tracks not found")
+			}
+
+			return nil, err
+		}
+
+		if id == idTracks {
+			err = reader.parseTracks(payload)
+			if err != nil {
+				return nil, err
+			}
+
+			return reader, nil
+		}
+	}
+}
+
+// Reset continues reading from r, e.g. the file after seeking to the start
+// of a cluster, keeping the tracks read by NewReader. Frames read but not
+// returned yet are dropped.
+func (r *Reader) Reset(rd io.Reader) {
+	r.r = &fileReader{r: bufio.NewReader(rd)}
+	r.pending = nil
+}
+
+// ReadFrame returns the next frame in stream order, the timestamps start at
+// the beginning of the file. It returns io.EOF at the end of the file.
+func (r *Reader) ReadFrame() (*dvrip.Frame, error) {
+	for len(r.pending) == 0 {
+		id, payload, err := r.readElement()
+		if err != nil {
+			return nil, err
+		}
+
+		if id != idCluster {
+			continue
+		}
+
+		err = r.parseCluster(payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	frame := r.pending[0]
+	r.pending[0] = nil
+	r.pending = r.pending[1:]
+
+	return frame, nil
+}
+
+// readElement reads the next child of the segment. An element that is cut
+// off ends the file.
+func (r *Reader) readElement() (uint32, []byte, error) {
+	h, err := readElementHeader(r.r)
+	if err == io.ErrUnexpectedEOF {
+		return 0, nil, io.EOF
+	}
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if h.unknown || h.size > maxElementSize {
+		return 0, nil, errors.New("mkv: unsupported element size")
+	}
+
+	if h.id != idTracks && h.id != idCluster {
+		err = r.r.skip(int64(h.size))
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	} else {
+		var payload []byte
+
+		payload, err = r.r.payload(int64(h.size))
+		if err == nil {
+			return h.id, payload, nil
+		}
+	}
+
+	if err == io.ErrUnexpectedEOF {
+		return 0, nil, io.EOF
+	}
+
+	return h.id, nil, err
+}
+
+func (r *Reader) parseTracks(b []byte) error {
+	err := walk(b, func(id uint32, _ int, entry []byte) error {
+		if id != idTrackEntry {
+			return nil
+		}
+
+		var (
+			number, typ uint64
+			codecID     string
+			private     []byte
+		)
+
+		err := walk(entry, func(id uint32, _ int, payload []byte) error {
+			switch id {
+			case idTrackNumber:
+				number = readUint(payload)
+			case idTrackType:
+				typ = readUint(payload)
+			case idCodecID:
+				codecID = string(payload)
+			case idCodecPrivate:
+				private = payload
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case typ == trackTypeVideo && codecID == "V_MPEG4/ISO/AVC":
+			r.codec = nalu.CodecH264
+		case typ == trackTypeVideo && codecID == "V_MPEGH/ISO/HEVC":
+			r.codec = nalu.CodecH265
+		case typ == trackTypeAudio && codecID == "A_MS/ACM" && len(private) >= 2 && binary.LittleEndian.Uint16(private) == 6:
+			r.audio = number
+			return nil
+		default:
+			return nil
+		}
+
+		r.video = number
+		r.vps, r.sps, r.pps, err = nalu.ParseConfig(r.codec, private)
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if r.video == 0 {
+		return errors.New("mkv: no supported video track")
+	}
+
+	return nil
+}
+
+func (r *Reader) parseCluster(b []byte) error {
+	var timecode int64
+
+	return walk(b, func(id uint32, _ int, payload []byte) error {
+		switch id {
+		case idTimecode:
+			timecode = int64(readUint(payload))
+		case idSimpleBlock:
+			if len(payload) < 4 || payload[0]&0x80 == 0 {
+				return errors.New("mkv: invalid block")
+			}
+
+			if payload[3]&0x06 != 0 {
+				return errors.New("mkv: laced blocks are not supported")
+			}
+
+			track := uint64(payload[0] & 0x7F)
+			t := timecode + int64(int16(binary.BigEndian.Uint16(payload[1:])))
+			data := payload[4:]
+
+			var frame *dvrip.Frame
+
+			switch track {
+			case r.video:
+				var err error
+
+				frame, err = r.videoFrame(data, payload[3]&0x80 != 0)
+				if err != nil {
+					return err
+				}
+			case r.audio:
+				frame = &dvrip.Frame{
+					Data:     append([]byte(nil), data...),
+					Meta:     dvrip.MetaInfo{Type: "G711A"},
+					Duration: time.Duration(len(data)) * time.Second / 8000,
+				}
+			default:
+				return nil
+			}
+
+			frame.PTS = time.Duration(t) * time.Millisecond
+			frame.DTS = frame.PTS
+
+			r.pending = append(r.pending, frame)
+		}
+
+		return nil
+	})
+}
+
+func (r *Reader) videoFrame(block []byte, keyframe bool) (*dvrip.Frame, error) {
+	data, err := nalu.AppendAnnexB(nil, block)
+	if err != nil {
+		return nil, err
+	}
+
+	frame := dvrip.NewVideoFrame(r.codec, data)
+	if !keyframe || frame.SPS != nil {
+		return frame, nil
+	}
+
+	var params []byte
+
+	for _, unit := range [][]byte{r.vps, r.sps, r.pps} {
+		if unit != nil {
+			params = append(params, 0, 0, 0, 1)
+			params = append(params, unit...)
+		}
+	}
+
+	return dvrip.NewVideoFrame(r.codec, append(params, data...)), nil
+}
@@ -0,0 +1,273 @@
+package mkv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// RepairFile repairs the Matroska file at path, see Repair.
+func RepairFile(path string) (bool, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+
+	repaired, err := Repair(f)
+	if err != nil {
+		f.Close()
+		return false, err
+	}
+
+	return repaired, f.Close()
+}
+
+// Repair completes a file written by Writer that was cut short, e.g. by a
+// power loss. A partially written cluster at the end is cut off, then the
+// cues are rebuilt from the remaining clusters and the seek head, duration
+// and segment size are filled in. It reports whether the file needed a
+// repair; files that were closed properly are left untouched.
+func Repair(f *os.File) (bool, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return false, err
+	}
+
+	r := &fileReader{r: bufio.NewReader(f)}
+
+	h, err := readElementHeader(r)
+	if err != nil || h.id != idEBML {
+		return false, errors.New("mkv: not a Matroska file")
+	}
+
+	err = r.skip(int64(h.size))
+	if err != nil {
+		return false, err
+	}
+
+	h, err = readElementHeader(r)
+	if err != nil || h.id != idSegment {
+		return false, errors.New("mkv: segment not found")
+	}
+
+	l := layout{segment: r.pos, seekHead: -1}
+
+	var (
+		end       = r.pos
+		complete  = true
+		finished  = false
+		cuesFound = false
+	)
+
+	for {
+		start := r.pos
+
+		h, err := readElementHeader(r)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil || h.unknown || start+int64(h.length)+int64(h.size) > stat.Size() {
+			complete = false
+			break
+		}
+
+		switch h.id {
+		case idVoid, idSeekHead:
+			if start == l.segment {
+				l.seekHead = start
+				finished = h.id == idSeekHead
+			}
+
+			err = r.skip(int64(h.size))
+		case idInfo:
+			l.info = start - l.segment
+			err = r.readInfo(&l, int64(h.size))
+		case idTracks:
+			l.tracks = start - l.segment
+			err = r.skip(int64(h.size))
+		case idCluster:
+			err = r.readCluster(&l, start-l.segment, int64(h.size))
+		case idCues:
+			cuesFound = true
+			err = r.skip(int64(h.size))
+		default:
+			err = r.skip(int64(h.size))
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		if h.id != idCues {
+			end = r.pos
+		}
+	}
+
+	if complete && cuesFound && finished {
+		return false, nil
+	}
+
+	if l.seekHead < 0 || l.tracks == 0 {
+		return false, errors.New("mkv: file was not written by this package")
+	}
+
+	err = f.Truncate(end)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = f.Seek(end, io.SeekStart)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = f.Write(cues(&l, end))
+	if err != nil {
+		return false, err
+	}
+
+	err = finish(f, &l, end)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// fileReader keeps track of the offset while reading a file.
+type fileReader struct {
+	r   *bufio.Reader
+	pos int64
+}
+
+func (r *fileReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.pos += int64(n)
+
+	return n, err
+}
+
+func (r *fileReader) skip(n int64) error {
+	m, err := io.CopyN(io.Discard, r.r, n)
+	r.pos += m
+
+	return err
+}
+
+func (r *fileReader) payload(size int64) ([]byte, error) {
+	b := make([]byte, size)
+
+	_, err := io.ReadFull(r, b)
+
+	return b, err
+}
+
+// readInfo finds the Duration element of the Info element.
+func (r *fileReader) readInfo(l *layout, size int64) error {
+	start := r.pos
+
+	b, err := r.payload(size)
+	if err != nil {
+		return err
+	}
+
+	return walk(b, func(id uint32, offset int, payload []byte) error {
+		if id == idDuration && len(payload) == 8 {
+			l.durationPos = start + int64(offset)
+		}
+
+		return nil
+	})
+}
+
+// readCluster adds a cue for a cluster starting with a video keyframe and
+// extends the duration to its last block.
+func (r *fileReader) readCluster(l *layout, position, size int64) error {
+	b, err := r.payload(size)
+	if err != nil {
+		return err
+	}
+
+	var (
+		timecode int64
+		first    = true
+	)
+
+	return walk(b, func(id uint32, _ int, payload []byte) error {
+		switch id {
+		case idTimecode:
+			timecode = int64(readUint(payload))
+		case idSimpleBlock:
+			if len(payload) < 4 || payload[0]&0x80 == 0 {
+				return fmt.Errorf("mkv: invalid block at cluster %v", position)
+			}
+
+			track := payload[0] & 0x7F
+			t := timecode + int64(int16(binary.BigEndian.Uint16(payload[1:])))
+
+			if first && track == videoTrack && payload[3]&0x80 != 0 {
+				l.cues = append(l.cues, cue{time: t, position: position})
+			}
+
+			if track == videoTrack {
+				first = false
+			}
+
+			if t > l.duration {
+				l.duration = t
+			}
+		}
+
+		return nil
+	})
+}
+
+// walk calls fn for each element in b with the offset of its payload.
+func walk(b []byte, fn func(id uint32, offset int, payload []byte) error) error {
+	r := &fileReader{r: bufio.NewReader(bytes.NewReader(b))}
+
+	for {
+		h, err := readElementHeader(r)
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		offset := int(r.pos)
+		if h.unknown || offset+int(h.size) > len(b) {
+			return errors.New("mkv: element exceeds its parent")
+		}
+
+		err = fn(h.id, offset, b[offset:offset+int(h.size)])
+		if err != nil {
+			return err
+		}
+
+		err = r.skip(int64(h.size))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func readUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+
+	return v
+}
@@ -0,0 +1,62 @@
+package mp4
+
+import "encoding/binary"
+
+// boxBuffer builds ISO BMFF boxes in memory. Boxes are opened with start,
+// which reserves the size field, and finished with end, which fills it in.
+type boxBuffer struct {
+	b []byte
+}
+
+func (b *boxBuffer) start(typ string) int {
+	pos := len(b.b)
+	b.u32(0)
+	b.b = append(b.b, typ...)
+
+	return pos
+}
+
+func (b *boxBuffer) startFull(typ string, version byte, flags uint32) int {
+	pos := b.start(typ)
+	b.u32(uint32(version)<<24 | flags&0xFFFFFF)
+
+	return pos
+}
+
+func (b *boxBuffer) end(pos int) {
+	binary.BigEndian.PutUint32(b.b[pos:], uint32(len(b.b)-pos))
+}
+
+func (b *boxBuffer) u8(v uint8) {
+	b.b = append(b.b, v)
+}
+
+func (b *boxBuffer) u16(v uint16) {
+	b.b = append(b.b, byte(v>>8), byte(v))
+}
+
+func (b *boxBuffer) u32(v uint32) {
+	b.b = append(b.b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (b *boxBuffer) u64(v uint64) {
+	b.u32(uint32(v >> 32))
+	b.u32(uint32(v))
+}
+
+func (b *boxBuffer) bytes(v []byte) {
+	b.b = append(b.b, v...)
+}
+
+func (b *boxBuffer) zeros(n int) {
+	for i := 0; i < n; i++ {
+		b.b = append(b.b, 0)
+	}
+}
+
+// matrix writes the unity transformation matrix of mvhd and tkhd.
+func (b *boxBuffer) matrix() {
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		b.u32(v)
+	}
+}
@@ -0,0 +1,23 @@
+package mp4
+
+import "bytes"
+
+// Capture collects the output of a Writer in memory. The Writer writes the
+// init segment and each fragment with a single call, so every entry of
+// Writes is one of them.
+type Capture struct {
+	Writes [][]byte
+}
+
+func (c *Capture) Write(b []byte) (int, error) {
+	c.Writes = append(c.Writes, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+// Take returns the writes joined together and clears them.
+func (c *Capture) Take() []byte {
+	b := bytes.Join(c.Writes, nil)
+	c.Writes = c.Writes[:0]
+
+	return b
+}
@@ -0,0 +1,104 @@
+package mp4
+
+import "encoding/binary"
+
+// fragment builds a moof box and the mdat box holding the samples of the
+// given tracks.
+func fragment(sequence uint32, tracks []*track) []byte {
+	var b boxBuffer
+
+	moof := b.start("moof")
+
+	mfhd := b.startFull("mfhd", 0, 0)
+	b.u32(sequence)
+	b.end(mfhd)
+
+	// positions of the trun data_offset fields, patched once the size of
+	// the moof box is known
+	offsets := make([]int, len(tracks))
+
+	for i, t := range tracks {
+		traf := b.start("traf")
+
+		tfhd := b.startFull("tfhd", 0, 0x020000) // default-base-is-moof
+		b.u32(t.id)
+		b.end(tfhd)
+
+		tfdt := b.startFull("tfdt", 1, 0)
+		b.u64(uint64(t.samples[0].dts))
+		b.end(tfdt)
+
+		// data-offset, sample-duration, sample-size and sample-flags present
+		trun := b.startFull("trun", 0, 0x000701)
+		b.u32(uint32(len(t.samples)))
+		offsets[i] = len(b.b)
+		b.u32(0)
+
+		for _, s := range t.samples {
+			b.u32(s.duration)
+			b.u32(s.size)
+
+			if s.sync {
+				b.u32(sampleFlagsSync)
+			} else {
+				b.u32(sampleFlagsNonSync)
+			}
+		}
+
+		b.end(trun)
+		b.end(traf)
+	}
+
+	b.end(moof)
+
+	size := 8
+	for _, t := range tracks {
+		size += len(t.data)
+	}
+
+	offset := len(b.b) + 8
+	for i, t := range tracks {
+		binary.BigEndian.PutUint32(b.b[offsets[i]:], uint32(offset))
+		offset += len(t.data)
+	}
+
+	b.u32(uint32(size))
+	b.bytes([]byte("mdat"))
+
+	for _, t := range tracks {
+		b.bytes(t.data)
+	}
+
+	return b.b
+}
+
+// fragmentIndex builds the mfra box listing the fragments that start with a
+// video keyframe, which lets players seek without scanning the file.
+func fragmentIndex(entries []fragmentEntry) []byte {
+	var b boxBuffer
+
+	mfra := b.start("mfra")
+
+	tfra := b.startFull("tfra", 1, 0)
+	b.u32(videoTrackID)
+	b.u32(0) // 1 byte traf, trun and sample numbers
+	b.u32(uint32(len(entries)))
+
+	for _, e := range entries {
+		b.u64(e.time)
+		b.u64(uint64(e.offset))
+		b.u8(1)
+		b.u8(1)
+		b.u8(1)
+	}
+
+	b.end(tfra)
+
+	mfro := b.startFull("mfro", 0, 0)
+	b.u32(uint32(len(b.b) + 4))
+	b.end(mfro)
+
+	b.end(mfra)
+
+	return b.b
+}
@@ -0,0 +1,195 @@
+package mp4
+
+import "godvr/internal/dvrip"
+
+// videoSampleEntry builds an avc1/hvc1 sample entry with its decoder
+// configuration box.
+func videoSampleEntry(typ, configType string, frame *dvrip.Frame, config func() ([]byte, error)) ([]byte, error) {
+	record, err := config()
+	if err != nil {
+		return nil, err
+	}
+
+	var b boxBuffer
+
+	entry := b.start(typ)
+	b.zeros(6)
+	b.u16(1) // data_reference_index
+	b.zeros(16)
+	b.u16(uint16(frame.Meta.Width))
+	b.u16(uint16(frame.Meta.Height))
+	b.u32(0x00480000) // 72 dpi
+	b.u32(0x00480000)
+	b.u32(0)
+	b.u16(1) // frame_count
+	b.zeros(32)
+	b.u16(0x0018) // depth
+	b.u16(0xFFFF)
+
+	box := b.start(configType)
+	b.bytes(record)
+	b.end(box)
+
+	b.end(entry)
+
+	return b.b, nil
+}
+
+func audioSampleEntry(b *boxBuffer) {
+	entry := b.start("alaw")
+	b.zeros(6)
+	b.u16(1) // data_reference_index
+	b.zeros(8)
+	b.u16(1)  // channelcount
+	b.u16(16) // samplesize
+	b.u32(0)
+	b.u32(audioTimescale << 16)
+	b.end(entry)
+}
+
+// initSegment builds the ftyp and moov boxes.
+func initSegment(width, height int, videoEntry []byte, audio bool) []byte {
+	var b boxBuffer
+
+	ftyp := b.start("ftyp")
+	b.bytes([]byte("iso6"))
+	b.u32(0)
+	b.bytes([]byte("iso6mp41dashiso5"))
+	b.end(ftyp)
+
+	moov := b.start("moov")
+
+	mvhd := b.startFull("mvhd", 0, 0)
+	b.u32(0)    // creation_time
+	b.u32(0)    // modification_time
+	b.u32(1000) // timescale
+	b.u32(0)    // duration, unknown for fragmented files
+	b.u32(0x00010000)
+	b.u16(0x0100)
+	b.zeros(10)
+	b.matrix()
+	b.zeros(24)
+	b.u32(audioTrackID + 1) // next_track_ID
+	b.end(mvhd)
+
+	trak(&b, videoTrackID, videoTimescale, width, height, func() {
+		vmhd := b.startFull("vmhd", 0, 1)
+		b.zeros(8)
+		b.end(vmhd)
+	}, func() {
+		b.bytes(videoEntry)
+	})
+
+	if audio {
+		trak(&b, audioTrackID, audioTimescale, 0, 0, func() {
+			smhd := b.startFull("smhd", 0, 0)
+			b.zeros(4)
+			b.end(smhd)
+		}, func() {
+			audioSampleEntry(&b)
+		})
+	}
+
+	mvex := b.start("mvex")
+	trex(&b, videoTrackID, sampleFlagsNonSync)
+	if audio {
+		trex(&b, audioTrackID, sampleFlagsSync)
+	}
+	b.end(mvex)
+
+	b.end(moov)
+
+	return b.b
+}
+
+func trak(b *boxBuffer, id, timescale uint32, width, height int, mediaHeader, sampleEntry func()) {
+	trak := b.start("trak")
+
+	tkhd := b.startFull("tkhd", 0, 7) // enabled, in movie, in preview
+	b.u32(0)
+	b.u32(0)
+	b.u32(id)
+	b.u32(0)
+	b.u32(0) // duration
+	b.zeros(8)
+	b.u16(0) // layer
+	b.u16(0) // alternate_group
+	if width == 0 {
+		b.u16(0x0100) // audio volume
+	} else {
+		b.u16(0)
+	}
+	b.u16(0)
+	b.matrix()
+	b.u32(uint32(width) << 16)
+	b.u32(uint32(height) << 16)
+	b.end(tkhd)
+
+	mdia := b.start("mdia")
+
+	mdhd := b.startFull("mdhd", 0, 0)
+	b.u32(0)
+	b.u32(0)
+	b.u32(timescale)
+	b.u32(0)
+	b.u16(0x55C4) // language "und"
+	b.u16(0)
+	b.end(mdhd)
+
+	hdlr := b.startFull("hdlr", 0, 0)
+	b.u32(0)
+	if width == 0 {
+		b.bytes([]byte("soun"))
+		b.zeros(12)
+		b.bytes([]byte("SoundHandler\x00"))
+	} else {
+		b.bytes([]byte("vide"))
+		b.zeros(12)
+		b.bytes([]byte("VideoHandler\x00"))
+	}
+	b.end(hdlr)
+
+	minf := b.start("minf")
+	mediaHeader()
+
+	dinf := b.start("dinf")
+	dref := b.startFull("dref", 0, 0)
+	b.u32(1)
+	url := b.startFull("url ", 0, 1) // media data is in the same file
+	b.end(url)
+	b.end(dref)
+	b.end(dinf)
+
+	stbl := b.start("stbl")
+
+	stsd := b.startFull("stsd", 0, 0)
+	b.u32(1)
+	sampleEntry()
+	b.end(stsd)
+
+	for _, typ := range []string{"stts", "stsc", "stco"} {
+		box := b.startFull(typ, 0, 0)
+		b.u32(0)
+		b.end(box)
+	}
+
+	stsz := b.startFull("stsz", 0, 0)
+	b.u32(0)
+	b.u32(0)
+	b.end(stsz)
+
+	b.end(stbl)
+	b.end(minf)
+	b.end(mdia)
+	b.end(trak)
+}
+
+func trex(b *boxBuffer, id, flags uint32) {
+	trex := b.startFull("trex", 0, 0)
+	b.u32(id)
+	b.u32(1) // default_sample_description_index
+	b.u32(0)
+	b.u32(0)
+	b.u32(flags)
+	b.end(trex)
+}
@@ -0,0 +1,318 @@
+// Package mp4 writes dvrip frame streams as fragmented MP4.
+//
+// The output starts with an init segment (ftyp and moov) followed by one
+// moof/mdat pair per fragment. Every fragment is written with a single call
+// to the underlying writer as soon as it is complete, so a file cut short by
+// a crash stays playable up to its last complete fragment.
+package mp4
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"godvr/internal/dvrip"
+	"godvr/internal/nalu"
+)
+
+const (
+	videoTimescale = 90000
+	audioTimescale = 8000
+
+	videoTrackID = 1
+	audioTrackID = 2
+
+	sampleFlagsSync    = 0x02000000
+	sampleFlagsNonSync = 0x01010000
+)
+
+// DefaultMaxFragmentDuration is used when Options.MaxFragmentDuration is
+// not set.
+const DefaultMaxFragmentDuration = 2 * time.Second
+
+type Options struct {
+	// Audio adds a G.711 A-law track even if no audio frame arrived before
+	// the first keyframe. Otherwise the track is only added if one did.
+	Audio bool
+
+	// MaxFragmentDuration starts a new fragment once the pending video
+	// exceeds it, even without a keyframe. Fragments always start at
+	// keyframes otherwise. A negative value puts every frame into a
+	// fragment of its own.
+	MaxFragmentDuration time.Duration
+
+	// NoIndex disables the mfra box written by Close.
+	NoIndex bool
+
+	// KeepTimestamps uses the frame timestamps as decode times instead of
+	// starting at zero, so the fragments written for parts of the same
+	// stream line up.
+	KeepTimestamps bool
+}
+
+// Writer muxes frames into a fragmented MP4 stream.
+type Writer struct {
+	w    io.Writer
+	opts Options
+
+	written  int64
+	started  bool
+	sawAudio bool
+	codec    string
+	sequence uint32
+
+	video *track
+	audio *track
+
+	// first timestamp of the file, all decode times are relative to it
+	origin time.Duration
+
+	index []fragmentEntry
+}
+
+type track struct {
+	id        uint32
+	timescale uint32
+
+	samples []sample
+	data    []byte
+
+	lastDTS int64
+	hasDTS  bool
+}
+
+type sample struct {
+	dts      int64
+	duration uint32
+	size     uint32
+	sync     bool
+}
+
+type fragmentEntry struct {
+	time   uint64
+	offset int64
+}
+
+var ErrClosed = errors.New("mp4: writer is closed")
+
+func NewWriter(w io.Writer, opts Options) *Writer {
+	if opts.MaxFragmentDuration == 0 {
+		opts.MaxFragmentDuration = DefaultMaxFragmentDuration
+	}
+
+	return &Writer{w: w, opts: opts}
+}
+
+// Started reports whether the init segment has been written, which happens
+// at the first keyframe that carries parameter sets.
+func (w *Writer) Started() bool {
+	return w.started
+}
+
+// WriteFrame adds a frame to the current fragment. Video frames before the
+// first keyframe and frames of unsupported codecs are dropped. The frame may
+// be released as soon as WriteFrame returns.
+func (w *Writer) WriteFrame(frame *dvrip.Frame) error {
+	if w.w == nil {
+		return ErrClosed
+	}
+
+	isVideo := frame.Meta.Frame != ""
+	isAudio := frame.Meta.Type == "G711A"
+
+	if !w.started {
+		if isAudio {
+			w.sawAudio = true
+		}
+
+		if !isVideo || !frame.Keyframe {
+			return nil
+		}
+
+		err := w.start(frame)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case isVideo:
+		if frame.Meta.Type != w.codec {
+			return nil
+		}
+
+		if frame.Keyframe && len(w.video.samples) > 0 {
+			err := w.Flush()
+			if err != nil {
+				return err
+			}
+		}
+
+		w.video.add(frame, w.origin, nalu.AppendLengthPrefixed(w.video.data, w.codec, frame.NALUs))
+
+		if w.pendingDuration() >= w.opts.MaxFragmentDuration {
+			return w.Flush()
+		}
+	case isAudio && w.audio != nil:
+		w.audio.add(frame, w.origin, append(w.audio.data, frame.Data...))
+	}
+
+	return nil
+}
+
+func (w *Writer) start(frame *dvrip.Frame) error {
+	codec := frame.Meta.Type
+
+	var (
+		entry []byte
+		err   error
+	)
+
+	switch codec {
+	case nalu.CodecH264:
+		entry, err = videoSampleEntry("avc1", "avcC", frame, func() ([]byte, error) {
+			return nalu.AVCConfig(frame.SPS, frame.PPS)
+		})
+	case nalu.CodecH265:
+		entry, err = videoSampleEntry("hvc1", "hvcC", frame, func() ([]byte, error) {
+			return nalu.HEVCConfig(frame.VPS, frame.SPS, frame.PPS)
+		})
+	default:
+		return nil
+	}
+
+	if err != nil {
+		// keep waiting for a keyframe with complete parameter sets
+		return nil
+	}
+
+	w.codec = codec
+
+	if !w.opts.KeepTimestamps {
+		w.origin = frame.DTS
+	}
+	w.video = &track{id: videoTrackID, timescale: videoTimescale}
+
+	if w.opts.Audio || w.sawAudio {
+		w.audio = &track{id: audioTrackID, timescale: audioTimescale}
+	}
+
+	init := initSegment(frame.Meta.Width, frame.Meta.Height, entry, w.audio != nil)
+
+	err = w.write(init)
+	if err != nil {
+		return err
+	}
+
+	w.started = true
+
+	return nil
+}
+
+func (t *track) add(frame *dvrip.Frame, origin time.Duration, data []byte) {
+	dts := int64(frame.DTS-origin) * int64(t.timescale) / int64(time.Second)
+	if dts < 0 {
+		dts = 0
+	}
+
+	if t.hasDTS && dts <= t.lastDTS {
+		dts = t.lastDTS + 1
+	}
+
+	duration := uint32(int64(frame.Duration) * int64(t.timescale) / int64(time.Second))
+
+	// the previous sample lasts until this one starts
+	if n := len(t.samples); n > 0 {
+		t.samples[n-1].duration = uint32(dts - t.samples[n-1].dts)
+	}
+
+	t.samples = append(t.samples, sample{
+		dts:      dts,
+		duration: duration,
+		size:     uint32(len(data) - len(t.data)),
+		sync:     frame.Keyframe || frame.Meta.Frame == "",
+	})
+
+	t.data = data
+	t.lastDTS = dts
+	t.hasDTS = true
+}
+
+func (t *track) reset() {
+	t.samples = t.samples[:0]
+	t.data = t.data[:0]
+}
+
+func (w *Writer) pendingDuration() time.Duration {
+	samples := w.video.samples
+	if len(samples) == 0 {
+		return 0
+	}
+
+	last := samples[len(samples)-1]
+	ticks := last.dts + int64(last.duration) - samples[0].dts
+
+	return time.Duration(ticks * int64(time.Second) / videoTimescale)
+}
+
+// Flush writes the pending frames as a fragment.
+func (w *Writer) Flush() error {
+	if !w.started {
+		return nil
+	}
+
+	var tracks []*track
+	for _, t := range []*track{w.video, w.audio} {
+		if t != nil && len(t.samples) > 0 {
+			tracks = append(tracks, t)
+		}
+	}
+
+	if len(tracks) == 0 {
+		return nil
+	}
+
+	w.sequence++
+
+	if w.video != nil && len(w.video.samples) > 0 && w.video.samples[0].sync {
+		w.index = append(w.index, fragmentEntry{
+			time:   uint64(w.video.samples[0].dts),
+			offset: w.written,
+		})
+	}
+
+	err := w.write(fragment(w.sequence, tracks))
+	if err != nil {
+		return err
+	}
+
+	for _, t := range tracks {
+		t.reset()
+	}
+
+	return nil
+}
+
+// Close flushes the last fragment and writes the fragment index. It does
+// not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.w == nil {
+		return ErrClosed
+	}
+
+	err := w.Flush()
+	if err == nil && w.started && !w.opts.NoIndex {
+		err = w.write(fragmentIndex(w.index))
+	}
+
+	w.w = nil
+
+	return err
+}
+
+func (w *Writer) write(b []byte) error {
+	n, err := w.w.Write(b)
+	w.written += int64(n)
+
+	return err
+}
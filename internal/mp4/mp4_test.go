@@ -0,0 +1,201 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"godvr/internal/dvrip"
+	"godvr/internal/mediatest"
+)
+
+type box struct {
+	typ  string
+	data []byte
+}
+
+func parseBoxes(t *testing.T, b []byte) []box {
+	var boxes []box
+
+	for len(b) > 0 {
+		if len(b) < 8 {
+			t.Fatalf("truncated box header: %x", b)
+		}
+
+		size := int(binary.BigEndian.Uint32(b))
+		if size < 8 || size > len(b) {
+			t.Fatalf("invalid %q box size %d, %d bytes left", b[4:8], size, len(b))
+		}
+
+		boxes = append(boxes, box{typ: string(b[4:8]), data: b[8:size]})
+		b = b[size:]
+	}
+
+	return boxes
+}
+
+func boxTypes(boxes []box) []string {
+	var types []string
+	for _, b := range boxes {
+		types = append(types, b.typ)
+	}
+
+	return types
+}
+
+func find(t *testing.T, boxes []box, path ...string) box {
+	for _, b := range boxes {
+		if b.typ != path[0] {
+			continue
+		}
+
+		if len(path) == 1 {
+			return b
+		}
+
+		return find(t, parseBoxes(t, b.data), path[1:]...)
+	}
+
+	t.Fatalf("box %v not found", path)
+
+	return box{}
+}
+
+func TestWriter(t *testing.T) {
+	var out bytes.Buffer
+
+	w := NewWriter(&out, Options{})
+
+	frames := []*dvrip.Frame{
+		mediatest.AudioFrame(0),
+		mediatest.VideoFrame(false, 0, 0), // dropped, there is no keyframe yet
+		mediatest.VideoFrame(true, 40*time.Millisecond, 0),
+		mediatest.AudioFrame(40 * time.Millisecond),
+		mediatest.VideoFrame(false, 80*time.Millisecond, 0),
+		mediatest.VideoFrame(true, 120*time.Millisecond, 0),
+		mediatest.AudioFrame(120 * time.Millisecond),
+		mediatest.VideoFrame(false, 160*time.Millisecond, 0),
+	}
+
+	for _, frame := range frames {
+		if err := w.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	boxes := parseBoxes(t, out.Bytes())
+	expected := []string{"ftyp", "moov", "moof", "mdat", "moof", "mdat", "mfra"}
+
+	if got := boxTypes(boxes); !equal(got, expected) {
+		t.Fatalf("got boxes %v, expected %v", got, expected)
+	}
+
+	moov := parseBoxes(t, boxes[1].data)
+	if got := boxTypes(moov); !equal(got, []string{"mvhd", "trak", "trak", "mvex"}) {
+		t.Errorf("got moov children %v", got)
+	}
+
+	avcC := find(t, moov, "trak", "mdia", "minf", "stbl", "stsd")
+	if !bytes.Contains(avcC.data, mediatest.SPS) || !bytes.Contains(avcC.data, []byte("avcC")) {
+		t.Error("sample entry does not carry the SPS")
+	}
+
+	// the first fragment holds the keyframe and the following P-frame
+	moof := parseBoxes(t, boxes[2].data)
+	trun := find(t, moof, "traf", "trun")
+	if count := binary.BigEndian.Uint32(trun.data[4:]); count != 2 {
+		t.Errorf("got %d video samples in the first fragment, expected 2", count)
+	}
+
+	offset := binary.BigEndian.Uint32(trun.data[8:])
+	firstSize := binary.BigEndian.Uint32(trun.data[16:])
+	fragment := out.Bytes()[len(boxes[0].data)+8+len(boxes[1].data)+8:]
+	sample := fragment[offset : offset+firstSize]
+
+	// parameter sets are stripped, the IDR slice is length prefixed
+	if !bytes.Equal(sample, []byte{0, 0, 0, 2, 0x65, 0x88}) {
+		t.Errorf("unexpected first sample %x", sample)
+	}
+
+	tfdt := find(t, parseBoxes(t, boxes[4].data), "traf", "tfdt")
+	if dts := binary.BigEndian.Uint64(tfdt.data[4:]); dts != 80*videoTimescale/1000 {
+		t.Errorf("got second fragment decode time %d", dts)
+	}
+}
+
+func TestWriterWaitsForParameterSets(t *testing.T) {
+	var out bytes.Buffer
+
+	w := NewWriter(&out, Options{})
+
+	frame := mediatest.VideoFrame(true, 0, 0)
+	frame.SPS, frame.PPS = nil, nil
+
+	if err := w.WriteFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Started() || out.Len() != 0 {
+		t.Error("writer started without parameter sets")
+	}
+}
+
+func TestWriterKeepTimestamps(t *testing.T) {
+	var out bytes.Buffer
+
+	w := NewWriter(&out, Options{KeepTimestamps: true, NoIndex: true})
+
+	for _, frame := range []*dvrip.Frame{mediatest.VideoFrame(true, 10*time.Second, 0), mediatest.VideoFrame(false, 10*time.Second+40*time.Millisecond, 0)} {
+		if err := w.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tfdt := find(t, parseBoxes(t, parseBoxes(t, out.Bytes())[2].data), "traf", "tfdt")
+	if dts := binary.BigEndian.Uint64(tfdt.data[4:]); dts != 10*videoTimescale {
+		t.Errorf("got decode time %d, expected %d", dts, 10*videoTimescale)
+	}
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestCapture(t *testing.T) {
+	var c Capture
+
+	w := NewWriter(&c, Options{NoIndex: true})
+	w.WriteFrame(mediatest.VideoFrame(true, 0, 0))
+	w.WriteFrame(mediatest.VideoFrame(false, 40*time.Millisecond, 0))
+	w.WriteFrame(mediatest.VideoFrame(true, 80*time.Millisecond, 0))
+	w.Close()
+
+	// the init segment and two fragments
+	if len(c.Writes) != 3 || string(c.Writes[0][4:8]) != "ftyp" || string(c.Writes[1][4:8]) != "moof" {
+		t.Fatalf("got %d writes", len(c.Writes))
+	}
+
+	size := len(c.Writes[0]) + len(c.Writes[1]) + len(c.Writes[2])
+	if b := c.Take(); len(b) != size || len(c.Writes) != 0 {
+		t.Errorf("got %d bytes and %d writes left", len(b), len(c.Writes))
+	}
+}
@@ -0,0 +1,554 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"godvr/internal/dvrip"
+	"godvr/internal/nalu"
+)
+
+// maxBoxSize limits the boxes read into memory by Reader.
+const maxBoxSize = 256 << 20
+
+var errInvalidBox = errors.New("mp4: invalid box")
+
+// Reader reads back the frames of a fragmented MP4 file as written by
+// Writer. Video frames are returned in Annex B form with the parameter sets
+// in front of every keyframe, so they can be muxed again.
+type Reader struct {
+	r      io.Reader
+	tracks map[uint32]*readTrack
+
+	codec         string
+	vps, sps, pps []byte
+
+	pending []*dvrip.Frame
+}
+
+type readTrack struct {
+	timescale uint32
+	video     bool
+	audio     bool
+
+	defaultDuration uint32
+	defaultSize     uint32
+	defaultFlags    uint32
+}
+
+// NewReader reads the init segment of r.
+func NewReader(r io.Reader) (*Reader, error) {
+	reader := &Reader{r: r, tracks: map[uint32]*readTrack{}}
+
+	for {
+		typ, box, err := reader.readBox()
+		if err != nil {
+			if err == io.EOF {
+				err = errors.New("mp4: moov box not found")
+			}
+
+			return nil, err
+		}
+
+		if typ == "moov" {
+			err = reader.parseMoov(box[8:])
+			if err != nil {
+				return nil, err
+			}
+
+			return reader, nil
+		}
+	}
+}
+
+// Reset continues reading from r, e.g. the file after seeking to the start
+// of a fragment, keeping the tracks read by NewReader. Frames read but not
+// returned yet are dropped.
+func (r *Reader) Reset(rd io.Reader) {
+	r.r = rd
+	r.pending = nil
+}
+
+// ReadFrame returns the next frame in decoding order, the timestamps start
+// at the beginning of the file. It returns io.EOF at the end of the file.
+func (r *Reader) ReadFrame() (*dvrip.Frame, error) {
+	for len(r.pending) == 0 {
+		typ, box, err := r.readBox()
+		if err != nil {
+			return nil, err
+		}
+
+		if typ != "moof" {
+			continue
+		}
+
+		typ, mdat, err := r.readBox()
+		if err == io.EOF || err == nil && typ != "mdat" {
+			return nil, errors.New("mp4: moof without mdat")
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		// data offsets are relative to the start of the moof box
+		err = r.parseFragment(box, append(box, mdat...))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	frame := r.pending[0]
+	r.pending[0] = nil
+	r.pending = r.pending[1:]
+
+	return frame, nil
+}
+
+// readBox reads a whole top level box including its header.
+func (r *Reader) readBox() (string, []byte, error) {
+	var header [8]byte
+
+	_, err := io.ReadFull(r.r, header[:])
+	if err != nil {
+		return "", nil, err
+	}
+
+	size := uint64(binary.BigEndian.Uint32(header[:]))
+	typ := string(header[4:])
+	headerSize := uint64(8)
+
+	var large [8]byte
+
+	if size == 1 {
+		_, err = io.ReadFull(r.r, large[:])
+		if err != nil {
+			return "", nil, io.ErrUnexpectedEOF
+		}
+
+		size = binary.BigEndian.Uint64(large[:])
+		headerSize = 16
+	}
+
+	if size == 0 {
+		// the box extends to the end of the file, only mdat does that
+		rest, err := io.ReadAll(r.r)
+		if err != nil {
+			return "", nil, err
+		}
+
+		return typ, append(header[:], rest...), nil
+	}
+
+	if size < headerSize || size > maxBoxSize {
+		return "", nil, fmt.Errorf("mp4: %q box of %d bytes", typ, size)
+	}
+
+	box := make([]byte, size)
+	copy(box, header[:])
+
+	if headerSize == 16 {
+		copy(box[8:], large[:])
+	}
+
+	_, err = io.ReadFull(r.r, box[headerSize:])
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return "", nil, err
+	}
+
+	return typ, box, nil
+}
+
+// children calls fn for each box in b with its payload.
+func children(b []byte, fn func(typ string, payload []byte) error) error {
+	for len(b) > 0 {
+		if len(b) < 8 {
+			return errInvalidBox
+		}
+
+		size := binary.BigEndian.Uint32(b)
+		if size < 8 || int(size) > len(b) {
+			return errInvalidBox
+		}
+
+		err := fn(string(b[4:8]), b[8:size])
+		if err != nil {
+			return err
+		}
+
+		b = b[size:]
+	}
+
+	return nil
+}
+
+func (r *Reader) parseMoov(b []byte) error {
+	err := children(b, func(typ string, payload []byte) error {
+		switch typ {
+		case "trak":
+			return r.parseTrak(payload)
+		case "mvex":
+			return children(payload, func(typ string, payload []byte) error {
+				if typ != "trex" || len(payload) < 24 {
+					return nil
+				}
+
+				if t, ok := r.tracks[binary.BigEndian.Uint32(payload[4:])]; ok {
+					t.defaultDuration = binary.BigEndian.Uint32(payload[12:])
+					t.defaultSize = binary.BigEndian.Uint32(payload[16:])
+					t.defaultFlags = binary.BigEndian.Uint32(payload[20:])
+				}
+
+				return nil
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if r.codec == "" {
+		return errors.New("mp4: no H.264 or H.265 track")
+	}
+
+	return nil
+}
+
+func (r *Reader) parseTrak(b []byte) error {
+	var (
+		id    uint32
+		track readTrack
+	)
+
+	var walk func(typ string, payload []byte) error
+	walk = func(typ string, payload []byte) error {
+		switch typ {
+		case "mdia", "minf", "stbl":
+			return children(payload, walk)
+		case "tkhd":
+			if len(payload) < 16 {
+				return errInvalidBox
+			}
+
+			if payload[0] == 1 {
+				if len(payload) < 24 {
+					return errInvalidBox
+				}
+
+				id = binary.BigEndian.Uint32(payload[20:])
+			} else {
+				id = binary.BigEndian.Uint32(payload[12:])
+			}
+		case "mdhd":
+			if len(payload) < 24 {
+				return errInvalidBox
+			}
+
+			if payload[0] == 1 {
+				if len(payload) < 36 {
+					return errInvalidBox
+				}
+
+				track.timescale = binary.BigEndian.Uint32(payload[20:])
+			} else {
+				track.timescale = binary.BigEndian.Uint32(payload[12:])
+			}
+		case "stsd":
+			if len(payload) < 8 {
+				return errInvalidBox
+			}
+
+			return children(payload[8:], func(typ string, entry []byte) error {
+				return r.parseSampleEntry(&track, typ, entry)
+			})
+		}
+
+		return nil
+	}
+
+	err := children(b, walk)
+	if err != nil {
+		return err
+	}
+
+	if (track.video || track.audio) && track.timescale > 0 {
+		r.tracks[id] = &track
+	}
+
+	return nil
+}
+
+// visualSampleEntrySize is the size of the fields of avc1 and hvc1 before
+// their child boxes.
+const visualSampleEntrySize = 78
+
+func (r *Reader) parseSampleEntry(track *readTrack, typ string, entry []byte) error {
+	var codec, configType string
+
+	switch typ {
+	case "avc1", "avc3":
+		codec, configType = nalu.CodecH264, "avcC"
+	case "hvc1", "hev1":
+		codec, configType = nalu.CodecH265, "hvcC"
+	case "alaw":
+		track.audio = true
+		return nil
+	default:
+		return nil
+	}
+
+	if len(entry) < visualSampleEntrySize || r.codec != "" {
+		return nil
+	}
+
+	return children(entry[visualSampleEntrySize:], func(typ string, payload []byte) error {
+		if typ != configType {
+			return nil
+		}
+
+		vps, sps, pps, err := nalu.ParseConfig(codec, payload)
+		if err != nil {
+			return err
+		}
+
+		r.codec = codec
+		r.vps, r.sps, r.pps = vps, sps, pps
+		track.video = true
+
+		return nil
+	})
+}
+
+// parseFragment queues the samples of a moof box, data holds the moof box
+// followed by its mdat box.
+func (r *Reader) parseFragment(moof, data []byte) error {
+	err := children(moof[8:], func(typ string, payload []byte) error {
+		if typ == "traf" {
+			return r.parseTraf(payload, data)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(r.pending, func(i, j int) bool {
+		return r.pending[i].DTS < r.pending[j].DTS
+	})
+
+	return nil
+}
+
+func (r *Reader) parseTraf(b, data []byte) error {
+	var (
+		track    *readTrack
+		duration uint32
+		size     uint32
+		flags    uint32
+		dts      uint64
+		base     uint64
+	)
+
+	return children(b, func(typ string, payload []byte) error {
+		switch typ {
+		case "tfhd":
+			if len(payload) < 8 {
+				return errInvalidBox
+			}
+
+			tfhdFlags := binary.BigEndian.Uint32(payload) & 0xFFFFFF
+
+			var ok bool
+			track, ok = r.tracks[binary.BigEndian.Uint32(payload[4:])]
+			if !ok {
+				return nil
+			}
+
+			duration, size, flags = track.defaultDuration, track.defaultSize, track.defaultFlags
+
+			p := payload[8:]
+			fields := []struct {
+				flag uint32
+				n    int
+				v    *uint32
+			}{
+				{0x01, 8, nil},
+				{0x02, 4, nil},
+				{0x08, 4, &duration},
+				{0x10, 4, &size},
+				{0x20, 4, &flags},
+			}
+
+			for _, f := range fields {
+				if tfhdFlags&f.flag == 0 {
+					continue
+				}
+
+				if len(p) < f.n {
+					return errInvalidBox
+				}
+
+				if f.flag == 0x01 {
+					base = binary.BigEndian.Uint64(p)
+				} else if f.v != nil {
+					*f.v = binary.BigEndian.Uint32(p)
+				}
+
+				p = p[f.n:]
+			}
+		case "tfdt":
+			if len(payload) < 8 {
+				return errInvalidBox
+			}
+
+			if payload[0] == 1 {
+				if len(payload) < 12 {
+					return errInvalidBox
+				}
+
+				dts = binary.BigEndian.Uint64(payload[4:])
+			} else {
+				dts = uint64(binary.BigEndian.Uint32(payload[4:]))
+			}
+		case "trun":
+			if track == nil {
+				return nil
+			}
+
+			var err error
+
+			dts, err = r.parseTrun(payload, data, track, base, dts, duration, size, flags)
+
+			return err
+		}
+
+		return nil
+	})
+}
+
+func (r *Reader) parseTrun(b, data []byte, track *readTrack, base, dts uint64, duration, size, flags uint32) (uint64, error) {
+	if len(b) < 8 {
+		return dts, errInvalidBox
+	}
+
+	trunFlags := binary.BigEndian.Uint32(b) & 0xFFFFFF
+	count := binary.BigEndian.Uint32(b[4:])
+	b = b[8:]
+
+	offset := base
+
+	if trunFlags&0x01 != 0 {
+		if len(b) < 4 {
+			return dts, errInvalidBox
+		}
+
+		offset += uint64(int32(binary.BigEndian.Uint32(b)))
+		b = b[4:]
+	}
+
+	firstFlags, hasFirstFlags := uint32(0), trunFlags&0x04 != 0
+	if hasFirstFlags {
+		if len(b) < 4 {
+			return dts, errInvalidBox
+		}
+
+		firstFlags = binary.BigEndian.Uint32(b)
+		b = b[4:]
+	}
+
+	for i := uint32(0); i < count; i++ {
+		sampleDuration, sampleSize, sampleFlags := duration, size, flags
+		var cto int64
+
+		for _, f := range []uint32{0x100, 0x200, 0x400, 0x800} {
+			if trunFlags&f == 0 {
+				continue
+			}
+
+			if len(b) < 4 {
+				return dts, errInvalidBox
+			}
+
+			v := binary.BigEndian.Uint32(b)
+			b = b[4:]
+
+			switch f {
+			case 0x100:
+				sampleDuration = v
+			case 0x200:
+				sampleSize = v
+			case 0x400:
+				sampleFlags = v
+			case 0x800:
+				cto = int64(int32(v))
+			}
+		}
+
+		if i == 0 && hasFirstFlags {
+			sampleFlags = firstFlags
+		}
+
+		if offset+uint64(sampleSize) > uint64(len(data)) {
+			return dts, errors.New("mp4: sample exceeds the mdat box")
+		}
+
+		sample := data[offset : offset+uint64(sampleSize)]
+		offset += uint64(sampleSize)
+
+		frame, err := r.frame(track, sample, sampleFlags&0x00010000 == 0)
+		if err != nil {
+			return dts, err
+		}
+
+		scale := func(v int64) time.Duration {
+			return time.Duration(v * int64(time.Second) / int64(track.timescale))
+		}
+
+		frame.DTS = scale(int64(dts))
+		frame.PTS = scale(int64(dts) + cto)
+		frame.Duration = scale(int64(sampleDuration))
+
+		r.pending = append(r.pending, frame)
+		dts += uint64(sampleDuration)
+	}
+
+	return dts, nil
+}
+
+func (r *Reader) frame(track *readTrack, sample []byte, sync bool) (*dvrip.Frame, error) {
+	if track.audio {
+		return &dvrip.Frame{
+			Data: append([]byte(nil), sample...),
+			Meta: dvrip.MetaInfo{Type: "G711A"},
+		}, nil
+	}
+
+	var data []byte
+
+	if sync {
+		for _, unit := range [][]byte{r.vps, r.sps, r.pps} {
+			if unit != nil {
+				data = append(data, 0, 0, 0, 1)
+				data = append(data, unit...)
+			}
+		}
+	}
+
+	data, err := nalu.AppendAnnexB(data, sample)
+	if err != nil {
+		return nil, err
+	}
+
+	return dvrip.NewVideoFrame(r.codec, data), nil
+}
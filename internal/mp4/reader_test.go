@@ -0,0 +1,77 @@
+package mp4
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"godvr/internal/dvrip"
+	"godvr/internal/mediatest"
+)
+
+func TestReader(t *testing.T) {
+	var out bytes.Buffer
+
+	w := NewWriter(&out, Options{Audio: true})
+
+	for i := 0; i < 6; i++ {
+		pts := time.Duration(i) * 40 * time.Millisecond
+
+		for _, frame := range []*dvrip.Frame{mediatest.VideoFrame(i%3 == 0, pts, 0), mediatest.AudioFrame(pts)} {
+			if err := w.WriteFrame(frame); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var video, audio, keyframes int
+
+	for {
+		frame, err := r.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if frame.Meta.Type == "G711A" {
+			audio++
+			continue
+		}
+
+		expected := mediatest.VideoFrame(frame.Keyframe, 0, 0)
+		if !bytes.Equal(frame.Data, expected.Data) {
+			t.Errorf("frame %d: got %x, expected %x", video, frame.Data, expected.Data)
+		}
+
+		if frame.DTS != time.Duration(video)*40*time.Millisecond {
+			t.Errorf("frame %d: got dts %v", video, frame.DTS)
+		}
+
+		if frame.Keyframe {
+			keyframes++
+
+			if frame.Meta.Width != 1920 || frame.Meta.Height != 1080 {
+				t.Errorf("got resolution %dx%d", frame.Meta.Width, frame.Meta.Height)
+			}
+		}
+
+		video++
+	}
+
+	if video != 6 || audio != 6 || keyframes != 2 {
+		t.Errorf("got %d video frames, %d keyframes and %d audio frames", video, keyframes, audio)
+	}
+}
@@ -0,0 +1,200 @@
+// Package mpegts writes dvrip frame streams as MPEG transport streams.
+//
+// The stream carries a single program with an H.264/H.265 video PID that
+// also carries the PCR and an optional G.711 A-law audio PID. PAT and PMT are
+// repeated in front of every keyframe, so the output can be cut into
+// independently decodable segments at keyframes.
+package mpegts
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"godvr/internal/dvrip"
+	"godvr/internal/nalu"
+)
+
+const (
+	packetSize = 188
+
+	pidPAT   = 0x0000
+	pidPMT   = 0x1000
+	pidVideo = 0x0100
+	pidAudio = 0x0101
+
+	streamTypeH264 = 0x1B
+	streamTypeH265 = 0x24
+	// there is no ISO stream type for G.711, 0x90 is the one used by
+	// surveillance equipment and understood by common demuxers
+	streamTypeG711A = 0x90
+
+	streamIDVideo = 0xE0
+	streamIDAudio = 0xC0
+
+	clockRate = 90000
+
+	// timestamps start at one second so that the PCR, which runs slightly
+	// ahead of them, never has to be negative
+	timestampOffset = clockRate
+	pcrDelay        = clockRate / 10
+
+	timestampMask = 1<<33 - 1
+)
+
+type Options struct {
+	// Audio adds the audio PID even if no audio frame arrived before the
+	// first keyframe.
+	Audio bool
+}
+
+// Writer muxes frames into a transport stream.
+type Writer struct {
+	w    io.Writer
+	opts Options
+
+	started  bool
+	sawAudio bool
+	audio    bool
+	codec    string
+	origin   time.Duration
+
+	continuity map[uint16]byte
+
+	buf []byte
+}
+
+var ErrClosed = errors.New("mpegts: writer is closed")
+
+func NewWriter(w io.Writer, opts Options) *Writer {
+	return &Writer{
+		w:          w,
+		opts:       opts,
+		continuity: map[uint16]byte{},
+	}
+}
+
+// Started reports whether the first keyframe has been written.
+func (w *Writer) Started() bool {
+	return w.started
+}
+
+// WriteFrame writes a frame as one PES packet. Frames before the first
+// keyframe and frames of unsupported codecs are dropped. Each frame is
+// written with a single call to the underlying writer.
+func (w *Writer) WriteFrame(frame *dvrip.Frame) error {
+	if w.w == nil {
+		return ErrClosed
+	}
+
+	isVideo := frame.Meta.Frame != ""
+	isAudio := frame.Meta.Type == "G711A"
+
+	if !w.started {
+		if isAudio {
+			w.sawAudio = true
+		}
+
+		if !isVideo || !frame.Keyframe {
+			return nil
+		}
+
+		switch frame.Meta.Type {
+		case nalu.CodecH264, nalu.CodecH265:
+		default:
+			return nil
+		}
+
+		w.started = true
+		w.codec = frame.Meta.Type
+		w.origin = frame.DTS
+		w.audio = w.opts.Audio || w.sawAudio
+	}
+
+	w.buf = w.buf[:0]
+
+	switch {
+	case isVideo:
+		if frame.Meta.Type != w.codec {
+			return nil
+		}
+
+		if frame.Keyframe {
+			w.writeTables()
+		}
+
+		pts := w.timestamp(frame.PTS)
+		w.writePES(pidVideo, streamIDVideo, pts, w.videoPayload(frame), true, frame.Keyframe)
+	case isAudio && w.audio:
+		pts := w.timestamp(frame.PTS)
+		w.writePES(pidAudio, streamIDAudio, pts, frame.Data, false, false)
+	default:
+		return nil
+	}
+
+	_, err := w.w.Write(w.buf)
+
+	return err
+}
+
+// Close stops the writer. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.w == nil {
+		return ErrClosed
+	}
+
+	w.w = nil
+
+	return nil
+}
+
+// timestamp converts a frame timestamp to the 33 bit 90kHz clock, which
+// wraps around after about 26.5 hours.
+func (w *Writer) timestamp(pts time.Duration) uint64 {
+	ticks := int64(pts-w.origin)*clockRate/int64(time.Second) + timestampOffset
+	if ticks < 0 {
+		ticks = 0
+	}
+
+	return uint64(ticks) & timestampMask
+}
+
+// videoPayload returns the frame as an Annex B access unit that starts with
+// an access unit delimiter, as required by the H.264/H.265 TS mappings.
+func (w *Writer) videoPayload(frame *dvrip.Frame) []byte {
+	var aud []byte
+
+	switch w.codec {
+	case nalu.CodecH264:
+		aud = []byte{0, 0, 0, 1, 0x09, 0xF0}
+	case nalu.CodecH265:
+		aud = []byte{0, 0, 0, 1, 0x46, 0x01, 0x50}
+	}
+
+	units := frame.NALUs
+	if units == nil {
+		units = nalu.Split(frame.Data)
+	}
+
+	payload := make([]byte, 0, len(aud)+len(frame.Data)+4*len(units))
+	payload = append(payload, aud...)
+
+	for _, unit := range units {
+		if isAUD(w.codec, unit) {
+			continue
+		}
+
+		payload = append(payload, 0, 0, 0, 1)
+		payload = append(payload, unit...)
+	}
+
+	return payload
+}
+
+func isAUD(codec string, unit []byte) bool {
+	if codec == nalu.CodecH264 {
+		return nalu.H264Type(unit) == nalu.H264AUD
+	}
+
+	return nalu.H265Type(unit) == nalu.H265AUD
+}
@@ -0,0 +1,237 @@
+package mpegts
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"godvr/internal/dvrip"
+	"godvr/internal/mediatest"
+)
+
+type pes struct {
+	pid          uint16
+	data         []byte
+	randomAccess bool
+	pcr          bool
+}
+
+// demux reassembles the PES packets and sections of a transport stream and
+// checks the packet framing and continuity counters on the way.
+func demux(t *testing.T, b []byte) []pes {
+	if len(b)%packetSize != 0 {
+		t.Fatalf("stream length %d is not a multiple of %d", len(b), packetSize)
+	}
+
+	var out []pes
+	continuity := map[uint16]int{}
+
+	for ; len(b) > 0; b = b[packetSize:] {
+		p := b[:packetSize]
+		if p[0] != 0x47 {
+			t.Fatalf("lost sync: %x", p[:4])
+		}
+
+		pid := uint16(p[1]&0x1F)<<8 | uint16(p[2])
+		start := p[1]&0x40 != 0
+		cc := int(p[3] & 0x0F)
+
+		if last, ok := continuity[pid]; ok && cc != (last+1)&0x0F {
+			t.Errorf("pid %x: continuity %d after %d", pid, cc, last)
+		}
+		continuity[pid] = cc
+
+		payload := p[4:]
+		var randomAccess, pcr bool
+
+		if p[3]&0x20 != 0 {
+			length := int(payload[0])
+			if length > 0 {
+				randomAccess = payload[1]&0x40 != 0
+				pcr = payload[1]&0x10 != 0
+			}
+
+			payload = payload[1+length:]
+		}
+
+		if start {
+			out = append(out, pes{pid: pid, randomAccess: randomAccess, pcr: pcr})
+		}
+
+		if len(out) == 0 {
+			t.Fatal("payload before the first unit start")
+		}
+
+		last := &out[len(out)-1]
+		last.data = append(last.data, payload...)
+	}
+
+	return out
+}
+
+func TestWriter(t *testing.T) {
+	var out bytes.Buffer
+
+	w := NewWriter(&out, Options{})
+
+	frames := []*dvrip.Frame{
+		{Data: []byte{0xd5, 0xd5}, Meta: dvrip.MetaInfo{Type: "G711A"}},
+		mediatest.VideoFrame(false, 0, 10), // dropped, there is no keyframe yet
+		mediatest.VideoFrame(true, 40*time.Millisecond, 1000),
+		{Data: bytes.Repeat([]byte{0xd5}, 320), Meta: dvrip.MetaInfo{Type: "G711A"}, PTS: 50 * time.Millisecond},
+		mediatest.VideoFrame(false, 80*time.Millisecond, 183-30),
+	}
+
+	for _, frame := range frames {
+		if err := w.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	units := demux(t, out.Bytes())
+	if len(units) != 5 {
+		t.Fatalf("got %d units, expected PAT, PMT and 3 PES packets", len(units))
+	}
+
+	pat, pmt := units[0], units[1]
+	if pat.pid != pidPAT || pmt.pid != pidPMT {
+		t.Fatalf("got tables on pids %x and %x", pat.pid, pmt.pid)
+	}
+
+	// the CRC over a section including its CRC is zero
+	for _, section := range [][]byte{pat.data, pmt.data} {
+		length := int(section[2]&0x0F)<<8 | int(section[3])
+		if crc32(section[1:4+length]) != 0 {
+			t.Errorf("invalid section crc: %x", section[:4+length])
+		}
+	}
+
+	if !bytes.Contains(pmt.data, []byte{streamTypeG711A, 0xE1, 0x01}) {
+		t.Error("audio stream missing from the PMT")
+	}
+
+	key := units[2]
+	if key.pid != pidVideo || !key.randomAccess || !key.pcr {
+		t.Errorf("unexpected keyframe packet: pid=%x randomAccess=%v pcr=%v", key.pid, key.randomAccess, key.pcr)
+	}
+
+	if !bytes.HasPrefix(key.data, []byte{0, 0, 1, streamIDVideo}) {
+		t.Fatalf("unexpected PES header: %x", key.data[:9])
+	}
+
+	if pts := decodeTimestamp(key.data[9:]); pts != timestampOffset {
+		t.Errorf("got keyframe pts %d, expected %d", pts, timestampOffset)
+	}
+
+	es := key.data[14:]
+	if !bytes.HasPrefix(es, []byte{0, 0, 0, 1, 0x09, 0xF0, 0, 0, 0, 1, 0x67}) {
+		t.Errorf("access unit does not start with an AUD and the SPS: %x", es[:12])
+	}
+
+	audio := units[3]
+	if audio.pid != pidAudio || len(audio.data) != 14+320 {
+		t.Errorf("unexpected audio packet: pid=%x size=%d", audio.pid, len(audio.data))
+	}
+
+	if pts := decodeTimestamp(audio.data[9:]); pts != timestampOffset+900 {
+		t.Errorf("got audio pts %d, expected %d", pts, timestampOffset+900)
+	}
+
+	// every video PES carries a PCR, only keyframes are random access points
+	if p := units[4]; p.randomAccess || !p.pcr {
+		t.Errorf("unexpected P-frame packet: randomAccess=%v pcr=%v", p.randomAccess, p.pcr)
+	}
+}
+
+func TestTimestampWraparound(t *testing.T) {
+	w := NewWriter(nil, Options{})
+
+	// 27 hours exceed the 33 bit range of the 90kHz clock
+	ts := w.timestamp(27 * time.Hour)
+	expected := uint64(27*3600*clockRate+timestampOffset) & timestampMask
+
+	if ts != expected {
+		t.Errorf("got %d, expected %d", ts, expected)
+	}
+}
+
+func TestReader(t *testing.T) {
+	var out bytes.Buffer
+
+	w := NewWriter(&out, Options{Audio: true})
+
+	for i := 0; i < 6; i++ {
+		pts := time.Duration(i) * 40 * time.Millisecond
+
+		frames := []*dvrip.Frame{
+			mediatest.VideoFrame(i%3 == 0, pts, 100*i),
+			{Data: bytes.Repeat([]byte{0xd5}, 320), Meta: dvrip.MetaInfo{Type: "G711A"}, PTS: pts},
+		}
+
+		for _, frame := range frames {
+			if err := w.WriteFrame(frame); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(&out)
+
+	var video, audio, keyframes int
+
+	for {
+		frame, err := r.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if frame.Meta.Type == "G711A" {
+			if len(frame.Data) != 320 {
+				t.Errorf("audio frame %d: got %d bytes", audio, len(frame.Data))
+			}
+
+			audio++
+			continue
+		}
+
+		expected := mediatest.VideoFrame(video%3 == 0, 0, 100*video)
+		if !bytes.Equal(frame.Data, expected.Data) {
+			t.Errorf("frame %d: got %x, expected %x", video, frame.Data, expected.Data)
+		}
+
+		if frame.PTS != time.Duration(video)*40*time.Millisecond {
+			t.Errorf("frame %d: got pts %v", video, frame.PTS)
+		}
+
+		if frame.Keyframe {
+			keyframes++
+		}
+
+		video++
+	}
+
+	if video != 6 || audio != 6 || keyframes != 2 {
+		t.Errorf("got %d video frames, %d keyframes and %d audio frames", video, keyframes, audio)
+	}
+}
+
+func TestReaderWraparound(t *testing.T) {
+	r := NewReader(nil)
+
+	for i, ts := range []uint64{timestampMask - 10, 5, 100} {
+		v := r.unwrap(pidVideo, ts)
+
+		if expected := []int64{timestampMask - 10, timestampMask + 6, timestampMask + 101}[i]; v != expected {
+			t.Errorf("timestamp %d: got %d, expected %d", i, v, expected)
+		}
+	}
+}
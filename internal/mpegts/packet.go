@@ -0,0 +1,208 @@
+package mpegts
+
+import "godvr/internal/nalu"
+
+func (w *Writer) nextContinuity(pid uint16) byte {
+	cc := w.continuity[pid]
+	w.continuity[pid] = (cc + 1) & 0x0F
+
+	return cc
+}
+
+// writeTables appends the PAT and the PMT, each in a packet of its own.
+func (w *Writer) writeTables() {
+	pat := []byte{
+		0x00,       // table_id
+		0xB0, 0x0D, // section_syntax_indicator, section_length
+		0x00, 0x01, // transport_stream_id
+		0xC1,       // version 0, current_next_indicator
+		0x00, 0x00, // section and last section number
+		0x00, 0x01, // program_number
+		0xE0 | pidPMT>>8, pidPMT & 0xFF,
+	}
+	w.writeSection(pidPAT, pat)
+
+	videoType := byte(streamTypeH264)
+	if w.codec == nalu.CodecH265 {
+		videoType = streamTypeH265
+	}
+
+	streams := []byte{
+		videoType, 0xE0 | pidVideo>>8, pidVideo & 0xFF, 0xF0, 0x00,
+	}
+
+	if w.audio {
+		streams = append(streams, streamTypeG711A, 0xE0|pidAudio>>8, pidAudio&0xFF, 0xF0, 0x00)
+	}
+
+	length := 9 + len(streams) + 4
+	pmt := []byte{
+		0x02, // table_id
+		0xB0 | byte(length>>8), byte(length),
+		0x00, 0x01, // program_number
+		0xC1,
+		0x00, 0x00,
+		0xE0 | pidVideo>>8, pidVideo & 0xFF, // PCR_PID
+		0xF0, 0x00, // program_info_length
+	}
+	pmt = append(pmt, streams...)
+	w.writeSection(pidPMT, pmt)
+}
+
+func (w *Writer) writeSection(pid uint16, section []byte) {
+	crc := crc32(section)
+	section = append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+
+	w.buf = append(w.buf,
+		0x47,
+		0x40|byte(pid>>8), byte(pid), // payload_unit_start_indicator
+		0x10|w.nextContinuity(pid),
+		0x00, // pointer_field
+	)
+	w.buf = append(w.buf, section...)
+
+	for i := 5 + len(section); i < packetSize; i++ {
+		w.buf = append(w.buf, 0xFF)
+	}
+}
+
+// writePES appends a PES packet split into transport packets. The first
+// packet of a video PES carries the PCR, keyframes are flagged as random
+// access points.
+func (w *Writer) writePES(pid uint16, streamID byte, pts uint64, payload []byte, pcr, randomAccess bool) {
+	header := []byte{
+		0x00, 0x00, 0x01, streamID,
+		0x00, 0x00, // PES_packet_length, filled in below for audio
+		0x80, // marker bits
+		0x80, // PTS only, DTS equals PTS
+		0x05, // PES_header_data_length
+	}
+	header = appendTimestamp(header, 0x20, pts)
+
+	// video PES packets may be larger than the 16 bit length field allows,
+	// they use 0 for an unbounded length
+	if streamID != streamIDVideo {
+		length := len(header) - 6 + len(payload)
+		if length <= 0xFFFF {
+			header[4] = byte(length >> 8)
+			header[5] = byte(length)
+		}
+	}
+
+	data := append(header, payload...)
+	first := true
+
+	for len(data) > 0 {
+		var adaptation []byte
+
+		if first && (pcr || randomAccess) {
+			flags := byte(0)
+			if randomAccess {
+				flags |= 0x40
+			}
+
+			if pcr {
+				flags |= 0x10
+			}
+
+			adaptation = append(adaptation, flags)
+
+			if pcr {
+				base := (pts - pcrDelay) & timestampMask
+				adaptation = append(adaptation,
+					byte(base>>25), byte(base>>17), byte(base>>9), byte(base>>1),
+					byte(base<<7)|0x7E, 0x00,
+				)
+			}
+		}
+
+		space := packetSize - 4
+		if adaptation != nil {
+			space -= 1 + len(adaptation)
+		}
+
+		// stuff the last packet through the adaptation field
+		if len(data) < space {
+			stuffing := space - len(data)
+
+			if adaptation == nil {
+				if stuffing == 1 {
+					adaptation = []byte{}
+				} else {
+					adaptation = []byte{0x00}
+				}
+
+				stuffing = packetSize - 4 - len(data) - 1 - len(adaptation)
+			}
+
+			for i := 0; i < stuffing; i++ {
+				adaptation = append(adaptation, 0xFF)
+			}
+
+			space = len(data)
+		}
+
+		start := byte(0)
+		if first {
+			start = 0x40
+		}
+
+		control := byte(0x10)
+		if adaptation != nil {
+			control = 0x30
+		}
+
+		w.buf = append(w.buf, 0x47, start|byte(pid>>8), byte(pid), control|w.nextContinuity(pid))
+
+		if adaptation != nil {
+			w.buf = append(w.buf, byte(len(adaptation)))
+			w.buf = append(w.buf, adaptation...)
+		}
+
+		w.buf = append(w.buf, data[:space]...)
+		data = data[space:]
+		first = false
+	}
+}
+
+// appendTimestamp appends a 33 bit PTS/DTS with its 4 bit prefix and
+// marker bits.
+func appendTimestamp(b []byte, prefix byte, ts uint64) []byte {
+	return append(b,
+		prefix|byte(ts>>29)&0x0E|0x01,
+		byte(ts>>22),
+		byte(ts>>14)&0xFE|0x01,
+		byte(ts>>7),
+		byte(ts<<1)|0x01,
+	)
+}
+
+var crcTable = func() [256]uint32 {
+	var table [256]uint32
+
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+
+		table[i] = crc
+	}
+
+	return table
+}()
+
+// crc32 is the CRC-32/MPEG-2 checksum used by PSI sections.
+func crc32(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+
+	for _, b := range data {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^b]
+	}
+
+	return crc
+}
@@ -0,0 +1,295 @@
+package mpegts
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"godvr/internal/dvrip"
+	"godvr/internal/nalu"
+)
+
+// maxPESSize limits the PES packets reassembled by Reader.
+const maxPESSize = 64 << 20
+
+// Reader reads back the frames of a transport stream as written by Writer.
+// It follows the PAT and PMT, so other single program streams with H.264 or
+// H.265 video and G.711 A-law audio can be read as well.
+type Reader struct {
+	r *bufio.Reader
+
+	pmtPID   int
+	streams  map[uint16]byte // stream type by PID
+	pes      map[uint16][]byte
+	pending  []*dvrip.Frame
+	eof      bool
+	first    int64
+	hasFirst bool
+	last     map[uint16]int64
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		r:       bufio.NewReaderSize(r, 64*packetSize),
+		pmtPID:  -1,
+		streams: map[uint16]byte{},
+		pes:     map[uint16][]byte{},
+		last:    map[uint16]int64{},
+	}
+}
+
+// Reset continues reading from r, e.g. the file after seeking to a packet
+// boundary, keeping the program and the timestamp origin of the frames read
+// so far. Incomplete PES packets and frames not returned yet are dropped.
+func (r *Reader) Reset(rd io.Reader) {
+	r.r.Reset(rd)
+	r.pes = map[uint16][]byte{}
+	r.pending = nil
+	r.eof = false
+}
+
+// ReadFrame returns the next frame in stream order, the timestamps start at
+// the first timestamp of the stream. It returns io.EOF at the end of the
+// stream.
+func (r *Reader) ReadFrame() (*dvrip.Frame, error) {
+	for len(r.pending) == 0 {
+		if r.eof {
+			return nil, io.EOF
+		}
+
+		err := r.readPacket()
+		if err == io.EOF {
+			r.eof = true
+
+			// the last PES packet of each stream ends with the stream
+			for pid := range r.pes {
+				r.flush(pid)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	frame := r.pending[0]
+	r.pending[0] = nil
+	r.pending = r.pending[1:]
+
+	return frame, nil
+}
+
+func (r *Reader) readPacket() error {
+	var p [packetSize]byte
+
+	_, err := io.ReadFull(r.r, p[:])
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			// a packet cut short by a crash
+			return io.EOF
+		}
+
+		return err
+	}
+
+	if p[0] != 0x47 {
+		return errors.New("mpegts: lost sync")
+	}
+
+	pid := uint16(p[1]&0x1F)<<8 | uint16(p[2])
+	start := p[1]&0x40 != 0
+	payload := p[4:]
+
+	if p[3]&0x20 != 0 {
+		length := int(payload[0])
+		if 1+length > len(payload) {
+			return errors.New("mpegts: invalid adaptation field")
+		}
+
+		payload = payload[1+length:]
+	}
+
+	if p[3]&0x10 == 0 {
+		return nil
+	}
+
+	switch {
+	case pid == pidPAT:
+		if start {
+			r.parsePAT(payload)
+		}
+	case int(pid) == r.pmtPID:
+		if start {
+			r.parsePMT(payload)
+		}
+	default:
+		if _, ok := r.streams[pid]; !ok {
+			return nil
+		}
+
+		if start {
+			r.flush(pid)
+			r.pes[pid] = append(r.pes[pid][:0], payload...)
+		} else if len(r.pes[pid]) > 0 && len(r.pes[pid]) < maxPESSize {
+			r.pes[pid] = append(r.pes[pid], payload...)
+		}
+	}
+
+	return nil
+}
+
+// section returns the section of a payload that starts one, without its CRC.
+func section(payload []byte) []byte {
+	if len(payload) < 1 || int(payload[0])+1 > len(payload) {
+		return nil
+	}
+
+	s := payload[1+int(payload[0]):]
+	if len(s) < 3 {
+		return nil
+	}
+
+	length := int(s[1]&0x0F)<<8 | int(s[2])
+	if length < 9 || 3+length > len(s) {
+		return nil
+	}
+
+	return s[:3+length-4]
+}
+
+func (r *Reader) parsePAT(payload []byte) {
+	s := section(payload)
+	if s == nil {
+		return
+	}
+
+	for b := s[8:]; len(b) >= 4; b = b[4:] {
+		program := binary.BigEndian.Uint16(b)
+		if program != 0 {
+			r.pmtPID = int(b[2]&0x1F)<<8 | int(b[3])
+			return
+		}
+	}
+}
+
+func (r *Reader) parsePMT(payload []byte) {
+	s := section(payload)
+	if s == nil || len(s) < 12 {
+		return
+	}
+
+	infoLength := int(s[10]&0x0F)<<8 | int(s[11])
+	if 12+infoLength > len(s) {
+		return
+	}
+
+	for b := s[12+infoLength:]; len(b) >= 5; {
+		typ := b[0]
+		pid := uint16(b[1]&0x1F)<<8 | uint16(b[2])
+		esLength := int(b[3]&0x0F)<<8 | int(b[4])
+
+		switch typ {
+		case streamTypeH264, streamTypeH265, streamTypeG711A:
+			r.streams[pid] = typ
+		}
+
+		if 5+esLength > len(b) {
+			return
+		}
+
+		b = b[5+esLength:]
+	}
+}
+
+// flush turns the PES packet collected for a PID into a frame.
+func (r *Reader) flush(pid uint16) {
+	pes := r.pes[pid]
+	r.pes[pid] = pes[:0]
+
+	if len(pes) < 9 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+		return
+	}
+
+	headerLength := int(pes[8])
+	if 9+headerLength > len(pes) {
+		return
+	}
+
+	var pts int64
+
+	if pes[7]&0x80 != 0 && headerLength >= 5 {
+		pts = r.unwrap(pid, decodeTimestamp(pes[9:]))
+	}
+
+	data := pes[9+headerLength:]
+
+	var frame *dvrip.Frame
+
+	switch r.streams[pid] {
+	case streamTypeH264:
+		frame = dvrip.NewVideoFrame(nalu.CodecH264, stripAUD(nalu.CodecH264, data))
+	case streamTypeH265:
+		frame = dvrip.NewVideoFrame(nalu.CodecH265, stripAUD(nalu.CodecH265, data))
+	case streamTypeG711A:
+		frame = &dvrip.Frame{
+			Data:     append([]byte(nil), data...),
+			Meta:     dvrip.MetaInfo{Type: "G711A"},
+			Duration: time.Duration(len(data)) * time.Second / 8000,
+		}
+	default:
+		return
+	}
+
+	if !r.hasFirst {
+		r.first = pts
+		r.hasFirst = true
+	}
+
+	frame.PTS = time.Duration((pts - r.first) * int64(time.Second) / clockRate)
+	frame.DTS = frame.PTS
+
+	r.pending = append(r.pending, frame)
+}
+
+// stripAUD drops the access unit delimiters that Writer adds again.
+func stripAUD(codec string, data []byte) []byte {
+	units := nalu.Split(data)
+	out := make([]byte, 0, len(data))
+
+	for _, unit := range units {
+		if isAUD(codec, unit) {
+			continue
+		}
+
+		out = append(out, 0, 0, 0, 1)
+		out = append(out, unit...)
+	}
+
+	return out
+}
+
+// unwrap extends a 33 bit timestamp past its wraparound by comparing it to
+// the previous one of the PID.
+func (r *Reader) unwrap(pid uint16, ts uint64) int64 {
+	v := int64(ts)
+
+	if last, ok := r.last[pid]; ok {
+		v += last &^ timestampMask
+
+		if v < last-(1<<32) {
+			v += 1 << 33
+		}
+	}
+
+	r.last[pid] = v
+
+	return v
+}
+
+func decodeTimestamp(b []byte) uint64 {
+	return uint64(b[0]&0x0E)<<29 | uint64(b[1])<<22 | uint64(b[2]&0xFE)<<14 | uint64(b[3])<<7 | uint64(b[4])>>1
+}
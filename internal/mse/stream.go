@@ -0,0 +1,407 @@
+// Package mse pushes the live video of a camera to browsers over a
+// WebSocket as fragmented MP4, ready to be appended to a SourceBuffer of
+// Media Source Extensions.
+//
+// A connection receives a text message with the MIME type of the stream,
+// e.g. {"mime":"video/mp4; codecs=\"avc1.64002a\""}, then the init segment
+// and a media segment per frame as binary messages. The three repeat after
+// the camera reconnected. The decode times continue across reconnects, so a
+// SourceBuffer in the default "segments" mode plays on. Browsers can't play
+// G.711 from MP4, so only the video is sent.
+package mse
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"godvr/internal/dvrip"
+	"godvr/internal/mp4"
+	"godvr/internal/nalu"
+	"godvr/internal/websocket"
+)
+
+const (
+	// clientQueue is the number of messages buffered for a client, a client
+	// that falls further behind loses frames until the next keyframe
+	clientQueue = 128
+
+	// maxGOPSize limits the frames kept for joining clients, which start at
+	// the next keyframe if the group of pictures is larger
+	maxGOPSize = 16 << 20
+
+	// writeTimeout drops a client that stopped reading
+	writeTimeout = 10 * time.Second
+)
+
+// message is a WebSocket message, the media segment of a frame unless text
+// is set.
+type message struct {
+	text     bool
+	keyframe bool
+	data     []byte
+}
+
+// client is a WebSocket connection watching the stream.
+type client struct {
+	queue chan message
+
+	// waiting drops the frames until the next keyframe, after joining
+	// without a group of pictures and after frames were dropped
+	waiting bool
+}
+
+// Stream muxes the video of a camera once and sends the segments to every
+// client, so a slow client never holds up the writer. The muxing only runs
+// while clients watch, the first client starts it with the frames since the
+// latest keyframe.
+type Stream struct {
+	// Upgrade configures the WebSocket handshake, e.g. the origins of the
+	// other sites allowed to watch. Set it before serving.
+	Upgrade websocket.Options
+
+	lock sync.Mutex
+
+	muxer   *mp4.Writer
+	capture mp4.Capture
+	codec   string
+
+	// header is the MIME type message and the init segment, nil until the
+	// muxer started
+	header []message
+
+	// gop is the segments since the latest keyframe for joining clients
+	gop     []message
+	gopSize int
+
+	// frames is a copy of the frames since the latest keyframe while no
+	// client watches, they are muxed when the first one joins
+	frames     []*dvrip.Frame
+	framesSize int
+
+	// offset continues the timestamps after a restart of the source
+	offset time.Duration
+	last   time.Duration
+
+	clients map[*client]struct{}
+	dropped uint64
+	closed  bool
+}
+
+// NewStream returns a stream without clients.
+func NewStream() *Stream {
+	return &Stream{clients: map[*client]struct{}{}}
+}
+
+// Restart tells the stream that the source reconnected, its timestamps
+// start at zero again and its parameters may have changed.
+func (s *Stream) Restart() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.offset = s.last
+	s.muxer = nil
+	s.frames, s.framesSize = nil, 0
+}
+
+// WriteFrame sends a video frame to the clients. The frame is not retained,
+// so it can be released afterwards.
+func (s *Stream) WriteFrame(frame *dvrip.Frame) {
+	if frame.Meta.Type != nalu.CodecH264 && frame.Meta.Type != nalu.CodecH265 {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	shifted := *frame
+	shifted.PTS += s.offset
+	shifted.DTS += s.offset
+
+	if end := shifted.DTS + frame.Duration; end > s.last {
+		s.last = end
+	}
+
+	if len(s.clients) == 0 {
+		s.cache(&shifted)
+		return
+	}
+
+	s.mux(&shifted)
+}
+
+// cache keeps a copy of the frames since the latest keyframe, up to
+// maxGOPSize bytes.
+func (s *Stream) cache(frame *dvrip.Frame) {
+	if frame.Keyframe {
+		s.frames, s.framesSize = s.frames[:0], 0
+	} else if len(s.frames) == 0 {
+		return
+	}
+
+	s.framesSize += len(frame.Data)
+	if s.framesSize > maxGOPSize {
+		s.frames, s.framesSize = nil, 0
+		return
+	}
+
+	s.frames = append(s.frames, frame.Clone())
+}
+
+// mux sends a frame whose timestamps were shifted to the clients.
+func (s *Stream) mux(frame *dvrip.Frame) {
+	if s.muxer == nil || frame.Meta.Type != s.codec {
+		s.newMuxer(frame.Meta.Type)
+	}
+
+	err := s.muxer.WriteFrame(frame)
+	if err != nil || !s.muxer.Started() {
+		return
+	}
+
+	if s.header == nil {
+		err = s.start(frame)
+		if err != nil {
+			return
+		}
+	}
+
+	// a segment per frame keeps the latency low
+	err = s.muxer.Flush()
+	if err != nil {
+		return
+	}
+
+	m := message{keyframe: frame.Keyframe, data: s.capture.Take()}
+	if len(m.data) == 0 {
+		return
+	}
+
+	if m.keyframe {
+		s.gop, s.gopSize = s.gop[:0], 0
+	}
+
+	if s.gop != nil || m.keyframe {
+		s.gop = append(s.gop, m)
+		s.gopSize += len(m.data)
+
+		if s.gopSize > maxGOPSize {
+			s.gop, s.gopSize = nil, 0
+		}
+	}
+
+	s.deliver(m)
+}
+
+// newMuxer starts a muxer for a codec, it writes an init segment with the
+// next keyframe.
+func (s *Stream) newMuxer(codec string) {
+	s.codec = codec
+	s.capture.Writes = nil
+	s.muxer = mp4.NewWriter(&s.capture, mp4.Options{MaxFragmentDuration: time.Hour, NoIndex: true, KeepTimestamps: true})
+	s.header = nil
+	s.gop, s.gopSize = nil, 0
+}
+
+// start sends the MIME type and the init segment to the clients once the
+// muxer wrote it for the keyframe.
+func (s *Stream) start(frame *dvrip.Frame) error {
+	codecs, err := nalu.CodecString(s.codec, frame.SPS)
+	if err != nil {
+		return err
+	}
+
+	info, err := json.Marshal(map[string]interface{}{
+		"mime":   fmt.Sprintf("video/mp4; codecs=%q", codecs),
+		"width":  frame.Meta.Width,
+		"height": frame.Meta.Height,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.header = []message{{text: true, data: info}, {data: s.capture.Take()}}
+
+	for c := range s.clients {
+		c.waiting = true
+
+		for _, m := range s.header {
+			s.send(c, m)
+		}
+	}
+
+	return nil
+}
+
+func (s *Stream) deliver(m message) {
+	for c := range s.clients {
+		if c.waiting {
+			if !m.keyframe {
+				continue
+			}
+
+			c.waiting = false
+		}
+
+		select {
+		case c.queue <- m:
+		default:
+			c.waiting = true
+			s.dropped++
+		}
+	}
+}
+
+// send queues a message that must not be dropped, a client without room
+// for it is disconnected.
+func (s *Stream) send(c *client, m message) {
+	select {
+	case c.queue <- m:
+	default:
+		delete(s.clients, c)
+		close(c.queue)
+	}
+}
+
+// join adds a client, which starts with the latest keyframe.
+func (s *Stream) join() (*client, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return nil, fmt.Errorf("stream is closed")
+	}
+
+	c := &client{
+		queue:   make(chan message, clientQueue+len(s.header)+len(s.gop)+len(s.frames)),
+		waiting: true,
+	}
+
+	s.clients[c] = struct{}{}
+
+	// the first client starts the muxing, which gets it the header and
+	// the segments of the cached frames
+	if len(s.clients) == 1 {
+		s.muxer, s.header = nil, nil
+		s.gop, s.gopSize = nil, 0
+
+		for _, frame := range s.frames {
+			s.mux(frame)
+		}
+
+		s.frames, s.framesSize = nil, 0
+
+		return c, nil
+	}
+
+	if s.header == nil {
+		return c, nil
+	}
+
+	for _, m := range s.header {
+		c.queue <- m
+	}
+
+	for _, m := range s.gop {
+		c.queue <- m
+		c.waiting = false
+	}
+
+	return c, nil
+}
+
+// leave removes a client.
+func (s *Stream) leave(c *client) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.clients, c)
+}
+
+// Clients returns the number of connected clients.
+func (s *Stream) Clients() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.clients)
+}
+
+// Dropped returns the number of frames that clients missed because they
+// did not keep up.
+func (s *Stream) Dropped() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.dropped
+}
+
+// Close disconnects the clients and rejects new ones.
+func (s *Stream) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closed = true
+
+	for c := range s.clients {
+		delete(s.clients, c)
+		close(c.queue)
+	}
+}
+
+// ServeHTTP upgrades the request to a WebSocket and sends the stream until
+// the client goes away.
+func (s *Stream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := websocket.Upgrade(w, r, s.Upgrade)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	c, err := s.join()
+	if err != nil {
+		return
+	}
+	defer s.leave(c)
+
+	// the client sends nothing but control messages, reading handles them
+	// and notices when it goes away
+	gone := make(chan struct{})
+
+	go func() {
+		defer close(gone)
+
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case m, ok := <-c.queue:
+			if !ok {
+				return
+			}
+
+			messageType := websocket.BinaryMessage
+			if m.text {
+				messageType = websocket.TextMessage
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+
+			if err := conn.WriteMessage(messageType, m.data); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"godvr/internal/dvrip"
+	"godvr/internal/mediatest"
+)
+
+// dial opens a WebSocket to the server.
+func dial(t *testing.T, addr string) *bufio.Reader {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { c.Close() })
+
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	c.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+
+	r := bufio.NewReader(c)
+
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake failed: %v", err)
+	}
+
+	return r
+}
+
+// readMessage reads an unfragmented message of the server.
+func readMessage(t *testing.T, r *bufio.Reader) (byte, []byte) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	length := int(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		var b [2]byte
+		io.ReadFull(r, b[:])
+		length = int(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		io.ReadFull(r, b[:])
+		length = int(binary.BigEndian.Uint64(b[:]))
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	return header[0] & 0x0F, payload
+}
+
+// decodeTime returns the decode time of a media segment.
+func decodeTime(t *testing.T, b []byte) uint64 {
+	i := bytes.Index(b, []byte("tfdt"))
+	if i < 0 || len(b) < i+16 {
+		t.Fatal("no tfdt box")
+	}
+
+	return binary.BigEndian.Uint64(b[i+8:])
+}
+
+// expectHeader reads the MIME type and the init segment.
+func expectHeader(t *testing.T, r *bufio.Reader) {
+	opcode, payload := readMessage(t, r)
+
+	var info struct {
+		Mime string
+	}
+
+	if err := json.Unmarshal(payload, &info); opcode != 1 || err != nil || info.Mime != `video/mp4; codecs="avc1.64002a"` {
+		t.Fatalf("got opcode %d, message %s", opcode, payload)
+	}
+
+	if opcode, payload := readMessage(t, r); opcode != 2 || string(payload[4:8]) != "ftyp" {
+		t.Fatalf("got opcode %d, %d bytes instead of the init segment", opcode, len(payload))
+	}
+}
+
+func TestStream(t *testing.T) {
+	s := NewStream()
+
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	// a client joining late starts with the latest keyframe
+	for i := 0; i < 30; i++ {
+		s.WriteFrame(mediatest.StreamFrame(i))
+	}
+
+	s.WriteFrame(&dvrip.Frame{Data: []byte{0xd5}, Meta: dvrip.MetaInfo{Type: "G711A"}})
+
+	r := dial(t, server.Listener.Addr().String())
+	expectHeader(t, r)
+
+	for i := 25; i < 30; i++ {
+		_, payload := readMessage(t, r)
+		if dts := decodeTime(t, payload); dts != uint64(i)*3600 {
+			t.Errorf("frame %d: got decode time %d", i, dts)
+		}
+	}
+
+	s.WriteFrame(mediatest.StreamFrame(30))
+
+	if _, payload := readMessage(t, r); decodeTime(t, payload) != 30*3600 {
+		t.Error("got an unexpected frame")
+	}
+
+	// after a reconnect the stream starts again with a header and keeps
+	// the timeline going
+	s.Restart()
+
+	for i := 0; i < 2; i++ {
+		s.WriteFrame(mediatest.StreamFrame(i))
+	}
+
+	expectHeader(t, r)
+
+	if _, payload := readMessage(t, r); decodeTime(t, payload) != 31*3600 {
+		t.Errorf("got decode time %d after the restart", decodeTime(t, payload))
+	}
+
+	if n := s.Clients(); n != 1 {
+		t.Errorf("got %d clients", n)
+	}
+
+	s.Close()
+
+	for {
+		if _, err := r.ReadByte(); err != nil {
+			break
+		}
+	}
+}
+
+func TestStreamSlowClient(t *testing.T) {
+	s := NewStream()
+	s.WriteFrame(mediatest.StreamFrame(0))
+
+	c, err := s.join()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the header and the keyframe fill the queue beyond clientQueue
+	for i := 1; i < clientQueue+10; i++ {
+		s.WriteFrame(mediatest.StreamFrame(i))
+	}
+
+	if s.Dropped() == 0 || !c.waiting {
+		t.Fatalf("got %d dropped frames", s.Dropped())
+	}
+
+	for len(c.queue) > 0 {
+		<-c.queue
+	}
+
+	// the client resumes with the next keyframe
+	for i := clientQueue + 10; i < 200; i++ {
+		s.WriteFrame(mediatest.StreamFrame(i))
+	}
+
+	if m := <-c.queue; !m.keyframe {
+		t.Error("client did not resume at a keyframe")
+	}
+}
+
+func TestStreamIdle(t *testing.T) {
+	s := NewStream()
+
+	// without clients the frames since the latest keyframe are kept but
+	// not muxed
+	for i := 0; i < 30; i++ {
+		s.WriteFrame(mediatest.StreamFrame(i))
+	}
+
+	if s.muxer != nil || len(s.frames) != 5 {
+		t.Fatalf("got muxer %v and %d cached frames", s.muxer != nil, len(s.frames))
+	}
+
+	c, err := s.join()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the MIME type, the init segment and the cached frames
+	if n := len(c.queue); n != 7 || len(s.frames) != 0 {
+		t.Fatalf("got %d messages, %d cached frames", n, len(s.frames))
+	}
+
+	s.leave(c)
+
+	gop := len(s.gop)
+
+	for i := 30; i < 40; i++ {
+		s.WriteFrame(mediatest.StreamFrame(i))
+	}
+
+	if len(s.gop) != gop || len(s.frames) != 0 {
+		t.Errorf("got %d segments, %d cached frames after the client left", len(s.gop)-gop, len(s.frames))
+	}
+}
@@ -0,0 +1,78 @@
+package nalu
+
+// bitReader reads the bit fields used by parameter sets, most significant
+// bit first.
+type bitReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *bitReader) bit() uint32 {
+	if r.err != nil {
+		return 0
+	}
+
+	if r.pos >= len(r.data)*8 {
+		r.err = errShortData
+		return 0
+	}
+
+	b := r.data[r.pos/8] >> (7 - uint(r.pos%8)) & 1
+	r.pos++
+
+	return uint32(b)
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	var v uint32
+
+	for i := 0; i < n; i++ {
+		v = v<<1 | r.bit()
+	}
+
+	return v
+}
+
+func (r *bitReader) flag() bool {
+	return r.bit() == 1
+}
+
+func (r *bitReader) skip(n int) {
+	if r.err != nil {
+		return
+	}
+
+	if r.pos+n > len(r.data)*8 {
+		r.err = errShortData
+		return
+	}
+
+	r.pos += n
+}
+
+// ue reads an unsigned Exp-Golomb code.
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+
+	for r.bit() == 0 {
+		if r.err != nil || zeros > 31 {
+			r.err = errShortData
+			return 0
+		}
+
+		zeros++
+	}
+
+	return (1<<uint(zeros) - 1) + r.bits(zeros)
+}
+
+// se reads a signed Exp-Golomb code.
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v&1 == 1 {
+		return int32((v + 1) / 2)
+	}
+
+	return -int32(v / 2)
+}
@@ -0,0 +1,289 @@
+package nalu
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// AVCConfig builds the AVCDecoderConfigurationRecord carried by the avcC box
+// of mp4 files and the CodecPrivate element of Matroska files.
+func AVCConfig(sps, pps []byte) ([]byte, error) {
+	if len(sps) < 4 || len(pps) == 0 {
+		return nil, errors.New("missing H.264 parameter sets")
+	}
+
+	b := []byte{
+		1,      // configurationVersion
+		sps[1], // AVCProfileIndication
+		sps[2], // profile_compatibility
+		sps[3], // AVCLevelIndication
+		0xFF,   // 4 byte NAL unit lengths
+		0xE1,   // one SPS
+	}
+	b = appendUnit(b, sps)
+	b = append(b, 1) // one PPS
+	b = appendUnit(b, pps)
+
+	return b, nil
+}
+
+// HEVCConfig builds the HEVCDecoderConfigurationRecord, the H.265
+// counterpart of AVCConfig. The general profile, tier and level fields are
+// copied from the SPS.
+func HEVCConfig(vps, sps, pps []byte) ([]byte, error) {
+	if len(vps) == 0 || len(pps) == 0 {
+		return nil, errors.New("missing H.265 parameter sets")
+	}
+
+	info, err := ParseH265SPS(sps)
+	if err != nil {
+		return nil, err
+	}
+
+	rbsp := RBSP(sps)
+
+	// profile_tier_level follows the two byte NAL header and one byte of
+	// vps id, max sub layers and temporal id nesting
+	ptl := rbsp[3:15]
+
+	b := []byte{1} // configurationVersion
+	b = append(b, ptl...)
+	b = append(b, 0xF0, 0x00)                  // min_spatial_segmentation_idc
+	b = append(b, 0xFC)                        // parallelismType
+	b = append(b, 0xFC|byte(info.ChromaIDC&3)) // chromaFormat
+	b = append(b, 0xF8, 0xF8)                  // bit_depth_luma_minus8, bit_depth_chroma_minus8
+	b = append(b, 0x00, 0x00)                  // avgFrameRate
+	b = append(b, 0x0F)                        // one temporal layer, nested, 4 byte NAL unit lengths
+	b = append(b, 3)                           // numOfArrays
+
+	for _, unit := range [][]byte{vps, sps, pps} {
+		b = append(b, 0x80|byte(H265Type(unit))) // array_completeness
+		b = append(b, 0x00, 0x01)
+		b = appendUnit(b, unit)
+	}
+
+	return b, nil
+}
+
+// CodecString returns the codecs parameter of the MIME type of a stream as
+// specified by RFC 6381, e.g. "avc1.64002a" or "hvc1.1.6.L120.90", which
+// browsers need to set up a decoder.
+func CodecString(codec string, sps []byte) (string, error) {
+	switch codec {
+	case CodecH264:
+		if len(sps) < 4 {
+			return "", errors.New("missing H.264 SPS")
+		}
+
+		return fmt.Sprintf("avc1.%02x%02x%02x", sps[1], sps[2], sps[3]), nil
+	case CodecH265:
+		rbsp := RBSP(sps)
+		if len(rbsp) < 15 {
+			return "", errors.New("missing H.265 SPS")
+		}
+
+		// the profile_tier_level as in HEVCConfig
+		ptl := rbsp[3:15]
+
+		var b strings.Builder
+
+		b.WriteString("hvc1.")
+		b.WriteString([]string{"", "A", "B", "C"}[ptl[0]>>6])
+		fmt.Fprintf(&b, "%d.%X.", ptl[0]&0x1F, bits.Reverse32(binary.BigEndian.Uint32(ptl[1:5])))
+
+		if ptl[0]&0x20 != 0 {
+			b.WriteString("H")
+		} else {
+			b.WriteString("L")
+		}
+
+		fmt.Fprintf(&b, "%d", ptl[11])
+
+		// the constraint flags without trailing zero bytes
+		constraints := ptl[5:11]
+		for len(constraints) > 0 && constraints[len(constraints)-1] == 0 {
+			constraints = constraints[:len(constraints)-1]
+		}
+
+		for _, c := range constraints {
+			fmt.Fprintf(&b, ".%X", c)
+		}
+
+		return b.String(), nil
+	}
+
+	return "", fmt.Errorf("unsupported codec: %v", codec)
+}
+
+// AppendLengthPrefixed appends the NAL units to dst in the 4 byte length
+// prefixed form used with AVCConfig and HEVCConfig. Parameter sets and access
+// unit delimiters are left out since the configuration record carries them.
+func AppendLengthPrefixed(dst []byte, codec string, units [][]byte) []byte {
+	for _, unit := range units {
+		if skipUnit(codec, unit) {
+			continue
+		}
+
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(unit)))
+
+		dst = append(dst, size[:]...)
+		dst = append(dst, unit...)
+	}
+
+	return dst
+}
+
+func skipUnit(codec string, unit []byte) bool {
+	switch codec {
+	case CodecH264:
+		switch H264Type(unit) {
+		case H264SPS, H264PPS, H264AUD:
+			return true
+		}
+	case CodecH265:
+		switch H265Type(unit) {
+		case H265VPS, H265SPS, H265PPS, H265AUD:
+			return true
+		}
+	}
+
+	return false
+}
+
+// appendUnit appends a NAL unit with its 16 bit length.
+func appendUnit(b []byte, unit []byte) []byte {
+	b = append(b, byte(len(unit)>>8), byte(len(unit)))
+
+	return append(b, unit...)
+}
+
+// ParseConfig returns the parameter sets of an AVC or HEVC decoder
+// configuration record, the inverse of AVCConfig and HEVCConfig. Only the
+// first unit of each type is returned.
+func ParseConfig(codec string, record []byte) (vps, sps, pps []byte, err error) {
+	errInvalid := errors.New("invalid decoder configuration record")
+
+	switch codec {
+	case CodecH264:
+		if len(record) < 6 {
+			return nil, nil, nil, errInvalid
+		}
+
+		b := record[5:]
+
+		for _, count := range []int{int(b[0] & 0x1F), -1} {
+			if count < 0 {
+				if len(b) == 0 {
+					return nil, nil, nil, errInvalid
+				}
+
+				count = int(b[0])
+			}
+
+			b = b[1:]
+
+			for i := 0; i < count; i++ {
+				var unit []byte
+
+				unit, b, err = readUnit(b)
+				if err != nil {
+					return nil, nil, nil, err
+				}
+
+				switch H264Type(unit) {
+				case H264SPS:
+					if sps == nil {
+						sps = unit
+					}
+				case H264PPS:
+					if pps == nil {
+						pps = unit
+					}
+				}
+			}
+		}
+	case CodecH265:
+		if len(record) < 23 {
+			return nil, nil, nil, errInvalid
+		}
+
+		arrays := int(record[22])
+		b := record[23:]
+
+		for i := 0; i < arrays; i++ {
+			if len(b) < 3 {
+				return nil, nil, nil, errInvalid
+			}
+
+			count := int(binary.BigEndian.Uint16(b[1:]))
+			b = b[3:]
+
+			for j := 0; j < count; j++ {
+				var unit []byte
+
+				unit, b, err = readUnit(b)
+				if err != nil {
+					return nil, nil, nil, err
+				}
+
+				switch H265Type(unit) {
+				case H265VPS:
+					if vps == nil {
+						vps = unit
+					}
+				case H265SPS:
+					if sps == nil {
+						sps = unit
+					}
+				case H265PPS:
+					if pps == nil {
+						pps = unit
+					}
+				}
+			}
+		}
+	default:
+		return nil, nil, nil, errors.New("unsupported codec: " + codec)
+	}
+
+	return vps, sps, pps, nil
+}
+
+// readUnit reads a NAL unit with its 16 bit length.
+func readUnit(b []byte) (unit, rest []byte, err error) {
+	if len(b) < 2 {
+		return nil, nil, errors.New("invalid decoder configuration record")
+	}
+
+	size := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+size {
+		return nil, nil, errors.New("invalid decoder configuration record")
+	}
+
+	return b[2 : 2+size], b[2+size:], nil
+}
+
+// AppendAnnexB converts 4 byte length prefixed NAL units to Annex B form and
+// appends them to dst.
+func AppendAnnexB(dst, data []byte) ([]byte, error) {
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return dst, errors.New("truncated NAL unit length")
+		}
+
+		size := int(binary.BigEndian.Uint32(data))
+		if size > len(data)-4 {
+			return dst, errors.New("NAL unit exceeds the sample")
+		}
+
+		dst = append(dst, 0, 0, 0, 1)
+		dst = append(dst, data[4:4+size]...)
+		data = data[4+size:]
+	}
+
+	return dst, nil
+}
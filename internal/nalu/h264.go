@@ -0,0 +1,191 @@
+package nalu
+
+import (
+	"fmt"
+	"strconv"
+)
+
+var h264Profiles = map[int]string{
+	66:  "Baseline",
+	77:  "Main",
+	88:  "Extended",
+	100: "High",
+	110: "High 10",
+	122: "High 4:2:2",
+	244: "High 4:4:4",
+}
+
+// ParseH264SPS parses an H.264 sequence parameter set NAL unit, including
+// its one byte header.
+func ParseH264SPS(unit []byte) (SPS, error) {
+	if H264Type(unit) != H264SPS {
+		return SPS{}, fmt.Errorf("not an H.264 SPS: nal type %v", H264Type(unit))
+	}
+
+	r := &bitReader{data: RBSP(unit[1:])}
+	sps := SPS{Codec: CodecH264, ChromaIDC: 1}
+
+	sps.ProfileIDC = int(r.bits(8))
+	r.skip(8) // constraint flags and reserved bits
+	sps.LevelIDC = int(r.bits(8))
+	r.ue() // seq_parameter_set_id
+
+	separateColourPlane := false
+
+	switch sps.ProfileIDC {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		sps.ChromaIDC = int(r.ue())
+		if sps.ChromaIDC == 3 {
+			separateColourPlane = r.flag()
+		}
+
+		r.ue() // bit_depth_luma_minus8
+		r.ue() // bit_depth_chroma_minus8
+		r.skip(1)
+
+		if r.flag() { // seq_scaling_matrix_present_flag
+			lists := 8
+			if sps.ChromaIDC == 3 {
+				lists = 12
+			}
+
+			for i := 0; i < lists; i++ {
+				if !r.flag() {
+					continue
+				}
+
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+
+				skipScalingList(r, size)
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+
+	switch r.ue() { // pic_order_cnt_type
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.skip(1)
+		r.se()
+		r.se()
+
+		cycle := r.ue()
+		for i := uint32(0); i < cycle && r.err == nil; i++ {
+			r.se()
+		}
+	}
+
+	r.ue()    // max_num_ref_frames
+	r.skip(1) // gaps_in_frame_num_value_allowed_flag
+
+	widthMbs := int(r.ue()) + 1
+	heightMapUnits := int(r.ue()) + 1
+
+	frameMbsOnly := r.flag()
+	if !frameMbsOnly {
+		r.skip(1) // mb_adaptive_frame_field_flag
+	}
+
+	r.skip(1) // direct_8x8_inference_flag
+
+	var cropLeft, cropRight, cropTop, cropBottom int
+	if r.flag() {
+		cropLeft = int(r.ue())
+		cropRight = int(r.ue())
+		cropTop = int(r.ue())
+		cropBottom = int(r.ue())
+	}
+
+	if r.err != nil {
+		return SPS{}, fmt.Errorf("failed to parse H.264 SPS: %w", r.err)
+	}
+
+	fieldFactor := 2
+	if frameMbsOnly {
+		fieldFactor = 1
+	}
+
+	cropX, cropY := 1, fieldFactor
+	if !separateColourPlane {
+		switch sps.ChromaIDC {
+		case 1:
+			cropX, cropY = 2, 2*fieldFactor
+		case 2:
+			cropX = 2
+		}
+	}
+
+	sps.Width = widthMbs*16 - cropX*(cropLeft+cropRight)
+	sps.Height = fieldFactor*heightMapUnits*16 - cropY*(cropTop+cropBottom)
+	sps.Profile = h264Profiles[sps.ProfileIDC]
+	sps.Level = strconv.FormatFloat(float64(sps.LevelIDC)/10, 'f', -1, 64)
+
+	if sps.Profile == "" {
+		sps.Profile = strconv.Itoa(sps.ProfileIDC)
+	}
+
+	if r.flag() { // vui_parameters_present_flag
+		sps.FPS = parseH264Timing(r)
+	}
+
+	return sps, nil
+}
+
+func skipScalingList(r *bitReader, size int) {
+	last, next := int32(8), int32(8)
+
+	for j := 0; j < size && r.err == nil; j++ {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+// parseH264Timing reads the VUI up to the timing info and returns the frame
+// rate it signals, or zero.
+func parseH264Timing(r *bitReader) float64 {
+	if r.flag() { // aspect_ratio_info_present_flag
+		if r.bits(8) == 255 {
+			r.skip(32)
+		}
+	}
+
+	if r.flag() { // overscan_info_present_flag
+		r.skip(1)
+	}
+
+	if r.flag() { // video_signal_type_present_flag
+		r.skip(4)
+
+		if r.flag() {
+			r.skip(24)
+		}
+	}
+
+	if r.flag() { // chroma_loc_info_present_flag
+		r.ue()
+		r.ue()
+	}
+
+	if !r.flag() { // timing_info_present_flag
+		return 0
+	}
+
+	unitsInTick := r.bits(32)
+	timeScale := r.bits(32)
+
+	if r.err != nil || unitsInTick == 0 {
+		return 0
+	}
+
+	return float64(timeScale) / float64(2*unitsInTick)
+}
@@ -0,0 +1,111 @@
+package nalu
+
+import (
+	"fmt"
+	"strconv"
+)
+
+var h265Profiles = map[int]string{
+	1: "Main",
+	2: "Main 10",
+	3: "Main Still Picture",
+	4: "Range Extensions",
+}
+
+// ParseH265SPS parses an H.265 sequence parameter set NAL unit, including
+// its two byte header. Frame rate is not reported for H.265.
+func ParseH265SPS(unit []byte) (SPS, error) {
+	if H265Type(unit) != H265SPS || len(unit) < 2 {
+		return SPS{}, fmt.Errorf("not an H.265 SPS: nal type %v", H265Type(unit))
+	}
+
+	r := &bitReader{data: RBSP(unit[2:])}
+	sps := SPS{Codec: CodecH265}
+
+	r.skip(4) // sps_video_parameter_set_id
+	maxSubLayersMinus1 := int(r.bits(3))
+	r.skip(1) // sps_temporal_id_nesting_flag
+
+	// profile_tier_level
+	r.skip(3) // general_profile_space and general_tier_flag
+	sps.ProfileIDC = int(r.bits(5))
+	r.skip(32) // general_profile_compatibility_flags
+	r.skip(48) // general constraint flags
+	sps.LevelIDC = int(r.bits(8))
+
+	profilePresent := make([]bool, maxSubLayersMinus1)
+	levelPresent := make([]bool, maxSubLayersMinus1)
+
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		profilePresent[i] = r.flag()
+		levelPresent[i] = r.flag()
+	}
+
+	if maxSubLayersMinus1 > 0 {
+		r.skip(2 * (8 - maxSubLayersMinus1))
+	}
+
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		if profilePresent[i] {
+			r.skip(88)
+		}
+
+		if levelPresent[i] {
+			r.skip(8)
+		}
+	}
+
+	r.ue() // sps_seq_parameter_set_id
+
+	sps.ChromaIDC = int(r.ue())
+	separateColourPlane := false
+	if sps.ChromaIDC == 3 {
+		separateColourPlane = r.flag()
+	}
+
+	sps.Width = int(r.ue())
+	sps.Height = int(r.ue())
+
+	if r.flag() { // conformance_window_flag
+		left, right := int(r.ue()), int(r.ue())
+		top, bottom := int(r.ue()), int(r.ue())
+
+		subWidth, subHeight := 1, 1
+		if !separateColourPlane {
+			switch sps.ChromaIDC {
+			case 1:
+				subWidth, subHeight = 2, 2
+			case 2:
+				subWidth = 2
+			}
+		}
+
+		sps.Width -= subWidth * (left + right)
+		sps.Height -= subHeight * (top + bottom)
+	}
+
+	if r.err != nil {
+		return SPS{}, fmt.Errorf("failed to parse H.265 SPS: %w", r.err)
+	}
+
+	sps.Profile = h265Profiles[sps.ProfileIDC]
+	if sps.Profile == "" {
+		sps.Profile = strconv.Itoa(sps.ProfileIDC)
+	}
+
+	sps.Level = strconv.FormatFloat(float64(sps.LevelIDC)/30, 'f', -1, 64)
+
+	return sps, nil
+}
+
+// ParseSPS parses a sequence parameter set of the given codec.
+func ParseSPS(codec string, unit []byte) (SPS, error) {
+	switch codec {
+	case CodecH264:
+		return ParseH264SPS(unit)
+	case CodecH265:
+		return ParseH265SPS(unit)
+	}
+
+	return SPS{}, fmt.Errorf("unsupported codec: %q", codec)
+}
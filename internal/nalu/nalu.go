@@ -0,0 +1,185 @@
+// Package nalu splits H.264 and H.265 Annex B bitstreams into NAL units and
+// parses the parameter sets that describe the coded video.
+package nalu
+
+import (
+	"bytes"
+	"errors"
+)
+
+const (
+	CodecH264 = "H264"
+	CodecH265 = "H265"
+)
+
+// H.264 NAL unit types.
+const (
+	H264Slice = 1
+	H264IDR   = 5
+	H264SEI   = 6
+	H264SPS   = 7
+	H264PPS   = 8
+	H264AUD   = 9
+)
+
+// H.265 NAL unit types.
+const (
+	H265BLAWLP   = 16
+	H265CRANUT   = 21
+	H265VPS      = 32
+	H265SPS      = 33
+	H265PPS      = 34
+	H265AUD      = 35
+	H265PrefixSE = 39
+)
+
+var errShortData = errors.New("not enough data")
+
+// Split returns the NAL units of an Annex B byte stream without their start
+// codes. The returned slices share memory with data.
+func Split(data []byte) [][]byte {
+	return AppendSplit(nil, data)
+}
+
+// AppendSplit works like Split but appends the NAL units to units, which
+// lets callers reuse the slice between frames.
+func AppendSplit(units [][]byte, data []byte) [][]byte {
+	start := startCode(data, 0)
+	if start < 0 {
+		if len(data) > 0 {
+			units = append(units, data)
+		}
+
+		return units
+	}
+
+	for start < len(data) {
+		next := startCode(data, start)
+
+		end := len(data)
+		if next >= 0 {
+			end = next - 3
+		}
+
+		// drop the leading zero of a 4 byte start code and trailing zeros
+		unit := bytes.TrimRight(data[start:end], "\x00")
+		if len(unit) > 0 {
+			units = append(units, unit)
+		}
+
+		if next < 0 {
+			break
+		}
+
+		start = next
+	}
+
+	return units
+}
+
+// startCode returns the offset just past the next 0x000001 sequence at or
+// after from, or -1 if there is none.
+func startCode(data []byte, from int) int {
+	for i := from; i+3 <= len(data); i++ {
+		if data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 {
+			return i + 3
+		}
+	}
+
+	return -1
+}
+
+// H264Type returns the nal_unit_type of an H.264 NAL unit.
+func H264Type(unit []byte) int {
+	if len(unit) == 0 {
+		return -1
+	}
+
+	return int(unit[0] & 0x1F)
+}
+
+// H265Type returns the nal_unit_type of an H.265 NAL unit.
+func H265Type(unit []byte) int {
+	if len(unit) == 0 {
+		return -1
+	}
+
+	return int(unit[0]>>1) & 0x3F
+}
+
+// IsKeyframe reports whether the NAL unit starts a picture that can be
+// decoded without references to earlier pictures.
+func IsKeyframe(codec string, unit []byte) bool {
+	switch codec {
+	case CodecH264:
+		return H264Type(unit) == H264IDR
+	case CodecH265:
+		t := H265Type(unit)
+		return t >= H265BLAWLP && t <= H265CRANUT
+	}
+
+	return false
+}
+
+// DetectCodec guesses the codec of an Annex B stream from its parameter
+// sets. It returns an empty string if the stream carries none.
+func DetectCodec(data []byte) string {
+	for _, unit := range Split(data) {
+		if len(unit) >= 2 && H265Type(unit) == H265VPS && unit[1] == 0x01 {
+			return CodecH265
+		}
+
+		switch H264Type(unit) {
+		case H264SPS, H264PPS:
+			if unit[0]&0x80 == 0 {
+				return CodecH264
+			}
+		}
+	}
+
+	return ""
+}
+
+// RBSP strips emulation prevention bytes from a NAL unit.
+func RBSP(unit []byte) []byte {
+	if bytes.Index(unit, []byte{0, 0, 3}) < 0 {
+		return unit
+	}
+
+	out := make([]byte, 0, len(unit))
+	zeros := 0
+
+	for _, b := range unit {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+
+		out = append(out, b)
+	}
+
+	return out
+}
+
+// SPS describes the coded video as signalled by a sequence parameter set.
+type SPS struct {
+	Codec   string
+	Width   int
+	Height  int
+	Profile string
+	Level   string
+
+	ProfileIDC int
+	LevelIDC   int
+	ChromaIDC  int
+
+	// FPS is derived from the VUI timing info and is zero when the encoder
+	// does not signal it.
+	FPS float64
+}
@@ -0,0 +1,186 @@
+package nalu
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestSplit(t *testing.T) {
+	data := []byte{
+		0x00, 0x00, 0x00, 0x01, 0x67, 0x01, 0x02,
+		0x00, 0x00, 0x01, 0x68, 0x03,
+		0x00, 0x00, 0x00, 0x01, 0x65, 0x04, 0x00, 0x05,
+	}
+
+	units := Split(data)
+	expected := [][]byte{{0x67, 0x01, 0x02}, {0x68, 0x03}, {0x65, 0x04, 0x00, 0x05}}
+
+	if len(units) != len(expected) {
+		t.Fatalf("got %d units, expected %d", len(units), len(expected))
+	}
+
+	for i := range units {
+		if !bytes.Equal(units[i], expected[i]) {
+			t.Errorf("unit %d: got %x, expected %x", i, units[i], expected[i])
+		}
+	}
+
+	if units := Split([]byte{0x41, 0x9a}); len(units) != 1 {
+		t.Errorf("expected data without start codes to be a single unit, got %d", len(units))
+	}
+}
+
+func TestRBSP(t *testing.T) {
+	got := RBSP([]byte{0x01, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00, 0x03, 0x01})
+	expected := []byte{0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01}
+
+	if !bytes.Equal(got, expected) {
+		t.Errorf("got %x, expected %x", got, expected)
+	}
+}
+
+func TestIsKeyframe(t *testing.T) {
+	tests := []struct {
+		codec    string
+		unit     []byte
+		expected bool
+	}{
+		{CodecH264, []byte{0x65}, true},
+		{CodecH264, []byte{0x41}, false},
+		{CodecH265, []byte{0x26, 0x01}, true},  // IDR_W_RADL
+		{CodecH265, []byte{0x2a, 0x01}, true},  // CRA_NUT
+		{CodecH265, []byte{0x02, 0x01}, false}, // TRAIL_R
+		{"MPEG4", []byte{0x65}, false},
+	}
+
+	for _, test := range tests {
+		if got := IsKeyframe(test.codec, test.unit); got != test.expected {
+			t.Errorf("%v %x: got %v, expected %v", test.codec, test.unit, got, test.expected)
+		}
+	}
+}
+
+func TestDetectCodec(t *testing.T) {
+	h264 := []byte{0, 0, 0, 1, 0x67, 0x64, 0, 0, 0, 1, 0x68, 0xee}
+	h265 := []byte{0, 0, 0, 1, 0x40, 0x01, 0x0c, 0, 0, 0, 1, 0x42, 0x01}
+
+	if got := DetectCodec(h264); got != CodecH264 {
+		t.Errorf("got %q, expected %q", got, CodecH264)
+	}
+
+	if got := DetectCodec(h265); got != CodecH265 {
+		t.Errorf("got %q, expected %q", got, CodecH265)
+	}
+
+	if got := DetectCodec([]byte{0, 0, 1, 0x41, 0x9a}); got != "" {
+		t.Errorf("got %q for a stream without parameter sets", got)
+	}
+}
+
+func TestParseSPS(t *testing.T) {
+	tests := []struct {
+		codec   string
+		sps     string
+		width   int
+		height  int
+		profile string
+		level   string
+	}{
+		{CodecH264, "6764002aacd940780227e5c044000003000400000300323c60c658", 1920, 1080, "High", "4.2"},
+		{CodecH264, "6742c01ed9005005bb011000000300100000030300f1831a80", 1280, 720, "Baseline", "3"},
+		{CodecH265, "420101016000000300900000030000030078a00502016965959a4932bc05a80808082000000300200000030321", 640, 360, "Main", "4"},
+	}
+
+	for _, test := range tests {
+		sps, err := ParseSPS(test.codec, mustHex(t, test.sps))
+		if err != nil {
+			t.Errorf("%v: %v", test.sps, err)
+			continue
+		}
+
+		if sps.Width != test.width || sps.Height != test.height || sps.Profile != test.profile || sps.Level != test.level {
+			t.Errorf("%v: got %+v", test.sps, sps)
+		}
+	}
+
+	_, err := ParseH264SPS([]byte{0x67, 0x64})
+	if err == nil {
+		t.Error("expected an error for a truncated SPS")
+	}
+}
+
+func TestConfigRoundTrip(t *testing.T) {
+	sps := mustHex(t, "6764002aacd940780227e5c044000003000400000300323c60c658")
+	pps := []byte{0x68, 0xeb, 0xe3, 0xcb}
+
+	record, err := AVCConfig(sps, pps)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, gotSPS, gotPPS, err := ParseConfig(CodecH264, record)
+	if err != nil || !bytes.Equal(gotSPS, sps) || !bytes.Equal(gotPPS, pps) {
+		t.Errorf("got sps %x pps %x: %v", gotSPS, gotPPS, err)
+	}
+
+	units := [][]byte{sps, pps, {0x65, 0x88}}
+	data := AppendLengthPrefixed(nil, CodecH264, units)
+
+	annexB, err := AppendAnnexB(nil, data)
+	if err != nil || !bytes.Equal(annexB, []byte{0, 0, 0, 1, 0x65, 0x88}) {
+		t.Errorf("got %x: %v", annexB, err)
+	}
+
+	if _, err := AppendAnnexB(nil, data[:5]); err == nil {
+		t.Error("expected an error for a truncated unit")
+	}
+}
+
+func TestHEVCConfigRoundTrip(t *testing.T) {
+	vps := []byte{0x40, 0x01, 0x0c, 0x01}
+	sps := mustHex(t, "420101016000000300900000030000030078a00502016965959a4932bc05a80808082000000300200000030321")
+	pps := []byte{0x44, 0x01, 0xc1, 0x72}
+
+	record, err := HEVCConfig(vps, sps, pps)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotVPS, gotSPS, gotPPS, err := ParseConfig(CodecH265, record)
+	if err != nil || !bytes.Equal(gotVPS, vps) || !bytes.Equal(gotSPS, sps) || !bytes.Equal(gotPPS, pps) {
+		t.Errorf("got vps %x sps %x pps %x: %v", gotVPS, gotSPS, gotPPS, err)
+	}
+}
+
+func TestCodecString(t *testing.T) {
+	tests := []struct {
+		codec    string
+		sps      string
+		expected string
+	}{
+		{CodecH264, "6764002aacd940780227e5c044000003000400000300323c60c658", "avc1.64002a"},
+		{CodecH264, "6742c01ed9005005bb011000000300100000030300f1831a80", "avc1.42c01e"},
+		{CodecH265, "420101016000000300900000030000030078a00502016965959a4932bc05a80808082000000300200000030321", "hvc1.1.6.L120.90"},
+	}
+
+	for _, test := range tests {
+		got, err := CodecString(test.codec, mustHex(t, test.sps))
+		if err != nil || got != test.expected {
+			t.Errorf("%v: got %q, %v", test.sps, got, err)
+		}
+	}
+
+	if _, err := CodecString(CodecH264, []byte{0x67}); err == nil {
+		t.Error("expected an error for a truncated SPS")
+	}
+}
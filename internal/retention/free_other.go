@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package retention
+
+import "errors"
+
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.New("not supported on this platform")
+}
@@ -0,0 +1,338 @@
+// Package retention deletes old recordings to keep a recording directory
+// within its age and size limits.
+package retention
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"godvr/internal/catalog"
+)
+
+// recordingExts are the extensions of the files managed by Enforce, other
+// files such as logs are neither counted nor deleted.
+var recordingExts = map[string]bool{
+	".mp4":   true,
+	".ts":    true,
+	".mkv":   true,
+	".video": true,
+	".audio": true,
+	".wav":   true,
+}
+
+// eventMarker is part of the names of event clips, e.g.
+// 10.00.00-10.00.30.event.mp4.
+const eventMarker = ".event."
+
+// activeWindow is how long after its last modification a file is considered
+// to be still being written.
+const activeWindow = time.Minute
+
+// Policy limits the recordings kept in a directory. Zero values disable a
+// limit.
+type Policy struct {
+	// MaxAge deletes recordings last modified longer ago.
+	MaxAge time.Duration
+
+	// MaxBytes is the limit of the total size of the recordings.
+	MaxBytes int64
+
+	// MinFreeBytes deletes recordings while the file system holding the
+	// directory has less free space.
+	MinFreeBytes int64
+
+	// ProtectEvents keeps event clips from being deleted for size or free
+	// space, they are still deleted by age.
+	ProtectEvents bool
+}
+
+// Enabled reports whether any limit is set.
+func (p Policy) Enabled() bool {
+	return p.MaxAge > 0 || p.MaxBytes > 0 || p.MinFreeBytes > 0
+}
+
+// Dir is a recording directory and the policy applied to it.
+type Dir struct {
+	Path   string
+	Policy Policy
+}
+
+type recording struct {
+	path    string
+	size    int64
+	modTime time.Time
+	event   bool
+
+	// dir is the index of the Dir holding the recording
+	dir int
+}
+
+// diskFree returns the free space of the file system holding a directory,
+// the tests replace it.
+var diskFree = freeSpace
+
+// Enforce deletes the recordings below dir that exceed the policy, oldest
+// first, and removes the directories left empty and the deleted files from
+// the catalog index in dir, if any. Files modified within the last minute
+// are considered in use and never deleted. It returns the paths of the
+// deleted files.
+func Enforce(dir string, p Policy) ([]string, error) {
+	return EnforceAll([]Dir{{Path: dir, Policy: p}})
+}
+
+// EnforceAll is Enforce for several directories, usually on the same disk.
+// The age and size limits apply to each directory on its own, while the free
+// space floors are met by deleting the oldest recordings of all the
+// directories with a floor first, whichever directory they are in.
+func EnforceAll(dirs []Dir) ([]string, error) {
+	now := time.Now()
+
+	var (
+		deleted []string
+		errs    []string
+		kept    []recording
+	)
+
+	pruned := make([]bool, len(dirs))
+
+	remove := func(r recording) bool {
+		err := os.Remove(r.path)
+		if err != nil {
+			errs = append(errs, err.Error())
+			return false
+		}
+
+		deleted = append(deleted, r.path)
+		pruned[r.dir] = true
+
+		return true
+	}
+
+	for i, d := range dirs {
+		p := d.Policy
+		if !p.Enabled() {
+			continue
+		}
+
+		recordings, err := scan(d.Path)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		var total int64
+		for _, r := range recordings {
+			total += r.size
+		}
+
+		for _, r := range recordings {
+			r.dir = i
+
+			if now.Sub(r.modTime) < activeWindow {
+				continue
+			}
+
+			expired := p.MaxAge > 0 && now.Sub(r.modTime) > p.MaxAge
+			overQuota := p.MaxBytes > 0 && total > p.MaxBytes
+
+			if !expired && (r.event && p.ProtectEvents || !overQuota) {
+				if p.MinFreeBytes > 0 && !(r.event && p.ProtectEvents) {
+					kept = append(kept, r)
+				}
+
+				continue
+			}
+
+			if remove(r) {
+				total -= r.size
+			}
+		}
+	}
+
+	// deleting from one directory never takes space from another, so a
+	// directory whose floor was met stays done
+	sort.SliceStable(kept, func(i, j int) bool {
+		return kept[i].modTime.Before(kept[j].modTime)
+	})
+
+	done := make([]bool, len(dirs))
+
+	for _, r := range kept {
+		if done[r.dir] {
+			continue
+		}
+
+		free, err := diskFree(dirs[r.dir].Path)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("failed to get the free space: %v", err))
+			done[r.dir] = true
+			continue
+		}
+
+		if free >= dirs[r.dir].Policy.MinFreeBytes {
+			done[r.dir] = true
+			continue
+		}
+
+		remove(r)
+	}
+
+	for i, d := range dirs {
+		if !pruned[i] {
+			continue
+		}
+
+		err := pruneDirs(d.Path)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+
+		err = catalog.Compact(d.Path)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("failed to compact the index: %v", err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return deleted, errors.New(strings.Join(errs, "; "))
+	}
+
+	return deleted, nil
+}
+
+// Usage returns the total size of the recordings below dir and the free
+// space of the file system holding it.
+func Usage(dir string) (used, free int64, err error) {
+	recordings, err := scan(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, r := range recordings {
+		used += r.size
+	}
+
+	free, err = freeSpace(dir)
+	if err != nil {
+		return used, 0, fmt.Errorf("failed to get the free space: %v", err)
+	}
+
+	return used, free, nil
+}
+
+// scan returns the recordings below dir, oldest first.
+func scan(dir string) ([]recording, error) {
+	var recordings []recording
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() || !recordingExts[filepath.Ext(path)] {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+
+			return err
+		}
+
+		recordings = append(recordings, recording{
+			path:    path,
+			size:    info.Size(),
+			modTime: info.ModTime(),
+			event:   strings.Contains(d.Name(), eventMarker),
+		})
+
+		return nil
+	})
+
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].modTime.Before(recordings[j].modTime)
+	})
+
+	return recordings, err
+}
+
+// pruneDirs removes the empty directories below dir, deepest first.
+func pruneDirs(dir string) error {
+	var dirs []string
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() && path != dir {
+			dirs = append(dirs, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		entries, err := os.ReadDir(dirs[i])
+		if err != nil || len(entries) > 0 {
+			continue
+		}
+
+		err = os.Remove(dirs[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var sizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"TiB", 1 << 40},
+	{"KB", 1e3},
+	{"MB", 1e6},
+	{"GB", 1e9},
+	{"TB", 1e12},
+	{"B", 1},
+}
+
+// ParseSize parses a size in bytes with an optional unit, e.g. 500MB, 2GiB
+// or 1024.
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	unit := int64(1)
+
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			unit = u.size
+			break
+		}
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+
+	return int64(v * float64(unit)), nil
+}
@@ -0,0 +1,172 @@
+package retention
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"godvr/internal/catalog"
+)
+
+// createFile creates a recording of size bytes last modified age ago.
+func createFile(t *testing.T, path string, size int, age time.Duration) {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(path, make([]byte, size), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modTime := time.Now().Add(-age)
+
+	err = os.Chtimes(path, modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestEnforce(t *testing.T) {
+	dir := t.TempDir()
+	path := func(name string) string {
+		return filepath.Join(dir, filepath.FromSlash(name))
+	}
+
+	createFile(t, path("2021/05/01/10.00.00-10.10.00.mp4"), 100, 72*time.Hour)
+	createFile(t, path("2021/06/01/10.00.00-10.10.00.mp4"), 100, 5*time.Hour)
+	createFile(t, path("2021/06/01/10.10.00-10.10.30.event.mp4"), 100, 4*time.Hour)
+	createFile(t, path("2021/06/01/10.20.00-10.30.00.mp4"), 100, 3*time.Hour)
+	createFile(t, path("2021/06/01/10.30.00.mp4"), 100, 0) // being written
+	createFile(t, path("logs.log"), 1000, 100*time.Hour)
+
+	for _, name := range []string{"2021/05/01/10.00.00-10.10.00.mp4", "2021/06/01/10.30.00.mp4"} {
+		err := catalog.Append(dir, catalog.Segment{Camera: "gate", Path: path(name)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deleted, err := Enforce(dir, Policy{
+		MaxAge:        48 * time.Hour,
+		MaxBytes:      250,
+		ProtectEvents: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the expired file, then the oldest unprotected one for the quota
+	expected := []string{
+		path("2021/05/01/10.00.00-10.10.00.mp4"),
+		path("2021/06/01/10.00.00-10.10.00.mp4"),
+		path("2021/06/01/10.20.00-10.30.00.mp4"),
+	}
+
+	if len(deleted) != len(expected) {
+		t.Fatalf("got deleted %v, expected %v", deleted, expected)
+	}
+
+	for i := range expected {
+		if deleted[i] != expected[i] {
+			t.Errorf("got deleted %v, expected %v", deleted[i], expected[i])
+		}
+	}
+
+	for _, name := range []string{"2021/06/01/10.10.00-10.10.30.event.mp4", "2021/06/01/10.30.00.mp4", "logs.log"} {
+		if !exists(path(name)) {
+			t.Errorf("%v was deleted", name)
+		}
+	}
+
+	if exists(path("2021/05")) {
+		t.Error("empty directories were not removed")
+	}
+
+	if segments, err := catalog.Read(dir); len(segments) != 1 || segments[0].Path != "2021/06/01/10.30.00.mp4" {
+		t.Errorf("deleted files were not removed from the index: %+v %v", segments, err)
+	}
+
+	// the log is not a recording
+	if used, _, err := Usage(dir); used != 200 {
+		t.Errorf("got %d bytes used: %v", used, err)
+	}
+}
+
+func TestEnforceAllFreeSpace(t *testing.T) {
+	root := t.TempDir()
+	path := func(name string) string {
+		return filepath.Join(root, filepath.FromSlash(name))
+	}
+
+	createFile(t, path("gate/2021/06/01/10.00.00-10.10.00.mp4"), 100, 6*time.Hour)
+	createFile(t, path("yard/2021/06/01/10.00.00-10.10.00.mp4"), 100, 5*time.Hour)
+	createFile(t, path("gate/2021/06/01/10.10.00-10.10.30.event.mp4"), 100, 4*time.Hour)
+	createFile(t, path("yard/2021/06/01/10.10.00-10.20.00.mp4"), 100, 3*time.Hour)
+	createFile(t, path("gate/2021/06/01/10.20.00-10.30.00.mp4"), 100, 2*time.Hour)
+
+	// the disk holds 1000 bytes
+	defer func(f func(string) (int64, error)) { diskFree = f }(diskFree)
+	diskFree = func(string) (int64, error) {
+		used, _, err := Usage(root)
+		return 1000 - used, err
+	}
+
+	policy := Policy{MinFreeBytes: 780, ProtectEvents: true}
+
+	deleted, err := EnforceAll([]Dir{
+		{Path: path("gate"), Policy: policy},
+		{Path: path("yard"), Policy: policy},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the oldest of both cameras, skipping the event clip
+	expected := []string{
+		path("gate/2021/06/01/10.00.00-10.10.00.mp4"),
+		path("yard/2021/06/01/10.00.00-10.10.00.mp4"),
+		path("yard/2021/06/01/10.10.00-10.20.00.mp4"),
+	}
+
+	if len(deleted) != len(expected) {
+		t.Fatalf("got deleted %v, expected %v", deleted, expected)
+	}
+
+	for i := range expected {
+		if deleted[i] != expected[i] {
+			t.Errorf("got deleted %v, expected %v", deleted[i], expected[i])
+		}
+	}
+
+	if exists(path("yard/2021")) {
+		t.Error("empty directories were not removed")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int64{
+		"1024":   1024,
+		"500MB":  500e6,
+		"2GiB":   2 << 30,
+		"1.5 GB": 1.5e9,
+	}
+
+	for s, expected := range tests {
+		got, err := ParseSize(s)
+		if err != nil || got != expected {
+			t.Errorf("ParseSize(%q) = %v, %v, expected %v", s, got, err, expected)
+		}
+	}
+
+	if _, err := ParseSize("lots"); err == nil {
+		t.Error("expected an error for an invalid size")
+	}
+}
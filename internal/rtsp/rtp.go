@@ -0,0 +1,181 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"time"
+
+	"godvr/internal/nalu"
+)
+
+const (
+	// maxPayload keeps the RTP packets within a typical 1500 byte MTU
+	maxPayload = 1400
+
+	payloadTypeVideo = 96
+	payloadTypePCMA  = 8
+
+	clockVideo = 90000
+	clockAudio = 8000
+
+	rtpHeaderSize = 12
+)
+
+// rtpTrack numbers the packets of a track. A packet is built once and sent
+// to every client, so the sequence numbers and the SSRC are shared.
+type rtpTrack struct {
+	payloadType byte
+	clock       uint32
+	ssrc        uint32
+	seq         uint16
+	base        uint32
+
+	// the timestamp of the latest packet and when it was sent, for the
+	// sender reports
+	timestamp uint32
+	sent      time.Time
+}
+
+// packet returns an RTP packet with room for size payload bytes.
+func (t *rtpTrack) packet(timestamp uint32, marker bool, size int) []byte {
+	p := make([]byte, rtpHeaderSize, rtpHeaderSize+size)
+	p[0] = 0x80
+	p[1] = t.payloadType
+
+	if marker {
+		p[1] |= 0x80
+	}
+
+	binary.BigEndian.PutUint16(p[2:], t.seq)
+	binary.BigEndian.PutUint32(p[4:], timestamp)
+	binary.BigEndian.PutUint32(p[8:], t.ssrc)
+
+	t.seq++
+
+	return p
+}
+
+// rtpTime converts a frame timestamp to the RTP clock of the track.
+func (t *rtpTrack) rtpTime(d time.Duration) uint32 {
+	return t.base + uint32(int64(d)*int64(t.clock)/int64(time.Second))
+}
+
+// packetizeVideo splits an access unit into RTP packets as specified by RFC
+// 6184 for H.264 and RFC 7798 for H.265, using fragmentation units for NAL
+// units that exceed the payload size. The marker is set on the last packet.
+func (t *rtpTrack) packetizeVideo(codec string, units [][]byte, timestamp uint32) [][]byte {
+	var packets [][]byte
+
+	// access unit delimiters are implied by the marker bit
+	var send [][]byte
+
+	for _, unit := range units {
+		if len(unit) < 2 || isAUD(codec, unit) {
+			continue
+		}
+
+		send = append(send, unit)
+	}
+
+	for i, unit := range send {
+		last := i == len(send)-1
+
+		if len(unit) <= maxPayload {
+			p := t.packet(timestamp, last, len(unit))
+			packets = append(packets, append(p, unit...))
+
+			continue
+		}
+
+		// the fragmentation unit headers replace the NAL unit header
+		var header []byte
+		var payload []byte
+
+		if codec == nalu.CodecH264 {
+			header = []byte{unit[0]&0xE0 | 28, unit[0] & 0x1F}
+			payload = unit[1:]
+		} else {
+			header = []byte{unit[0]&0x81 | 49<<1, unit[1], unit[0] >> 1 & 0x3F}
+			payload = unit[2:]
+		}
+
+		fu := len(header) - 1
+		first := true
+
+		for len(payload) > 0 {
+			n := maxPayload - len(header)
+			if n > len(payload) {
+				n = len(payload)
+			}
+
+			end := n == len(payload)
+
+			h := append([]byte(nil), header...)
+			if first {
+				h[fu] |= 0x80
+			}
+
+			if end {
+				h[fu] |= 0x40
+			}
+
+			p := t.packet(timestamp, last && end, len(h)+n)
+			p = append(p, h...)
+			packets = append(packets, append(p, payload[:n]...))
+
+			payload = payload[n:]
+			first = false
+		}
+	}
+
+	return packets
+}
+
+// packetizeAudio splits G.711 samples into RTP packets, the timestamp
+// advances by one per sample.
+func (t *rtpTrack) packetizeAudio(data []byte, timestamp uint32) [][]byte {
+	var packets [][]byte
+
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxPayload {
+			n = maxPayload
+		}
+
+		p := t.packet(timestamp, false, n)
+		packets = append(packets, append(p, data[:n]...))
+
+		data = data[n:]
+		timestamp += uint32(n)
+	}
+
+	return packets
+}
+
+// senderReport builds an RTCP sender report that maps the wall clock to the
+// RTP clock of the track.
+func senderReport(ssrc uint32, now time.Time, timestamp uint32, packets, octets uint32) []byte {
+	p := make([]byte, 28)
+	p[0] = 0x80
+	p[1] = 200
+	binary.BigEndian.PutUint16(p[2:], 6)
+	binary.BigEndian.PutUint32(p[4:], ssrc)
+
+	// NTP time counts from 1900
+	seconds := uint64(now.Unix() + 2208988800)
+	fraction := uint64(now.Nanosecond()) << 32 / uint64(time.Second)
+	binary.BigEndian.PutUint64(p[8:], seconds<<32|fraction)
+
+	binary.BigEndian.PutUint32(p[16:], timestamp)
+	binary.BigEndian.PutUint32(p[20:], packets)
+	binary.BigEndian.PutUint32(p[24:], octets)
+
+	return p
+}
+
+func isAUD(codec string, unit []byte) bool {
+	if codec == nalu.CodecH264 {
+		return nalu.H264Type(unit) == nalu.H264AUD
+	}
+
+	return nalu.H265Type(unit) == nalu.H265AUD
+}
@@ -0,0 +1,521 @@
+// Package rtsp restreams dvrip frames to RTSP clients.
+//
+// Each camera is a Stream at rtsp://host:port/{name}. The video track is
+// packetized as specified by RFC 6184 (H.264) or RFC 7798 (H.265) and the
+// audio track as G.711 A-law (PCMA). RTP is sent interleaved on the RTSP
+// connection or over UDP to the ports requested by the client; a session
+// lasts as long as its RTSP connection.
+package rtsp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// describeTimeout is how long DESCRIBE waits for the first keyframe of
+	// a stream
+	describeTimeout = 10 * time.Second
+
+	// sessionTimeout is announced to the clients, which send a keep-alive
+	// request within it
+	sessionTimeout = 60
+
+	writeTimeout  = 10 * time.Second
+	reportPeriod  = 5 * time.Second
+	maxBodyLength = 64 << 10
+)
+
+// Server serves the streams of the cameras.
+type Server struct {
+	log *log.Logger
+
+	lock     sync.Mutex
+	streams  map[string]*Stream
+	listener net.Listener
+	conns    map[*conn]struct{}
+}
+
+func NewServer(logger *log.Logger) *Server {
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+
+	return &Server{
+		log:     logger,
+		streams: map[string]*Stream{},
+		conns:   map[*conn]struct{}{},
+	}
+}
+
+// Stream returns the stream with the given name, which is created on first
+// use.
+func (s *Server) Stream(name string) *Stream {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st, ok := s.streams[name]
+	if !ok {
+		st = newStream(name)
+		s.streams[name] = st
+	}
+
+	return st
+}
+
+// RemoveStream removes a stream and disconnects its clients.
+func (s *Server) RemoveStream(name string) {
+	s.lock.Lock()
+	st, ok := s.streams[name]
+	delete(s.streams, name)
+	s.lock.Unlock()
+
+	if ok {
+		st.close()
+	}
+}
+
+func (s *Server) lookup(name string) *Stream {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.streams[name]
+}
+
+// ListenAndServe serves RTSP on the TCP address addr, e.g. ":8554".
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until Close is called.
+func (s *Server) Serve(l net.Listener) error {
+	s.lock.Lock()
+	s.listener = l
+	s.lock.Unlock()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			return err
+		}
+
+		c := &conn{server: s, c: nc, r: bufio.NewReader(nc)}
+
+		s.lock.Lock()
+		s.conns[c] = struct{}{}
+		s.lock.Unlock()
+
+		go c.serve()
+	}
+}
+
+// Close stops the listener and disconnects all clients.
+func (s *Server) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+
+	for c := range s.conns {
+		c.c.Close()
+	}
+
+	return err
+}
+
+// request is an RTSP request.
+type request struct {
+	method string
+	url    *url.URL
+	header textproto.MIMEHeader
+}
+
+// response is an RTSP response.
+type response struct {
+	status int
+	header []string // "Name: value" lines
+	body   string
+}
+
+var statusText = map[int]string{
+	200: "OK",
+	400: "Bad Request",
+	404: "Not Found",
+	454: "Session Not Found",
+	455: "Method Not Valid in This State",
+	459: "Aggregate Operation Not Allowed",
+	461: "Unsupported Transport",
+	500: "Internal Server Error",
+	501: "Not Implemented",
+	503: "Service Unavailable",
+}
+
+// conn is an RTSP connection with at most one session.
+type conn struct {
+	server *Server
+	c      net.Conn
+	r      *bufio.Reader
+
+	wlock sync.Mutex
+
+	session    string
+	stream     *Stream
+	transports [2]transport
+	client     *client
+}
+
+func (c *conn) serve() {
+	defer c.close()
+
+	tp := textproto.NewReader(c.r)
+
+	for {
+		// RTCP receiver reports interleaved by the client
+		b, err := c.r.Peek(1)
+		if err != nil {
+			return
+		}
+
+		if b[0] == '$' {
+			var header [4]byte
+
+			_, err = io.ReadFull(c.r, header[:])
+			if err == nil {
+				_, err = c.r.Discard(int(header[2])<<8 | int(header[3]))
+			}
+
+			if err != nil {
+				return
+			}
+
+			continue
+		}
+
+		req, err := readRequest(tp)
+		if err != nil {
+			if err != io.EOF {
+				c.server.log.Printf("rtsp: %v: %v", c.c.RemoteAddr(), err)
+			}
+
+			return
+		}
+
+		if n, _ := strconv.Atoi(req.header.Get("Content-Length")); n > 0 {
+			if n > maxBodyLength {
+				return
+			}
+
+			_, err = c.r.Discard(n)
+			if err != nil {
+				return
+			}
+		}
+
+		resp := c.handle(req)
+
+		err = c.respond(req, resp)
+		if err != nil || req.method == "TEARDOWN" {
+			return
+		}
+	}
+}
+
+func readRequest(tp *textproto.Reader) (*request, error) {
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Fields(line)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "RTSP/") {
+		return nil, fmt.Errorf("invalid request line: %q", line)
+	}
+
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	req := &request{method: parts[0], header: header}
+
+	if parts[1] == "*" {
+		req.url = &url.URL{Path: "*"}
+		return req, nil
+	}
+
+	req.url, err = url.Parse(parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+func (c *conn) respond(req *request, resp response) error {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "RTSP/1.0 %d %v\r\n", resp.status, statusText[resp.status])
+	fmt.Fprintf(&b, "CSeq: %v\r\n", req.header.Get("CSeq"))
+	fmt.Fprintf(&b, "Server: godvr\r\n")
+
+	for _, h := range resp.header {
+		fmt.Fprintf(&b, "%v\r\n", h)
+	}
+
+	if resp.body != "" {
+		fmt.Fprintf(&b, "Content-Length: %d\r\n", len(resp.body))
+	}
+
+	b.WriteString("\r\n")
+	b.WriteString(resp.body)
+
+	return c.write([]byte(b.String()))
+}
+
+// write writes to the connection, the responses and interleaved packets
+// must not mix.
+func (c *conn) write(bufs ...[]byte) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	c.c.SetWriteDeadline(time.Now().Add(writeTimeout))
+
+	b := net.Buffers(bufs)
+	_, err := b.WriteTo(c.c)
+
+	return err
+}
+
+func (c *conn) handle(req *request) response {
+	if s := req.header.Get("Session"); s != "" && c.session != "" {
+		if id := strings.SplitN(s, ";", 2)[0]; strings.TrimSpace(id) != c.session {
+			return response{status: 454}
+		}
+	}
+
+	switch req.method {
+	case "OPTIONS":
+		return response{status: 200, header: []string{"Public: OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER, SET_PARAMETER"}}
+	case "DESCRIBE":
+		return c.describe(req)
+	case "SETUP":
+		return c.setup(req)
+	case "PLAY":
+		return c.play(req)
+	case "TEARDOWN":
+		return c.withSession(response{status: 200})
+	case "GET_PARAMETER", "SET_PARAMETER":
+		return c.withSession(response{status: 200})
+	}
+
+	return response{status: 501}
+}
+
+func (c *conn) withSession(resp response) response {
+	if c.session != "" {
+		resp.header = append(resp.header, fmt.Sprintf("Session: %v;timeout=%d", c.session, sessionTimeout))
+	}
+
+	return resp
+}
+
+// streamPath splits the path of a request URL into the stream name and the
+// track ID, which is -1 for the aggregate URL.
+func streamPath(u *url.URL) (string, int) {
+	path := strings.Trim(u.Path, "/")
+
+	i := strings.LastIndex(path, "/")
+	if i >= 0 && strings.HasPrefix(path[i+1:], "trackID=") {
+		track, err := strconv.Atoi(strings.TrimPrefix(path[i+1:], "trackID="))
+		if err == nil {
+			return path[:i], track
+		}
+	}
+
+	return path, -1
+}
+
+func (c *conn) describe(req *request) response {
+	name, _ := streamPath(req.url)
+
+	st := c.server.lookup(name)
+	if st == nil {
+		return response{status: 404}
+	}
+
+	host, _, _ := net.SplitHostPort(c.c.LocalAddr().String())
+
+	sdp, err := st.describe(host, describeTimeout)
+	if err != nil {
+		c.server.log.Printf("rtsp: %v", err)
+		return response{status: 503}
+	}
+
+	base := *req.url
+	base.Path = "/" + name + "/"
+
+	return response{
+		status: 200,
+		header: []string{"Content-Type: application/sdp", "Content-Base: " + base.String()},
+		body:   sdp,
+	}
+}
+
+func (c *conn) setup(req *request) response {
+	if c.client != nil {
+		return response{status: 455}
+	}
+
+	name, track := streamPath(req.url)
+	if track < 0 {
+		return response{status: 459}
+	}
+
+	st := c.server.lookup(name)
+	if st == nil || !st.hasTrack(track) {
+		return response{status: 404}
+	}
+
+	if c.stream != nil && c.stream != st {
+		return response{status: 459}
+	}
+
+	t, reply, err := c.newTransport(req.header.Get("Transport"))
+	if err != nil {
+		c.server.log.Printf("rtsp: %v: %v", c.c.RemoteAddr(), err)
+		return response{status: 461}
+	}
+
+	if old := c.transports[track]; old != nil {
+		old.close()
+	}
+
+	c.stream = st
+	c.transports[track] = t
+
+	if c.session == "" {
+		id := make([]byte, 8)
+		rand.Read(id)
+		c.session = hex.EncodeToString(id)
+	}
+
+	return c.withSession(response{status: 200, header: []string{"Transport: " + reply}})
+}
+
+func (c *conn) play(req *request) response {
+	if c.stream == nil {
+		return response{status: 455}
+	}
+
+	if c.client == nil {
+		var tracks [2]bool
+		for i, t := range c.transports {
+			tracks[i] = t != nil
+		}
+
+		client, err := c.stream.play(tracks)
+		if err != nil {
+			return response{status: 404}
+		}
+
+		c.client = client
+
+		go c.send(c.stream, client)
+	}
+
+	return c.withSession(response{status: 200, header: []string{"Range: npt=0.000-"}})
+}
+
+// send writes the queued packets of a client and the sender reports until
+// the client stops.
+func (c *conn) send(st *Stream, cl *client) {
+	ticker := time.NewTicker(reportPeriod)
+	defer ticker.Stop()
+
+	var packets, octets [2]uint32
+
+	for {
+		select {
+		case b := <-cl.queue:
+			t := c.transports[b.track]
+
+			for _, p := range b.packets {
+				err := t.writeRTP(p)
+				if err != nil {
+					c.c.Close()
+					return
+				}
+
+				packets[b.track]++
+				octets[b.track] += uint32(len(p) - rtpHeaderSize)
+			}
+		case now := <-ticker.C:
+			for track, t := range c.transports {
+				if t == nil {
+					continue
+				}
+
+				ssrc, timestamp, ok := st.report(track, now)
+				if !ok {
+					continue
+				}
+
+				err := t.writeRTCP(senderReport(ssrc, now, timestamp, packets[track], octets[track]))
+				if err != nil {
+					c.c.Close()
+					return
+				}
+			}
+		case <-cl.done:
+			// the stream was removed or changed its codec
+			c.c.Close()
+			return
+		}
+	}
+}
+
+func (c *conn) close() {
+	if c.client != nil {
+		c.stream.stop(c.client)
+
+		if c.client.dropped > 0 {
+			c.server.log.Printf("rtsp: %v: dropped %d frames of %v", c.c.RemoteAddr(), c.client.dropped, c.stream.name)
+		}
+	}
+
+	for _, t := range c.transports {
+		if t != nil {
+			t.close()
+		}
+	}
+
+	c.c.Close()
+
+	c.server.lock.Lock()
+	delete(c.server.conns, c)
+	c.server.lock.Unlock()
+}
@@ -0,0 +1,264 @@
+package rtsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"godvr/internal/dvrip"
+	"godvr/internal/mediatest"
+	"godvr/internal/nalu"
+)
+
+func TestPacketizeVideo(t *testing.T) {
+	track := &rtpTrack{payloadType: payloadTypeVideo, clock: clockVideo, seq: 65535}
+
+	unit := append([]byte{0x65}, bytes.Repeat([]byte{0xAB}, 3000)...)
+	packets := track.packetizeVideo(nalu.CodecH264, [][]byte{{0x09, 0xF0}, mediatest.SPS, unit}, 1234)
+
+	// the SPS and three fragments, the AUD is dropped
+	if len(packets) != 4 {
+		t.Fatalf("got %d packets", len(packets))
+	}
+
+	if !bytes.Equal(packets[0][rtpHeaderSize:], mediatest.SPS) || packets[0][1]&0x80 != 0 {
+		t.Errorf("unexpected first packet: %x", packets[0][:rtpHeaderSize+4])
+	}
+
+	var reassembled []byte
+
+	for i, p := range packets[1:] {
+		// the sequence number wraps after the SPS
+		if seq := binary.BigEndian.Uint16(p[2:]); seq != uint16(i) {
+			t.Errorf("packet %d: got sequence number %d", i+1, seq)
+		}
+
+		if ts := binary.BigEndian.Uint32(p[4:]); ts != 1234 {
+			t.Errorf("packet %d: got timestamp %d", i+1, ts)
+		}
+
+		indicator, header := p[rtpHeaderSize], p[rtpHeaderSize+1]
+		if indicator != 0x60|28 || header&0x1F != 5 {
+			t.Errorf("packet %d: unexpected FU-A header %x %x", i+1, indicator, header)
+		}
+
+		start, end, marker := header&0x80 != 0, header&0x40 != 0, p[1]&0x80 != 0
+		if start != (i == 0) || end != (i == 2) || marker != (i == 2) {
+			t.Errorf("packet %d: got start=%v end=%v marker=%v", i+1, start, end, marker)
+		}
+
+		if len(p) > rtpHeaderSize+maxPayload {
+			t.Errorf("packet %d: got %d bytes", i+1, len(p))
+		}
+
+		reassembled = append(reassembled, p[rtpHeaderSize+2:]...)
+	}
+
+	if !bytes.Equal(reassembled, unit[1:]) {
+		t.Error("fragments do not add up to the NAL unit")
+	}
+}
+
+func TestPacketizeH265(t *testing.T) {
+	track := &rtpTrack{payloadType: payloadTypeVideo, clock: clockVideo}
+
+	// an IDR_W_RADL slice
+	unit := append([]byte{19 << 1, 0x01}, bytes.Repeat([]byte{0xAB}, 2000)...)
+	packets := track.packetizeVideo(nalu.CodecH265, [][]byte{unit}, 0)
+
+	if len(packets) != 2 {
+		t.Fatalf("got %d packets", len(packets))
+	}
+
+	for i, p := range packets {
+		h := p[rtpHeaderSize : rtpHeaderSize+3]
+		if h[0]>>1&0x3F != 49 || h[1] != 0x01 || h[2]&0x3F != 19 {
+			t.Errorf("packet %d: unexpected FU header %x", i, h)
+		}
+	}
+}
+
+// testClient is an RTSP client that receives interleaved packets.
+type testClient struct {
+	t    *testing.T
+	c    net.Conn
+	r    *bufio.Reader
+	cseq int
+}
+
+func dial(t *testing.T, addr string) *testClient {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	return &testClient{t: t, c: c, r: bufio.NewReader(c)}
+}
+
+func (c *testClient) do(method, url string, header ...string) (int, textproto.MIMEHeader, string) {
+	c.cseq++
+
+	fmt.Fprintf(c.c, "%v %v RTSP/1.0\r\nCSeq: %d\r\n%v\r\n", method, url, c.cseq, strings.Join(append(header, ""), "\r\n"))
+
+	tp := textproto.NewReader(c.r)
+
+	line, err := tp.ReadLine()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	var status int
+	fmt.Sscanf(line, "RTSP/1.0 %d", &status)
+
+	h, err := tp.ReadMIMEHeader()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	if h.Get("CSeq") != fmt.Sprint(c.cseq) {
+		c.t.Errorf("got CSeq %v, expected %d", h.Get("CSeq"), c.cseq)
+	}
+
+	var body []byte
+
+	var n int
+	fmt.Sscan(h.Get("Content-Length"), &n)
+
+	if n > 0 {
+		body = make([]byte, n)
+		if _, err := io.ReadFull(c.r, body); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+
+	return status, h, string(body)
+}
+
+// packet reads the next interleaved packet.
+func (c *testClient) packet() (byte, []byte) {
+	var header [4]byte
+
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		c.t.Fatal(err)
+	}
+
+	if header[0] != '$' {
+		c.t.Fatalf("unexpected data: %x", header)
+	}
+
+	p := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(c.r, p); err != nil {
+		c.t.Fatal(err)
+	}
+
+	return header[1], p
+}
+
+func TestServer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(nil)
+	defer s.Close()
+
+	go s.Serve(l)
+
+	stream := s.Stream("gate")
+	stream.WriteFrame(&dvrip.Frame{Data: bytes.Repeat([]byte{0xd5}, 320), Meta: dvrip.MetaInfo{Type: "G711A"}})
+	stream.WriteFrame(mediatest.VideoFrame(true, 0, 100))
+
+	url := "rtsp://" + l.Addr().String() + "/gate"
+
+	var clients []*testClient
+
+	for i := 0; i < 2; i++ {
+		c := dial(t, l.Addr().String())
+		defer c.c.Close()
+
+		if status, _, _ := c.do("DESCRIBE", url+"/missing"); status != 404 {
+			t.Errorf("got status %d for a missing stream", status)
+		}
+
+		status, h, sdp := c.do("DESCRIBE", url, "Accept: application/sdp")
+		if status != 200 {
+			t.Fatalf("DESCRIBE: got status %d", status)
+		}
+
+		for _, line := range []string{"a=rtpmap:96 H264/90000", "profile-level-id=64002A", "a=rtpmap:8 PCMA/8000", "a=control:trackID=1"} {
+			if !strings.Contains(sdp, line) {
+				t.Errorf("SDP does not contain %q:\n%v", line, sdp)
+			}
+		}
+
+		base := h.Get("Content-Base")
+
+		status, h, _ = c.do("SETUP", base+"trackID=0", "Transport: RTP/AVP/TCP;unicast;interleaved=0-1")
+		if status != 200 || !strings.Contains(h.Get("Transport"), "interleaved=0-1") {
+			t.Fatalf("SETUP: got status %d, transport %v", status, h.Get("Transport"))
+		}
+
+		session := strings.SplitN(h.Get("Session"), ";", 2)[0]
+
+		status, _, _ = c.do("SETUP", base+"trackID=1", "Transport: RTP/AVP/TCP;unicast;interleaved=2-3", "Session: "+session)
+		if status != 200 {
+			t.Fatalf("SETUP: got status %d", status)
+		}
+
+		if status, _, _ = c.do("PLAY", base, "Session: wrong"); status != 454 {
+			t.Errorf("got status %d for a wrong session", status)
+		}
+
+		if status, _, _ = c.do("PLAY", base, "Session: "+session); status != 200 {
+			t.Fatalf("PLAY: got status %d", status)
+		}
+
+		clients = append(clients, c)
+	}
+
+	// both clients wait for a keyframe
+	stream.WriteFrame(mediatest.VideoFrame(false, 40*time.Millisecond, 10))
+	stream.WriteFrame(mediatest.VideoFrame(true, 80*time.Millisecond, 2000))
+	stream.WriteFrame(&dvrip.Frame{Data: bytes.Repeat([]byte{0xd5}, 320), Meta: dvrip.MetaInfo{Type: "G711A"}, PTS: 80 * time.Millisecond})
+
+	for i, c := range clients {
+		var channels []byte
+
+		for len(channels) < 5 {
+			channel, p := c.packet()
+			channels = append(channels, channel)
+
+			if channel == 0 && binary.BigEndian.Uint32(p[4:]) != stream.tracks[trackVideo].base+7200 {
+				t.Errorf("client %d: got timestamp %d", i, binary.BigEndian.Uint32(p[4:]))
+			}
+		}
+
+		// SPS, PPS, two fragments of the IDR slice and the audio
+		if !bytes.Equal(channels, []byte{0, 0, 0, 0, 2}) {
+			t.Errorf("client %d: got packets on channels %v", i, channels)
+		}
+	}
+
+	if n := stream.Clients(); n != 2 {
+		t.Errorf("got %d clients", n)
+	}
+
+	s.RemoveStream("gate")
+
+	// the removed stream disconnects its clients
+	for i, c := range clients {
+		if _, err := c.r.ReadByte(); err != io.EOF {
+			t.Errorf("client %d: got %v, expected EOF", i, err)
+		}
+	}
+}
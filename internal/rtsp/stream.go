@@ -0,0 +1,344 @@
+package rtsp
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"godvr/internal/dvrip"
+	"godvr/internal/nalu"
+)
+
+const (
+	trackVideo = 0
+	trackAudio = 1
+)
+
+// clientQueue is the number of frames buffered for a client, a client that
+// falls further behind loses frames until the next keyframe.
+const clientQueue = 256
+
+// batch is the packets of a frame.
+type batch struct {
+	track    int
+	keyframe bool
+	packets  [][]byte
+}
+
+// client is a playing session of a stream.
+type client struct {
+	queue chan batch
+	done  chan struct{}
+
+	// tracks that were set up
+	tracks [2]bool
+
+	// waiting drops the frames until the next keyframe, after joining the
+	// stream and after frames were dropped
+	waiting bool
+	dropped int
+}
+
+// Stream is the live stream of a camera. Every frame written to it is
+// packetized once and the packets are queued for each playing client, so a
+// slow client never holds up the writer.
+type Stream struct {
+	name string
+
+	lock sync.Mutex
+
+	codec         string
+	vps, sps, pps []byte
+	audio         bool
+	ready         chan struct{}
+
+	tracks [2]rtpTrack
+
+	// offset continues the timestamps after a restart of the source
+	offset time.Duration
+	last   time.Duration
+
+	clients map[*client]struct{}
+	closed  bool
+}
+
+func newStream(name string) *Stream {
+	s := &Stream{
+		name:    name,
+		ready:   make(chan struct{}),
+		clients: map[*client]struct{}{},
+	}
+
+	s.tracks[trackVideo] = rtpTrack{payloadType: payloadTypeVideo, clock: clockVideo}
+	s.tracks[trackAudio] = rtpTrack{payloadType: payloadTypePCMA, clock: clockAudio}
+
+	for i := range s.tracks {
+		t := &s.tracks[i]
+		t.ssrc = rand.Uint32()
+		t.seq = uint16(rand.Uint32())
+		t.base = rand.Uint32()
+	}
+
+	return s
+}
+
+// Restart tells the stream that the source reconnected and its timestamps
+// start at zero again.
+func (s *Stream) Restart() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.offset = s.last + 100*time.Millisecond
+
+	for c := range s.clients {
+		c.waiting = true
+	}
+}
+
+// WriteFrame sends a frame to the playing clients. The frame is not
+// retained, so it can be released afterwards.
+func (s *Stream) WriteFrame(frame *dvrip.Frame) {
+	isVideo := frame.Meta.Type == nalu.CodecH264 || frame.Meta.Type == nalu.CodecH265
+	isAudio := frame.Meta.Type == "G711A"
+
+	if !isVideo && !isAudio {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	pts := frame.PTS + s.offset
+	if pts > s.last {
+		s.last = pts
+	}
+
+	b := batch{keyframe: frame.Keyframe}
+
+	if isAudio {
+		s.audio = true
+
+		t := &s.tracks[trackAudio]
+		t.timestamp, t.sent = t.rtpTime(pts), time.Now()
+
+		b.track = trackAudio
+		b.packets = t.packetizeAudio(frame.Data, t.timestamp)
+	} else {
+		if frame.Meta.Type != s.codec {
+			if s.codec != "" {
+				// the clients have to describe the stream again
+				s.closeClients()
+				s.ready = make(chan struct{})
+				s.vps, s.sps, s.pps = nil, nil, nil
+			}
+
+			s.codec = frame.Meta.Type
+		}
+
+		s.setParameterSets(frame)
+
+		units := frame.NALUs
+		if units == nil {
+			units = nalu.Split(frame.Data)
+		}
+
+		t := &s.tracks[trackVideo]
+		t.timestamp, t.sent = t.rtpTime(pts), time.Now()
+
+		b.track = trackVideo
+		b.packets = t.packetizeVideo(s.codec, units, t.timestamp)
+	}
+
+	s.deliver(b)
+}
+
+// setParameterSets keeps the latest parameter sets for the SDP.
+func (s *Stream) setParameterSets(frame *dvrip.Frame) {
+	if frame.SPS != nil {
+		s.sps = append(s.sps[:0], frame.SPS...)
+	}
+
+	if frame.PPS != nil {
+		s.pps = append(s.pps[:0], frame.PPS...)
+	}
+
+	if frame.VPS != nil {
+		s.vps = append(s.vps[:0], frame.VPS...)
+	}
+
+	complete := s.sps != nil && s.pps != nil && (s.codec == nalu.CodecH264 || s.vps != nil)
+
+	select {
+	case <-s.ready:
+	default:
+		if complete {
+			close(s.ready)
+		}
+	}
+}
+
+func (s *Stream) deliver(b batch) {
+	for c := range s.clients {
+		if !c.tracks[b.track] {
+			continue
+		}
+
+		if c.waiting && c.tracks[trackVideo] {
+			if b.track != trackVideo || !b.keyframe {
+				continue
+			}
+
+			c.waiting = false
+		}
+
+		select {
+		case c.queue <- b:
+		default:
+			c.waiting = true
+			c.dropped++
+		}
+	}
+}
+
+// describe waits until the parameter sets of the stream are known and
+// returns its SDP.
+func (s *Stream) describe(host string, timeout time.Duration) (string, error) {
+	s.lock.Lock()
+	ready := s.ready
+	s.lock.Unlock()
+
+	select {
+	case <-ready:
+	case <-time.After(timeout):
+		return "", fmt.Errorf("no keyframe received from %v", s.name)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "v=0\r\n")
+	fmt.Fprintf(&b, "o=- %d 1 IN IP4 %v\r\n", s.tracks[trackVideo].ssrc, host)
+	fmt.Fprintf(&b, "s=%v\r\n", s.name)
+	fmt.Fprintf(&b, "c=IN IP4 0.0.0.0\r\n")
+	fmt.Fprintf(&b, "t=0 0\r\n")
+	fmt.Fprintf(&b, "a=control:*\r\n")
+
+	fmt.Fprintf(&b, "m=video 0 RTP/AVP %d\r\n", payloadTypeVideo)
+
+	encode := base64.StdEncoding.EncodeToString
+
+	if s.codec == nalu.CodecH264 {
+		fmt.Fprintf(&b, "a=rtpmap:%d H264/%d\r\n", payloadTypeVideo, clockVideo)
+		fmt.Fprintf(&b, "a=fmtp:%d packetization-mode=1", payloadTypeVideo)
+
+		if len(s.sps) >= 4 {
+			fmt.Fprintf(&b, ";profile-level-id=%v", strings.ToUpper(hex.EncodeToString(s.sps[1:4])))
+		}
+
+		fmt.Fprintf(&b, ";sprop-parameter-sets=%v,%v\r\n", encode(s.sps), encode(s.pps))
+	} else {
+		fmt.Fprintf(&b, "a=rtpmap:%d H265/%d\r\n", payloadTypeVideo, clockVideo)
+		fmt.Fprintf(&b, "a=fmtp:%d sprop-vps=%v;sprop-sps=%v;sprop-pps=%v\r\n",
+			payloadTypeVideo, encode(s.vps), encode(s.sps), encode(s.pps))
+	}
+
+	fmt.Fprintf(&b, "a=control:trackID=%d\r\n", trackVideo)
+
+	if s.audio {
+		fmt.Fprintf(&b, "m=audio 0 RTP/AVP %d\r\n", payloadTypePCMA)
+		fmt.Fprintf(&b, "a=rtpmap:%d PCMA/%d\r\n", payloadTypePCMA, clockAudio)
+		fmt.Fprintf(&b, "a=control:trackID=%d\r\n", trackAudio)
+	}
+
+	return b.String(), nil
+}
+
+// hasTrack reports whether the stream has a track with the given ID.
+func (s *Stream) hasTrack(track int) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return track == trackVideo || track == trackAudio && s.audio
+}
+
+// play adds a client for the tracks that were set up.
+func (s *Stream) play(tracks [2]bool) (*client, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return nil, fmt.Errorf("stream %v is closed", s.name)
+	}
+
+	c := &client{
+		queue:   make(chan batch, clientQueue),
+		done:    make(chan struct{}),
+		tracks:  tracks,
+		waiting: true,
+	}
+
+	s.clients[c] = struct{}{}
+
+	return c, nil
+}
+
+// stop removes a client.
+func (s *Stream) stop(c *client) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.clients[c]; ok {
+		delete(s.clients, c)
+		close(c.done)
+	}
+}
+
+// report returns the SSRC and the current RTP timestamp of a track for a
+// sender report, ok is false until a packet was sent.
+func (s *Stream) report(track int, now time.Time) (ssrc, timestamp uint32, ok bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	t := &s.tracks[track]
+	if t.sent.IsZero() {
+		return 0, 0, false
+	}
+
+	elapsed := now.Sub(t.sent)
+
+	return t.ssrc, t.timestamp + uint32(int64(elapsed)*int64(t.clock)/int64(time.Second)), true
+}
+
+// Clients returns the number of playing clients.
+func (s *Stream) Clients() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.clients)
+}
+
+// closeClients ends the sessions of all clients.
+func (s *Stream) closeClients() {
+	for c := range s.clients {
+		delete(s.clients, c)
+		close(c.done)
+	}
+}
+
+func (s *Stream) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closed = true
+	s.closeClients()
+}
@@ -0,0 +1,156 @@
+package rtsp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// transport sends the RTP and RTCP packets of a track to a client.
+type transport interface {
+	writeRTP(p []byte) error
+	writeRTCP(p []byte) error
+	close()
+}
+
+// interleaved sends the packets on the RTSP connection, framed as specified
+// by RFC 2326 section 10.12.
+type interleaved struct {
+	c       *conn
+	channel byte
+}
+
+func (t *interleaved) writeRTP(p []byte) error {
+	return t.c.write([]byte{'$', t.channel, byte(len(p) >> 8), byte(len(p))}, p)
+}
+
+func (t *interleaved) writeRTCP(p []byte) error {
+	return t.c.write([]byte{'$', t.channel + 1, byte(len(p) >> 8), byte(len(p))}, p)
+}
+
+func (t *interleaved) close() {}
+
+// udp sends the packets from a pair of sockets to the client ports.
+type udp struct {
+	rtp, rtcp         *net.UDPConn
+	rtpAddr, rtcpAddr *net.UDPAddr
+}
+
+func (t *udp) writeRTP(p []byte) error {
+	_, err := t.rtp.WriteToUDP(p, t.rtpAddr)
+	return err
+}
+
+func (t *udp) writeRTCP(p []byte) error {
+	_, err := t.rtcp.WriteToUDP(p, t.rtcpAddr)
+	return err
+}
+
+func (t *udp) close() {
+	t.rtp.Close()
+	t.rtcp.Close()
+}
+
+// newTransport picks the first transport of a Transport header that is
+// supported and returns it with the Transport header of the reply.
+func (c *conn) newTransport(header string) (transport, string, error) {
+	for _, spec := range strings.Split(header, ",") {
+		params := strings.Split(strings.TrimSpace(spec), ";")
+		profile := params[0]
+
+		values := map[string]string{}
+		for _, p := range params[1:] {
+			kv := strings.SplitN(p, "=", 2)
+			if len(kv) == 2 {
+				values[kv[0]] = kv[1]
+			} else {
+				values[kv[0]] = ""
+			}
+		}
+
+		if _, ok := values["multicast"]; ok {
+			continue
+		}
+
+		switch profile {
+		case "RTP/AVP/TCP":
+			first, _, err := portRange(values["interleaved"])
+			if err != nil || first > 254 {
+				continue
+			}
+
+			reply := fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", first, first+1)
+
+			return &interleaved{c: c, channel: byte(first)}, reply, nil
+		case "RTP/AVP", "RTP/AVP/UDP":
+			first, second, err := portRange(values["client_port"])
+			if err != nil {
+				continue
+			}
+
+			t, err := c.newUDP(first, second)
+			if err != nil {
+				return nil, "", err
+			}
+
+			reply := fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;server_port=%d-%d",
+				first, second, t.rtp.LocalAddr().(*net.UDPAddr).Port, t.rtcp.LocalAddr().(*net.UDPAddr).Port)
+
+			return t, reply, nil
+		}
+	}
+
+	return nil, "", fmt.Errorf("unsupported transport: %q", header)
+}
+
+// newUDP opens the sockets that send to the client ports on the address of
+// the RTSP client.
+func (c *conn) newUDP(rtpPort, rtcpPort int) (*udp, error) {
+	local, ok := c.c.LocalAddr().(*net.TCPAddr)
+	remote, ok2 := c.c.RemoteAddr().(*net.TCPAddr)
+
+	if !ok || !ok2 {
+		return nil, errors.New("UDP needs a TCP connection")
+	}
+
+	rtp, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		return nil, err
+	}
+
+	rtcp, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		rtp.Close()
+		return nil, err
+	}
+
+	return &udp{
+		rtp:      rtp,
+		rtcp:     rtcp,
+		rtpAddr:  &net.UDPAddr{IP: remote.IP, Port: rtpPort, Zone: remote.Zone},
+		rtcpAddr: &net.UDPAddr{IP: remote.IP, Port: rtcpPort, Zone: remote.Zone},
+	}, nil
+}
+
+// portRange parses "a-b", b defaults to a+1.
+func portRange(s string) (int, int, error) {
+	parts := strings.SplitN(s, "-", 2)
+
+	first, err := strconv.Atoi(parts[0])
+	if err != nil || first < 0 || first > 65534 {
+		return 0, 0, fmt.Errorf("invalid port range: %q", s)
+	}
+
+	second := first + 1
+
+	if len(parts) == 2 {
+		second, err = strconv.Atoi(parts[1])
+		if err != nil || second < 0 || second > 65535 {
+			return 0, 0, fmt.Errorf("invalid port range: %q", s)
+		}
+	}
+
+	return first, second, nil
+}
@@ -0,0 +1,175 @@
+package wav
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// maxChunkSize limits the chunks before the samples that are read into
+// memory.
+const maxChunkSize = 1 << 16
+
+var errInvalidFile = errors.New("wav: invalid file")
+
+// Reader reads the samples of a mono WAVE file as written by Writer.
+type Reader struct {
+	r          io.Reader
+	format     Format
+	sampleRate int
+
+	// remaining is the size of the samples left, -1 for a file cut short
+	// whose header has a zero size and that is read until its end
+	remaining int64
+
+	buf []byte
+}
+
+// NewReader reads the header of r up to the samples.
+func NewReader(r io.Reader) (*Reader, error) {
+	reader := &Reader{r: r}
+
+	var riff [12]byte
+
+	_, err := io.ReadFull(r, riff[:])
+	if err != nil {
+		return nil, err
+	}
+
+	if string(riff[:4]) != "RIFF" || string(riff[8:]) != "WAVE" {
+		return nil, errInvalidFile
+	}
+
+	for {
+		var chunk [8]byte
+
+		_, err := io.ReadFull(r, chunk[:])
+		if err != nil {
+			if err == io.EOF {
+				err = errors.New("wav: data chunk not found")
+			}
+
+			return nil, err
+		}
+
+		id, size := string(chunk[:4]), int64(binary.LittleEndian.Uint32(chunk[4:]))
+
+		if id == "data" {
+			if reader.format == 0 {
+				return nil, errors.New("wav: fmt chunk not found")
+			}
+
+			reader.remaining = size
+			if size == 0 {
+				reader.remaining = -1
+			}
+
+			return reader, nil
+		}
+
+		// the chunks are padded to an even size
+		size += size % 2
+
+		if id != "fmt " {
+			_, err = io.CopyN(io.Discard, r, size)
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		if size < 16 || size > maxChunkSize {
+			return nil, errInvalidFile
+		}
+
+		b := make([]byte, size)
+
+		_, err = io.ReadFull(r, b)
+		if err != nil {
+			return nil, err
+		}
+
+		err = reader.parseFormat(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (r *Reader) parseFormat(b []byte) error {
+	format := Format(binary.LittleEndian.Uint16(b))
+	channels := binary.LittleEndian.Uint16(b[2:])
+	bits := int(binary.LittleEndian.Uint16(b[14:]))
+
+	if format != PCM && format != ALaw && format != MuLaw {
+		return errors.New("wav: unsupported format")
+	}
+
+	if channels != 1 || bits != format.bitsPerSample() {
+		return errors.New("wav: only mono files of 16-bit PCM and G.711 are supported")
+	}
+
+	r.format = format
+	r.sampleRate = int(binary.LittleEndian.Uint32(b[4:]))
+
+	return nil
+}
+
+// Format returns the encoding of the samples.
+func (r *Reader) Format() Format {
+	return r.format
+}
+
+// SampleRate returns the number of samples per second.
+func (r *Reader) SampleRate() int {
+	return r.sampleRate
+}
+
+// Read reads encoded samples in the format of the file, e.g. the G.711 data
+// of a file in that encoding.
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+
+	if r.remaining > 0 && int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+
+	n, err := r.r.Read(p)
+	if r.remaining > 0 {
+		r.remaining -= int64(n)
+	}
+
+	return n, err
+}
+
+// ReadSamples reads up to len(dst) samples of a PCM file and returns the
+// number read, io.EOF after the last one.
+func (r *Reader) ReadSamples(dst []int16) (int, error) {
+	if r.format != PCM {
+		return 0, errors.New("not a PCM file")
+	}
+
+	if cap(r.buf) < 2*len(dst) {
+		r.buf = make([]byte, 2*len(dst))
+	}
+
+	b := r.buf[:2*len(dst)]
+
+	n, err := io.ReadFull(r, b)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+
+	for i := 0; i < n/2; i++ {
+		dst[i] = int16(binary.LittleEndian.Uint16(b[2*i:]))
+	}
+
+	if n/2 == 0 && err == nil {
+		err = io.EOF
+	}
+
+	return n / 2, err
+}
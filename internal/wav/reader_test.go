@@ -0,0 +1,94 @@
+package wav
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFile writes a file with the data as written by write.
+func writeFile(t *testing.T, format Format, write func(w *Writer) error) []byte {
+	path := filepath.Join(t.TempDir(), "audio.wav")
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w, err := NewWriter(f, format, 8000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := write(w); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestReader(t *testing.T) {
+	alaw := writeFile(t, ALaw, func(w *Writer) error {
+		_, err := w.Write([]byte{0xD5, 0x55, 0xD4})
+		return err
+	})
+
+	r, err := NewReader(bytes.NewReader(alaw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the padding is not a sample
+	if b, err := io.ReadAll(r); r.Format() != ALaw || r.SampleRate() != 8000 || !bytes.Equal(b, []byte{0xD5, 0x55, 0xD4}) {
+		t.Errorf("got format %d, rate %d and %x: %v", r.Format(), r.SampleRate(), b, err)
+	}
+
+	pcm := writeFile(t, PCM, func(w *Writer) error {
+		return w.WriteSamples([]int16{1, -2, 3})
+	})
+
+	// a file cut short by a crash keeps zero sizes
+	for _, b := range [][]byte{pcm, append(pcm[:40:40], 0, 0, 0, 0, 1, 0, 0xFE, 0xFF, 3, 0)} {
+		r, err := NewReader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []int16
+
+		samples := make([]int16, 2)
+
+		for {
+			n, err := r.ReadSamples(samples)
+			got = append(got, samples[:n]...)
+
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if len(got) != 3 || got[0] != 1 || got[1] != -2 || got[2] != 3 {
+			t.Errorf("got samples %v", got)
+		}
+	}
+
+	if _, err := NewReader(bytes.NewReader(alaw[:20])); err == nil {
+		t.Error("expected an error for a truncated header")
+	}
+}
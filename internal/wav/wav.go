@@ -0,0 +1,195 @@
+// Package wav writes and reads mono WAVE files of linear PCM or G.711,
+// which every player and audio tool reads.
+//
+// The sizes in the header are only known at the end, so Close seeks back to
+// write them. A file cut short by a crash keeps zero sizes in its header,
+// which most tools read as "until the end of the file".
+package wav
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// riffSizeAt is the offset of the size of the RIFF chunk, the whole file
+// but the first 8 bytes.
+const riffSizeAt = 4
+
+// Format is the encoding of the samples.
+type Format uint16
+
+const (
+	// PCM is 16-bit signed little-endian linear PCM.
+	PCM Format = 1
+
+	// ALaw and MuLaw are G.711 with one byte per sample.
+	ALaw  Format = 6
+	MuLaw Format = 7
+)
+
+// bitsPerSample returns the size of a sample of the format.
+func (f Format) bitsPerSample() int {
+	if f == PCM {
+		return 16
+	}
+
+	return 8
+}
+
+// Writer writes the samples of a WAVE file.
+type Writer struct {
+	w      io.WriteSeeker
+	format Format
+
+	// header is the size of the header, the samples start there
+	header int64
+
+	// factAt and dataAt are the offsets of the sample count, which only
+	// the formats other than PCM have, and of the size of the data chunk
+	factAt, dataAt int64
+
+	size   int64
+	closed bool
+}
+
+// header builds the little-endian header of a file.
+type header []byte
+
+func (h *header) put16(v int) {
+	*h = append(*h, byte(v), byte(v>>8))
+}
+
+func (h *header) put32(v int) {
+	*h = append(*h, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+// NewWriter writes the header of a file with a sample rate such as
+// g711.SampleRate to w.
+func NewWriter(w io.WriteSeeker, format Format, sampleRate int) (*Writer, error) {
+	if format != PCM && format != ALaw && format != MuLaw {
+		return nil, errors.New("unsupported format")
+	}
+
+	wr := &Writer{w: w, format: format}
+	blockAlign := format.bitsPerSample() / 8
+
+	h := header("RIFF\x00\x00\x00\x00WAVEfmt ")
+
+	// the formats other than PCM carry the size of an empty extension
+	if format == PCM {
+		h.put32(16)
+	} else {
+		h.put32(18)
+	}
+
+	h.put16(int(format))
+	h.put16(1)
+	h.put32(sampleRate)
+	h.put32(sampleRate * blockAlign)
+	h.put16(blockAlign)
+	h.put16(format.bitsPerSample())
+
+	if format != PCM {
+		h.put16(0)
+		h = append(h, "fact"...)
+		h.put32(4)
+		wr.factAt = int64(len(h))
+		h.put32(0)
+	}
+
+	h = append(h, "data"...)
+	wr.dataAt = int64(len(h))
+	h.put32(0)
+
+	wr.header = int64(len(h))
+
+	_, err := w.Write(h)
+	if err != nil {
+		return nil, err
+	}
+
+	return wr, nil
+}
+
+// Write writes encoded samples in the format of the file, e.g. the data of
+// G.711 frames to a file in the same encoding.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("writer is closed")
+	}
+
+	n, err := w.w.Write(p)
+	w.size += int64(n)
+
+	return n, err
+}
+
+// WriteSamples writes the samples of a PCM file.
+func (w *Writer) WriteSamples(samples []int16) error {
+	if w.format != PCM {
+		return errors.New("not a PCM file")
+	}
+
+	b := make([]byte, 2*len(samples))
+	for i, s := range samples {
+		binary.LittleEndian.PutUint16(b[2*i:], uint16(s))
+	}
+
+	_, err := w.Write(b)
+
+	return err
+}
+
+// Close pads the data to an even size and writes the sizes to the header.
+// It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+
+	w.closed = true
+
+	end := w.header + w.size
+
+	if w.size%2 == 1 {
+		_, err := w.w.Write([]byte{0})
+		if err != nil {
+			return err
+		}
+
+		end++
+	}
+
+	err := w.putSize(riffSizeAt, end-8)
+	if err == nil {
+		err = w.putSize(w.dataAt, w.size)
+	}
+
+	// a sample is a byte in the formats with a fact chunk
+	if err == nil && w.factAt != 0 {
+		err = w.putSize(w.factAt, w.size)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	_, err = w.w.Seek(end, io.SeekStart)
+
+	return err
+}
+
+func (w *Writer) putSize(at, size int64) error {
+	_, err := w.w.Seek(at, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(size))
+
+	_, err = w.w.Write(b[:])
+
+	return err
+}
@@ -0,0 +1,78 @@
+package wav
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	tests := []struct {
+		format Format
+		write  func(w *Writer) error
+		header int
+		size   int
+		data   []byte
+	}{
+		{
+			format: PCM,
+			write:  func(w *Writer) error { return w.WriteSamples([]int16{1, -2}) },
+			header: 44,
+			size:   4,
+			data:   []byte{1, 0, 0xFE, 0xFF},
+		},
+		{
+			format: ALaw,
+			write:  func(w *Writer) error { _, err := w.Write([]byte{0xD5, 0x55, 0xD4}); return err },
+			header: 58,
+			size:   3,
+			data:   []byte{0xD5, 0x55, 0xD4, 0}, // padded to an even size
+		},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "audio.wav")
+
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w, err := NewWriter(f, test.format, 8000)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := test.write(w); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		f.Close()
+
+		b, _ := os.ReadFile(path)
+		if len(b) != test.header+len(test.data) || !bytes.Equal(b[test.header:], test.data) {
+			t.Fatalf("format %d: got %x", test.format, b)
+		}
+
+		le := binary.LittleEndian
+
+		if string(b[:4]) != "RIFF" || int(le.Uint32(b[4:])) != len(b)-8 || string(b[8:16]) != "WAVEfmt " {
+			t.Errorf("format %d: unexpected RIFF header %x", test.format, b[:16])
+		}
+
+		if Format(le.Uint16(b[20:])) != test.format || le.Uint32(b[24:]) != 8000 {
+			t.Errorf("format %d: unexpected fmt chunk %x", test.format, b[16:36])
+		}
+
+		dataSize := le.Uint32(b[test.header-4:])
+		if string(b[test.header-8:test.header-4]) != "data" || int(dataSize) != test.size {
+			t.Errorf("format %d: got data size %d", test.format, dataSize)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+// Package webhook posts the events of the recorder as JSON to an HTTP
+// endpoint, e.g. to alert when a camera goes dark.
+//
+// Every request carries the headers X-Godvr-Event with the event type,
+// X-Godvr-Delivery with the event ID, which stays the same across retries,
+// and X-Godvr-Timestamp with the Unix time of the attempt. With a secret
+// the header X-Godvr-Signature is "sha256=" followed by the hex encoded
+// HMAC-SHA256 of the timestamp, a dot and the body, so receivers can check
+// both the sender and the age of a request.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Event types.
+const (
+	// Connected is sent when a stream of a camera started.
+	Connected = "connected"
+
+	// Disconnected is sent when a stream was lost.
+	Disconnected = "disconnected"
+
+	// LoginFailed is sent when a camera rejects the login, only once until
+	// a login succeeds.
+	LoginFailed = "login_failed"
+
+	// Stalled is sent when the watchdog reconnects a stream that stopped
+	// sending keyframes.
+	Stalled = "stalled"
+
+	// Alarm is sent for the alarms of the devices.
+	Alarm = "alarm"
+
+	// ClipWritten is sent when a clip of the event recording mode is
+	// finished.
+	ClipWritten = "clip_written"
+)
+
+const (
+	// maxPending limits the events being delivered, newer events are
+	// dropped while the endpoint is down for long
+	maxPending = 256
+
+	requestTimeout = 10 * time.Second
+)
+
+// Event is the body of a request.
+type Event struct {
+	ID     string    `json:"id"`
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+	Camera string    `json:"camera"`
+	Stream string    `json:"stream,omitempty"`
+
+	// Error is the cause of a disconnect, a failed login or a stall.
+	Error string `json:"error,omitempty"`
+
+	// Alarm is the alarm of the device for the alarm event.
+	Alarm *AlarmInfo `json:"alarm,omitempty"`
+
+	// Clip is the finished file for the clip_written event.
+	Clip *ClipInfo `json:"clip,omitempty"`
+}
+
+// AlarmInfo describes a device alarm.
+type AlarmInfo struct {
+	Channel int    `json:"channel"`
+	Event   string `json:"event"`
+	Active  bool   `json:"active"`
+}
+
+// ClipInfo describes an event clip.
+type ClipInfo struct {
+	Path  string    `json:"path"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Size  int64     `json:"size"`
+}
+
+// Notifier delivers the events to a URL. Failed deliveries are retried with
+// exponential backoff, for network errors, 429 and 5xx responses.
+type Notifier struct {
+	url    string
+	secret []byte
+
+	// Attempts, Backoff, Client and Logger may be changed before the first
+	// Notify. Backoff is the delay before the first retry, it doubles for
+	// each further one.
+	Attempts int
+	Backoff  time.Duration
+	Client   *http.Client
+	Logger   *log.Logger
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	pending chan struct{}
+	wg      sync.WaitGroup
+}
+
+// New returns a notifier posting to url, the requests are signed if secret
+// is not empty.
+func New(url, secret string) *Notifier {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Notifier{
+		url:      url,
+		secret:   []byte(secret),
+		Attempts: 5,
+		Backoff:  time.Second,
+		Client:   &http.Client{Timeout: requestTimeout},
+		Logger:   log.Default(),
+		ctx:      ctx,
+		cancel:   cancel,
+		pending:  make(chan struct{}, maxPending),
+	}
+}
+
+// Notify delivers an event in the background, the ID and time are set if
+// they are empty. It does nothing on a nil notifier, so callers don't need
+// to check whether webhooks are configured.
+func (n *Notifier) Notify(e Event) {
+	if n == nil {
+		return
+	}
+
+	if e.ID == "" {
+		e.ID = newID()
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	select {
+	case n.pending <- struct{}{}:
+	default:
+		n.Logger.Printf("webhook: dropped %v event of %v, too many pending", e.Type, e.Camera)
+		return
+	}
+
+	n.wg.Add(1)
+
+	go func() {
+		defer n.wg.Done()
+		defer func() { <-n.pending }()
+
+		err := n.deliver(e)
+		if err != nil {
+			n.Logger.Printf("webhook: failed to deliver %v event of %v: %v", e.Type, e.Camera, err)
+		}
+	}()
+}
+
+// deliver posts an event until it is accepted or the attempts are used up.
+func (n *Notifier) deliver(e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	backoff := n.Backoff
+
+	for attempt := 1; ; attempt++ {
+		retry, err := n.post(e, body)
+		if err == nil || !retry || attempt >= n.Attempts {
+			return err
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-n.ctx.Done():
+			return err
+		}
+
+		backoff *= 2
+	}
+}
+
+// post makes a single attempt, it returns whether a failure is worth a
+// retry.
+func (n *Notifier) post(e Event, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(n.ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "godvr")
+	req.Header.Set("X-Godvr-Event", e.Type)
+	req.Header.Set("X-Godvr-Delivery", e.ID)
+	req.Header.Set("X-Godvr-Timestamp", timestamp)
+
+	if len(n.secret) > 0 {
+		req.Header.Set("X-Godvr-Signature", "sha256="+Sign(n.secret, timestamp, body))
+	}
+
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("got status %v", resp.Status)
+	default:
+		return false, fmt.Errorf("got status %v", resp.Status)
+	}
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of a request as sent in the
+// X-Godvr-Signature header.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Close waits up to timeout for the pending deliveries and cancels the ones
+// still running afterwards.
+func (n *Notifier) Close(timeout time.Duration) {
+	if n == nil {
+		return
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		n.cancel()
+		<-done
+	}
+
+	n.cancel()
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
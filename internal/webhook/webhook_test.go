@@ -0,0 +1,112 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type request struct {
+	header http.Header
+	body   []byte
+}
+
+// endpoint records the requests and answers with the given status codes,
+// 200 once they are used up.
+func endpoint(t *testing.T, codes ...int) (*httptest.Server, func() []request) {
+	var (
+		lock     sync.Mutex
+		requests []request
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		lock.Lock()
+		requests = append(requests, request{r.Header, body})
+		code := http.StatusOK
+		if len(requests) <= len(codes) {
+			code = codes[len(requests)-1]
+		}
+		lock.Unlock()
+
+		w.WriteHeader(code)
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server, func() []request {
+		lock.Lock()
+		defer lock.Unlock()
+
+		return append([]request(nil), requests...)
+	}
+}
+
+func newTestNotifier(url, secret string) *Notifier {
+	n := New(url, secret)
+	n.Backoff = time.Millisecond
+	n.Logger = log.New(io.Discard, "", 0)
+
+	return n
+}
+
+func TestRetry(t *testing.T) {
+	server, requests := endpoint(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+
+	n := newTestNotifier(server.URL, "secret")
+	n.Notify(Event{Type: Disconnected, Camera: "gate", Stream: "Main", Error: "EOF"})
+	n.Close(5 * time.Second)
+
+	got := requests()
+	if len(got) != 3 {
+		t.Fatalf("got %d requests, expected 3", len(got))
+	}
+
+	if got[0].header.Get("X-Godvr-Delivery") != got[2].header.Get("X-Godvr-Delivery") {
+		t.Error("the delivery ID changed between the retries")
+	}
+
+	var e Event
+
+	last := got[2]
+	if err := json.Unmarshal(last.body, &e); err != nil || e.Type != Disconnected || e.Camera != "gate" || e.Error != "EOF" || e.ID == "" || e.Time.IsZero() {
+		t.Errorf("got event %+v: %v", e, err)
+	}
+
+	expected := "sha256=" + Sign([]byte("secret"), last.header.Get("X-Godvr-Timestamp"), last.body)
+	if sig := last.header.Get("X-Godvr-Signature"); sig != expected || last.header.Get("X-Godvr-Event") != Disconnected {
+		t.Errorf("got signature %q, expected %q", sig, expected)
+	}
+}
+
+func TestNoRetry(t *testing.T) {
+	server, requests := endpoint(t, http.StatusBadRequest)
+
+	n := newTestNotifier(server.URL, "")
+	n.Notify(Event{Type: Connected, Camera: "gate"})
+	n.Close(5 * time.Second)
+
+	got := requests()
+	if len(got) != 1 || got[0].header.Get("X-Godvr-Signature") != "" {
+		t.Errorf("got %d requests, signature %q", len(got), got[0].header.Get("X-Godvr-Signature"))
+	}
+
+	// without webhooks the notifier is nil
+	var none *Notifier
+	none.Notify(Event{Type: Connected})
+	none.Close(time.Second)
+}
+
+func TestSign(t *testing.T) {
+	// echo -n '1600000000.{}' | openssl dgst -sha256 -hmac secret
+	if sig := Sign([]byte("secret"), "1600000000", []byte("{}")); sig != "1e56a11da123b137c26fa37b7c222060bdf22988aa9b3248c31244f8b2ef4a28" {
+		t.Errorf("got signature %v", sig)
+	}
+}
@@ -0,0 +1,331 @@
+// Package websocket implements the server side of the WebSocket protocol,
+// RFC 6455, as far as pushing media to browsers needs it: the handshake,
+// text and binary messages, ping and close. Extensions and subprotocols are
+// not supported.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The message types, the opcodes of their frames.
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+
+	opContinuation = 0
+	opClose        = 8
+	opPing         = 9
+	opPong         = 10
+)
+
+// MaxMessageSize limits the messages read from clients, which only send
+// control messages to a media stream.
+const MaxMessageSize = 64 << 10
+
+// acceptGUID is appended to the key of the client, see RFC 6455 section 1.3.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// closeTimeout limits how long Close waits to send the close frame.
+const closeTimeout = time.Second
+
+var (
+	errNotMasked = errors.New("websocket: client frame is not masked")
+	errTooLarge  = errors.New("websocket: message is too large")
+)
+
+// Conn is a WebSocket connection. One goroutine may read while others
+// write, writes are serialised.
+type Conn struct {
+	c net.Conn
+	r *bufio.Reader
+
+	writeLock sync.Mutex
+	closeOnce sync.Once
+}
+
+// Options configure the handshake of Upgrade.
+type Options struct {
+	// AllowedOrigins are the origins of the pages on other sites that may
+	// connect besides the pages served by the host of the request, e.g.
+	// "https://example.com", "*" allows any. Browsers send the cookies of
+	// the host with the handshake whichever page opens the connection, see
+	// RFC 6455 section 10.2.
+	AllowedOrigins []string
+}
+
+// Upgrade answers the handshake of a WebSocket request and takes over its
+// connection. Requests from browsers on other sites than the host are
+// rejected unless their origin is allowed by opts. On failure it has
+// replied with an error status.
+func Upgrade(w http.ResponseWriter, r *http.Request, opts Options) (*Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+
+	switch {
+	case !opts.allowed(r):
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return nil, fmt.Errorf("websocket: origin not allowed: %v", r.Header.Get("Origin"))
+	case r.Method != http.MethodGet:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, errors.New("websocket: method is not GET")
+	case !hasToken(r.Header, "Connection", "upgrade") || !hasToken(r.Header, "Upgrade", "websocket"):
+		http.Error(w, "WebSocket upgrade expected", http.StatusUpgradeRequired)
+		return nil, errors.New("websocket: not an upgrade request")
+	case r.Header.Get("Sec-WebSocket-Version") != "13":
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusBadRequest)
+		return nil, errors.New("websocket: unsupported version")
+	case key == "":
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("websocket: missing key")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection can't be upgraded", http.StatusInternalServerError)
+		return nil, errors.New("websocket: response does not implement http.Hijacker")
+	}
+
+	c, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	// the handler may have set a deadline for the HTTP request
+	c.SetDeadline(time.Time{})
+
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %v\r\n\r\n", acceptKey(key))
+
+	err = rw.Flush()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return &Conn{c: c, r: rw.Reader}, nil
+}
+
+// allowed reports whether the origin of the request is its host or one of
+// the allowed origins. Clients other than browsers send no origin.
+func (opts Options) allowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	for _, o := range opts.AllowedOrigins {
+		if o == "*" || strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
+		}
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+func acceptKey(key string) string {
+	h := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// hasToken reports whether a comma separated header contains token.
+func hasToken(h http.Header, name, token string) bool {
+	for _, value := range h[name] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// WriteMessage sends a text or binary message in a single frame.
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	return c.writeFrame(byte(messageType), data)
+}
+
+// SetWriteDeadline sets the deadline of the following writes, a slow client
+// then fails instead of blocking the writer.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.c.SetWriteDeadline(t)
+}
+
+// writeFrame writes a final, unmasked frame, it is called with writeLock
+// held.
+func (c *Conn) writeFrame(opcode byte, data []byte) error {
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+
+	switch n := len(data); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = append(header, byte(n>>8), byte(n))
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+
+	buffers := net.Buffers{header, data}
+	_, err := buffers.WriteTo(c.c)
+
+	return err
+}
+
+// ReadMessage returns the next text or binary message of the client. Pings
+// are answered while reading, a close message is answered and reported as
+// io.EOF.
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	var (
+		messageType int
+		message     []byte
+	)
+
+	for {
+		final, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch opcode {
+		case opPing:
+			c.writeLock.Lock()
+			err = c.writeFrame(opPong, payload)
+			c.writeLock.Unlock()
+
+			if err != nil {
+				return 0, nil, err
+			}
+
+			continue
+		case opPong:
+			continue
+		case opClose:
+			c.writeLock.Lock()
+			c.writeFrame(opClose, nil)
+			c.writeLock.Unlock()
+
+			return 0, nil, io.EOF
+		case TextMessage, BinaryMessage:
+			if messageType != 0 {
+				return 0, nil, errors.New("websocket: unexpected new message in a fragmented one")
+			}
+
+			messageType = int(opcode)
+		case opContinuation:
+			if messageType == 0 {
+				return 0, nil, errors.New("websocket: unexpected continuation frame")
+			}
+		default:
+			return 0, nil, fmt.Errorf("websocket: unknown opcode %d", opcode)
+		}
+
+		if len(message)+len(payload) > MaxMessageSize {
+			return 0, nil, errTooLarge
+		}
+
+		message = append(message, payload...)
+
+		if final {
+			return messageType, message, nil
+		}
+	}
+}
+
+// readFrame reads a frame of the client and unmasks its payload.
+func (c *Conn) readFrame() (bool, byte, []byte, error) {
+	var header [2]byte
+
+	_, err := io.ReadFull(c.r, header[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	final := header[0]&0x80 != 0
+	opcode := header[0] & 0x0F
+
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, errNotMasked
+	}
+
+	length := uint64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		var b [2]byte
+		_, err = io.ReadFull(c.r, b[:])
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		_, err = io.ReadFull(c.r, b[:])
+		length = binary.BigEndian.Uint64(b[:])
+	}
+
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	if length > MaxMessageSize {
+		return false, 0, nil, errTooLarge
+	}
+
+	var mask [4]byte
+
+	_, err = io.ReadFull(c.r, mask[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	payload := make([]byte, length)
+
+	_, err = io.ReadFull(c.r, payload)
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return final, opcode, payload, nil
+}
+
+// Close sends a close frame if possible and closes the connection.
+func (c *Conn) Close() error {
+	err := net.ErrClosed
+
+	c.closeOnce.Do(func() {
+		c.c.SetWriteDeadline(time.Now().Add(closeTimeout))
+
+		c.writeLock.Lock()
+		c.writeFrame(opClose, nil)
+		c.writeLock.Unlock()
+
+		err = c.c.Close()
+	})
+
+	return err
+}
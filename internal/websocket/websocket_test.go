@@ -0,0 +1,211 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// readServerFrame reads an unmasked frame of the server.
+func readServerFrame(t *testing.T, r *bufio.Reader) (byte, []byte) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	if header[0]&0x80 == 0 || header[1]&0x80 != 0 {
+		t.Fatalf("unexpected frame header %x", header)
+	}
+
+	length := uint64(header[1])
+
+	switch length {
+	case 126:
+		var b [2]byte
+		io.ReadFull(r, b[:])
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		io.ReadFull(r, b[:])
+		length = binary.BigEndian.Uint64(b[:])
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	return header[0] & 0x0F, payload
+}
+
+// clientFrame builds a masked frame.
+func clientFrame(final bool, opcode byte, payload []byte) []byte {
+	b := []byte{opcode, 0x80 | byte(len(payload))}
+	if final {
+		b[0] |= 0x80
+	}
+
+	mask := []byte{1, 2, 3, 4}
+	b = append(b, mask...)
+
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+
+	return b
+}
+
+func TestConn(t *testing.T) {
+	large := bytes.Repeat([]byte{0xAB}, 70000)
+	done := make(chan error, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r, Options{})
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		c.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		c.WriteMessage(TextMessage, []byte("hello"))
+		c.WriteMessage(BinaryMessage, large)
+
+		// echo until the client closes
+		for {
+			messageType, message, err := c.ReadMessage()
+			if err != nil {
+				done <- err
+				return
+			}
+
+			c.WriteMessage(messageType, message)
+		}
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Errorf("got status %d for a plain request", resp.StatusCode)
+	}
+
+	c, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	c.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\nOrigin: http://test\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+
+	r := bufio.NewReader(c)
+
+	resp, err = http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the example of RFC 6455 section 1.3
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("got status %d, accept %q", resp.StatusCode, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+
+	if opcode, payload := readServerFrame(t, r); opcode != TextMessage || string(payload) != "hello" {
+		t.Errorf("got opcode %d, payload %q", opcode, payload)
+	}
+
+	if opcode, payload := readServerFrame(t, r); opcode != BinaryMessage || !bytes.Equal(payload, large) {
+		t.Errorf("got opcode %d, %d bytes", opcode, len(payload))
+	}
+
+	c.Write(clientFrame(true, opPing, []byte("ping")))
+
+	if opcode, payload := readServerFrame(t, r); opcode != opPong || string(payload) != "ping" {
+		t.Errorf("got opcode %d, payload %q for a ping", opcode, payload)
+	}
+
+	// a fragmented message with a ping in between
+	c.Write(clientFrame(false, TextMessage, []byte("hel")))
+	c.Write(clientFrame(true, opPing, nil))
+	c.Write(clientFrame(true, opContinuation, []byte("lo")))
+
+	if opcode, _ := readServerFrame(t, r); opcode != opPong {
+		t.Errorf("got opcode %d, expected a pong", opcode)
+	}
+
+	if opcode, payload := readServerFrame(t, r); opcode != TextMessage || string(payload) != "hello" {
+		t.Errorf("got opcode %d, payload %q for the echo", opcode, payload)
+	}
+
+	c.Write(clientFrame(true, opClose, nil))
+
+	if opcode, _ := readServerFrame(t, r); opcode != opClose {
+		t.Errorf("got opcode %d, expected close", opcode)
+	}
+
+	if err := <-done; err != io.EOF {
+		t.Errorf("got %v, expected EOF", err)
+	}
+}
+
+func TestUpgradeOrigin(t *testing.T) {
+	tests := []struct {
+		origin  string
+		allowed []string
+		status  int
+	}{
+		{"", nil, http.StatusSwitchingProtocols},
+		{"http://nvr:8080", nil, http.StatusSwitchingProtocols},
+		{"https://NVR:8080", nil, http.StatusSwitchingProtocols},
+		{"https://evil.example", nil, http.StatusForbidden},
+		{"http://nvr", nil, http.StatusForbidden},
+		{"https://app.example", []string{"https://app.example/"}, http.StatusSwitchingProtocols},
+		{"https://evil.example", []string{"https://app.example"}, http.StatusForbidden},
+		{"https://evil.example", []string{"*"}, http.StatusSwitchingProtocols},
+	}
+
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Host = "nvr:8080"
+
+			c, err := Upgrade(w, r, Options{AllowedOrigins: test.allowed})
+			if err == nil {
+				c.Close()
+			}
+		}))
+
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+
+		if test.origin != "" {
+			req.Header.Set("Origin", test.origin)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != test.status {
+			t.Errorf("origin %q allowing %v: got status %d, expected %d", test.origin, test.allowed, resp.StatusCode, test.status)
+		}
+
+		server.Close()
+	}
+}